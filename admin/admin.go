@@ -0,0 +1,349 @@
+// Package admin provides an embeddable HTTP API of the outbox admin operations. It returns JSON and leaves the
+// authentication and the authorization to the embedding application
+package admin
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pkritiotis/outbox"
+)
+
+const (
+	defaultLimit = 50
+	maxLimit     = 1000
+)
+
+// states are the record states accepted by the state query parameter
+var states = map[string]outbox.RecordState{
+	"pending":              outbox.PendingDelivery,
+	"delivered":            outbox.Delivered,
+	"max_attempts_reached": outbox.MaxAttemptsReached,
+	"exported":             outbox.Exported,
+	"expired":              outbox.Expired,
+}
+
+// Record is the JSON representation of a record
+type Record struct {
+	ID               uuid.UUID      `json:"id"`
+	State            string         `json:"state"`
+	CreatedOn        time.Time      `json:"created_on"`
+	LockID           *string        `json:"locked_by,omitempty"`
+	LockedOn         *time.Time     `json:"locked_on,omitempty"`
+	ProcessedOn      *time.Time     `json:"processed_on,omitempty"`
+	NumberOfAttempts int            `json:"number_of_attempts"`
+	LastAttemptOn    *time.Time     `json:"last_attempted_on,omitempty"`
+	Error            *string        `json:"error,omitempty"`
+	ExpiresAt        *time.Time     `json:"expires_at,omitempty"`
+	NextRetryAt      *time.Time     `json:"next_retry_at,omitempty"`
+	Message          outbox.Message `json:"message"`
+}
+
+// RecordPage is a page of records. Next is the cursor of the next page, empty on the last page
+type RecordPage struct {
+	Records []Record `json:"records"`
+	Next    string   `json:"next,omitempty"`
+}
+
+// Status is the JSON representation of the dispatcher status and backlog
+type Status struct {
+	Paused                  bool       `json:"paused"`
+	PausedTopics            []string   `json:"paused_topics"`
+	PendingRecords          int64      `json:"pending_records"`
+	OldestPendingCreatedOn  *time.Time `json:"oldest_pending_created_on,omitempty"`
+	OldestPendingAgeSeconds float64    `json:"oldest_pending_age_seconds"`
+}
+
+type handler struct {
+	dispatcher outbox.Dispatcher
+	store      outbox.Store
+	clock      outbox.Clock
+}
+
+// Handler returns the admin API of the dispatcher and its store, meant to be mounted behind the authentication of
+// the application, e.g. http.Handle("/outbox/admin/", http.StripPrefix("/outbox/admin", admin.Handler(d))). The
+// store calls go through the Store of the dispatcher, within its MaxDBConcurrency, and the retry times are relative
+// to its Clock.
+//
+// Read-only endpoints:
+//   - GET /status: the dispatcher status and backlog
+//   - GET /records?state=max_attempts_reached&limit=50&after=<cursor>: a page of the records of a state, pending by
+//     default, oldest first
+//   - GET /records/{id}: a record
+//
+// Mutating endpoints, all POST:
+//   - /records/{id}/requeue: moves a dead-lettered record back to pending delivery
+//   - /records/{id}/retry?at=<RFC 3339 time> or ?in=10m: overrides the next retry time of a pending record, now by
+//     default
+//   - /locks/release?older_than=10m: clears the locks acquired or extended more than older_than ago
+//   - /pause and /resume: pauses and resumes the whole dispatch
+//   - /topics/{topic}/pause and /topics/{topic}/resume: pauses and resumes the dispatch of a topic
+func Handler(dispatcher outbox.Dispatcher) http.Handler {
+	h := handler{dispatcher: dispatcher, store: dispatcher.Store(), clock: dispatcher.Clock()}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /status", h.status)
+	mux.HandleFunc("GET /records", h.listRecords)
+	mux.HandleFunc("GET /records/{id}", h.getRecord)
+	mux.HandleFunc("POST /records/{id}/requeue", h.requeueRecord)
+	mux.HandleFunc("POST /records/{id}/retry", h.retryRecord)
+	mux.HandleFunc("POST /locks/release", h.releaseLocks)
+	mux.HandleFunc("POST /pause", func(w http.ResponseWriter, r *http.Request) {
+		dispatcher.Pause()
+		h.status(w, r)
+	})
+	mux.HandleFunc("POST /resume", func(w http.ResponseWriter, r *http.Request) {
+		dispatcher.Resume()
+		h.status(w, r)
+	})
+	mux.HandleFunc("POST /topics/{topic}/pause", func(w http.ResponseWriter, r *http.Request) {
+		dispatcher.PauseTopic(r.PathValue("topic"))
+		h.status(w, r)
+	})
+	mux.HandleFunc("POST /topics/{topic}/resume", func(w http.ResponseWriter, r *http.Request) {
+		dispatcher.ResumeTopic(r.PathValue("topic"))
+		h.status(w, r)
+	})
+	return mux
+}
+
+func (h handler) status(w http.ResponseWriter, _ *http.Request) {
+	backlog, err := h.dispatcher.Backlog()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	status := h.dispatcher.Status()
+	writeJSON(w, http.StatusOK, Status{
+		Paused:                  status.Paused,
+		PausedTopics:            status.PausedTopics,
+		PendingRecords:          backlog.Records,
+		OldestPendingCreatedOn:  backlog.OldestCreatedOn,
+		OldestPendingAgeSeconds: backlog.OldestAge.Seconds(),
+	})
+}
+
+func (h handler) listRecords(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	state := outbox.PendingDelivery
+	if name := query.Get("state"); name != "" {
+		var ok bool
+		state, ok = states[name]
+		if !ok {
+			writeError(w, badRequest(fmt.Errorf("unknown state %q", name)))
+			return
+		}
+	}
+	limit := defaultLimit
+	if value := query.Get("limit"); value != "" {
+		var err error
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > maxLimit {
+			writeError(w, badRequest(fmt.Errorf("the limit must be between 1 and %d", maxLimit)))
+			return
+		}
+	}
+	createdOn, id, err := decodeCursor(query.Get("after"))
+	if err != nil {
+		writeError(w, badRequest(err))
+		return
+	}
+
+	records, err := h.store.GetRecordsByState(state, createdOn, id, limit)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	page := RecordPage{Records: make([]Record, 0, len(records))}
+	for _, rec := range records {
+		page.Records = append(page.Records, toRecord(rec))
+	}
+	if len(records) == limit {
+		last := records[len(records)-1]
+		page.Next = encodeCursor(last.CreatedOn, last.ID)
+	}
+	writeJSON(w, http.StatusOK, page)
+}
+
+func (h handler) getRecord(w http.ResponseWriter, r *http.Request) {
+	id, err := uuid.Parse(r.PathValue("id"))
+	if err != nil {
+		writeError(w, badRequest(err))
+		return
+	}
+	rec, err := h.store.GetRecordByID(id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, toRecord(rec))
+}
+
+func (h handler) requeueRecord(w http.ResponseWriter, r *http.Request) {
+	id, err := uuid.Parse(r.PathValue("id"))
+	if err != nil {
+		writeError(w, badRequest(err))
+		return
+	}
+	err = h.store.RequeueRecord(id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	h.getRecord(w, r)
+}
+
+func (h handler) retryRecord(w http.ResponseWriter, r *http.Request) {
+	id, err := uuid.Parse(r.PathValue("id"))
+	if err != nil {
+		writeError(w, badRequest(err))
+		return
+	}
+	retryAt, err := parseRetryTime(r.URL.Query().Get("at"), r.URL.Query().Get("in"), h.clock.Now().UTC())
+	if err != nil {
+		writeError(w, badRequest(err))
+		return
+	}
+	err = h.store.SetNextRetryAt(id, retryAt)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	h.getRecord(w, r)
+}
+
+// parseRetryTime returns the retry time of the at time or the in duration, or now if neither is set. Past times are
+// retried now, and times more than outbox.MaxNextRetryDelay after now are rejected
+func parseRetryTime(at string, in string, now time.Time) (time.Time, error) {
+	retryAt := now
+	switch {
+	case at != "" && in != "":
+		return time.Time{}, errors.New("at and in can not be combined")
+	case at != "":
+		t, err := time.Parse(time.RFC3339, at)
+		if err != nil {
+			return time.Time{}, errors.New("at must be an RFC 3339 time, e.g. 2024-01-02T03:04:05Z")
+		}
+		retryAt = t.UTC()
+	case in != "":
+		d, err := time.ParseDuration(in)
+		if err != nil || d < 0 {
+			return time.Time{}, errors.New("in must be a non-negative duration, e.g. 10m")
+		}
+		retryAt = now.Add(d)
+	}
+	if retryAt.Before(now) {
+		return now, nil
+	}
+	if retryAt.Sub(now) > outbox.MaxNextRetryDelay {
+		return time.Time{}, fmt.Errorf("the retry can not be postponed by more than %v", outbox.MaxNextRetryDelay)
+	}
+	return retryAt, nil
+}
+
+func (h handler) releaseLocks(w http.ResponseWriter, r *http.Request) {
+	olderThan, err := time.ParseDuration(r.URL.Query().Get("older_than"))
+	if err != nil || olderThan <= 0 {
+		writeError(w, badRequest(errors.New("older_than must be a positive duration, e.g. 10m")))
+		return
+	}
+	err = h.dispatcher.ReleaseStaleLocks(olderThan)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func toRecord(rec outbox.Record) Record {
+	state := strconv.Itoa(int(rec.State))
+	for name, s := range states {
+		if s == rec.State {
+			state = name
+		}
+	}
+	return Record{
+		ID:               rec.ID,
+		State:            state,
+		CreatedOn:        rec.CreatedOn,
+		LockID:           rec.LockID,
+		LockedOn:         rec.LockedOn,
+		ProcessedOn:      rec.ProcessedOn,
+		NumberOfAttempts: rec.NumberOfAttempts,
+		LastAttemptOn:    rec.LastAttemptOn,
+		Error:            rec.Error,
+		ExpiresAt:        rec.ExpiresAt,
+		NextRetryAt:      rec.NextRetryAt,
+		Message:          rec.Message,
+	}
+}
+
+// encodeCursor returns the opaque cursor of the records created after the (createdOn, id) pair
+func encodeCursor(createdOn time.Time, id uuid.UUID) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(createdOn.UTC().Format(time.RFC3339Nano) + "," + id.String()))
+}
+
+// decodeCursor returns the (createdOn, id) pair of the cursor, or the zero pair of the first page if it is empty
+func decodeCursor(cursor string) (time.Time, uuid.UUID, error) {
+	if cursor == "" {
+		return time.Time{}, uuid.Nil, nil
+	}
+	errInvalid := errors.New("invalid cursor")
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return time.Time{}, uuid.Nil, errInvalid
+	}
+	createdOnValue, idValue, ok := strings.Cut(string(raw), ",")
+	if !ok {
+		return time.Time{}, uuid.Nil, errInvalid
+	}
+	createdOn, err := time.Parse(time.RFC3339Nano, createdOnValue)
+	if err != nil {
+		return time.Time{}, uuid.Nil, errInvalid
+	}
+	id, err := uuid.Parse(idValue)
+	if err != nil {
+		return time.Time{}, uuid.Nil, errInvalid
+	}
+	return createdOn, id, nil
+}
+
+// requestError is an error caused by an invalid request
+type requestError struct {
+	err error
+}
+
+func (e requestError) Error() string {
+	return e.err.Error()
+}
+
+func badRequest(err error) error {
+	return requestError{err: err}
+}
+
+// writeError writes the error with the status code of its kind
+func writeError(w http.ResponseWriter, err error) {
+	code := http.StatusInternalServerError
+	var reqErr requestError
+	switch {
+	case errors.As(err, &reqErr):
+		code = http.StatusBadRequest
+	case errors.Is(err, outbox.ErrRecordNotFound):
+		code = http.StatusNotFound
+	case errors.Is(err, outbox.ErrDuplicateRecord):
+		code = http.StatusConflict
+	}
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
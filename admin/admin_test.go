@@ -0,0 +1,272 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pkritiotis/outbox"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestHandler(t *testing.T) {
+	createdOn := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	rec := outbox.Record{
+		ID:               uuid.MustParse("4b1c7f1e-2a5e-4b8a-9f43-6c1f0d0a0001"),
+		State:            outbox.MaxAttemptsReached,
+		CreatedOn:        createdOn,
+		NumberOfAttempts: 3,
+		Message:          outbox.Message{Key: "key", Body: []byte("body"), Topic: "orders"},
+	}
+	missing := uuid.MustParse("4b1c7f1e-2a5e-4b8a-9f43-6c1f0d0a0002")
+	cursor := encodeCursor(rec.CreatedOn, rec.ID)
+
+	tests := map[string]struct {
+		method  string
+		target  string
+		store   func(mp *outbox.MockStore)
+		expCode int
+		expBody string
+	}{
+		"Status should return the dispatcher status and backlog": {
+			method: http.MethodGet,
+			target: "/status",
+			store: func(mp *outbox.MockStore) {
+				mp.On("GetBacklogByState", outbox.PendingDelivery).Return(outbox.Backlog{Records: 2}, nil)
+			},
+			expCode: http.StatusOK,
+			expBody: `{"paused":false,"paused_topics":[],"pending_records":2,"oldest_pending_age_seconds":0}`,
+		},
+		"Listing should return a page of the records of the state": {
+			method: http.MethodGet,
+			target: "/records?state=max_attempts_reached&limit=1",
+			store: func(mp *outbox.MockStore) {
+				mp.On("GetRecordsByState", outbox.MaxAttemptsReached, time.Time{}, uuid.Nil, 1).Return([]outbox.Record{rec}, nil)
+			},
+			expCode: http.StatusOK,
+			expBody: `{"records":[{"id":"4b1c7f1e-2a5e-4b8a-9f43-6c1f0d0a0001","state":"max_attempts_reached","created_on":"2024-01-02T03:04:05Z","number_of_attempts":3,"message":{"key":"key","headers":null,"body":"Ym9keQ==","topic":"orders"}}],"next":"` + cursor + `"}`,
+		},
+		"Listing after a cursor should return the next page": {
+			method: http.MethodGet,
+			target: "/records?after=" + cursor,
+			store: func(mp *outbox.MockStore) {
+				mp.On("GetRecordsByState", outbox.PendingDelivery, rec.CreatedOn, rec.ID, defaultLimit).Return([]outbox.Record{}, nil)
+			},
+			expCode: http.StatusOK,
+			expBody: `{"records":[]}`,
+		},
+		"Listing an unknown state should return bad request": {
+			method:  http.MethodGet,
+			target:  "/records?state=unknown",
+			store:   func(mp *outbox.MockStore) {},
+			expCode: http.StatusBadRequest,
+			expBody: `{"error":"unknown state \"unknown\""}`,
+		},
+		"Getting a missing record should return not found": {
+			method: http.MethodGet,
+			target: "/records/" + missing.String(),
+			store: func(mp *outbox.MockStore) {
+				mp.On("GetRecordByID", missing).Return(outbox.Record{}, fmt.Errorf("%w: %v", outbox.ErrRecordNotFound, missing))
+			},
+			expCode: http.StatusNotFound,
+			expBody: `{"error":"the record was not found: ` + missing.String() + `"}`,
+		},
+		"Requeue should return the requeued record": {
+			method: http.MethodPost,
+			target: "/records/" + rec.ID.String() + "/requeue",
+			store: func(mp *outbox.MockStore) {
+				requeued := rec
+				requeued.State = outbox.PendingDelivery
+				requeued.NumberOfAttempts = 0
+				mp.On("RequeueRecord", rec.ID).Return(nil)
+				mp.On("GetRecordByID", rec.ID).Return(requeued, nil)
+			},
+			expCode: http.StatusOK,
+			expBody: `{"id":"4b1c7f1e-2a5e-4b8a-9f43-6c1f0d0a0001","state":"pending","created_on":"2024-01-02T03:04:05Z","number_of_attempts":0,"message":{"key":"key","headers":null,"body":"Ym9keQ==","topic":"orders"}}`,
+		},
+		"Requeue conflicting with a pending record should return conflict": {
+			method: http.MethodPost,
+			target: "/records/" + rec.ID.String() + "/requeue",
+			store: func(mp *outbox.MockStore) {
+				mp.On("RequeueRecord", rec.ID).Return(outbox.ErrDuplicateRecord)
+			},
+			expCode: http.StatusConflict,
+			expBody: `{"error":"the record already exists"}`,
+		},
+		"Requeue with GET should not be allowed": {
+			method:  http.MethodGet,
+			target:  "/records/" + rec.ID.String() + "/requeue",
+			store:   func(mp *outbox.MockStore) {},
+			expCode: http.StatusMethodNotAllowed,
+		},
+		"Retry should return the rescheduled record": {
+			method: http.MethodPost,
+			target: "/records/" + rec.ID.String() + "/retry?in=10m",
+			store: func(mp *outbox.MockStore) {
+				rescheduled := rec
+				rescheduled.State = outbox.PendingDelivery
+				rescheduled.NextRetryAt = &createdOn
+				mp.On("SetNextRetryAt", rec.ID, mock.AnythingOfType("time.Time")).Return(nil)
+				mp.On("GetRecordByID", rec.ID).Return(rescheduled, nil)
+			},
+			expCode: http.StatusOK,
+			expBody: `{"id":"4b1c7f1e-2a5e-4b8a-9f43-6c1f0d0a0001","state":"pending","created_on":"2024-01-02T03:04:05Z","number_of_attempts":3,"next_retry_at":"2024-01-02T03:04:05Z","message":{"key":"key","headers":null,"body":"Ym9keQ==","topic":"orders"}}`,
+		},
+		"Retry of a missing record should return not found": {
+			method: http.MethodPost,
+			target: "/records/" + missing.String() + "/retry",
+			store: func(mp *outbox.MockStore) {
+				mp.On("SetNextRetryAt", missing, mock.AnythingOfType("time.Time")).Return(fmt.Errorf("%w: no pending record %v", outbox.ErrRecordNotFound, missing))
+			},
+			expCode: http.StatusNotFound,
+			expBody: `{"error":"the record was not found: no pending record ` + missing.String() + `"}`,
+		},
+		"Retry with an invalid time should return bad request": {
+			method:  http.MethodPost,
+			target:  "/records/" + rec.ID.String() + "/retry?in=-1m",
+			store:   func(mp *outbox.MockStore) {},
+			expCode: http.StatusBadRequest,
+			expBody: `{"error":"in must be a non-negative duration, e.g. 10m"}`,
+		},
+		"Lock release should clear the stale locks": {
+			method: http.MethodPost,
+			target: "/locks/release?older_than=10m",
+			store: func(mp *outbox.MockStore) {
+				mp.On("ClearLocksWithDurationBeforeDate", mock.AnythingOfType("time.Time")).Return(nil)
+			},
+			expCode: http.StatusNoContent,
+		},
+		"Lock release without duration should return bad request": {
+			method:  http.MethodPost,
+			target:  "/locks/release",
+			store:   func(mp *outbox.MockStore) {},
+			expCode: http.StatusBadRequest,
+			expBody: `{"error":"older_than must be a positive duration, e.g. 10m"}`,
+		},
+		"Store errors should return internal server error": {
+			method: http.MethodGet,
+			target: "/records/" + rec.ID.String(),
+			store: func(mp *outbox.MockStore) {
+				mp.On("GetRecordByID", rec.ID).Return(outbox.Record{}, errors.New("db error"))
+			},
+			expCode: http.StatusInternalServerError,
+			expBody: `{"error":"db error"}`,
+		},
+	}
+	for name, test := range tests {
+		tt := test
+		t.Run(name, func(t *testing.T) {
+			store := &outbox.MockStore{}
+			tt.store(store)
+			h := Handler(outbox.NewDispatcher(store, &outbox.MockBroker{}, outbox.DispatcherSettings{}, "1"))
+
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(tt.method, tt.target, nil))
+
+			assert.Equal(t, tt.expCode, w.Code)
+			if tt.expBody != "" {
+				assert.JSONEq(t, tt.expBody, w.Body.String())
+			}
+			store.AssertExpectations(t)
+		})
+	}
+}
+
+type fixedClock time.Time
+
+func (c fixedClock) Now() time.Time { return time.Time(c) }
+
+func TestHandler_retryClock(t *testing.T) {
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	id := uuid.New()
+	store := &outbox.MockStore{}
+	store.On("SetNextRetryAt", id, now.Add(10*time.Minute)).Return(nil)
+	store.On("GetRecordByID", id).Return(outbox.Record{ID: id, State: outbox.PendingDelivery}, nil)
+	settings := outbox.DispatcherSettings{Clock: fixedClock(now), MaxDBConcurrency: 1}
+	h := Handler(outbox.NewDispatcher(store, &outbox.MockBroker{}, settings, "1"))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/records/"+id.String()+"/retry?in=10m", nil))
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	store.AssertExpectations(t)
+}
+
+func TestHandler_pause(t *testing.T) {
+	store := &outbox.MockStore{}
+	store.On("GetBacklogByState", outbox.PendingDelivery).Return(outbox.Backlog{}, nil)
+	d := outbox.NewDispatcher(store, &outbox.MockBroker{}, outbox.DispatcherSettings{}, "1")
+	h := Handler(d)
+
+	for _, target := range []string{"/pause", "/topics/orders/pause", "/topics/payments/pause", "/topics/payments/resume"} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, target, nil))
+		assert.Equal(t, http.StatusOK, w.Code, target)
+	}
+	assert.Equal(t, outbox.DispatcherStatus{Paused: true, PausedTopics: []string{"orders"}}, d.Status())
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/resume", strings.NewReader("")))
+	var status Status
+	assert.Nil(t, json.NewDecoder(w.Body).Decode(&status))
+	assert.Equal(t, Status{PausedTopics: []string{"orders"}}, status)
+}
+
+func Test_parseRetryTime(t *testing.T) {
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	tests := map[string]struct {
+		at     string
+		in     string
+		exp    time.Time
+		expErr string
+	}{
+		"No time should retry now": {
+			exp: now,
+		},
+		"Time should be parsed": {
+			at:  "2024-01-02T05:04:05+01:00",
+			exp: now.Add(time.Hour),
+		},
+		"Past time should retry now": {
+			at:  "2020-01-01T00:00:00Z",
+			exp: now,
+		},
+		"Duration should be added to now": {
+			in:  "10m",
+			exp: now.Add(10 * time.Minute),
+		},
+		"Time too far in the future should be rejected": {
+			in:     "721h",
+			expErr: "the retry can not be postponed by more than 720h0m0s",
+		},
+		"Invalid time should be rejected": {
+			at:     "tomorrow",
+			expErr: "at must be an RFC 3339 time, e.g. 2024-01-02T03:04:05Z",
+		},
+		"Time and duration should not be combined": {
+			at:     "2024-01-02T05:04:05Z",
+			in:     "10m",
+			expErr: "at and in can not be combined",
+		},
+	}
+	for name, test := range tests {
+		tt := test
+		t.Run(name, func(t *testing.T) {
+			retryAt, err := parseRetryTime(tt.at, tt.in, now)
+			if tt.expErr != "" {
+				assert.EqualError(t, err, tt.expErr)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, tt.exp, retryAt)
+		})
+	}
+}
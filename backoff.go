@@ -0,0 +1,43 @@
+package outbox
+
+import (
+	"math"
+	"time"
+)
+
+// BackoffPolicy defines the delay between the delivery attempts of a record
+type BackoffPolicy interface {
+	// NextRetryDelay returns the delay before the next delivery attempt of a record that failed numberOfAttempts times
+	NextRetryDelay(numberOfAttempts int) time.Duration
+}
+
+// ExponentialBackoff multiplies the delay by Multiplier after every attempt, starting from InitialDelay,
+// up to MaxDelay
+type ExponentialBackoff struct {
+	InitialDelay time.Duration
+	MaxDelay     time.Duration
+	// Multiplier defaults to 2 if it is lower than 1
+	Multiplier float64
+}
+
+// NextRetryDelay returns InitialDelay * Multiplier^(numberOfAttempts-1), capped at MaxDelay if it is set
+func (b ExponentialBackoff) NextRetryDelay(numberOfAttempts int) time.Duration {
+	multiplier := b.Multiplier
+	if multiplier < 1 {
+		multiplier = 2
+	}
+	delay := float64(b.InitialDelay)
+	for i := 1; i < numberOfAttempts; i++ {
+		delay *= multiplier
+		if b.MaxDelay > 0 && delay >= float64(b.MaxDelay) {
+			return b.MaxDelay
+		}
+	}
+	if b.MaxDelay > 0 && delay > float64(b.MaxDelay) {
+		return b.MaxDelay
+	}
+	if delay >= math.MaxInt64 {
+		return math.MaxInt64
+	}
+	return time.Duration(delay)
+}
@@ -0,0 +1,49 @@
+package outbox
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExponentialBackoff_NextRetryDelay(t *testing.T) {
+	tests := map[string]struct {
+		backoff          ExponentialBackoff
+		numberOfAttempts int
+		expDelay         time.Duration
+	}{
+		"First attempt should wait for the initial delay": {
+			backoff:          ExponentialBackoff{InitialDelay: time.Second, Multiplier: 3},
+			numberOfAttempts: 1,
+			expDelay:         time.Second,
+		},
+		"Delay should be multiplied after every attempt": {
+			backoff:          ExponentialBackoff{InitialDelay: time.Second, Multiplier: 3},
+			numberOfAttempts: 3,
+			expDelay:         9 * time.Second,
+		},
+		"Multiplier should default to 2": {
+			backoff:          ExponentialBackoff{InitialDelay: time.Second},
+			numberOfAttempts: 4,
+			expDelay:         8 * time.Second,
+		},
+		"Delay should be capped at the max delay": {
+			backoff:          ExponentialBackoff{InitialDelay: time.Second, MaxDelay: 5 * time.Second},
+			numberOfAttempts: 10,
+			expDelay:         5 * time.Second,
+		},
+		"Delay without max delay should not overflow": {
+			backoff:          ExponentialBackoff{InitialDelay: time.Second},
+			numberOfAttempts: 1000,
+			expDelay:         math.MaxInt64,
+		},
+	}
+	for name, test := range tests {
+		tt := test
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tt.expDelay, tt.backoff.NextRetryDelay(tt.numberOfAttempts))
+		})
+	}
+}
@@ -1,7 +1,34 @@
 // Package outbox provides an interface for message brokers to send Message objects
 package outbox
 
+import "context"
+
 // MessageBroker provides an interface for message brokers to send Message objects
 type MessageBroker interface {
 	Send(message Message) error
 }
+
+// ContextMessageBroker is implemented by the message brokers that can abort a Send once the provided context is done.
+// The dispatcher uses it to bound the publish attempts by the PublishTimeout and the record expiration
+type ContextMessageBroker interface {
+	SendContext(ctx context.Context, message Message) error
+}
+
+// AsyncMessageBroker is implemented by the message brokers that acknowledge the messages asynchronously.
+// SendAsync must not block until the message is delivered and must call done exactly once with the outcome of the
+// delivery, possibly from another goroutine and in a different order than the messages were sent.
+// The dispatcher uses it to publish Unordered batches, marking every record as its acknowledgement arrives
+type AsyncMessageBroker interface {
+	SendAsync(message Message, done func(err error))
+}
+
+// TransactionalMessageBroker is implemented by the message brokers that can publish a message in two phases, e.g.
+// within a broker transaction. Prepare makes the message durable at the broker without exposing it to the consumers
+// and returns the handle of the prepared publish, which Commit exposes to the consumers and Abort discards.
+// Commit and Abort must be idempotent and accept the handles prepared by another process, since they are called again
+// on the recovery of a crashed dispatcher. The dispatcher uses it with the TwoPhasePublish setting
+type TransactionalMessageBroker interface {
+	Prepare(ctx context.Context, message Message) (handle string, err error)
+	Commit(ctx context.Context, handle string) error
+	Abort(ctx context.Context, handle string) error
+}
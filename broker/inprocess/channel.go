@@ -0,0 +1,73 @@
+package inprocess
+
+import (
+	"context"
+
+	"github.com/pkritiotis/outbox"
+)
+
+// Delivery is a message delivered through the channel of a ChannelBroker
+type Delivery struct {
+	Message outbox.Message
+	ack     chan error
+	ctx     context.Context
+}
+
+// Context returns the context of the delivery, which is done once the dispatcher stops waiting for the
+// acknowledgement
+func (d Delivery) Context() context.Context {
+	return d.ctx
+}
+
+// Ack acknowledges the delivery. The record is marked as delivered if err is nil and failed with err otherwise.
+// It must be called exactly once, and does not block if the dispatcher has stopped waiting
+func (d Delivery) Ack(err error) {
+	d.ack <- err
+}
+
+// ChannelBroker implements the MessageBroker and ContextMessageBroker interfaces by delivering the messages to a
+// channel and waiting for their acknowledgement
+type ChannelBroker struct {
+	deliveries chan Delivery
+	keyHeader  *string
+}
+
+// NewChannelBroker constructor. The channel of the deliveries is unbuffered, so that a message is only handed over
+// to a ready consumer
+func NewChannelBroker() *ChannelBroker {
+	return &ChannelBroker{deliveries: make(chan Delivery)}
+}
+
+// Deliveries returns the channel of the deliveries, which can be consumed by multiple goroutines
+func (b *ChannelBroker) Deliveries() <-chan Delivery {
+	return b.deliveries
+}
+
+// KeyAsHeader delivers the key of the messages in the header name, see outbox.KeyAsHeader. It must be called before
+// the first send
+func (b *ChannelBroker) KeyAsHeader(name string) {
+	b.keyHeader = &name
+}
+
+// Send delivers the message and waits for its acknowledgement
+func (b *ChannelBroker) Send(message outbox.Message) error {
+	return b.SendContext(context.Background(), message)
+}
+
+// SendContext delivers the message and waits for its acknowledgement, or fails with the error of the context once it is
+// done. A message that was delivered but not acknowledged in time may still be processed by the consumer, so it may be
+// processed more than once
+func (b *ChannelBroker) SendContext(ctx context.Context, message outbox.Message) error {
+	d := Delivery{Message: keyAsHeader(message, b.keyHeader), ack: make(chan error, 1), ctx: ctx}
+	select {
+	case b.deliveries <- d:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case err := <-d.ack:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
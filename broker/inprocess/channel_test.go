@@ -0,0 +1,70 @@
+package inprocess
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/pkritiotis/outbox"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChannelBroker_SendContext(t *testing.T) {
+	msg := outbox.Message{Key: "key", Body: []byte("body"), Topic: "topic"}
+	tests := map[string]struct {
+		ackErr error
+		expErr error
+	}{
+		"Successful acknowledgement should return no error": {
+			ackErr: nil,
+			expErr: nil,
+		},
+		"Negative acknowledgement should return its error": {
+			ackErr: errors.New("consumer error"),
+			expErr: errors.New("consumer error"),
+		},
+	}
+	for name, test := range tests {
+		tt := test
+		t.Run(name, func(t *testing.T) {
+			b := NewChannelBroker()
+			go func() {
+				d := <-b.Deliveries()
+				assert.Equal(t, msg, d.Message)
+				d.Ack(tt.ackErr)
+			}()
+			assert.Equal(t, tt.expErr, b.Send(msg))
+		})
+	}
+}
+
+func TestChannelBroker_SendContext_timeout(t *testing.T) {
+	msg := outbox.Message{Key: "key", Topic: "topic"}
+	b := NewChannelBroker()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, b.SendContext(ctx, msg))
+
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	delivered := make(chan Delivery, 1)
+	go func() { delivered <- <-b.Deliveries() }()
+	assert.Equal(t, context.DeadlineExceeded, b.SendContext(ctx, msg))
+
+	d := <-delivered
+	assert.NotNil(t, d.Context().Err())
+	d.Ack(nil)
+}
+
+func TestChannelBroker_KeyAsHeader(t *testing.T) {
+	b := NewChannelBroker()
+	b.KeyAsHeader("X-Key")
+	go func() {
+		d := <-b.Deliveries()
+		assert.Equal(t, map[string]string{"X-Key": "key"}, d.Message.Headers)
+		d.Ack(nil)
+	}()
+	assert.Nil(t, b.Send(outbox.Message{Key: "key", Topic: "topic"}))
+}
@@ -0,0 +1,67 @@
+// Package inprocess provides message brokers delivering the outbox messages to in-process consumers, turning the outbox
+// into a durable work queue with the lock, retry and expiry handling of the dispatcher
+package inprocess
+
+import (
+	"context"
+
+	"github.com/pkritiotis/outbox"
+)
+
+// Handler consumes a message. The record of the message is marked as delivered only if it returns nil, and failed
+// with the returned error otherwise, so it is retried as any record failing to be published. The context is done
+// once the PublishTimeout or the expiry of the record is reached
+type Handler func(ctx context.Context, message outbox.Message) error
+
+// Broker implements the MessageBroker and ContextMessageBroker interfaces by calling a Handler
+type Broker struct {
+	handler   Handler
+	keyHeader *string
+}
+
+// NewBroker constructor
+func NewBroker(handler Handler) *Broker {
+	return &Broker{handler: handler}
+}
+
+// Send calls the handler with the message
+func (b Broker) Send(message outbox.Message) error {
+	return b.SendContext(context.Background(), message)
+}
+
+// SendContext calls the handler with the message
+func (b Broker) SendContext(ctx context.Context, message outbox.Message) error {
+	return b.handler(ctx, keyAsHeader(message, b.keyHeader))
+}
+
+// KeyAsHeader calls the handler with the key of the messages in the header name, see outbox.KeyAsHeader, for the
+// handlers reading the headers only
+func (b *Broker) KeyAsHeader(name string) {
+	b.keyHeader = &name
+}
+
+// keyAsHeader copies the key of the message to the header, if it is set
+func keyAsHeader(message outbox.Message, header *string) outbox.Message {
+	if header == nil {
+		return message
+	}
+	return outbox.KeyAsHeader(message, *header)
+}
+
+// Tee returns a Handler publishing the message to the broker before calling the handler, so that the messages are
+// both published and consumed in-process. The record is only marked as delivered if both succeed, and the message is
+// published again when the handler fails
+func Tee(broker outbox.MessageBroker, handler Handler) Handler {
+	return func(ctx context.Context, message outbox.Message) error {
+		var err error
+		if ctxBroker, ok := broker.(outbox.ContextMessageBroker); ok {
+			err = ctxBroker.SendContext(ctx, message)
+		} else {
+			err = broker.Send(message)
+		}
+		if err != nil {
+			return err
+		}
+		return handler(ctx, message)
+	}
+}
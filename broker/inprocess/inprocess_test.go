@@ -0,0 +1,91 @@
+package inprocess
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/pkritiotis/outbox"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBroker_Send(t *testing.T) {
+	msg := outbox.Message{Key: "key", Body: []byte("body"), Topic: "topic"}
+	tests := map[string]struct {
+		handlerErr error
+		expErr     error
+	}{
+		"Successful handling should return no error": {
+			handlerErr: nil,
+			expErr:     nil,
+		},
+		"Failed handling should return the error of the handler": {
+			handlerErr: errors.New("handler error"),
+			expErr:     errors.New("handler error"),
+		},
+	}
+	for name, test := range tests {
+		tt := test
+		t.Run(name, func(t *testing.T) {
+			var handled []outbox.Message
+			b := NewBroker(func(_ context.Context, message outbox.Message) error {
+				handled = append(handled, message)
+				return tt.handlerErr
+			})
+			assert.Equal(t, tt.expErr, b.Send(msg))
+			assert.Equal(t, []outbox.Message{msg}, handled)
+		})
+	}
+}
+
+func TestBroker_KeyAsHeader(t *testing.T) {
+	var handled outbox.Message
+	b := NewBroker(func(_ context.Context, message outbox.Message) error {
+		handled = message
+		return nil
+	})
+	b.KeyAsHeader("")
+
+	assert.Nil(t, b.Send(outbox.Message{Key: "key", Topic: "topic"}))
+	assert.Equal(t, map[string]string{outbox.DefaultKeyHeader: "key"}, handled.Headers)
+}
+
+func TestTee(t *testing.T) {
+	msg := outbox.Message{Key: "key", Body: []byte("body"), Topic: "topic"}
+	tests := map[string]struct {
+		brokerErr  error
+		handlerErr error
+		expErr     error
+		expHandled int
+	}{
+		"Successful publishing should call the handler": {
+			expErr:     nil,
+			expHandled: 1,
+		},
+		"Failed publishing should not call the handler": {
+			brokerErr:  errors.New("broker error"),
+			expErr:     errors.New("broker error"),
+			expHandled: 0,
+		},
+		"Failed handling should return the error of the handler": {
+			handlerErr: errors.New("handler error"),
+			expErr:     errors.New("handler error"),
+			expHandled: 1,
+		},
+	}
+	for name, test := range tests {
+		tt := test
+		t.Run(name, func(t *testing.T) {
+			broker := &outbox.MockBroker{}
+			broker.On("Send", msg).Return(tt.brokerErr)
+			handled := 0
+			h := Tee(broker, func(context.Context, outbox.Message) error {
+				handled++
+				return tt.handlerErr
+			})
+			assert.Equal(t, tt.expErr, h(context.Background(), msg))
+			assert.Equal(t, tt.expHandled, handled)
+			broker.AssertNumberOfCalls(t, "Send", 1)
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package kafka
+
+import (
+	"github.com/IBM/sarama"
+
+	"github.com/pkritiotis/outbox"
+)
+
+// AsyncBroker implements the AsyncMessageBroker interface on top of a sarama.AsyncProducer, so that the dispatcher
+// does not wait for the acknowledgement of every message before sending the next one in Unordered mode
+type AsyncBroker struct {
+	producer sarama.AsyncProducer
+	done     chan struct{}
+}
+
+// NewAsyncBroker constructor
+func NewAsyncBroker(brokers []string, config *sarama.Config) (*AsyncBroker, error) {
+	config.Producer.Return.Successes = true
+	config.Producer.Return.Errors = true
+	producer, err := sarama.NewAsyncProducer(brokers, config)
+	if err != nil {
+		return nil, err
+	}
+	return newAsyncBroker(producer), nil
+}
+
+func newAsyncBroker(producer sarama.AsyncProducer) *AsyncBroker {
+	b := &AsyncBroker{producer: producer, done: make(chan struct{})}
+	go b.dispatchAcks()
+	return b
+}
+
+// dispatchAcks calls the done callback of every acknowledged message until the producer is closed
+func (b *AsyncBroker) dispatchAcks() {
+	defer close(b.done)
+	successes, errs := b.producer.Successes(), b.producer.Errors()
+	for successes != nil || errs != nil {
+		select {
+		case msg, ok := <-successes:
+			if !ok {
+				successes = nil
+				continue
+			}
+			msg.Metadata.(func(err error))(nil)
+		case perr, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
+			}
+			perr.Msg.Metadata.(func(err error))(translateError(perr.Err))
+		}
+	}
+}
+
+// SendAsync sends the message to kafka and calls done once kafka acknowledges it
+func (b *AsyncBroker) SendAsync(event outbox.Message, done func(err error)) {
+	msg := producerMessage(event)
+	msg.Metadata = done
+	b.producer.Input() <- msg
+}
+
+// Send delivers the message to kafka and waits for its acknowledgement
+func (b *AsyncBroker) Send(event outbox.Message) error {
+	errChan := make(chan error, 1)
+	b.SendAsync(event, func(err error) { errChan <- err })
+	return <-errChan
+}
+
+// Close flushes the buffered messages, waits for their acknowledgements and closes the producer
+func (b *AsyncBroker) Close() error {
+	b.producer.AsyncClose()
+	<-b.done
+	return nil
+}
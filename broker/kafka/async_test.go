@@ -0,0 +1,50 @@
+package kafka
+
+import (
+	"testing"
+
+	"github.com/IBM/sarama"
+	"github.com/pkritiotis/outbox"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAsyncBroker_SendAsync(t *testing.T) {
+	tests := map[string]struct {
+		produceErr sarama.KError
+		expErr     error
+	}{
+		"Successful delivery should acknowledge the message without error": {
+			produceErr: sarama.ErrNoError,
+			expErr:     nil,
+		},
+		"Unsuccessful delivery should acknowledge the message with the error": {
+			produceErr: sarama.ErrBrokerNotAvailable,
+			expErr:     sarama.ErrBrokerNotAvailable,
+		},
+	}
+	for name, test := range tests {
+		tt := test
+		t.Run(name, func(t *testing.T) {
+			mb := sarama.NewMockBroker(t, 1)
+			defer mb.Close()
+			mb.SetHandlerByMap(map[string]sarama.MockResponse{
+				"MetadataRequest": sarama.NewMockMetadataResponse(t).
+					SetBroker(mb.Addr(), mb.BrokerID()).
+					SetLeader("sampleTopic", 0, mb.BrokerID()),
+				"ProduceRequest": sarama.NewMockProduceResponse(t).SetError("sampleTopic", 0, tt.produceErr),
+			})
+			config := sarama.NewConfig()
+			config.Producer.Retry.Max = 0
+			config.Producer.Partitioner = sarama.NewRandomPartitioner
+			b, err := NewAsyncBroker([]string{mb.Addr()}, config)
+			assert.Nil(t, err)
+
+			acks := make(chan error, 1)
+			b.SendAsync(outbox.Message{Key: "sampleKey", Body: []byte("testing"), Topic: "sampleTopic"}, func(err error) {
+				acks <- err
+			})
+			assert.Equal(t, tt.expErr, <-acks)
+			assert.Nil(t, b.Close())
+		})
+	}
+}
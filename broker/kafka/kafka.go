@@ -2,6 +2,10 @@
 package kafka
 
 import (
+	"errors"
+	"fmt"
+	"strings"
+
 	"github.com/IBM/sarama"
 
 	"github.com/pkritiotis/outbox"
@@ -24,6 +28,13 @@ func NewBroker(brokers []string, config *sarama.Config) (*Broker, error) {
 
 // Send delivers the message to kafka
 func (b Broker) Send(event outbox.Message) error {
+	_, _, err := b.producer.SendMessage(producerMessage(event))
+
+	return translateError(err)
+}
+
+// producerMessage converts the outbox message to a kafka producer message
+func producerMessage(event outbox.Message) *sarama.ProducerMessage {
 	var headers []sarama.RecordHeader
 
 	for k, v := range event.Headers {
@@ -33,12 +44,24 @@ func (b Broker) Send(event outbox.Message) error {
 		})
 	}
 
-	msg := &sarama.ProducerMessage{
-		Topic: event.Topic,
-		Key:   sarama.StringEncoder(event.Key),
-		Value: sarama.StringEncoder(event.Body),
+	return &sarama.ProducerMessage{
+		Topic:   event.Topic,
+		Key:     sarama.StringEncoder(event.Key),
+		Value:   sarama.StringEncoder(event.Body),
+		Headers: headers,
 	}
-	_, _, err := b.producer.SendMessage(msg)
+}
+
+// maxMessageBytesPrefix is the prefix of the error returned by the producer for messages larger than
+// Producer.MaxMessageBytes, which are rejected before being sent to kafka
+const maxMessageBytesPrefix = "Attempt to produce message larger than configured Producer.MaxMessageBytes"
 
+// translateError maps the message size errors to a permanent outbox.ErrMessageTooLargeForBroker
+func translateError(err error) error {
+	var configErr sarama.ConfigurationError
+	if errors.Is(err, sarama.ErrMessageSizeTooLarge) ||
+		errors.As(err, &configErr) && strings.HasPrefix(string(configErr), maxMessageBytesPrefix) {
+		return &outbox.PermanentError{Err: fmt.Errorf("%w: %w", outbox.ErrMessageTooLargeForBroker, err)}
+	}
 	return err
 }
@@ -1,6 +1,8 @@
 package kafka
 
 import (
+	"errors"
+	"fmt"
 	"testing"
 
 	"github.com/IBM/sarama"
@@ -42,6 +44,32 @@ func TestBroker_Send(t *testing.T) {
 			},
 			expErr: sarama.KError(sarama.ErrBrokerNotAvailable),
 		},
+		"Message rejected by kafka as too large should return a permanent error": {
+			broker: func() *sarama.MockBroker {
+				mp := sarama.NewMockBroker(t, 1)
+				mp.SetHandlerByMap(map[string]sarama.MockResponse{
+					"MetadataRequest": sarama.NewMockMetadataResponse(t).
+						SetBroker(mp.Addr(), mp.BrokerID()).
+						SetLeader("sampleTopic", 0, mp.BrokerID()),
+					"ProduceRequest": sarama.NewMockProduceResponse(t).SetError("sampleTopic", 0, sarama.ErrMessageSizeTooLarge),
+				})
+				return mp
+			}(),
+			config: func() *sarama.Config {
+				mp := sarama.NewConfig()
+				mp.Producer.Return.Successes = true
+				mp.Producer.Partitioner = sarama.NewRandomPartitioner
+				return mp
+			}(),
+			event: outbox.Message{
+				Key:   "sampleKey",
+				Body:  sarama.ByteEncoder("testing"),
+				Topic: "sampleTopic",
+			},
+			expErr: &outbox.PermanentError{
+				Err: fmt.Errorf("%w: %w", outbox.ErrMessageTooLargeForBroker, sarama.ErrMessageSizeTooLarge),
+			},
+		},
 	}
 	for name, test := range tests {
 		tt := test
@@ -83,3 +111,45 @@ func TestNewBroker_success(t *testing.T) {
 	assert.Nil(t, err)
 	assert.NotNil(t, b)
 }
+
+func Test_translateError(t *testing.T) {
+	tooLargeErr := sarama.ConfigurationError(maxMessageBytesPrefix + ": 120 > 10")
+	otherConfigErr := sarama.ConfigurationError("Producer.Return.Successes must be true to be used in a SyncProducer")
+
+	var permanentErr *outbox.PermanentError
+	assert.True(t, errors.As(translateError(sarama.ErrMessageSizeTooLarge), &permanentErr))
+	assert.True(t, errors.Is(translateError(sarama.ErrMessageSizeTooLarge), outbox.ErrMessageTooLargeForBroker))
+	assert.True(t, errors.Is(translateError(tooLargeErr), outbox.ErrMessageTooLargeForBroker))
+	assert.Equal(t, otherConfigErr, translateError(otherConfigErr))
+	assert.Equal(t, sarama.ErrBrokerNotAvailable, translateError(sarama.ErrBrokerNotAvailable))
+	assert.Nil(t, translateError(nil))
+}
+
+// recordingProducer keeps the messages sent through SendMessage
+type recordingProducer struct {
+	sarama.SyncProducer
+	messages []*sarama.ProducerMessage
+}
+
+func (p *recordingProducer) SendMessage(msg *sarama.ProducerMessage) (int32, int64, error) {
+	p.messages = append(p.messages, msg)
+	return 0, 0, nil
+}
+
+func TestBroker_Send_headers(t *testing.T) {
+	producer := &recordingProducer{}
+	b := Broker{producer: producer}
+
+	err := b.Send(outbox.Message{
+		Key:     "sampleKey",
+		Headers: map[string]string{"testKey": "testValue"},
+		Body:    []byte("testing"),
+		Topic:   "sampleTopic",
+	})
+
+	assert.Nil(t, err)
+	assert.Len(t, producer.messages, 1)
+	assert.Equal(t, []sarama.RecordHeader{
+		{Key: sarama.ByteEncoder("testKey"), Value: sarama.ByteEncoder("testValue")},
+	}, producer.messages[0].Headers)
+}
@@ -0,0 +1,162 @@
+// Package memory provides a message broker recording the published messages in memory, to test the enqueue, dispatch
+// and publish flow of the services without a real message broker
+package memory
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/pkritiotis/outbox"
+)
+
+// ErrInjected is the error returned by the sends failed by the fault injection of the Broker. It is wrapped in an
+// outbox.PermanentError after FailWithPermanentError
+var ErrInjected = errors.New("injected broker failure")
+
+// Broker implements the MessageBroker and ContextMessageBroker interfaces by recording the messages it publishes.
+// It is safe for concurrent use
+type Broker struct {
+	mu        sync.Mutex
+	published []outbox.Message
+	sends     int
+	failNth   map[int]bool
+	failNext  int
+	// failKeys is the number of the next sends of every key to fail, negative to fail all of them
+	failKeys  map[string]int
+	permanent bool
+	delay     time.Duration
+	keyHeader *string
+}
+
+// NewBroker constructor
+func NewBroker() *Broker {
+	return &Broker{failNth: map[int]bool{}, failKeys: map[string]int{}}
+}
+
+// Send records the message, unless its send is failed by the fault injection
+func (b *Broker) Send(message outbox.Message) error {
+	return b.SendContext(context.Background(), message)
+}
+
+// SendContext records the message after the Delay, unless its send is failed by the fault injection or the context
+// is done
+func (b *Broker) SendContext(ctx context.Context, message outbox.Message) error {
+	b.mu.Lock()
+	b.sends++
+	n, delay := b.sends, b.delay
+	b.mu.Unlock()
+
+	if delay > 0 {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.fails(n, message.Key) {
+		if b.permanent {
+			return &outbox.PermanentError{Err: ErrInjected}
+		}
+		return ErrInjected
+	}
+	if b.keyHeader != nil {
+		message = outbox.KeyAsHeader(message, *b.keyHeader)
+	}
+	b.published = append(b.published, message)
+	return nil
+}
+
+// fails reports whether the nth send of a message with the key is failed, consuming the injected failures
+func (b *Broker) fails(n int, key string) bool {
+	if b.failNth[n] {
+		return true
+	}
+	if b.failNext > 0 {
+		b.failNext--
+		return true
+	}
+	switch remaining := b.failKeys[key]; {
+	case remaining < 0:
+		return true
+	case remaining > 0:
+		b.failKeys[key] = remaining - 1
+		return true
+	}
+	return false
+}
+
+// Published returns the messages published successfully so far, in the order they were sent
+func (b *Broker) Published() []outbox.Message {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]outbox.Message(nil), b.published...)
+}
+
+// Sends returns the number of sends so far, failed or not
+func (b *Broker) Sends() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.sends
+}
+
+// FailNth fails the nth send with ErrInjected, counting from 1 since the creation of the broker
+func (b *Broker) FailNth(n int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failNth[n] = true
+}
+
+// FailOnKey fails every send of the messages with the key with ErrInjected, e.g. to simulate a poison message
+func (b *Broker) FailOnKey(key string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failKeys[key] = -1
+}
+
+// FailNext fails the next n sends with ErrInjected, e.g. to simulate a transient outage of the broker
+func (b *Broker) FailNext(n int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failNext = n
+}
+
+// FailKey fails the next times sends of the messages with the key with ErrInjected, e.g. to simulate a record
+// delivered after a number of retries
+func (b *Broker) FailKey(key string, times int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failKeys[key] = times
+}
+
+// FailWithPermanentError wraps the injected failures in an outbox.PermanentError, so that the failed records are
+// moved to the MaxAttemptsReached state without further attempts
+func (b *Broker) FailWithPermanentError() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.permanent = true
+}
+
+// KeyAsHeader records the key of the messages in the header name, see outbox.KeyAsHeader, like the brokers without
+// native keys
+func (b *Broker) KeyAsHeader(name string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.keyHeader = &name
+}
+
+// Delay delays every send by d, e.g. to simulate a slow broker with the PublishTimeout or the lock heartbeat. The
+// delayed sends return the error of their context if it is done before d
+func (b *Broker) Delay(d time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.delay = d
+}
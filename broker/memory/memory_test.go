@@ -0,0 +1,120 @@
+package memory
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/pkritiotis/outbox"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBroker_Send(t *testing.T) {
+	first := outbox.Message{Key: "1", Body: []byte("body"), Topic: "topic"}
+	second := outbox.Message{Key: "2", Body: []byte("body"), Topic: "topic"}
+	tests := map[string]struct {
+		broker       func() *Broker
+		expErrs      []error
+		expPublished []outbox.Message
+	}{
+		"Successful sends should record the messages in order": {
+			broker:       NewBroker,
+			expErrs:      []error{nil, nil, nil},
+			expPublished: []outbox.Message{first, second, first},
+		},
+		"Failed nth send should not record the message": {
+			broker: func() *Broker {
+				b := NewBroker()
+				b.FailNth(2)
+				return b
+			},
+			expErrs:      []error{nil, ErrInjected, nil},
+			expPublished: []outbox.Message{first, first},
+		},
+		"Failed key should fail every send of the key": {
+			broker: func() *Broker {
+				b := NewBroker()
+				b.FailOnKey("1")
+				return b
+			},
+			expErrs:      []error{ErrInjected, nil, ErrInjected},
+			expPublished: []outbox.Message{second},
+		},
+		"Failed next sends should only fail the next n sends": {
+			broker: func() *Broker {
+				b := NewBroker()
+				b.FailNext(2)
+				return b
+			},
+			expErrs:      []error{ErrInjected, ErrInjected, nil},
+			expPublished: []outbox.Message{first},
+		},
+		"Failed key times should only fail the next sends of the key": {
+			broker: func() *Broker {
+				b := NewBroker()
+				b.FailKey("1", 1)
+				return b
+			},
+			expErrs:      []error{ErrInjected, nil, nil},
+			expPublished: []outbox.Message{second, first},
+		},
+		"Permanent failures should wrap the injected error": {
+			broker: func() *Broker {
+				b := NewBroker()
+				b.FailNext(1)
+				b.FailWithPermanentError()
+				return b
+			},
+			expErrs:      []error{&outbox.PermanentError{Err: ErrInjected}, nil, nil},
+			expPublished: []outbox.Message{second, first},
+		},
+	}
+	for name, test := range tests {
+		tt := test
+		t.Run(name, func(t *testing.T) {
+			b := tt.broker()
+			var errs []error
+			for _, msg := range []outbox.Message{first, second, first} {
+				errs = append(errs, b.Send(msg))
+			}
+			assert.Equal(t, tt.expErrs, errs)
+			assert.Equal(t, tt.expPublished, b.Published())
+			assert.Equal(t, 3, b.Sends())
+		})
+	}
+}
+
+func TestBroker_SendContext_canceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	b := NewBroker()
+
+	assert.Equal(t, context.Canceled, b.SendContext(ctx, outbox.Message{Key: "1"}))
+	assert.Empty(t, b.Published())
+}
+
+func TestBroker_Delay(t *testing.T) {
+	b := NewBroker()
+	b.Delay(50 * time.Millisecond)
+
+	start := time.Now()
+	assert.Nil(t, b.Send(outbox.Message{Key: "1"}))
+	assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	err := b.SendContext(ctx, outbox.Message{Key: "2"})
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+	assert.Equal(t, []outbox.Message{{Key: "1"}}, b.Published())
+}
+
+func TestBroker_KeyAsHeader(t *testing.T) {
+	b := NewBroker()
+	b.KeyAsHeader("X-Key")
+
+	assert.Nil(t, b.Send(outbox.Message{Key: "1", Headers: map[string]string{"trace": "abc"}}))
+	assert.Equal(t, []outbox.Message{
+		{Key: "1", Headers: map[string]string{"trace": "abc", "X-Key": "1"}},
+	}, b.Published())
+}
@@ -0,0 +1,19 @@
+package outbox
+
+import (
+	"time"
+
+	time2 "github.com/pkritiotis/outbox/internal/time"
+)
+
+// Clock provides the current time. The outbox takes all its time decisions, i.e. the record creation, lock,
+// retry and expiry times, with a single Clock, which should be shared by all the outbox instances,
+// e.g. the database clock of mysql.DBClock
+type Clock interface {
+	Now() time.Time
+}
+
+// clockOrDefault returns the provided clock or the local clock if it is nil
+func clockOrDefault(clock Clock) Clock {
+	return time2.ProviderOrDefault(clock)
+}
@@ -0,0 +1,75 @@
+package outbox
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	time2 "github.com/pkritiotis/outbox/internal/time"
+	"github.com/stretchr/testify/assert"
+)
+
+// skewedClock is the local clock of an instance, skewed from the real time
+type skewedClock struct {
+	skew time.Duration
+}
+
+func (c skewedClock) Now() time.Time {
+	return time.Now().Add(c.skew)
+}
+
+func Test_clock_skewedInstances(t *testing.T) {
+	maxLockDuration := 10 * time.Minute
+	tests := map[string]struct {
+		lockerClock Clock
+		reaperClock Clock
+		expReaped   bool
+	}{
+		"Local clocks of skewed instances should reap a fresh lock": {
+			lockerClock: skewedClock{},
+			reaperClock: skewedClock{skew: time.Hour},
+			expReaped:   true,
+		},
+		"Shared clock should not reap a fresh lock of a skewed instance": {
+			lockerClock: skewedClock{skew: time.Hour},
+			reaperClock: skewedClock{skew: time.Hour},
+			expReaped:   false,
+		},
+	}
+	for name, test := range tests {
+		tt := test
+		t.Run(name, func(t *testing.T) {
+			id := uuid.New()
+			store := &lockTableStore{records: map[uuid.UUID]Record{id: {ID: id, State: PendingDelivery}}}
+			locker := newStateSelector(store, "instance-a", tt.lockerClock, 0)
+			reaper := newRecordUnlocker(store, maxLockDuration, tt.reaperClock)
+
+			_, err := locker.selectRecords()
+			assert.Nil(t, err)
+			assert.Nil(t, reaper.UnlockExpiredMessages())
+
+			assert.Equal(t, tt.expReaped, store.reaped > 0)
+		})
+	}
+}
+
+func Test_clockOrDefault(t *testing.T) {
+	clock := skewedClock{skew: time.Hour}
+	assert.Equal(t, clock, clockOrDefault(clock))
+	assert.Equal(t, time2.NewTimeProvider(), clockOrDefault(nil))
+}
+
+func TestNewDispatcher_clock(t *testing.T) {
+	clock := skewedClock{skew: time.Hour}
+	store := &MockStore{}
+	d := NewDispatcher(store, &MockBroker{}, DispatcherSettings{Clock: clock}, "1")
+
+	assert.Equal(t, clock, d.time)
+	assert.Equal(t, clock, d.recordProcessor.(*defaultRecordProcessor).time)
+	selector := newStateSelector(store, "1", clock, 0)
+	selector.paused = d.pausedTopics
+	assert.Equal(t, selector, d.recordProcessor.(*defaultRecordProcessor).selector)
+	assert.Equal(t, clock, d.recordUnlocker.(recordUnlocker).time)
+	assert.Equal(t, clock, d.recordCleaner.(recordCleaner).time)
+	assert.Equal(t, clock, NewPublisherWithClock(store, clock).time)
+}
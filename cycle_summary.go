@@ -0,0 +1,68 @@
+package outbox
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	time2 "time"
+)
+
+// cycleSummary counts the outcomes of the records of a processing cycle, which can be stored concurrently
+type cycleSummary struct {
+	mu           sync.Mutex
+	startedAt    time2.Time
+	locked       int
+	published    int
+	failed       int
+	deadLettered int
+	expired      int
+}
+
+// delivered counts a record marked as delivered
+func (s *cycleSummary) delivered() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.published++
+}
+
+// stored counts a stored failure of a record, by its expiry or the state it moved to
+func (s *cycleSummary) stored(res publishResult, failure RecordFailure) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case res.expired:
+		s.expired++
+	case failure.State == MaxAttemptsReached:
+		s.deadLettered++
+	default:
+		s.failed++
+	}
+}
+
+// log emits the summary as a single structured log line, with the error of the cycle if it failed
+func (s *cycleSummary) log(logger *slog.Logger, level slog.Level, finishedAt time2.Time, err error) {
+	if s == nil {
+		return
+	}
+	logger = loggerOrDefault(logger)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	attrs := []slog.Attr{
+		slog.Int("locked", s.locked),
+		slog.Int("published", s.published),
+		slog.Int("failed", s.failed),
+		slog.Int("dead_lettered", s.deadLettered),
+		slog.Int("expired", s.expired),
+		slog.Duration("duration", finishedAt.Sub(s.startedAt)),
+	}
+	if err != nil {
+		attrs = append(attrs, slog.String("error", err.Error()))
+	}
+	logger.LogAttrs(context.Background(), level, "Outbox dispatch cycle", attrs...)
+}
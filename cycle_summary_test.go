@@ -0,0 +1,94 @@
+package outbox
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	time2 "github.com/pkritiotis/outbox/internal/time"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func Test_defaultRecordProcessor_ProcessRecords_cyclesSummary(t *testing.T) {
+	sampleTime := time.Now().UTC()
+	timeProvider := &time2.MockProvider{}
+	timeProvider.On("Now").Return(sampleTime)
+	machineID := "1"
+	expiresAt := sampleTime.Add(-time.Second)
+	records := []Record{
+		{ID: uuid.New(), Message: Message{Key: "delivered"}, State: PendingDelivery},
+		{ID: uuid.New(), Message: Message{Key: "dead-lettered"}, State: PendingDelivery, NumberOfAttempts: 2},
+		{ID: uuid.New(), Message: Message{Key: "retried"}, State: PendingDelivery},
+		{ID: uuid.New(), Message: Message{Key: "expired"}, State: PendingDelivery, ExpiresAt: &expiresAt},
+	}
+
+	tests := map[string]struct {
+		records  []Record
+		level    slog.Level
+		disabled bool
+		expLog   string
+	}{
+		"Cycle should be summarized": {
+			records: records,
+			expLog:  "level=INFO msg=\"Outbox dispatch cycle\" locked=4 published=1 failed=1 dead_lettered=1 expired=1 duration=0s error=",
+		},
+		"Empty cycle should be summarized at the configured level": {
+			records: []Record{},
+			level:   slog.LevelDebug,
+			expLog:  "level=DEBUG msg=\"Outbox dispatch cycle\" locked=0 published=0 failed=0 dead_lettered=0 expired=0 duration=0s\n",
+		},
+		"Cycle should not be summarized by default": {
+			records:  records,
+			disabled: true,
+		},
+	}
+	for name, test := range tests {
+		tt := test
+		t.Run(name, func(t *testing.T) {
+			store := &MockStore{}
+			store.On("UpdateRecordsLockByStates", machineID, sampleTime, []RecordState{PendingDelivery}, 0).Return(nil)
+			store.On("GetRecordsByLockID", machineID).Return(tt.records, nil)
+			store.On("ClearLocksByLockID", machineID).Return(nil)
+			store.On("MarkProcessed", records[0].ID, 1, sampleTime, machineID).Return(nil)
+			store.On("RecordFailures", mock.Anything, machineID).Return(nil)
+			broker := &MockBroker{}
+			broker.On("Send", MetadataHeaders{}.withMetadataHeaders(records[0])).Return(nil)
+			broker.On("Send", mock.Anything).Return(errors.New("broker error"))
+			var logs bytes.Buffer
+			handler := slog.NewTextHandler(&logs, &slog.HandlerOptions{
+				Level: slog.LevelDebug,
+				ReplaceAttr: func(_ []string, a slog.Attr) slog.Attr {
+					if a.Key == slog.TimeKey {
+						return slog.Attr{}
+					}
+					return a
+				},
+			})
+
+			d := defaultRecordProcessor{
+				messageBroker:      broker,
+				time:               timeProvider,
+				store:              store,
+				machineID:          machineID,
+				orderingMode:       Unordered,
+				retrialPolicy:      RetrialPolicy{MaxSendAttemptsEnabled: true, MaxSendAttempts: 3},
+				selector:           stateSelector{store: store, time: timeProvider, lockID: machineID},
+				logCyclesSummary:   !tt.disabled,
+				cyclesSummaryLevel: tt.level,
+				logger:             slog.New(handler),
+			}
+			_ = d.ProcessRecords()
+
+			if tt.disabled {
+				assert.Empty(t, logs.String())
+				return
+			}
+			assert.Contains(t, logs.String(), tt.expLog)
+			assert.Equal(t, 1, bytes.Count(logs.Bytes(), []byte("\n")))
+		})
+	}
+}
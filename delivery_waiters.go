@@ -0,0 +1,131 @@
+package outbox
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// DeliveryWaiters is the bounded registry of the records awaited by Publisher.EnqueueAndWait. The same registry must
+// be set to the Publisher with WithDeliveryWaiters and to the DispatcherSettings of a dispatcher of the same process,
+// which notifies the waiters once it has stored the outcome of the records
+type DeliveryWaiters struct {
+	mu      sync.Mutex
+	max     int
+	waiters map[uuid.UUID]chan error
+}
+
+// NewDeliveryWaiters constructs a registry of up to max concurrently awaited records
+func NewDeliveryWaiters(max int) *DeliveryWaiters {
+	return &DeliveryWaiters{max: max, waiters: map[uuid.UUID]chan error{}}
+}
+
+// register returns the channel receiving the outcome of the record, or ErrTooManyWaiters if the registry is full
+func (w *DeliveryWaiters) register(id uuid.UUID) (<-chan error, error) {
+	if w == nil {
+		return nil, ErrTooManyWaiters
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.waiters) >= w.max {
+		return nil, ErrTooManyWaiters
+	}
+	ch := make(chan error, 1)
+	w.waiters[id] = ch
+	return ch, nil
+}
+
+func (w *DeliveryWaiters) unregister(id uuid.UUID) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.waiters, id)
+}
+
+// notify sends the outcome of the record to its waiter, if any
+func (w *DeliveryWaiters) notify(id uuid.UUID, err error) {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	ch, ok := w.waiters[id]
+	if !ok {
+		return
+	}
+	delete(w.waiters, id)
+	ch <- err
+}
+
+// notifyFailed notifies the waiter of the record once the stored failure is final, with ErrRecordExpired or
+// ErrRecordDeadLettered. The waiter keeps waiting for the retries of the other failures
+func (w *DeliveryWaiters) notifyFailed(id uuid.UUID, failure RecordFailure, reason error) {
+	switch failure.State {
+	case Expired:
+		w.notify(id, ErrRecordExpired)
+	case MaxAttemptsReached:
+		w.notify(id, fmt.Errorf("%w: %w", ErrRecordDeadLettered, reason))
+	}
+}
+
+// WithDeliveryWaiters returns a copy of the publisher awaiting the records of EnqueueAndWait with the registry
+func (o Publisher) WithDeliveryWaiters(waiters *DeliveryWaiters) Publisher {
+	o.waiters = waiters
+	return o
+}
+
+// EnqueueAndWait stores the message outside of a transaction and blocks until a dispatcher of the same process
+// delivers it, or the context is done. It returns nil once the record is marked as delivered, and ErrRecordExpired or
+// ErrRecordDeadLettered if it will never be delivered. The context must have a deadline, otherwise ErrNoDeadline is
+// returned without storing the message. ErrTooManyWaiters is returned without storing the message when the
+// DeliveryWaiters of the publisher are full or not set.
+// Only the dispatchers sharing the DeliveryWaiters, i.e. of the same process, notify the waiter. When the context is
+// done first, the state of the record is read once from the store, so that a record delivered by the dispatcher of
+// another process is still confirmed, and the context error is returned if it is not final yet. The record stays
+// enqueued in that case, and is delivered later as any record.
+// It is meant for the rare flows that need a delivery confirmation, since it holds the caller for a whole dispatch
+// cycle at least
+func (o Publisher) EnqueueAndWait(ctx context.Context, msg Message) error {
+	if _, ok := ctx.Deadline(); !ok {
+		return ErrNoDeadline
+	}
+	record := o.newRecord(msg)
+	outcome, err := o.waiters.register(record.ID)
+	if err != nil {
+		return err
+	}
+	defer o.waiters.unregister(record.ID)
+
+	err = o.store.AddRecord(ctx, record)
+	if err != nil {
+		return err
+	}
+	select {
+	case err = <-outcome:
+		return err
+	case <-ctx.Done():
+		return o.storedOutcome(ctx, record.ID)
+	}
+}
+
+// storedOutcome returns the outcome of the record stored in the store once the context of EnqueueAndWait is done, or
+// the context error if the record is still pending or could not be read
+func (o Publisher) storedOutcome(ctx context.Context, id uuid.UUID) error {
+	rec, err := o.store.GetRecordByID(id)
+	if err != nil {
+		return ctx.Err()
+	}
+	switch rec.State {
+	case Delivered:
+		return nil
+	case Expired:
+		return ErrRecordExpired
+	case MaxAttemptsReached:
+		if rec.Error != nil {
+			return fmt.Errorf("%w: %s", ErrRecordDeadLettered, *rec.Error)
+		}
+		return ErrRecordDeadLettered
+	}
+	return ctx.Err()
+}
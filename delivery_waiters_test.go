@@ -0,0 +1,192 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	time2 "github.com/pkritiotis/outbox/internal/time"
+	uuid2 "github.com/pkritiotis/outbox/internal/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestPublisher_EnqueueAndWait(t *testing.T) {
+	sampleUUID := uuid.New()
+	sampleTime := time.Now().UTC()
+	timeProvider := &time2.MockProvider{}
+	timeProvider.On("Now").Return(sampleTime)
+	uuidProvider := &uuid2.MockProvider{}
+	uuidProvider.On("NewUUID").Return(sampleUUID)
+	msg := Message{Key: "key", Body: []byte("body"), Topic: "topic"}
+	record := Record{ID: sampleUUID, Message: msg, State: PendingDelivery, CreatedOn: sampleTime}
+	deadLetterErr := fmt.Errorf("%w: %w", ErrRecordDeadLettered, errors.New("broker error"))
+	lastErr := "broker error"
+	delivered := record
+	delivered.State = Delivered
+	deadLettered := record
+	deadLettered.State = MaxAttemptsReached
+	deadLettered.Error = &lastErr
+
+	tests := map[string]struct {
+		withoutDeadline bool
+		waiters         *DeliveryWaiters
+		addErr          error
+		outcome         *error
+		stored          Record
+		getErr          error
+		expErr          error
+		expAdded        bool
+	}{
+		"Delivered record should return without error": {
+			waiters:  NewDeliveryWaiters(1),
+			outcome:  new(error),
+			expErr:   nil,
+			expAdded: true,
+		},
+		"Dead lettered record should return the dead letter error": {
+			waiters:  NewDeliveryWaiters(1),
+			outcome:  &deadLetterErr,
+			expErr:   deadLetterErr,
+			expAdded: true,
+		},
+		"Undelivered record should return the context error": {
+			waiters:  NewDeliveryWaiters(1),
+			stored:   record,
+			expErr:   context.DeadlineExceeded,
+			expAdded: true,
+		},
+		"Record delivered without notification should return without error": {
+			waiters:  NewDeliveryWaiters(1),
+			stored:   delivered,
+			expErr:   nil,
+			expAdded: true,
+		},
+		"Record dead lettered without notification should return the dead letter error": {
+			waiters:  NewDeliveryWaiters(1),
+			stored:   deadLettered,
+			expErr:   fmt.Errorf("%w: %s", ErrRecordDeadLettered, "broker error"),
+			expAdded: true,
+		},
+		"Error in reading the undelivered record should return the context error": {
+			waiters:  NewDeliveryWaiters(1),
+			getErr:   errors.New("db error"),
+			expErr:   context.DeadlineExceeded,
+			expAdded: true,
+		},
+		"Error in storing the record should return an error": {
+			waiters:  NewDeliveryWaiters(1),
+			addErr:   ErrOutboxFull,
+			expErr:   ErrOutboxFull,
+			expAdded: true,
+		},
+		"Context without deadline should not store the record": {
+			withoutDeadline: true,
+			waiters:         NewDeliveryWaiters(1),
+			expErr:          ErrNoDeadline,
+		},
+		"Full waiters should not store the record": {
+			waiters: NewDeliveryWaiters(0),
+			expErr:  ErrTooManyWaiters,
+		},
+		"Missing waiters should not store the record": {
+			waiters: nil,
+			expErr:  ErrTooManyWaiters,
+		},
+	}
+	for name, test := range tests {
+		tt := test
+		t.Run(name, func(t *testing.T) {
+			store := &MockStore{}
+			store.On("AddRecord", mock.Anything, record).Return(tt.addErr).Run(func(mock.Arguments) {
+				if tt.outcome != nil {
+					go tt.waiters.notify(sampleUUID, *tt.outcome)
+				}
+			})
+			store.On("GetRecordByID", sampleUUID).Return(tt.stored, tt.getErr)
+			ctx := context.Background()
+			if !tt.withoutDeadline {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, 50*time.Millisecond)
+				defer cancel()
+			}
+			p := Publisher{store: store, time: timeProvider, uuid: uuidProvider}.WithDeliveryWaiters(tt.waiters)
+
+			err := p.EnqueueAndWait(ctx, msg)
+
+			assert.Equal(t, tt.expErr, err)
+			if tt.expAdded {
+				store.AssertCalled(t, "AddRecord", mock.Anything, record)
+				assert.Empty(t, tt.waiters.waiters)
+			} else {
+				store.AssertNotCalled(t, "AddRecord", mock.Anything, mock.Anything)
+			}
+		})
+	}
+}
+
+func Test_defaultRecordProcessor_ProcessRecords_deliveryWaiters(t *testing.T) {
+	sampleTime := time.Now().UTC()
+	timeProvider := &time2.MockProvider{}
+	timeProvider.On("Now").Return(sampleTime)
+	machineID := "1"
+	brokerErr := errors.New("broker error")
+	expiresAt := sampleTime.Add(-time.Second)
+	records := []Record{
+		{ID: uuid.New(), Message: Message{Key: "delivered"}, State: PendingDelivery},
+		{ID: uuid.New(), Message: Message{Key: "dead-lettered"}, State: PendingDelivery, NumberOfAttempts: 2},
+		{ID: uuid.New(), Message: Message{Key: "retried"}, State: PendingDelivery},
+		{ID: uuid.New(), Message: Message{Key: "expired"}, State: PendingDelivery, ExpiresAt: &expiresAt},
+	}
+
+	for name, mode := range map[string]OrderingMode{"Ordered batch": Ordered, "Unordered batch": Unordered} {
+		orderingMode := mode
+		t.Run(name, func(t *testing.T) {
+			store := &MockStore{}
+			store.On("UpdateRecordsLockByStates", machineID, sampleTime, []RecordState{PendingDelivery}, 0).Return(nil)
+			store.On("GetRecordsByLockID", machineID).Return(records, nil)
+			store.On("ClearLocksByLockID", machineID).Return(nil)
+			store.On("MarkProcessed", records[0].ID, 1, sampleTime, machineID).Return(nil)
+			store.On("RecordFailure", mock.Anything, machineID).Return(nil)
+			store.On("RecordFailures", mock.Anything, machineID).Return(nil)
+			broker := &MockBroker{}
+			broker.On("Send", MetadataHeaders{}.withMetadataHeaders(records[0])).Return(nil)
+			broker.On("Send", mock.Anything).Return(brokerErr)
+
+			waiters := NewDeliveryWaiters(len(records))
+			var outcomes []<-chan error
+			for _, rec := range records {
+				outcome, err := waiters.register(rec.ID)
+				assert.Nil(t, err)
+				outcomes = append(outcomes, outcome)
+			}
+			d := defaultRecordProcessor{
+				messageBroker:   broker,
+				time:            timeProvider,
+				store:           store,
+				machineID:       machineID,
+				orderingMode:    orderingMode,
+				retrialPolicy:   RetrialPolicy{MaxSendAttemptsEnabled: true, MaxSendAttempts: 3},
+				selector:        stateSelector{store: store, time: timeProvider, lockID: machineID},
+				deliveryWaiters: waiters,
+			}
+			_ = d.ProcessRecords()
+
+			if orderingMode == Ordered {
+				// The ordered batch stops at the dead lettered record
+				assert.Nil(t, <-outcomes[0])
+				assert.Equal(t, fmt.Errorf("%w: %w", ErrRecordDeadLettered, brokerErr), <-outcomes[1])
+				assert.Len(t, waiters.waiters, 2)
+				return
+			}
+			assert.Nil(t, <-outcomes[0])
+			assert.Equal(t, fmt.Errorf("%w: %w", ErrRecordDeadLettered, brokerErr), <-outcomes[1])
+			assert.Equal(t, ErrRecordExpired, <-outcomes[3])
+			assert.Len(t, waiters.waiters, 1)
+			assert.Contains(t, waiters.waiters, records[2].ID)
+		})
+	}
+}
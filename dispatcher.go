@@ -1,8 +1,13 @@
 package outbox
 
 import (
-	"log"
+	"context"
+	"fmt"
+	"log/slog"
 	"time"
+
+	"github.com/google/uuid"
+	time2 "github.com/pkritiotis/outbox/internal/time"
 )
 
 type processor interface {
@@ -17,12 +22,34 @@ type cleaner interface {
 	RemoveExpiredMessages() error
 }
 
+type ageChecker interface {
+	CheckRecordsAge() error
+}
+
 // RetrialPolicy contains the retrial settings
 type RetrialPolicy struct {
 	MaxSendAttemptsEnabled bool
 	MaxSendAttempts        int
+	// Backoff delays the next delivery attempt of the failed records. They are retried in the next cycle if not set
+	Backoff BackoffPolicy
 }
 
+// OrderingMode defines how the records of a locked batch are published
+type OrderingMode int
+
+const (
+	// Ordered publishes the records of a batch one by one in creation order and stops at the first failure
+	Ordered OrderingMode = iota
+	// Unordered publishes every record of a batch regardless of the failures of the others,
+	// allowing the records to be published concurrently
+	Unordered
+	// KeyOrdered publishes the records of different topic and message key pairs concurrently, with up to
+	// IntraBatchConcurrency workers, and the records of the same pair one by one in creation order. A failed record
+	// stops the publishing of the later records of its key in the batch. It speeds up the recovery of large backlogs
+	// without breaking the per key ordering. Records without a key are not ordered
+	KeyOrdered
+)
+
 // DispatcherSettings defines the set of configurations for the dispatcher
 type DispatcherSettings struct {
 	ProcessInterval           time.Duration
@@ -31,6 +58,100 @@ type DispatcherSettings struct {
 	CleanupWorkerInterval     time.Duration
 	RetrialPolicy             RetrialPolicy
 	MessagesRetentionDuration time.Duration
+	// AuditAttempts appends an audit entry of every publish attempt, successful or not, with Store.AddAttempts
+	AuditAttempts bool
+	// AttemptsRetentionDuration is the duration after which the audit entries of the attempts are removed by the
+	// cleanup worker. The entries are kept forever if it is not set
+	AttemptsRetentionDuration time.Duration
+	// OrderingMode defines whether the records of a batch have to be published in order. Defaults to Ordered
+	OrderingMode OrderingMode
+	// IntraBatchConcurrency is the number of records of a locked batch that are published concurrently.
+	// It only applies to the Unordered and KeyOrdered modes, values lower than 2 publish the batch serially
+	IntraBatchConcurrency int
+	// SelectionStrategy defines how the records to be dispatched are selected. Defaults to StateBasedSelection
+	SelectionStrategy SelectionStrategy
+	// BatchSize is the maximum number of records locked per cycle by the StateBasedSelection strategy, the records that
+	// have been due the longest first. All the due records are locked if it is not set
+	BatchSize int
+	// MaxBatchBytes is the maximum cumulative size of the decoded messages of a batch selected by the
+	// StateBasedSelection strategy, whichever of BatchSize and MaxBatchBytes is reached first. The locked records after
+	// it are released with the batch and selected in a later cycle. A message larger than it is published alone.
+	// The batch is not limited by size if it is not set
+	MaxBatchBytes int
+	// RecordLess orders the records of a selected batch before they are published, e.g. by a business priority header,
+	// and reports whether a must be published before b. Records that compare equal keep the order of the store. Only
+	// the records of a batch are ordered, so the publish order is not guaranteed across batches, and BatchSize bounds
+	// the records it compares. In the KeyOrdered mode the records of a key keep the order of the store, and only the
+	// keys are ordered. It is ignored by the WatermarkSelection strategy, and the records keep the order of the store
+	// if it is not set
+	RecordLess func(a, b Record) bool
+	// WatermarkStart is the creation time after which the WatermarkSelection strategy starts dispatching records
+	WatermarkStart time.Time
+	// WatermarkBatchSize is the maximum number of records selected per cycle by the WatermarkSelection strategy
+	WatermarkBatchSize int
+	// WatermarkLag is the grace period for the late commits of the WatermarkSelection strategy, which only selects the
+	// records created more than WatermarkLag ago. A record committed later than that after its creation time is
+	// created before the watermark and is skipped forever. Defaults to 10 seconds, a negative value disables it.
+	// A record that fails holds back the records after it, so its attempts are capped by the RetrialPolicy, or by 10
+	// attempts if it is not enabled, before it is dead-lettered and skipped
+	WatermarkLag time.Duration
+	// RecordAgeSLA is the maximum time a record should stay undelivered. Records exceeding it are reported to
+	// OnRecordAgeSLAExceeded every RecordAgeCheckInterval. The check is disabled if either of them is not set
+	RecordAgeSLA           time.Duration
+	RecordAgeCheckInterval time.Duration
+	// OnRecordAgeSLAExceeded is called with the ids of the undelivered records that were created more than
+	// RecordAgeSLA ago, oldest first
+	OnRecordAgeSLAExceeded func(ids []uuid.UUID)
+	// OnDeadLetter is called with the record and the error of its last attempt once a record is moved to the
+	// MaxAttemptsReached state, e.g. to notify a webhook. It is called synchronously by the dispatcher after the
+	// record is updated, so a slow callback delays the rest of the batch. It is not called if it is not set
+	OnDeadLetter func(rec Record, reason error)
+	// ShutdownAckTimeout is the maximum time to wait for the in-flight AsyncMessageBroker acknowledgements once the
+	// dispatcher is stopped. The acknowledged records are marked as delivered and the others are unlocked without an
+	// attempt, to be published again by the next dispatcher. They are waited for up to the AckTimeout if it is not set
+	ShutdownAckTimeout time.Duration
+	// DeliveryWaiters are notified of the outcome of the records awaited by Publisher.EnqueueAndWait. It must be the
+	// registry of the publisher
+	DeliveryWaiters *DeliveryWaiters
+	// TwoPhasePublish publishes the messages in two phases through brokers implementing TransactionalMessageBroker:
+	// the publish is prepared and its handle stored on the record, the record is marked as delivered, and the publish
+	// is committed. The publishes left prepared by a crashed dispatcher are recovered with RecoverPreparedPublishes,
+	// which Run calls on start. It only applies to the StateBasedSelection strategy, and the Unordered batches are
+	// prepared with Prepare even by AsyncMessageBroker brokers. It is ignored if the broker does not implement
+	// TransactionalMessageBroker
+	TwoPhasePublish bool
+	// PublishTimeout is the maximum duration of a publish attempt. It is only enforced by ContextMessageBroker brokers
+	PublishTimeout time.Duration
+	// AckTimeout is the maximum time to wait for the acknowledgement of a message sent through an
+	// AsyncMessageBroker, after which the record is failed with ErrAckTimeout. Defaults to 30 seconds
+	AckTimeout time.Duration
+	// LockHeartbeatInterval is the interval at which the locks of the batch being published are extended, so that
+	// batches taking longer than MaxLockTimeDuration are not unlocked and published again by another dispatcher.
+	// It should be well below MaxLockTimeDuration. Locks are not extended if it is not set
+	LockHeartbeatInterval time.Duration
+	// MaxDBConcurrency is the maximum number of concurrent store calls of the dispatcher, so that it does not use
+	// all the connections of a pool shared with the application. The locked records of a batch or a drain are then
+	// fetched in full before they are processed, so MaxBatchBytes no longer bounds the decoded records. In a
+	// DispatcherGroup it limits the calls of one outbox, see DispatcherGroupSettings.MaxDBConcurrency for the whole
+	// group. Store calls are not limited if it is not set
+	MaxDBConcurrency int
+	// Clock is the clock of the lock, retry, expiry and retention decisions of the dispatcher. It should be the clock
+	// of the Publisher, so that the record creation times are comparable. Defaults to the local clock
+	Clock Clock
+	// Metrics records the dispatcher metrics. Defaults to NoopMetricsRecorder
+	Metrics MetricsRecorder
+	// LogCyclesSummary logs one line per processing cycle with the number of locked, published, failed, dead-lettered
+	// and expired records and the duration of the cycle. The cycles skipped while the dispatcher is paused are not
+	// logged
+	LogCyclesSummary bool
+	// CyclesSummaryLevel is the level of the cycle summaries, slog.LevelInfo by default
+	CyclesSummaryLevel slog.Level
+	// Logger is the logger of the dispatcher: the cycle summaries, the runs of the workers at debug level and the
+	// failures that are not returned, e.g. of the lock heartbeats, at warn level. Defaults to slog.Default()
+	Logger *slog.Logger
+	// MetadataHeaders are the names of the reserved headers added to the published messages. Use
+	// DefaultMetadataHeaders to enable them, only the record id is added by default
+	MetadataHeaders MetadataHeaders
 }
 
 // Dispatcher initializes and runs the outbox dispatcher
@@ -38,66 +159,153 @@ type Dispatcher struct {
 	recordProcessor processor
 	recordUnlocker  unlocker
 	recordCleaner   cleaner
+	recordAgeCheck  ageChecker
 	settings        DispatcherSettings
+	store           Store
+	machineID       string
+	time            time2.Provider
+	pausedTopics    *pausedTopics
+	shutdown        *shutdown
+	twoPhaseBroker  TransactionalMessageBroker
+	// name is the name of the outbox of a DispatcherGroup member, which prefixes the errors of its workers
+	name string
 }
 
 // NewDispatcher constructor
 func NewDispatcher(store Store, broker MessageBroker, settings DispatcherSettings, machineID string) Dispatcher {
-	return Dispatcher{
+	clock := clockOrDefault(settings.Clock)
+	if settings.MaxDBConcurrency > 0 {
+		store = newLimitedStore(store, settings.MaxDBConcurrency)
+	}
+	paused := newPausedTopics()
+	stop := &shutdown{}
+	d := Dispatcher{
 		recordProcessor: newProcessor(
 			store,
 			broker,
 			machineID,
-			settings.RetrialPolicy,
+			settings,
+			paused,
+			stop,
 		),
 		recordUnlocker: newRecordUnlocker(
 			store,
 			settings.MaxLockTimeDuration,
+			clock,
 		),
 		recordCleaner: newRecordCleaner(
 			store,
 			settings.MessagesRetentionDuration,
+			settings.AttemptsRetentionDuration,
+			clock,
+			settings.Logger,
 		),
-		settings: settings,
+		settings:       settings,
+		store:          store,
+		machineID:      machineID,
+		time:           clock,
+		pausedTopics:   paused,
+		shutdown:       stop,
+		twoPhaseBroker: twoPhaseBroker(broker, settings),
+	}
+	if settings.RecordAgeSLA > 0 && settings.RecordAgeCheckInterval > 0 && settings.OnRecordAgeSLAExceeded != nil {
+		d.recordAgeCheck = newRecordAgeChecker(store, settings.RecordAgeSLA, settings.OnRecordAgeSLAExceeded, clock)
 	}
+	return d
 }
 
 // Run periodically checks for new outbox messages from the Store, sends the messages through the MessageBroker
-// and updates the message status accordingly
+// and updates the message status accordingly. Once doneChan is signaled no new batch is locked, and the channel
+// returned by Stopped is closed when the current batch is released
 func (d Dispatcher) Run(errChan chan<- error, doneChan <-chan struct{}) {
 	doneProc := make(chan struct{}, 1)
+	doneWorkers := make(chan struct{}, 1)
+
+	go func() {
+		<-doneChan
+		d.shutdown.stop()
+		doneProc <- struct{}{}
+		doneWorkers <- struct{}{}
+	}()
+
+	go d.runRecordProcessor(errChan, doneProc)
+	d.runWorkers(errChan, doneWorkers)
+}
+
+// runWorkers starts the lock checker, the retention cleaner and the record age checker, which are stopped once
+// doneChan is signaled
+func (d Dispatcher) runWorkers(errChan chan<- error, doneChan <-chan struct{}) {
 	doneUnlock := make(chan struct{}, 1)
 	doneClear := make(chan struct{}, 1)
+	doneAgeCheck := make(chan struct{}, 1)
 
 	go func() {
 		<-doneChan
-		doneProc <- struct{}{}
 		doneUnlock <- struct{}{}
 		doneClear <- struct{}{}
+		doneAgeCheck <- struct{}{}
 	}()
 
-	go d.runRecordProcessor(errChan, doneProc)
 	go d.runRecordUnlocker(errChan, doneUnlock)
 	go d.runRecordCleaner(errChan, doneClear)
+	if d.recordAgeCheck != nil {
+		go d.runRecordAgeChecker(errChan, doneAgeCheck)
+	}
+}
+
+// recoverOnStart recovers the prepared publishes before the first batch with the TwoPhasePublish setting
+func (d Dispatcher) recoverOnStart(errChan chan<- error) {
+	if d.twoPhaseBroker == nil {
+		return
+	}
+	recovered, err := d.RecoverPreparedPublishes(context.Background())
+	if err != nil {
+		errChan <- d.named(err)
+	} else if recovered > 0 {
+		d.logger().Info("Recovered the prepared publishes", slog.Int("recovered", recovered))
+	}
+}
+
+// logger returns the Logger of the settings or the default logger
+func (d Dispatcher) logger() *slog.Logger {
+	return loggerOrDefault(d.settings.Logger)
+}
+
+// loggerOrDefault returns the provided logger or slog.Default() if it is nil
+func loggerOrDefault(logger *slog.Logger) *slog.Logger {
+	if logger == nil {
+		return slog.Default()
+	}
+	return logger
+}
+
+// named prefixes the error with the name of the outbox of a DispatcherGroup member
+func (d Dispatcher) named(err error) error {
+	if d.name == "" {
+		return err
+	}
+	return fmt.Errorf("outbox %s: %w", d.name, err)
 }
 
 // runRecordProcessor processes the unsent records of the store
 func (d Dispatcher) runRecordProcessor(errChan chan<- error, doneChan <-chan struct{}) {
+	defer d.shutdown.finish()
+	d.recoverOnStart(errChan)
 	ticker := time.NewTicker(d.settings.ProcessInterval)
 	for {
-		log.Print("Record processor Running")
+		d.logger().Debug("Record processor Running")
 		err := d.recordProcessor.ProcessRecords()
 		if err != nil {
-			errChan <- err
+			errChan <- d.named(err)
 		}
-		log.Print("Record Processing Finished")
+		d.logger().Debug("Record Processing Finished")
 
 		select {
 		case <-ticker.C:
 			continue
 		case <-doneChan:
 			ticker.Stop()
-			log.Print("Stopping Record processor")
+			d.logger().Info("Stopping Record processor")
 			return
 		}
 	}
@@ -106,18 +314,18 @@ func (d Dispatcher) runRecordProcessor(errChan chan<- error, doneChan <-chan str
 func (d Dispatcher) runRecordUnlocker(errChan chan<- error, doneChan <-chan struct{}) {
 	ticker := time.NewTicker(d.settings.LockCheckerInterval)
 	for {
-		log.Print("Record unlocker Running")
+		d.logger().Debug("Record unlocker Running")
 		err := d.recordUnlocker.UnlockExpiredMessages()
 		if err != nil {
-			errChan <- err
+			errChan <- d.named(err)
 		}
-		log.Print("Record unlocker Finished")
+		d.logger().Debug("Record unlocker Finished")
 		select {
 		case <-ticker.C:
 			continue
 		case <-doneChan:
 			ticker.Stop()
-			log.Print("Stopping Record unlocker")
+			d.logger().Info("Stopping Record unlocker")
 			return
 
 		}
@@ -127,20 +335,40 @@ func (d Dispatcher) runRecordUnlocker(errChan chan<- error, doneChan <-chan stru
 func (d Dispatcher) runRecordCleaner(errChan chan<- error, doneChan <-chan struct{}) {
 	ticker := time.NewTicker(d.settings.CleanupWorkerInterval)
 	for {
-		log.Print("Record retention cleaner Running")
+		d.logger().Debug("Record retention cleaner Running")
 		err := d.recordCleaner.RemoveExpiredMessages()
 		if err != nil {
-			errChan <- err
+			errChan <- d.named(err)
 		}
-		log.Print("Record retention cleaner Finished")
+		d.logger().Debug("Record retention cleaner Finished")
 		select {
 		case <-ticker.C:
 			continue
 		case <-doneChan:
 			ticker.Stop()
-			log.Print("Stopping Record retention cleaner")
+			d.logger().Info("Stopping Record retention cleaner")
 			return
 
 		}
 	}
 }
+
+func (d Dispatcher) runRecordAgeChecker(errChan chan<- error, doneChan <-chan struct{}) {
+	ticker := time.NewTicker(d.settings.RecordAgeCheckInterval)
+	for {
+		d.logger().Debug("Record age checker Running")
+		err := d.recordAgeCheck.CheckRecordsAge()
+		if err != nil {
+			errChan <- d.named(err)
+		}
+		d.logger().Debug("Record age checker Finished")
+		select {
+		case <-ticker.C:
+			continue
+		case <-doneChan:
+			ticker.Stop()
+			d.logger().Info("Stopping Record age checker")
+			return
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package outbox
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// GroupMember is an outbox dispatched by a DispatcherGroup, usually a table of its own with the TableName setting of
+// the mySQL store
+type GroupMember struct {
+	// Name identifies the outbox in the lock ids, the metrics, the errors and the status of the group. It must be
+	// unique within the group
+	Name string
+	// Store is the store of the outbox
+	Store Store
+	// Settings are the dispatcher settings of the outbox. The ProcessInterval is replaced by the one of the group. Its
+	// MaxDBConcurrency limits the store calls of this outbox only, see DispatcherGroupSettings.MaxDBConcurrency for a
+	// limit of the whole group
+	Settings DispatcherSettings
+}
+
+// DispatcherGroupSettings defines the set of configurations for the dispatcher group
+type DispatcherGroupSettings struct {
+	// ProcessInterval is the interval between the rounds of the group, each of them processing one batch per outbox
+	ProcessInterval time.Duration
+	// MaxDBConcurrency is the maximum number of concurrent store calls of all the outboxes of the group together, e.g.
+	// when their stores share one *sql.DB. It applies on top of the MaxDBConcurrency of every outbox, which only
+	// limits the calls of that outbox. Store calls are not limited by the group if it is not set
+	MaxDBConcurrency int
+	// Logger is the logger of the runs of the record processor of the group, at debug level. The outboxes log with the
+	// Logger of their settings. Defaults to slog.Default()
+	Logger *slog.Logger
+}
+
+// DispatcherGroup dispatches several outboxes with a single record processor, one batch of every outbox per round.
+// Every outbox keeps the retrial, dead letter and retention settings of its dispatcher and a lock id of its own
+type DispatcherGroup struct {
+	names       []string
+	dispatchers []Dispatcher
+	settings    DispatcherGroupSettings
+	shutdown    *shutdown
+}
+
+// NewDispatcherGroup constructor. The records of a member are locked with the "<machineID>/<name>" lock id, so that
+// the lock checkers and the drains of the members do not release the locks of each other. Its metrics are tagged with
+// TagOutbox. The metrics of the member stores are not, their recorders should be wrapped with TagMetrics
+func NewDispatcherGroup(broker MessageBroker, members []GroupMember, settings DispatcherGroupSettings, machineID string) (*DispatcherGroup, error) {
+	if len(members) == 0 {
+		return nil, fmt.Errorf("the dispatcher group has no outboxes")
+	}
+	g := &DispatcherGroup{settings: settings, shutdown: &shutdown{}}
+	var slots chan struct{}
+	if settings.MaxDBConcurrency > 0 {
+		slots = make(chan struct{}, settings.MaxDBConcurrency)
+	}
+	seen := map[string]bool{}
+	for _, m := range members {
+		if m.Name == "" {
+			return nil, fmt.Errorf("the outboxes of a dispatcher group must be named")
+		}
+		if seen[m.Name] {
+			return nil, fmt.Errorf("the outbox %q is a member of the dispatcher group more than once", m.Name)
+		}
+		seen[m.Name] = true
+		s := m.Settings
+		s.ProcessInterval = settings.ProcessInterval
+		s.Metrics = TagMetrics(s.Metrics, m.Name)
+		store := m.Store
+		if slots != nil {
+			store = &limitedStore{store: store, slots: slots}
+		}
+		d := NewDispatcher(store, broker, s, machineID+"/"+m.Name)
+		d.name = m.Name
+		g.names = append(g.names, m.Name)
+		g.dispatchers = append(g.dispatchers, d)
+	}
+	return g, nil
+}
+
+// Run dispatches the outboxes of the group until doneChan is signaled. Every round processes one batch of every
+// outbox, starting from the next outbox each round, so that the BatchSize of an outbox bounds the records it publishes
+// before the others. The errors are prefixed with the name of the outbox. The lock checkers, the retention cleaners
+// and the record age checkers of the outboxes run on their own
+func (g *DispatcherGroup) Run(errChan chan<- error, doneChan <-chan struct{}) {
+	doneProc := make(chan struct{}, 1)
+	doneWorkers := make([]chan struct{}, len(g.dispatchers))
+	for i := range doneWorkers {
+		doneWorkers[i] = make(chan struct{}, 1)
+	}
+
+	go func() {
+		<-doneChan
+		g.shutdown.stop()
+		for _, d := range g.dispatchers {
+			d.shutdown.stop()
+		}
+		doneProc <- struct{}{}
+		for _, done := range doneWorkers {
+			done <- struct{}{}
+		}
+	}()
+
+	go g.runRecordProcessor(errChan, doneProc)
+	for i, d := range g.dispatchers {
+		d.runWorkers(errChan, doneWorkers[i])
+	}
+}
+
+// runRecordProcessor processes the unsent records of the outboxes round-robin
+func (g *DispatcherGroup) runRecordProcessor(errChan chan<- error, doneChan <-chan struct{}) {
+	defer g.shutdown.finish()
+	for _, d := range g.dispatchers {
+		defer d.shutdown.finish()
+	}
+	for _, d := range g.dispatchers {
+		d.recoverOnStart(errChan)
+	}
+	logger := loggerOrDefault(g.settings.Logger)
+	ticker := time.NewTicker(g.settings.ProcessInterval)
+	for round := 0; ; round++ {
+		logger.Debug("Record processor Running")
+		g.processRound(errChan, round)
+		logger.Debug("Record Processing Finished")
+
+		select {
+		case <-ticker.C:
+			continue
+		case <-doneChan:
+			ticker.Stop()
+			logger.Info("Stopping Record processor")
+			return
+		}
+	}
+}
+
+// processRound processes one batch of every outbox, starting from the outbox of the round
+func (g *DispatcherGroup) processRound(errChan chan<- error, round int) {
+	for n := range g.dispatchers {
+		d := g.dispatchers[(round+n)%len(g.dispatchers)]
+		err := d.recordProcessor.ProcessRecords()
+		if err != nil {
+			errChan <- d.named(err)
+		}
+	}
+}
+
+// Names returns the names of the outboxes of the group, in the order of the members
+func (g *DispatcherGroup) Names() []string {
+	return append([]string(nil), g.names...)
+}
+
+// Dispatcher returns the dispatcher of the named outbox, e.g. to pause its topics or to serve it with admin.Handler.
+// Its Run must not be called, since the outbox is dispatched by the group
+func (g *DispatcherGroup) Dispatcher(name string) (Dispatcher, bool) {
+	for i, n := range g.names {
+		if n == name {
+			return g.dispatchers[i], true
+		}
+	}
+	return Dispatcher{}, false
+}
+
+// Status returns the status of the runtime controls of every outbox, by name
+func (g *DispatcherGroup) Status() map[string]DispatcherStatus {
+	status := make(map[string]DispatcherStatus, len(g.names))
+	for i, name := range g.names {
+		status[name] = g.dispatchers[i].Status()
+	}
+	return status
+}
+
+// Backlogs returns the backlog of every outbox, by name. It queries the stores and stops at the first error
+func (g *DispatcherGroup) Backlogs() (map[string]Backlog, error) {
+	backlogs := make(map[string]Backlog, len(g.names))
+	for i, name := range g.names {
+		backlog, err := g.dispatchers[i].Backlog()
+		if err != nil {
+			return nil, g.dispatchers[i].named(err)
+		}
+		backlogs[name] = backlog
+	}
+	return backlogs, nil
+}
+
+// Stopped returns a channel closed once the record processor of the group has stopped after the doneChan of Run is
+// signaled, i.e. once the last batches of all the outboxes are released
+func (g *DispatcherGroup) Stopped() <-chan struct{} {
+	_, stopped := g.shutdown.channels()
+	return stopped
+}
+
+// TagMetrics returns the recorder adding the TagOutbox tag with the outbox name to all the metrics, e.g. to tell apart
+// the store metrics of the members of a DispatcherGroup:
+//
+//	settings := mysql.Settings{TableName: "orders_outbox", Metrics: outbox.TagMetrics(recorder, "orders")}
+//
+// It returns nil if the recorder is nil
+func TagMetrics(recorder MetricsRecorder, outbox string) MetricsRecorder {
+	if recorder == nil {
+		return nil
+	}
+	return taggedMetrics{recorder: recorder, outbox: outbox}
+}
+
+// taggedMetrics adds the TagOutbox tag of a group member to the metrics of its dispatcher
+type taggedMetrics struct {
+	recorder MetricsRecorder
+	outbox   string
+}
+
+func (m taggedMetrics) tags(tags map[string]string) map[string]string {
+	tagged := make(map[string]string, len(tags)+1)
+	for k, v := range tags {
+		tagged[k] = v
+	}
+	tagged[TagOutbox] = m.outbox
+	return tagged
+}
+
+// Count implements MetricsRecorder
+func (m taggedMetrics) Count(name string, value int64, tags map[string]string) {
+	m.recorder.Count(name, value, m.tags(tags))
+}
+
+// Observe implements MetricsRecorder
+func (m taggedMetrics) Observe(name string, value float64, tags map[string]string) {
+	m.recorder.Observe(name, value, m.tags(tags))
+}
+
+// Gauge implements MetricsRecorder
+func (m taggedMetrics) Gauge(name string, value float64, tags map[string]string) {
+	m.recorder.Gauge(name, value, m.tags(tags))
+}
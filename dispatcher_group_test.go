@@ -0,0 +1,217 @@
+package outbox
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// orderProcessor appends its name to the shared calls on every cycle
+type orderProcessor struct {
+	name  string
+	mu    *sync.Mutex
+	calls *[]string
+	err   error
+}
+
+func (p orderProcessor) ProcessRecords() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	*p.calls = append(*p.calls, p.name)
+	return p.err
+}
+
+// tagsRecorder keeps the tags of the last recorded metric
+type tagsRecorder struct {
+	NoopMetricsRecorder
+	tags map[string]string
+}
+
+func (r *tagsRecorder) Count(_ string, _ int64, tags map[string]string) {
+	r.tags = tags
+}
+
+func TestNewDispatcherGroup(t *testing.T) {
+	tests := map[string]struct {
+		members []GroupMember
+		expErr  error
+	}{
+		"Group without outboxes should return an error": {
+			expErr: errors.New("the dispatcher group has no outboxes"),
+		},
+		"Unnamed outbox should return an error": {
+			members: []GroupMember{{Name: "orders"}, {}},
+			expErr:  errors.New("the outboxes of a dispatcher group must be named"),
+		},
+		"Duplicate outbox should return an error": {
+			members: []GroupMember{{Name: "orders"}, {Name: "orders"}},
+			expErr:  errors.New(`the outbox "orders" is a member of the dispatcher group more than once`),
+		},
+	}
+	for name, test := range tests {
+		tt := test
+		t.Run(name, func(t *testing.T) {
+			g, err := NewDispatcherGroup(&MockBroker{}, tt.members, DispatcherGroupSettings{}, "1")
+			assert.Equal(t, tt.expErr, err)
+			assert.Nil(t, g)
+		})
+	}
+
+	recorder := &tagsRecorder{}
+	g, err := NewDispatcherGroup(&MockBroker{}, []GroupMember{
+		{Name: "orders", Store: &MockStore{}, Settings: DispatcherSettings{ProcessInterval: time.Hour, Metrics: recorder}},
+		{Name: "payments", Store: &MockStore{}},
+	}, DispatcherGroupSettings{ProcessInterval: time.Second}, "1")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"orders", "payments"}, g.Names())
+
+	orders, ok := g.Dispatcher("orders")
+	assert.True(t, ok)
+	assert.Equal(t, "1/orders", orders.machineID)
+	assert.Equal(t, time.Second, orders.settings.ProcessInterval)
+	orders.settings.Metrics.Count(MetricPublished, 1, map[string]string{TagTopic: "topic"})
+	assert.Equal(t, map[string]string{TagTopic: "topic", TagOutbox: "orders"}, recorder.tags)
+
+	payments, ok := g.Dispatcher("payments")
+	assert.True(t, ok)
+	assert.Equal(t, "1/payments", payments.machineID)
+	assert.Nil(t, payments.settings.Metrics)
+	_, ok = g.Dispatcher("unknown")
+	assert.False(t, ok)
+}
+
+func TestNewDispatcherGroup_MaxDBConcurrency(t *testing.T) {
+	g, err := NewDispatcherGroup(&MockBroker{}, []GroupMember{
+		{Name: "orders", Store: &MockStore{}},
+		{Name: "payments", Store: &MockStore{}, Settings: DispatcherSettings{MaxDBConcurrency: 1}},
+	}, DispatcherGroupSettings{ProcessInterval: time.Second, MaxDBConcurrency: 2}, "1")
+	assert.Nil(t, err)
+
+	orders, _ := g.Dispatcher("orders")
+	ordersStore, ok := orders.store.(*limitedStore)
+	assert.True(t, ok)
+	assert.Equal(t, 2, cap(ordersStore.slots))
+
+	// The outbox limit wraps the limit shared by the group
+	payments, _ := g.Dispatcher("payments")
+	paymentsStore, ok := payments.store.(*limitedStore)
+	assert.True(t, ok)
+	assert.Equal(t, 1, cap(paymentsStore.slots))
+	groupStore, ok := paymentsStore.store.(*limitedStore)
+	assert.True(t, ok)
+	assert.Equal(t, ordersStore.slots, groupStore.slots)
+}
+
+func TestTagMetrics(t *testing.T) {
+	assert.Nil(t, TagMetrics(nil, "orders"))
+
+	recorder := &tagsRecorder{}
+	TagMetrics(recorder, "orders").Count(MetricPublished, 1, map[string]string{TagQuery: "query"})
+	assert.Equal(t, map[string]string{TagQuery: "query", TagOutbox: "orders"}, recorder.tags)
+}
+
+func TestDispatcherGroup_processRound(t *testing.T) {
+	var mu sync.Mutex
+	var calls []string
+	g := &DispatcherGroup{names: []string{"a", "b", "c"}}
+	for _, name := range g.names {
+		p := orderProcessor{name: name, mu: &mu, calls: &calls}
+		if name == "b" {
+			p.err = errors.New("process error")
+		}
+		g.dispatchers = append(g.dispatchers, Dispatcher{recordProcessor: p, name: name})
+	}
+	errChan := make(chan error, 10)
+
+	// Every round processes every outbox once, starting from the next one
+	for round := 0; round < 3; round++ {
+		g.processRound(errChan, round)
+	}
+	assert.Equal(t, []string{"a", "b", "c", "b", "c", "a", "c", "a", "b"}, calls)
+	assert.Len(t, errChan, 3)
+	assert.Equal(t, fmt.Errorf("outbox b: %w", errors.New("process error")), <-errChan)
+}
+
+func TestDispatcherGroup_Run(t *testing.T) {
+	var mu sync.Mutex
+	var calls []string
+	var dispatchers []Dispatcher
+	for _, name := range []string{"orders", "payments"} {
+		processor := orderProcessor{name: name, mu: &mu, calls: &calls}
+		unlocker := &mockRecordUnlocker{}
+		unlocker.On("UnlockExpiredMessages").Return(errors.New("unlock error"))
+		cleaner := &mockRecordCleaner{}
+		cleaner.On("RemoveExpiredMessages").Return(nil)
+		dispatchers = append(dispatchers, Dispatcher{
+			recordProcessor: processor,
+			recordUnlocker:  unlocker,
+			recordCleaner:   cleaner,
+			settings:        DispatcherSettings{LockCheckerInterval: time.Hour, CleanupWorkerInterval: time.Hour},
+			shutdown:        &shutdown{},
+			name:            name,
+		})
+	}
+	g := &DispatcherGroup{
+		names:       []string{"orders", "payments"},
+		dispatchers: dispatchers,
+		settings:    DispatcherGroupSettings{ProcessInterval: time.Hour},
+		shutdown:    &shutdown{},
+	}
+	errChan := make(chan error, 2)
+	doneChan := make(chan struct{})
+	g.Run(errChan, doneChan)
+
+	// The errors of the workers are prefixed with the name of their outbox
+	errs := []string{(<-errChan).Error(), (<-errChan).Error()}
+	assert.ElementsMatch(t, []string{"outbox orders: unlock error", "outbox payments: unlock error"}, errs)
+
+	doneChan <- struct{}{}
+	select {
+	case <-g.Stopped():
+	case <-time.After(time.Second):
+		t.Fatal("the group should be stopped once doneChan is signaled")
+	}
+	for _, d := range dispatchers {
+		assert.True(t, d.shutdown.isStopping())
+		<-d.Stopped()
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []string{"orders", "payments"}, calls)
+}
+
+func TestDispatcherGroup_Status(t *testing.T) {
+	oldest := time.Now().UTC()
+	orders := &MockStore{}
+	orders.On("GetBacklogByState", PendingDelivery).Return(Backlog{Records: 3, OldestCreatedOn: &oldest}, nil)
+	payments := &MockStore{}
+	payments.On("GetBacklogByState", PendingDelivery).Return(Backlog{}, nil)
+	g, err := NewDispatcherGroup(&MockBroker{}, []GroupMember{
+		{Name: "orders", Store: orders},
+		{Name: "payments", Store: payments},
+	}, DispatcherGroupSettings{}, "1")
+	assert.Nil(t, err)
+
+	backlogs, err := g.Backlogs()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3), backlogs["orders"].Records)
+	assert.Equal(t, Backlog{}, backlogs["payments"])
+
+	paymentsDispatcher, _ := g.Dispatcher("payments")
+	paymentsDispatcher.PauseTopic("refunds")
+	assert.Equal(t, map[string]DispatcherStatus{
+		"orders":   {PausedTopics: []string{}},
+		"payments": {PausedTopics: []string{"refunds"}},
+	}, g.Status())
+
+	failing := &MockStore{}
+	failing.On("GetBacklogByState", PendingDelivery).Return(Backlog{}, errors.New("db error"))
+	g, err = NewDispatcherGroup(&MockBroker{}, []GroupMember{{Name: "orders", Store: failing}}, DispatcherGroupSettings{}, "1")
+	assert.Nil(t, err)
+	_, err = g.Backlogs()
+	assert.Equal(t, fmt.Errorf("outbox orders: %w", errors.New("db error")), err)
+}
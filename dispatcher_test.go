@@ -5,6 +5,7 @@ import (
 	"testing"
 	"time"
 
+	time2 "github.com/pkritiotis/outbox/internal/time"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -13,6 +14,7 @@ func TestDispatcher_Run(t *testing.T) {
 		recordProcessor processor
 		recordUnlocker  unlocker
 		recordCleaner   cleaner
+		recordAgeCheck  ageChecker
 		settings        DispatcherSettings
 		errChan         chan error
 		doneChan        chan struct{}
@@ -142,6 +144,40 @@ func TestDispatcher_Run(t *testing.T) {
 			doneChan: make(chan struct{}),
 			expError: errors.New("cleaner error"),
 		},
+		"Error in record age check should return error": {
+			recordProcessor: func() *mockRecordProcessor {
+				mp := mockRecordProcessor{}
+				mp.On("ProcessRecords").Return(nil)
+				return &mp
+			}(),
+			recordUnlocker: func() *mockRecordUnlocker {
+				mp := mockRecordUnlocker{}
+				mp.On("UnlockExpiredMessages").Return(nil)
+				return &mp
+			}(),
+			recordCleaner: func() *mockRecordCleaner {
+				mp := mockRecordCleaner{}
+				mp.On("RemoveExpiredMessages").Return(nil)
+				return &mp
+			}(),
+			recordAgeCheck: func() *mockRecordAgeChecker {
+				mp := mockRecordAgeChecker{}
+				mp.On("CheckRecordsAge").Return(errors.New("age check error"))
+				return &mp
+			}(),
+			settings: DispatcherSettings{
+				ProcessInterval:           1,
+				LockCheckerInterval:       1,
+				CleanupWorkerInterval:     1,
+				MaxLockTimeDuration:       1,
+				MessagesRetentionDuration: 10 * time.Minute,
+				RecordAgeSLA:              time.Minute,
+				RecordAgeCheckInterval:    1,
+			},
+			errChan:  make(chan error),
+			doneChan: make(chan struct{}),
+			expError: errors.New("age check error"),
+		},
 	}
 
 	for name, test := range tests {
@@ -151,6 +187,7 @@ func TestDispatcher_Run(t *testing.T) {
 				recordProcessor: tt.recordProcessor,
 				recordUnlocker:  tt.recordUnlocker,
 				recordCleaner:   tt.recordCleaner,
+				recordAgeCheck:  tt.recordAgeCheck,
 				settings:        tt.settings,
 			}
 			d.Run(tt.errChan, tt.doneChan)
@@ -175,17 +212,28 @@ func TestNewDispatcher(t *testing.T) {
 			&store,
 			&broker,
 			machineID,
-			RetrialPolicy{},
+			DispatcherSettings{},
+			newPausedTopics(),
+			&shutdown{},
 		),
 		recordUnlocker: newRecordUnlocker(
 			&store,
 			time.Duration(0),
+			time2.NewTimeProvider(),
 		),
 		recordCleaner: newRecordCleaner(
 			&store,
 			time.Duration(0),
+			time.Duration(0),
+			time2.NewTimeProvider(),
+			nil,
 		),
-		settings: DispatcherSettings{},
+		settings:     DispatcherSettings{},
+		store:        &store,
+		machineID:    machineID,
+		time:         time2.NewTimeProvider(),
+		pausedTopics: newPausedTopics(),
+		shutdown:     &shutdown{},
 	}
 
 	d := NewDispatcher(&store, &broker, settings, machineID)
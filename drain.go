@@ -0,0 +1,59 @@
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ExportedRecord is the newline delimited JSON representation of a record written by DrainToWriter
+type ExportedRecord struct {
+	ID               uuid.UUID  `json:"id"`
+	CreatedOn        time.Time  `json:"created_on"`
+	NumberOfAttempts int        `json:"number_of_attempts"`
+	Error            *string    `json:"error,omitempty"`
+	ExpiresAt        *time.Time `json:"expires_at,omitempty"`
+	Message          Message    `json:"message"`
+}
+
+// DrainToWriter streams all the unlocked PendingDelivery records, including the ones waiting for their next retry, to
+// w as newline delimited JSON and marks them as Exported, so that they are excluded from the dispatch. It is meant as
+// a safety valve for extended broker outages, when the records would otherwise be removed by the retention cleaner
+// before they are delivered.
+// The exported records can be stored again with Publisher.ImportFromReader.
+// It returns the number of the exported records
+func (d Dispatcher) DrainToWriter(ctx context.Context, w io.Writer) (int, error) {
+	lockID := d.machineID + "-drain"
+	err := d.store.UpdateRecordLockByState(lockID, d.time.Now().UTC(), PendingDelivery)
+	defer d.store.ClearLocksByLockID(lockID)
+	if err != nil {
+		return 0, err
+	}
+
+	enc := json.NewEncoder(w)
+	exported := 0
+	err = d.store.IterateRecordsByLockID(ctx, lockID, func(rec Record) error {
+		encErr := enc.Encode(ExportedRecord{
+			ID:               rec.ID,
+			CreatedOn:        rec.CreatedOn,
+			NumberOfAttempts: rec.NumberOfAttempts,
+			Error:            rec.Error,
+			ExpiresAt:        rec.ExpiresAt,
+			Message:          rec.Message,
+		})
+		if encErr != nil {
+			return fmt.Errorf("could not write the record %v: %w", rec.ID, encErr)
+		}
+		markErr := d.store.MarkExported(rec.ID, lockID)
+		if markErr != nil {
+			return fmt.Errorf("could not mark the record %v as exported: %w", rec.ID, markErr)
+		}
+		exported++
+		return nil
+	})
+	return exported, err
+}
@@ -0,0 +1,103 @@
+package outbox
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	time2 "github.com/pkritiotis/outbox/internal/time"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDispatcher_DrainToWriter(t *testing.T) {
+	sampleTime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	timeProvider := &time2.MockProvider{}
+	timeProvider.On("Now").Return(sampleTime)
+	ctx := context.Background()
+	lockID := "1-drain"
+	errMsg := "broker error"
+	nextRetryAt := sampleTime.Add(time.Hour)
+	expiresAt := sampleTime.Add(24 * time.Hour)
+	records := []Record{
+		{
+			ID:               uuid.MustParse("4b1c7f1e-2a5e-4b8a-9f43-6c1f0d0a0001"),
+			Message:          Message{Key: "key1", Body: []byte("body1"), Topic: "topic"},
+			CreatedOn:        sampleTime,
+			NumberOfAttempts: 2,
+			Error:            &errMsg,
+			ExpiresAt:        &expiresAt,
+		},
+		{
+			ID:        uuid.MustParse("4b1c7f1e-2a5e-4b8a-9f43-6c1f0d0a0002"),
+			Message:   Message{Key: "key2", Headers: map[string]string{"h": "v"}, Body: []byte("body2"), Topic: "topic"},
+			CreatedOn: sampleTime,
+			// A record waiting for its next retry is drained too
+			NextRetryAt: &nextRetryAt,
+		},
+	}
+	expOutput := `{"id":"4b1c7f1e-2a5e-4b8a-9f43-6c1f0d0a0001","created_on":"2024-01-02T03:04:05Z","number_of_attempts":2,"error":"broker error","expires_at":"2024-01-03T03:04:05Z","message":{"key":"key1","headers":null,"body":"Ym9keTE=","topic":"topic"}}
+{"id":"4b1c7f1e-2a5e-4b8a-9f43-6c1f0d0a0002","created_on":"2024-01-02T03:04:05Z","number_of_attempts":0,"message":{"key":"key2","headers":{"h":"v"},"body":"Ym9keTI=","topic":"topic"}}
+`
+
+	tests := map[string]struct {
+		store       *MockStore
+		expExported int
+		expOutput   string
+		expErr      error
+	}{
+		"Successful drain should export all the records": {
+			store: func() *MockStore {
+				mp := MockStore{}
+				mp.On("UpdateRecordLockByState", lockID, sampleTime, PendingDelivery).Return(nil)
+				mp.On("IterateRecordsByLockID", ctx, lockID).Return(records, nil)
+				mp.On("MarkExported", records[0].ID, lockID).Return(nil)
+				mp.On("MarkExported", records[1].ID, lockID).Return(nil)
+				mp.On("ClearLocksByLockID", lockID).Return(nil)
+				return &mp
+			}(),
+			expExported: 2,
+			expOutput:   expOutput,
+			expErr:      nil,
+		},
+		"Error in locking should return an error": {
+			store: func() *MockStore {
+				mp := MockStore{}
+				mp.On("UpdateRecordLockByState", lockID, sampleTime, PendingDelivery).Return(errors.New("lock error"))
+				mp.On("ClearLocksByLockID", lockID).Return(nil)
+				return &mp
+			}(),
+			expExported: 0,
+			expOutput:   "",
+			expErr:      errors.New("lock error"),
+		},
+		"Error in marking a record as exported should stop the drain": {
+			store: func() *MockStore {
+				mp := MockStore{}
+				mp.On("UpdateRecordLockByState", lockID, sampleTime, PendingDelivery).Return(nil)
+				mp.On("IterateRecordsByLockID", ctx, lockID).Return(records, nil)
+				mp.On("MarkExported", records[0].ID, lockID).Return(errors.New("db error"))
+				mp.On("ClearLocksByLockID", lockID).Return(nil)
+				return &mp
+			}(),
+			expExported: 0,
+			expOutput:   expOutput[:bytes.IndexByte([]byte(expOutput), '\n')+1],
+			expErr:      fmt.Errorf("could not mark the record %v as exported: %w", records[0].ID, errors.New("db error")),
+		},
+	}
+	for name, test := range tests {
+		tt := test
+		t.Run(name, func(t *testing.T) {
+			d := Dispatcher{store: tt.store, machineID: "1", time: timeProvider}
+			w := &bytes.Buffer{}
+			exported, err := d.DrainToWriter(ctx, w)
+			assert.Equal(t, tt.expErr, err)
+			assert.Equal(t, tt.expExported, exported)
+			assert.Equal(t, tt.expOutput, w.String())
+			tt.store.AssertCalled(t, "ClearLocksByLockID", lockID)
+		})
+	}
+}
@@ -0,0 +1,50 @@
+package outbox
+
+import "errors"
+
+var (
+	// ErrRecordLockLost is returned when a record update is rejected because the record is no longer locked by the caller
+	ErrRecordLockLost = errors.New("the record is not locked by the provided lock id")
+	// ErrRecordNotFound is returned when a record that does not exist, or is not in the expected state, is requested
+	ErrRecordNotFound = errors.New("the record was not found")
+	// ErrDuplicateRecord is returned when a record conflicts with an already stored record
+	ErrDuplicateRecord = errors.New("the record already exists")
+	// ErrRecordExpired is stored as the error of the records that expired before they could be published
+	ErrRecordExpired = errors.New("the record expired before it was published")
+	// ErrSchemaMissing is returned when the store is used before its schema is created
+	ErrSchemaMissing = errors.New("the outbox schema does not exist")
+	// ErrSchemaOutdated is returned when the schema of the store is older than the schema version the store requires
+	ErrSchemaOutdated = errors.New("the outbox schema is outdated")
+	// ErrMessageTooLargeForBroker is returned by the brokers that reject a message because of its size
+	ErrMessageTooLargeForBroker = errors.New("the message is too large for the broker")
+	// ErrSerializerQuarantined is returned when a record is rejected because the serialization of its message type
+	// failed too many times in a row
+	ErrSerializerQuarantined = errors.New("the serialization of the message type is quarantined")
+	// ErrFutureTimestamp is returned when a record is rejected because its timestamps are too far in the future
+	ErrFutureTimestamp = errors.New("the record timestamp is in the future")
+	// ErrOutboxFull is returned when a record is rejected because the store holds the maximum number of pending records
+	ErrOutboxFull = errors.New("the outbox is full")
+	// ErrAckTimeout is stored as the error of the records that were not acknowledged by an AsyncMessageBroker
+	// within the AckTimeout
+	ErrAckTimeout = errors.New("the message was not acknowledged by the broker in time")
+	// ErrRecordDeadLettered is returned by Publisher.EnqueueAndWait when the record reached the MaxAttemptsReached state
+	ErrRecordDeadLettered = errors.New("the record reached the maximum attempts")
+	// ErrNoDeadline is returned by Publisher.EnqueueAndWait when the context has no deadline
+	ErrNoDeadline = errors.New("the context has no deadline")
+	// ErrTooManyWaiters is returned by Publisher.EnqueueAndWait when the DeliveryWaiters are full
+	ErrTooManyWaiters = errors.New("too many records are awaited")
+)
+
+// PermanentError is returned by the brokers for the send errors that would occur again on every attempt.
+// The records failing with a PermanentError are moved to the MaxAttemptsReached state without further attempts
+type PermanentError struct {
+	Err error
+}
+
+func (e *PermanentError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *PermanentError) Unwrap() error {
+	return e.Err
+}
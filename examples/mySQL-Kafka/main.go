@@ -98,6 +98,6 @@ func main() {
 
 func openDbConnection() (*sql.DB, error) {
 	return sql.Open("mysql",
-		fmt.Sprintf("%v:%v@tcp(%v:%v)/%v?parseTime=True",
+		fmt.Sprintf("%v:%v@tcp(%v:%v)/%v?parseTime=True&loc=UTC",
 			sqlSettings.MySQLUsername, sqlSettings.MySQLPass, sqlSettings.MySQLHost, sqlSettings.MySQLPort, sqlSettings.MySQLDB))
 }
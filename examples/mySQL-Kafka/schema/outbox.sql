@@ -8,5 +8,13 @@ CREATE TABLE outbox (
         processed_on DATETIME NULL,
         number_of_attempts INT NOT NULL,
         last_attempted_on DATETIME NULL,
-        error varchar(1000) NULL
+        error varchar(1000) NULL,
+        expires_at DATETIME NULL,
+        next_retry_at DATETIME NULL,
+        business_key CHAR(64) NULL,
+        sequence BIGINT NULL,
+        pending_business_key CHAR(64) AS (IF(state = 0, business_key, NULL)) STORED,
+        PRIMARY KEY (id),
+        INDEX idx_outbox_state_next_retry_at (state, next_retry_at),
+        UNIQUE INDEX uq_outbox_pending_business_key (pending_business_key)
 )
\ No newline at end of file
@@ -0,0 +1,126 @@
+package outbox
+
+import (
+	"strconv"
+	"time"
+)
+
+// MetadataHeaders defines the names of the reserved headers that the dispatcher adds to every published message.
+// Headers with an empty name are not added, except the RecordID header, so the zero value only adds the record id
+type MetadataHeaders struct {
+	// RecordID is the header holding the record id, which consumers can use as a deduplication key. It is added to
+	// every message, with the name of the DefaultMetadataHeaders if it is empty
+	RecordID string
+	// CreatedOn is the header holding the record creation time in RFC 3339 format
+	CreatedOn string
+	// Attempt is the header holding the number of the publish attempt, starting from 1
+	Attempt string
+	// Sequence is the header holding the per key sequence number of the record. It is only added to the records
+	// numbered by the store
+	Sequence string
+	// ExpiresAt is the header holding the expiry time of the record in RFC 3339 format, so that the consumers can skip
+	// the messages received too late. It is only added to the records with an expiry
+	ExpiresAt string
+}
+
+// DefaultMetadataHeaders are the default names of the reserved headers
+var DefaultMetadataHeaders = MetadataHeaders{
+	RecordID:  "outbox-record-id",
+	CreatedOn: "outbox-created-on",
+	Attempt:   "outbox-attempt",
+	Sequence:  "outbox-sequence",
+	ExpiresAt: "outbox-expires-at",
+}
+
+// recordIDHeader returns the name of the RecordID header, which defaults to the one of the DefaultMetadataHeaders
+func (h MetadataHeaders) recordIDHeader() string {
+	if h.RecordID == "" {
+		return DefaultMetadataHeaders.RecordID
+	}
+	return h.RecordID
+}
+
+// withMetadataHeaders returns the record message with the reserved headers set, overriding any producer header
+// with the same name. The record message headers are left untouched
+func (h MetadataHeaders) withMetadataHeaders(rec Record) Message {
+	msg := rec.Message
+	headers := make(map[string]string, len(msg.Headers)+5)
+	for k, v := range msg.Headers {
+		headers[k] = v
+	}
+	headers[h.recordIDHeader()] = rec.ID.String()
+	if h.CreatedOn != "" {
+		headers[h.CreatedOn] = rec.CreatedOn.UTC().Format(time.RFC3339Nano)
+	}
+	if h.Attempt != "" {
+		headers[h.Attempt] = strconv.Itoa(rec.NumberOfAttempts)
+	}
+	if h.Sequence != "" && rec.Sequence != nil {
+		headers[h.Sequence] = strconv.FormatInt(*rec.Sequence, 10)
+	}
+	if h.ExpiresAt != "" && rec.ExpiresAt != nil {
+		headers[h.ExpiresAt] = rec.ExpiresAt.UTC().Format(time.RFC3339Nano)
+	}
+	msg.Headers = headers
+	return msg
+}
+
+// DedupKey returns the deduplication key of a delivered message, the id of its record held by the RecordID header.
+// The record id is the same on every redelivery of the record, so consumers can store the processed keys and skip
+// the messages they have already processed. It returns an empty string if the header is absent, e.g. the message was
+// not published by the dispatcher or the broker dropped its headers
+func (h MetadataHeaders) DedupKey(msg Message) string {
+	return msg.Headers[h.recordIDHeader()]
+}
+
+// CreationTime returns the creation time of a delivered message held by the CreatedOn header, e.g. to measure its
+// staleness on the consumer side. It returns false if the header is disabled, absent or invalid
+func (h MetadataHeaders) CreationTime(msg Message) (time.Time, bool) {
+	return h.timeHeader(msg, h.CreatedOn)
+}
+
+// Deadline returns the expiry time of a delivered message held by the ExpiresAt header, after which the consumer may
+// skip it. It returns false if the message has no expiry, or the header is disabled or invalid
+func (h MetadataHeaders) Deadline(msg Message) (time.Time, bool) {
+	return h.timeHeader(msg, h.ExpiresAt)
+}
+
+func (h MetadataHeaders) timeHeader(msg Message, name string) (time.Time, bool) {
+	value, ok := msg.Headers[name]
+	if name == "" || !ok {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// DedupKey returns the deduplication key of a message delivered with the RecordID header of the
+// DefaultMetadataHeaders, see MetadataHeaders.DedupKey. Use MetadataHeaders.DedupKey if the header is renamed
+func (m Message) DedupKey() string {
+	return DefaultMetadataHeaders.DedupKey(m)
+}
+
+// DefaultKeyHeader is the default name of the header carrying the message key on brokers without native keys
+const DefaultKeyHeader = "X-Message-Key"
+
+// KeyAsHeader returns the message with its key copied to the header name, so that brokers without a native key,
+// e.g. webhooks or plain queues, do not drop it. The name defaults to DefaultKeyHeader if it is empty.
+// Messages without a key are returned unchanged and the headers of the provided message are left untouched
+func KeyAsHeader(msg Message, name string) Message {
+	if msg.Key == "" {
+		return msg
+	}
+	if name == "" {
+		name = DefaultKeyHeader
+	}
+	headers := make(map[string]string, len(msg.Headers)+1)
+	for k, v := range msg.Headers {
+		headers[k] = v
+	}
+	headers[name] = msg.Key
+	msg.Headers = headers
+	return msg
+}
@@ -0,0 +1,161 @@
+package outbox
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetadataHeaders_withMetadataHeaders(t *testing.T) {
+	sequence := int64(7)
+	rec := Record{
+		ID:               uuid.MustParse("4b1c7f1e-2a5e-4b8a-9f43-6c1f0d0a0001"),
+		CreatedOn:        time.Date(2024, 1, 2, 3, 4, 5, 6, time.UTC),
+		NumberOfAttempts: 2,
+		Sequence:         &sequence,
+		Message: Message{
+			Key:     "key",
+			Headers: map[string]string{"custom": "value", "outbox-attempt": "producer value"},
+			Body:    []byte("body"),
+			Topic:   "topic",
+		},
+	}
+	tests := map[string]struct {
+		headers    MetadataHeaders
+		expires    bool
+		expHeaders map[string]string
+	}{
+		"Default headers should be added and override the producer headers": {
+			headers: DefaultMetadataHeaders,
+			expHeaders: map[string]string{
+				"custom":            "value",
+				"outbox-record-id":  "4b1c7f1e-2a5e-4b8a-9f43-6c1f0d0a0001",
+				"outbox-created-on": "2024-01-02T03:04:05.000000006Z",
+				"outbox-attempt":    "2",
+				"outbox-sequence":   "7",
+			},
+		},
+		"Expiry should be added to the records with an expiry": {
+			headers: MetadataHeaders{ExpiresAt: "X-Deadline"},
+			expires: true,
+			expHeaders: map[string]string{
+				"custom":           "value",
+				"outbox-attempt":   "producer value",
+				"outbox-record-id": "4b1c7f1e-2a5e-4b8a-9f43-6c1f0d0a0001",
+				"X-Deadline":       "2024-01-02T04:04:05Z",
+			},
+		},
+		"Renamed headers should be added with the configured names": {
+			headers: MetadataHeaders{RecordID: "X-Dedup-Key"},
+			expHeaders: map[string]string{
+				"custom":         "value",
+				"outbox-attempt": "producer value",
+				"X-Dedup-Key":    "4b1c7f1e-2a5e-4b8a-9f43-6c1f0d0a0001",
+			},
+		},
+		"Zero value should only add the record id": {
+			headers: MetadataHeaders{},
+			expHeaders: map[string]string{
+				"custom":           "value",
+				"outbox-attempt":   "producer value",
+				"outbox-record-id": "4b1c7f1e-2a5e-4b8a-9f43-6c1f0d0a0001",
+			},
+		},
+	}
+	for name, test := range tests {
+		tt := test
+		t.Run(name, func(t *testing.T) {
+			rec := rec
+			if tt.expires {
+				expiresAt := time.Date(2024, 1, 2, 5, 4, 5, 0, time.FixedZone("CET", 3600))
+				rec.ExpiresAt = &expiresAt
+			}
+			msg := tt.headers.withMetadataHeaders(rec)
+			assert.Equal(t, tt.expHeaders, msg.Headers)
+			assert.Equal(t, rec.Message.Body, msg.Body)
+			assert.Equal(t, "producer value", rec.Message.Headers["outbox-attempt"])
+		})
+	}
+}
+
+func TestKeyAsHeader(t *testing.T) {
+	tests := map[string]struct {
+		msg        Message
+		name       string
+		expHeaders map[string]string
+	}{
+		"Key should be added with the default header name": {
+			msg:        Message{Key: "key", Headers: map[string]string{"custom": "value"}},
+			name:       "",
+			expHeaders: map[string]string{"custom": "value", DefaultKeyHeader: "key"},
+		},
+		"Key should be added with the configured header name": {
+			msg:        Message{Key: "key"},
+			name:       "X-Routing-Key",
+			expHeaders: map[string]string{"X-Routing-Key": "key"},
+		},
+		"Message without a key should be unchanged": {
+			msg:        Message{Headers: map[string]string{"custom": "value"}},
+			name:       "",
+			expHeaders: map[string]string{"custom": "value"},
+		},
+	}
+	for name, test := range tests {
+		tt := test
+		t.Run(name, func(t *testing.T) {
+			headers := map[string]string{}
+			for k, v := range tt.msg.Headers {
+				headers[k] = v
+			}
+			msg := KeyAsHeader(tt.msg, tt.name)
+			assert.Equal(t, tt.expHeaders, msg.Headers)
+			assert.Equal(t, tt.msg.Key, msg.Key)
+			if tt.msg.Headers != nil {
+				assert.Equal(t, headers, tt.msg.Headers)
+			}
+		})
+	}
+}
+
+func TestMessage_DedupKey(t *testing.T) {
+	id := uuid.MustParse("4b1c7f1e-2a5e-4b8a-9f43-6c1f0d0a0001")
+	rec := Record{ID: id, Message: Message{Key: "key", Topic: "topic"}}
+
+	first := DefaultMetadataHeaders.withMetadataHeaders(rec)
+	rec.NumberOfAttempts++
+	redelivered := DefaultMetadataHeaders.withMetadataHeaders(rec)
+	assert.Equal(t, id.String(), first.DedupKey())
+	assert.Equal(t, first.DedupKey(), redelivered.DedupKey())
+
+	renamed := MetadataHeaders{RecordID: "X-Dedup-Key"}
+	assert.Equal(t, id.String(), renamed.DedupKey(renamed.withMetadataHeaders(rec)))
+	assert.Equal(t, "", renamed.withMetadataHeaders(rec).DedupKey())
+	// The record id is added even without metadata headers
+	assert.Equal(t, id.String(), MetadataHeaders{}.withMetadataHeaders(rec).DedupKey())
+	assert.Equal(t, id.String(), MetadataHeaders{}.DedupKey(first))
+	assert.Equal(t, "", rec.Message.DedupKey())
+}
+
+func TestMetadataHeaders_Deadline(t *testing.T) {
+	createdOn := time.Date(2024, 1, 2, 3, 4, 5, 6, time.UTC)
+	expiresAt := createdOn.Add(time.Minute)
+	rec := Record{ID: uuid.New(), CreatedOn: createdOn, ExpiresAt: &expiresAt}
+	msg := DefaultMetadataHeaders.withMetadataHeaders(rec)
+
+	created, ok := DefaultMetadataHeaders.CreationTime(msg)
+	assert.True(t, ok)
+	assert.Equal(t, createdOn, created)
+	deadline, ok := DefaultMetadataHeaders.Deadline(msg)
+	assert.True(t, ok)
+	assert.Equal(t, expiresAt, deadline)
+
+	rec.ExpiresAt = nil
+	_, ok = DefaultMetadataHeaders.Deadline(DefaultMetadataHeaders.withMetadataHeaders(rec))
+	assert.False(t, ok)
+	_, ok = MetadataHeaders{}.CreationTime(msg)
+	assert.False(t, ok)
+	_, ok = DefaultMetadataHeaders.CreationTime(Message{Headers: map[string]string{"outbox-created-on": "yesterday"}})
+	assert.False(t, ok)
+}
@@ -0,0 +1,92 @@
+package outbox
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/google/uuid"
+)
+
+// maxImportLineSize is the maximum size of a single line read by ImportFromReader
+const maxImportLineSize = 16 * 1024 * 1024
+
+// ImportSettings defines how ImportFromReader stores the imported records
+type ImportSettings struct {
+	// PreserveIDs stores the records with their exported ids instead of new ones. The drained records still stored in
+	// the Exported state are replaced with Store.ReplaceExportedRecord, so that they are dispatched again. Records whose
+	// id is stored in any other state, e.g. Delivered by an earlier import, or locked are skipped and reported with
+	// ErrDuplicateRecord
+	PreserveIDs bool
+}
+
+// ImportFromReader reads the newline delimited JSON records written by Dispatcher.DrainToWriter and stores them as
+// PendingDelivery records with a new creation time and their expiry time, so that they are dispatched again unless
+// they expired in the meantime.
+// Invalid lines do not abort the import; it returns the number of the imported records and the joined errors of the
+// lines that could not be imported
+func (o Publisher) ImportFromReader(ctx context.Context, r io.Reader, settings ImportSettings) (int, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxImportLineSize)
+
+	imported := 0
+	var errs []error
+	for line := 1; scanner.Scan(); line++ {
+		if ctx.Err() != nil {
+			return imported, errors.Join(append(errs, ctx.Err())...)
+		}
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		err := o.importRecord(ctx, scanner.Bytes(), settings)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("line %d: %w", line, err))
+			continue
+		}
+		imported++
+	}
+	if err := scanner.Err(); err != nil {
+		errs = append(errs, err)
+	}
+	return imported, errors.Join(errs...)
+}
+
+// importRecord validates and stores a single exported record
+func (o Publisher) importRecord(ctx context.Context, line []byte, settings ImportSettings) error {
+	var exp ExportedRecord
+	err := json.Unmarshal(line, &exp)
+	if err != nil {
+		return fmt.Errorf("invalid record: %w", err)
+	}
+	if exp.Message.Topic == "" {
+		return errors.New("invalid record: the message topic is empty")
+	}
+
+	id := o.uuid.NewUUID()
+	if settings.PreserveIDs {
+		if exp.ID == uuid.Nil {
+			return errors.New("invalid record: the record id is empty")
+		}
+		id = exp.ID
+	}
+	rec := Record{
+		ID:        id,
+		Message:   exp.Message,
+		State:     PendingDelivery,
+		CreatedOn: o.time.Now().UTC(),
+		ExpiresAt: exp.ExpiresAt,
+	}
+	err = o.store.AddRecord(ctx, rec)
+	if !settings.PreserveIDs || !errors.Is(err, ErrDuplicateRecord) {
+		return err
+	}
+	replaceErr := o.store.ReplaceExportedRecord(ctx, rec)
+	if errors.Is(replaceErr, ErrRecordNotFound) {
+		// The record conflicts with the business key of another record
+		return err
+	}
+	return replaceErr
+}
@@ -0,0 +1,146 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	time2 "github.com/pkritiotis/outbox/internal/time"
+	uuid2 "github.com/pkritiotis/outbox/internal/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestPublisher_ImportFromReader(t *testing.T) {
+	sampleTime := time.Now()
+	timeProvider := &time2.MockProvider{}
+	timeProvider.On("Now").Return(sampleTime)
+	newID := uuid.New()
+	uuidProvider := &uuid2.MockProvider{}
+	uuidProvider.On("NewUUID").Return(newID)
+	ctx := context.Background()
+
+	exportedID := uuid.MustParse("4b1c7f1e-2a5e-4b8a-9f43-6c1f0d0a0001")
+	input := `{"id":"4b1c7f1e-2a5e-4b8a-9f43-6c1f0d0a0001","created_on":"2024-01-02T03:04:05Z","number_of_attempts":2,"expires_at":"2024-01-03T03:04:05Z","message":{"key":"key1","headers":{"h":"v"},"body":"Ym9keTE=","topic":"topic"}}
+not a json line
+
+{"id":"4b1c7f1e-2a5e-4b8a-9f43-6c1f0d0a0002","message":{"key":"key2","body":"Ym9keTI="}}
+`
+	message := Message{Key: "key1", Headers: map[string]string{"h": "v"}, Body: []byte("body1"), Topic: "topic"}
+	expiresAt := time.Date(2024, 1, 3, 3, 4, 5, 0, time.UTC)
+	preserved := Record{ID: exportedID, Message: message, State: PendingDelivery, CreatedOn: sampleTime.UTC(), ExpiresAt: &expiresAt}
+
+	tests := map[string]struct {
+		settings    ImportSettings
+		store       *MockStore
+		expImported int
+		expErrs     []string
+	}{
+		"Import with new ids should store the valid lines and report the invalid ones": {
+			settings: ImportSettings{},
+			store: func() *MockStore {
+				mp := MockStore{}
+				mp.On("AddRecord", ctx, Record{
+					ID:        newID,
+					Message:   message,
+					State:     PendingDelivery,
+					CreatedOn: sampleTime.UTC(),
+					ExpiresAt: &expiresAt,
+				}).Return(nil)
+				return &mp
+			}(),
+			expImported: 1,
+			expErrs: []string{
+				"line 2: invalid record: invalid character 'o' in literal null (expecting 'u')",
+				"line 4: invalid record: the message topic is empty",
+			},
+		},
+		"Import with preserved ids should replace the drained records": {
+			settings: ImportSettings{PreserveIDs: true},
+			store: func() *MockStore {
+				mp := MockStore{}
+				mp.On("AddRecord", ctx, preserved).Return(ErrDuplicateRecord)
+				mp.On("ReplaceExportedRecord", ctx, preserved).Return(nil)
+				return &mp
+			}(),
+			expImported: 1,
+			expErrs: []string{
+				"line 2: invalid record: invalid character 'o' in literal null (expecting 'u')",
+				"line 4: invalid record: the message topic is empty",
+			},
+		},
+		"Import with preserved ids should report the pending duplicate records": {
+			settings: ImportSettings{PreserveIDs: true},
+			store: func() *MockStore {
+				mp := MockStore{}
+				mp.On("AddRecord", ctx, preserved).Return(ErrDuplicateRecord)
+				mp.On("ReplaceExportedRecord", ctx, preserved).Return(ErrDuplicateRecord)
+				return &mp
+			}(),
+			expImported: 0,
+			expErrs: []string{
+				fmt.Sprintf("line 1: %v", ErrDuplicateRecord),
+				"line 2: invalid record: invalid character 'o' in literal null (expecting 'u')",
+				"line 4: invalid record: the message topic is empty",
+			},
+		},
+		"Import with preserved ids should skip the delivered records": {
+			settings: ImportSettings{PreserveIDs: true},
+			store: func() *MockStore {
+				mp := MockStore{}
+				mp.On("AddRecord", ctx, preserved).Return(ErrDuplicateRecord)
+				// The store only replaces an Exported record, so a Delivered one is reported as a duplicate
+				mp.On("ReplaceExportedRecord", ctx, preserved).Return(ErrDuplicateRecord)
+				return &mp
+			}(),
+			expImported: 0,
+			expErrs: []string{
+				fmt.Sprintf("line 1: %v", ErrDuplicateRecord),
+				"line 2: invalid record: invalid character 'o' in literal null (expecting 'u')",
+				"line 4: invalid record: the message topic is empty",
+			},
+		},
+		"Import with preserved ids should report the business key conflicts": {
+			settings: ImportSettings{PreserveIDs: true},
+			store: func() *MockStore {
+				mp := MockStore{}
+				mp.On("AddRecord", ctx, preserved).Return(ErrDuplicateRecord)
+				mp.On("ReplaceExportedRecord", ctx, preserved).Return(ErrRecordNotFound)
+				return &mp
+			}(),
+			expImported: 0,
+			expErrs: []string{
+				fmt.Sprintf("line 1: %v", ErrDuplicateRecord),
+				"line 2: invalid record: invalid character 'o' in literal null (expecting 'u')",
+				"line 4: invalid record: the message topic is empty",
+			},
+		},
+	}
+	for name, test := range tests {
+		tt := test
+		t.Run(name, func(t *testing.T) {
+			p := Publisher{store: tt.store, time: timeProvider, uuid: uuidProvider}
+			imported, err := p.ImportFromReader(ctx, strings.NewReader(input), tt.settings)
+			assert.Equal(t, tt.expImported, imported)
+			assert.Equal(t, strings.Join(tt.expErrs, "\n"), err.Error())
+		})
+	}
+}
+
+func TestPublisher_ImportFromReader_duplicateIsDetectable(t *testing.T) {
+	store := &MockStore{}
+	store.On("AddRecord", context.Background(), mock.AnythingOfType("outbox.Record")).Return(ErrDuplicateRecord)
+	store.On("ReplaceExportedRecord", context.Background(), mock.AnythingOfType("outbox.Record")).Return(ErrDuplicateRecord)
+	p := NewPublisher(store)
+
+	_, err := p.ImportFromReader(context.Background(),
+		strings.NewReader(`{"id":"4b1c7f1e-2a5e-4b8a-9f43-6c1f0d0a0001","message":{"topic":"topic"}}`),
+		ImportSettings{PreserveIDs: true},
+	)
+
+	assert.True(t, errors.Is(err, ErrDuplicateRecord))
+}
@@ -16,6 +16,14 @@ func NewTimeProvider() Provider {
 	return timeProvider{}
 }
 
+// ProviderOrDefault returns the provided Provider, or the default time provider if it is nil
+func ProviderOrDefault(provider Provider) Provider {
+	if provider == nil {
+		return NewTimeProvider()
+	}
+	return provider
+}
+
 // Now returns the current time
 func (t timeProvider) Now() time.Time {
 	return time.Now()
@@ -0,0 +1,201 @@
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// limitedStore limits the number of concurrent calls to the wrapped Store
+type limitedStore struct {
+	store Store
+	slots chan struct{}
+}
+
+func newLimitedStore(store Store, maxConcurrency int) *limitedStore {
+	return &limitedStore{store: store, slots: make(chan struct{}, maxConcurrency)}
+}
+
+// acquire blocks until a slot is free and returns the function releasing it
+func (s *limitedStore) acquire() func() {
+	s.slots <- struct{}{}
+	return func() { <-s.slots }
+}
+
+func (s *limitedStore) AddRecordTx(record Record, tx *sql.Tx) error {
+	defer s.acquire()()
+	return s.store.AddRecordTx(record, tx)
+}
+
+func (s *limitedStore) AddRecord(ctx context.Context, record Record) error {
+	defer s.acquire()()
+	return s.store.AddRecord(ctx, record)
+}
+
+func (s *limitedStore) GetRecordsByLockID(lockID string) ([]Record, error) {
+	defer s.acquire()()
+	return s.store.GetRecordsByLockID(lockID)
+}
+
+// IterateRecordsByLockID fetches all the locked records before calling fn, so that the slot of the iteration is
+// released before the callbacks call the store, which would deadlock once all the slots are taken
+func (s *limitedStore) IterateRecordsByLockID(ctx context.Context, lockID string, fn func(Record) error) error {
+	records, err := s.bufferRecordsByLockID(ctx, lockID)
+	if err != nil {
+		return err
+	}
+	for _, rec := range records {
+		err = fn(rec)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *limitedStore) bufferRecordsByLockID(ctx context.Context, lockID string) ([]Record, error) {
+	defer s.acquire()()
+	var records []Record
+	err := s.store.IterateRecordsByLockID(ctx, lockID, func(rec Record) error {
+		records = append(records, rec)
+		return nil
+	})
+	return records, err
+}
+
+func (s *limitedStore) GetRecordsAfterWatermark(createdOn time.Time, id uuid.UUID, limit int) ([]Record, error) {
+	defer s.acquire()()
+	return s.store.GetRecordsAfterWatermark(createdOn, id, limit)
+}
+
+func (s *limitedStore) GetRecordIDsByStateCreatedBefore(state RecordState, createdBefore time.Time, limit int) ([]uuid.UUID, error) {
+	defer s.acquire()()
+	return s.store.GetRecordIDsByStateCreatedBefore(state, createdBefore, limit)
+}
+
+func (s *limitedStore) GetRecordByID(id uuid.UUID) (Record, error) {
+	defer s.acquire()()
+	return s.store.GetRecordByID(id)
+}
+
+func (s *limitedStore) GetRecordsByState(state RecordState, createdOn time.Time, id uuid.UUID, limit int) ([]Record, error) {
+	defer s.acquire()()
+	return s.store.GetRecordsByState(state, createdOn, id, limit)
+}
+
+func (s *limitedStore) RequeueRecord(id uuid.UUID) error {
+	defer s.acquire()()
+	return s.store.RequeueRecord(id)
+}
+
+func (s *limitedStore) ReplaceExportedRecord(ctx context.Context, record Record) error {
+	defer s.acquire()()
+	return s.store.ReplaceExportedRecord(ctx, record)
+}
+
+func (s *limitedStore) SetNextRetryAt(id uuid.UUID, nextRetryAt time.Time) error {
+	defer s.acquire()()
+	return s.store.SetNextRetryAt(id, nextRetryAt)
+}
+
+func (s *limitedStore) GetBacklogByState(state RecordState) (Backlog, error) {
+	defer s.acquire()()
+	return s.store.GetBacklogByState(state)
+}
+
+func (s *limitedStore) UpdateRecordLockByState(lockID string, lockedOn time.Time, state RecordState) error {
+	defer s.acquire()()
+	return s.store.UpdateRecordLockByState(lockID, lockedOn, state)
+}
+
+func (s *limitedStore) UpdateRecordsLockByStates(lockID string, lockedOn time.Time, states []RecordState, limit int) error {
+	defer s.acquire()()
+	return s.store.UpdateRecordsLockByStates(lockID, lockedOn, states, limit)
+}
+
+func (s *limitedStore) UpdateRecordsLockByStatesExcludingTopics(lockID string, lockedOn time.Time, states []RecordState, limit int, excludedTopics []string) error {
+	defer s.acquire()()
+	return s.store.UpdateRecordsLockByStatesExcludingTopics(lockID, lockedOn, states, limit, excludedTopics)
+}
+
+func (s *limitedStore) UpdateRecordByID(message Record) error {
+	defer s.acquire()()
+	return s.store.UpdateRecordByID(message)
+}
+
+func (s *limitedStore) MarkProcessed(id uuid.UUID, numberOfAttempts int, processedOn time.Time, lockID string) error {
+	defer s.acquire()()
+	return s.store.MarkProcessed(id, numberOfAttempts, processedOn, lockID)
+}
+
+func (s *limitedStore) RecordFailure(failure RecordFailure, lockID string) error {
+	defer s.acquire()()
+	return s.store.RecordFailure(failure, lockID)
+}
+
+func (s *limitedStore) RecordFailures(failures []RecordFailure, lockID string) error {
+	defer s.acquire()()
+	return s.store.RecordFailures(failures, lockID)
+}
+
+func (s *limitedStore) MarkExported(id uuid.UUID, lockID string) error {
+	defer s.acquire()()
+	return s.store.MarkExported(id, lockID)
+}
+
+func (s *limitedStore) SetLock(id uuid.UUID, lockID *string, lockedOn *time.Time) error {
+	defer s.acquire()()
+	return s.store.SetLock(id, lockID, lockedOn)
+}
+
+func (s *limitedStore) ExtendLock(lockID string, lockedOn time.Time) error {
+	defer s.acquire()()
+	return s.store.ExtendLock(lockID, lockedOn)
+}
+
+func (s *limitedStore) ClearLocksWithDurationBeforeDate(time time.Time) error {
+	defer s.acquire()()
+	return s.store.ClearLocksWithDurationBeforeDate(time)
+}
+
+func (s *limitedStore) ClearLocksByLockID(lockID string) error {
+	defer s.acquire()()
+	return s.store.ClearLocksByLockID(lockID)
+}
+
+func (s *limitedStore) RemoveRecordsBeforeDatetime(expiryTime time.Time) (int64, int64, error) {
+	defer s.acquire()()
+	return s.store.RemoveRecordsBeforeDatetime(expiryTime)
+}
+
+func (s *limitedStore) RemoveRecordsByIDs(ids []uuid.UUID) (int64, int64, error) {
+	defer s.acquire()()
+	return s.store.RemoveRecordsByIDs(ids)
+}
+
+func (s *limitedStore) AddAttempts(attempts []Attempt) error {
+	defer s.acquire()()
+	return s.store.AddAttempts(attempts)
+}
+
+func (s *limitedStore) RemoveAttemptsBeforeDatetime(before time.Time) (int64, error) {
+	defer s.acquire()()
+	return s.store.RemoveAttemptsBeforeDatetime(before)
+}
+
+func (s *limitedStore) SetPublishHandle(id uuid.UUID, lockID string, handle string) error {
+	defer s.acquire()()
+	return s.store.SetPublishHandle(id, lockID, handle)
+}
+
+func (s *limitedStore) ClearPublishHandle(id uuid.UUID, handle string) error {
+	defer s.acquire()()
+	return s.store.ClearPublishHandle(id, handle)
+}
+
+func (s *limitedStore) GetRecordsWithPublishHandle(deliveredBefore time.Time, limit int) ([]Record, error) {
+	defer s.acquire()()
+	return s.store.GetRecordsWithPublishHandle(deliveredBefore, limit)
+}
@@ -0,0 +1,101 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+// blockingStore tracks the maximum number of concurrent ClearLocksByLockID calls
+type blockingStore struct {
+	MockStore
+	mu          sync.Mutex
+	inFlight    int
+	maxInFlight int
+}
+
+func (s *blockingStore) ClearLocksByLockID(string) error {
+	s.mu.Lock()
+	s.inFlight++
+	if s.inFlight > s.maxInFlight {
+		s.maxInFlight = s.inFlight
+	}
+	s.mu.Unlock()
+
+	time.Sleep(10 * time.Millisecond)
+
+	s.mu.Lock()
+	s.inFlight--
+	s.mu.Unlock()
+	return nil
+}
+
+func Test_limitedStore(t *testing.T) {
+	store := &blockingStore{}
+	limited := newLimitedStore(store, 3)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.Nil(t, limited.ClearLocksByLockID("1"))
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, 3, store.maxInFlight)
+}
+
+func Test_newLimitedStore(t *testing.T) {
+	assert.Equal(t, 1, cap(newLimitedStore(&MockStore{}, 1).slots))
+	assert.Equal(t, 5, cap(newLimitedStore(&MockStore{}, 5).slots))
+}
+
+func Test_limitedStore_IterateRecordsByLockID(t *testing.T) {
+	records := []Record{{ID: uuid.New()}, {ID: uuid.New()}}
+	store := &MockStore{}
+	store.On("IterateRecordsByLockID", context.Background(), "1").Return(records, nil)
+	store.On("MarkExported", records[0].ID, "1").Return(nil)
+	store.On("MarkExported", records[1].ID, "1").Return(nil)
+	limited := newLimitedStore(store, 1)
+
+	// The callbacks call the store without deadlocking on the single slot
+	done := make(chan error, 1)
+	var iterated []Record
+	go func() {
+		done <- limited.IterateRecordsByLockID(context.Background(), "1", func(rec Record) error {
+			iterated = append(iterated, rec)
+			return limited.MarkExported(rec.ID, "1")
+		})
+	}()
+	select {
+	case err := <-done:
+		assert.Nil(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("the iteration should not hold its slot during the callbacks")
+	}
+	assert.Equal(t, records, iterated)
+	store.AssertExpectations(t)
+
+	// The error of a callback stops the iteration
+	err := limited.IterateRecordsByLockID(context.Background(), "1", func(rec Record) error {
+		return errors.New("callback error")
+	})
+	assert.Equal(t, errors.New("callback error"), err)
+}
+
+func TestNewDispatcher_maxDBConcurrency(t *testing.T) {
+	store := &MockStore{}
+	d := NewDispatcher(store, &MockBroker{}, DispatcherSettings{MaxDBConcurrency: 4}, "1")
+
+	limited, ok := d.store.(*limitedStore)
+	assert.True(t, ok)
+	assert.Equal(t, store, limited.store)
+	assert.Equal(t, limited, d.recordProcessor.(*defaultRecordProcessor).store)
+}
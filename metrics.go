@@ -0,0 +1,68 @@
+package outbox
+
+// MetricsRecorder records the metrics emitted by the outbox components.
+// Implementations are expected to be safe for concurrent use
+type MetricsRecorder interface {
+	// Count increments the counter name by value
+	Count(name string, value int64, tags map[string]string)
+	// Observe records value in the distribution name
+	Observe(name string, value float64, tags map[string]string)
+	// Gauge sets the current value of the gauge name
+	Gauge(name string, value float64, tags map[string]string)
+}
+
+// Metric names emitted by the outbox components
+const (
+	// MetricSerializedBytes is the distribution of the serialized message sizes before compression
+	MetricSerializedBytes = "outbox_serialized_bytes"
+	// MetricStoredBytes is the distribution of the stored message sizes after compression
+	MetricStoredBytes = "outbox_stored_bytes"
+	// MetricCompressionRatio is the distribution of the stored to serialized size ratio of the compressed messages
+	MetricCompressionRatio = "outbox_compression_ratio"
+	// MetricSerializations counts the serialized messages, tagged with TagCompressed
+	MetricSerializations = "outbox_serializations_total"
+	// MetricSerializationFailures counts the messages that could not be serialized, tagged with TagMessageType
+	MetricSerializationFailures = "outbox_serialization_failures_total"
+	// MetricPublished counts the messages published successfully, tagged with TagTopic
+	MetricPublished = "outbox_published_total"
+	// MetricPublishFailures counts the failed publish attempts, tagged with TagTopic
+	MetricPublishFailures = "outbox_publish_failures_total"
+	// MetricDeadLettered counts the records moved to the MaxAttemptsReached state, tagged with TagTopic
+	MetricDeadLettered = "outbox_dead_lettered_total"
+	// MetricPublishDuration is the distribution of the publish attempt durations in seconds, tagged with TagTopic
+	MetricPublishDuration = "outbox_publish_duration_seconds"
+	// MetricDeliveryLatency is the distribution of the times in seconds from the creation of the records to their
+	// successful publishing, including the time they waited in the outbox, tagged with TagTopic
+	MetricDeliveryLatency = "outbox_delivery_latency_seconds"
+	// MetricBatchSize is the number of records selected by the last dispatch cycle
+	MetricBatchSize = "outbox_batch_size"
+	// MetricSlowQueries counts the store queries slower than the store threshold, tagged with TagQuery
+	MetricSlowQueries = "outbox_slow_queries_total"
+)
+
+// Metric tag names
+const (
+	// TagCompressed is "true" if the message was compressed and "false" otherwise
+	TagCompressed = "compressed"
+	// TagTopic is the topic of the message
+	TagTopic = "topic"
+	// TagQuery is the name of the store query
+	TagQuery = "query"
+	// TagMessageType is the message type of the serializer of the message, empty for the messages without a type
+	TagMessageType = "message_type"
+	// TagOutbox is the name of the outbox of a DispatcherGroup member. It is added to all the metrics of the member
+	// dispatchers, and to the metrics of the stores whose recorder is wrapped with TagMetrics
+	TagOutbox = "outbox"
+)
+
+// NoopMetricsRecorder discards all the metrics
+type NoopMetricsRecorder struct{}
+
+// Count does nothing
+func (NoopMetricsRecorder) Count(string, int64, map[string]string) {}
+
+// Observe does nothing
+func (NoopMetricsRecorder) Observe(string, float64, map[string]string) {}
+
+// Gauge does nothing
+func (NoopMetricsRecorder) Gauge(string, float64, map[string]string) {}
@@ -0,0 +1,129 @@
+// Package otel provides an OpenTelemetry implementation of the outbox.MetricsRecorder interface
+package otel
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+
+	"github.com/pkritiotis/outbox"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// instrument describes the OpenTelemetry instrument of an outbox metric
+type instrument struct {
+	description string
+	unit        string
+}
+
+// instruments are the descriptions and units of the metrics emitted by the outbox components.
+// Metrics that are not listed are recorded without description and unit
+var instruments = map[string]instrument{
+	outbox.MetricSerializedBytes:       {description: "Size of the serialized messages before compression", unit: "By"},
+	outbox.MetricStoredBytes:           {description: "Size of the stored messages after compression", unit: "By"},
+	outbox.MetricCompressionRatio:      {description: "Stored to serialized size ratio of the compressed messages", unit: "1"},
+	outbox.MetricSerializations:        {description: "Number of serialized messages", unit: "{message}"},
+	outbox.MetricPublished:             {description: "Number of messages published successfully", unit: "{message}"},
+	outbox.MetricPublishFailures:       {description: "Number of failed publish attempts", unit: "{attempt}"},
+	outbox.MetricDeadLettered:          {description: "Number of records that reached the maximum attempts", unit: "{record}"},
+	outbox.MetricPublishDuration:       {description: "Duration of the publish attempts", unit: "s"},
+	outbox.MetricDeliveryLatency:       {description: "Time from the creation of the records to their publishing", unit: "s"},
+	outbox.MetricBatchSize:             {description: "Number of records selected by the last dispatch cycle", unit: "{record}"},
+	outbox.MetricSlowQueries:           {description: "Number of store queries slower than the threshold", unit: "{query}"},
+	outbox.MetricSerializationFailures: {description: "Number of messages that could not be serialized", unit: "{message}"},
+}
+
+// Recorder records the outbox metrics with an OpenTelemetry Meter. Counters are recorded as Int64Counter,
+// distributions as Float64Histogram and gauges as Float64Gauge instruments, that are created on first use
+type Recorder struct {
+	meter      metric.Meter
+	mu         sync.Mutex
+	logger     *slog.Logger
+	counters   map[string]metric.Int64Counter
+	histograms map[string]metric.Float64Histogram
+	gauges     map[string]metric.Float64Gauge
+}
+
+// NewRecorder constructor
+func NewRecorder(meter metric.Meter) *Recorder {
+	return &Recorder{
+		meter:      meter,
+		counters:   map[string]metric.Int64Counter{},
+		histograms: map[string]metric.Float64Histogram{},
+		gauges:     map[string]metric.Float64Gauge{},
+	}
+}
+
+// SetLogger sets the logger of the instrument creation errors, slog.Default() by default
+func (r *Recorder) SetLogger(logger *slog.Logger) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.logger = logger
+}
+
+// Count adds value to the name counter
+func (r *Recorder) Count(name string, value int64, tags map[string]string) {
+	r.mu.Lock()
+	counter, ok := r.counters[name]
+	if !ok {
+		var err error
+		i := instruments[name]
+		counter, err = r.meter.Int64Counter(name, metric.WithDescription(i.description), metric.WithUnit(i.unit))
+		r.logError(name, err)
+		r.counters[name] = counter
+	}
+	r.mu.Unlock()
+	counter.Add(context.Background(), value, metric.WithAttributeSet(attributes(tags)))
+}
+
+// Observe records value in the name histogram
+func (r *Recorder) Observe(name string, value float64, tags map[string]string) {
+	r.mu.Lock()
+	histogram, ok := r.histograms[name]
+	if !ok {
+		var err error
+		i := instruments[name]
+		histogram, err = r.meter.Float64Histogram(name, metric.WithDescription(i.description), metric.WithUnit(i.unit))
+		r.logError(name, err)
+		r.histograms[name] = histogram
+	}
+	r.mu.Unlock()
+	histogram.Record(context.Background(), value, metric.WithAttributeSet(attributes(tags)))
+}
+
+// Gauge sets the value of the name gauge
+func (r *Recorder) Gauge(name string, value float64, tags map[string]string) {
+	r.mu.Lock()
+	gauge, ok := r.gauges[name]
+	if !ok {
+		var err error
+		i := instruments[name]
+		gauge, err = r.meter.Float64Gauge(name, metric.WithDescription(i.description), metric.WithUnit(i.unit))
+		r.logError(name, err)
+		r.gauges[name] = gauge
+	}
+	r.mu.Unlock()
+	gauge.Record(context.Background(), value, metric.WithAttributeSet(attributes(tags)))
+}
+
+// logError logs the instrument creation errors, with the lock held. The meter still returns a usable instrument in
+// that case
+func (r *Recorder) logError(name string, err error) {
+	if err == nil {
+		return
+	}
+	logger := r.logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	logger.Warn("Could not create the instrument", slog.String("instrument", name), slog.String("error", err.Error()))
+}
+
+func attributes(tags map[string]string) attribute.Set {
+	kvs := make([]attribute.KeyValue, 0, len(tags))
+	for k, v := range tags {
+		kvs = append(kvs, attribute.String(k, v))
+	}
+	return attribute.NewSet(kvs...)
+}
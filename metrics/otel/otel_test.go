@@ -0,0 +1,49 @@
+package otel
+
+import (
+	"context"
+	"testing"
+
+	"github.com/pkritiotis/outbox"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+func TestRecorder(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	provider := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+	r := NewRecorder(provider.Meter("outbox"))
+	tags := map[string]string{outbox.TagTopic: "topic"}
+
+	r.Count(outbox.MetricPublished, 1, tags)
+	r.Count(outbox.MetricPublished, 2, tags)
+	r.Observe(outbox.MetricPublishDuration, 0.5, tags)
+	r.Gauge(outbox.MetricBatchSize, 10, nil)
+	r.Gauge(outbox.MetricBatchSize, 4, nil)
+
+	var rm metricdata.ResourceMetrics
+	assert.Nil(t, reader.Collect(context.Background(), &rm))
+	assert.Len(t, rm.ScopeMetrics, 1)
+	metrics := map[string]metricdata.Metrics{}
+	for _, m := range rm.ScopeMetrics[0].Metrics {
+		metrics[m.Name] = m
+	}
+	topic := attribute.NewSet(attribute.String(outbox.TagTopic, "topic"))
+
+	published := metrics[outbox.MetricPublished]
+	assert.Equal(t, "{message}", published.Unit)
+	sum := published.Data.(metricdata.Sum[int64])
+	assert.Equal(t, int64(3), sum.DataPoints[0].Value)
+	assert.Equal(t, topic, sum.DataPoints[0].Attributes)
+
+	duration := metrics[outbox.MetricPublishDuration]
+	assert.Equal(t, "s", duration.Unit)
+	histogram := duration.Data.(metricdata.Histogram[float64])
+	assert.Equal(t, uint64(1), histogram.DataPoints[0].Count)
+	assert.Equal(t, 0.5, histogram.DataPoints[0].Sum)
+
+	gauge := metrics[outbox.MetricBatchSize].Data.(metricdata.Gauge[float64])
+	assert.Equal(t, float64(4), gauge.DataPoints[0].Value)
+}
@@ -0,0 +1,228 @@
+// Package prometheus provides a Prometheus collector of the outbox metrics, implementing both the
+// prometheus.Collector and the outbox.MetricsRecorder interfaces
+package prometheus
+
+import (
+	"sync"
+
+	"github.com/pkritiotis/outbox"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// metric describes the Prometheus metric of an outbox metric
+type metric struct {
+	help   string
+	labels []string
+}
+
+// counters, histograms and gauges are the Prometheus metrics of the metrics emitted by the outbox components.
+// Metrics that are not listed are not collected, since Prometheus metrics need a fixed set of labels. All of them are
+// also labeled with the outbox.TagOutbox of the DispatcherGroup members, empty for a single dispatcher
+var (
+	counters = map[string]metric{
+		outbox.MetricSerializations:        {help: "Number of serialized messages", labels: []string{outbox.TagCompressed}},
+		outbox.MetricPublished:             {help: "Number of messages published successfully", labels: []string{outbox.TagTopic}},
+		outbox.MetricPublishFailures:       {help: "Number of failed publish attempts", labels: []string{outbox.TagTopic}},
+		outbox.MetricDeadLettered:          {help: "Number of records that reached the maximum attempts", labels: []string{outbox.TagTopic}},
+		outbox.MetricSlowQueries:           {help: "Number of store queries slower than the threshold", labels: []string{outbox.TagQuery}},
+		outbox.MetricSerializationFailures: {help: "Number of messages that could not be serialized", labels: []string{outbox.TagMessageType}},
+	}
+	histograms = map[string]metric{
+		outbox.MetricSerializedBytes:  {help: "Size of the serialized messages before compression in bytes", labels: []string{outbox.TagCompressed}},
+		outbox.MetricStoredBytes:      {help: "Size of the stored messages after compression in bytes", labels: []string{outbox.TagCompressed}},
+		outbox.MetricCompressionRatio: {help: "Stored to serialized size ratio of the compressed messages", labels: []string{outbox.TagCompressed}},
+		outbox.MetricPublishDuration:  {help: "Duration of the publish attempts in seconds", labels: []string{outbox.TagTopic}},
+		outbox.MetricDeliveryLatency:  {help: "Time from the creation of the records to their publishing in seconds", labels: []string{outbox.TagTopic}},
+	}
+	gauges = map[string]metric{
+		outbox.MetricBatchSize: {help: "Number of records selected by the last dispatch cycle"},
+	}
+)
+
+// Metric names of the dispatcher status collected on every scrape
+const (
+	// MetricBacklog is the number of PendingDelivery records
+	MetricBacklog = "outbox_backlog_records"
+	// MetricOldestPendingAge is the age in seconds of the oldest PendingDelivery record, 0 if there are none
+	MetricOldestPendingAge = "outbox_oldest_pending_age_seconds"
+	// MetricDispatchPaused is 1 while the whole dispatch is paused with Dispatcher.Pause and 0 otherwise
+	MetricDispatchPaused = "outbox_dispatch_paused"
+	// MetricTopicPaused is 1 for every topic paused with Dispatcher.PauseTopic, labeled with the topic
+	MetricTopicPaused = "outbox_topic_paused"
+)
+
+// StatusSource reports the status of a dispatcher, it is implemented by outbox.Dispatcher
+type StatusSource interface {
+	Backlog() (outbox.Backlog, error)
+	Status() outbox.DispatcherStatus
+}
+
+// GroupStatusSources returns the dispatchers of the members of the group by name, to be set with SetStatusSources
+func GroupStatusSources(group *outbox.DispatcherGroup) map[string]StatusSource {
+	sources := map[string]StatusSource{}
+	for _, name := range group.Names() {
+		d, _ := group.Dispatcher(name)
+		sources[name] = d
+	}
+	return sources
+}
+
+// Collector collects the metrics recorded through the outbox.MetricsRecorder interface and, if status sources are
+// set, the backlog and the paused topics of the dispatchers on every scrape
+type Collector struct {
+	counters   map[string]*prometheus.CounterVec
+	histograms map[string]*prometheus.HistogramVec
+	gauges     map[string]*prometheus.GaugeVec
+
+	backlogDesc   *prometheus.Desc
+	oldestAgeDesc *prometheus.Desc
+	pausedDesc    *prometheus.Desc
+	allPausedDesc *prometheus.Desc
+
+	mu      sync.RWMutex
+	sources map[string]StatusSource
+}
+
+// NewCollector constructor
+func NewCollector() *Collector {
+	c := &Collector{
+		counters:      map[string]*prometheus.CounterVec{},
+		histograms:    map[string]*prometheus.HistogramVec{},
+		gauges:        map[string]*prometheus.GaugeVec{},
+		backlogDesc:   prometheus.NewDesc(MetricBacklog, "Number of records pending delivery", []string{outbox.TagOutbox}, nil),
+		oldestAgeDesc: prometheus.NewDesc(MetricOldestPendingAge, "Age of the oldest record pending delivery in seconds", []string{outbox.TagOutbox}, nil),
+		pausedDesc:    prometheus.NewDesc(MetricTopicPaused, "Topics whose dispatch is paused", []string{outbox.TagTopic, outbox.TagOutbox}, nil),
+		allPausedDesc: prometheus.NewDesc(MetricDispatchPaused, "Whether the whole dispatch is paused", []string{outbox.TagOutbox}, nil),
+	}
+	for name, m := range counters {
+		c.counters[name] = prometheus.NewCounterVec(prometheus.CounterOpts{Name: name, Help: m.help}, labelNames(m))
+	}
+	for name, m := range histograms {
+		c.histograms[name] = prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: name, Help: m.help, Buckets: buckets(name)}, labelNames(m))
+	}
+	for name, m := range gauges {
+		c.gauges[name] = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: name, Help: m.help}, labelNames(m))
+	}
+	return c
+}
+
+// labelNames returns the labels of the metric followed by the outbox label
+func labelNames(m metric) []string {
+	return append(append([]string(nil), m.labels...), outbox.TagOutbox)
+}
+
+// buckets returns the histogram buckets of the metric
+func buckets(name string) []float64 {
+	switch name {
+	case outbox.MetricSerializedBytes, outbox.MetricStoredBytes:
+		return prometheus.ExponentialBuckets(64, 4, 10)
+	case outbox.MetricCompressionRatio:
+		return prometheus.LinearBuckets(0.1, 0.1, 10)
+	case outbox.MetricDeliveryLatency:
+		// From 10 milliseconds to about 12 hours, since the records may wait in the outbox during a broker outage
+		return prometheus.ExponentialBuckets(0.01, 4, 12)
+	}
+	return prometheus.DefBuckets
+}
+
+// SetStatusSource sets the dispatcher whose status is collected. The collector is usually created before the
+// dispatcher, since it is its MetricsRecorder
+func (c *Collector) SetStatusSource(source StatusSource) {
+	c.SetStatusSources(map[string]StatusSource{"": source})
+}
+
+// SetStatusSources sets the dispatchers whose status is collected by outbox name, e.g. the GroupStatusSources of a
+// DispatcherGroup. Their status is labeled with their name
+func (c *Collector) SetStatusSources(sources map[string]StatusSource) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sources = sources
+}
+
+// Count adds value to the name counter
+func (c *Collector) Count(name string, value int64, tags map[string]string) {
+	if counter, ok := c.counters[name]; ok {
+		counter.With(labels(counters[name], tags)).Add(float64(value))
+	}
+}
+
+// Observe records value in the name histogram
+func (c *Collector) Observe(name string, value float64, tags map[string]string) {
+	if histogram, ok := c.histograms[name]; ok {
+		histogram.With(labels(histograms[name], tags)).Observe(value)
+	}
+}
+
+// Gauge sets the value of the name gauge
+func (c *Collector) Gauge(name string, value float64, tags map[string]string) {
+	if gauge, ok := c.gauges[name]; ok {
+		gauge.With(labels(gauges[name], tags)).Set(value)
+	}
+}
+
+// labels returns the values of the labels and the outbox label of the metric, ignoring the other tags
+func labels(m metric, tags map[string]string) prometheus.Labels {
+	l := make(prometheus.Labels, len(m.labels)+1)
+	for _, name := range m.labels {
+		l[name] = tags[name]
+	}
+	l[outbox.TagOutbox] = tags[outbox.TagOutbox]
+	return l
+}
+
+// Describe implements prometheus.Collector
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	for _, counter := range c.counters {
+		counter.Describe(ch)
+	}
+	for _, histogram := range c.histograms {
+		histogram.Describe(ch)
+	}
+	for _, gauge := range c.gauges {
+		gauge.Describe(ch)
+	}
+	ch <- c.backlogDesc
+	ch <- c.oldestAgeDesc
+	ch <- c.pausedDesc
+	ch <- c.allPausedDesc
+}
+
+// Collect implements prometheus.Collector. The backlog is read from the store on every scrape
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	for _, counter := range c.counters {
+		counter.Collect(ch)
+	}
+	for _, histogram := range c.histograms {
+		histogram.Collect(ch)
+	}
+	for _, gauge := range c.gauges {
+		gauge.Collect(ch)
+	}
+
+	c.mu.RLock()
+	sources := c.sources
+	c.mu.RUnlock()
+	for name, source := range sources {
+		c.collectStatus(ch, name, source)
+	}
+}
+
+// collectStatus collects the status of the dispatcher of the named outbox
+func (c *Collector) collectStatus(ch chan<- prometheus.Metric, name string, source StatusSource) {
+	backlog, err := source.Backlog()
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(c.backlogDesc, err)
+	} else {
+		ch <- prometheus.MustNewConstMetric(c.backlogDesc, prometheus.GaugeValue, float64(backlog.Records), name)
+		ch <- prometheus.MustNewConstMetric(c.oldestAgeDesc, prometheus.GaugeValue, backlog.OldestAge.Seconds(), name)
+	}
+	status := source.Status()
+	allPaused := 0.0
+	if status.Paused {
+		allPaused = 1
+	}
+	ch <- prometheus.MustNewConstMetric(c.allPausedDesc, prometheus.GaugeValue, allPaused, name)
+	for _, topic := range status.PausedTopics {
+		ch <- prometheus.MustNewConstMetric(c.pausedDesc, prometheus.GaugeValue, 1, topic, name)
+	}
+}
@@ -0,0 +1,125 @@
+package prometheus
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkritiotis/outbox"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// staticSource is a StatusSource returning a fixed status
+type staticSource struct {
+	backlog outbox.Backlog
+	err     error
+	status  outbox.DispatcherStatus
+}
+
+func (s staticSource) Backlog() (outbox.Backlog, error) {
+	return s.backlog, s.err
+}
+
+func (s staticSource) Status() outbox.DispatcherStatus {
+	return s.status
+}
+
+func TestCollector(t *testing.T) {
+	c := NewCollector()
+	registry := prometheus.NewPedanticRegistry()
+	assert.Nil(t, registry.Register(c))
+	tags := map[string]string{outbox.TagTopic: "orders", "ignored": "value"}
+
+	c.Count(outbox.MetricPublished, 1, tags)
+	c.Count(outbox.MetricPublished, 2, tags)
+	c.Count(outbox.MetricPublishFailures, 1, tags)
+	c.Count("unknown_total", 1, tags)
+	c.Observe(outbox.MetricPublishDuration, 0.5, tags)
+	c.Observe(outbox.MetricDeliveryLatency, 12, tags)
+	c.Gauge(outbox.MetricBatchSize, 10, nil)
+	c.Gauge(outbox.MetricBatchSize, 4, nil)
+	c.SetStatusSource(staticSource{
+		backlog: outbox.Backlog{Records: 7, OldestAge: 90 * time.Second},
+		status:  outbox.DispatcherStatus{Paused: true, PausedTopics: []string{"payments"}},
+	})
+
+	expected := `
+# HELP outbox_backlog_records Number of records pending delivery
+# TYPE outbox_backlog_records gauge
+outbox_backlog_records{outbox=""} 7
+# HELP outbox_batch_size Number of records selected by the last dispatch cycle
+# TYPE outbox_batch_size gauge
+outbox_batch_size{outbox=""} 4
+# HELP outbox_dispatch_paused Whether the whole dispatch is paused
+# TYPE outbox_dispatch_paused gauge
+outbox_dispatch_paused{outbox=""} 1
+# HELP outbox_oldest_pending_age_seconds Age of the oldest record pending delivery in seconds
+# TYPE outbox_oldest_pending_age_seconds gauge
+outbox_oldest_pending_age_seconds{outbox=""} 90
+# HELP outbox_publish_failures_total Number of failed publish attempts
+# TYPE outbox_publish_failures_total counter
+outbox_publish_failures_total{outbox="",topic="orders"} 1
+# HELP outbox_published_total Number of messages published successfully
+# TYPE outbox_published_total counter
+outbox_published_total{outbox="",topic="orders"} 3
+# HELP outbox_topic_paused Topics whose dispatch is paused
+# TYPE outbox_topic_paused gauge
+outbox_topic_paused{outbox="",topic="payments"} 1
+`
+	assert.Nil(t, testutil.GatherAndCompare(registry, strings.NewReader(expected),
+		MetricBacklog, MetricOldestPendingAge, MetricDispatchPaused, MetricTopicPaused,
+		outbox.MetricBatchSize, outbox.MetricPublished, outbox.MetricPublishFailures,
+	))
+	assert.Equal(t, 1, testutil.CollectAndCount(c, outbox.MetricPublishDuration))
+	assert.Equal(t, 1, testutil.CollectAndCount(c, outbox.MetricDeliveryLatency))
+
+	c.SetStatusSource(staticSource{err: errors.New("db error")})
+	_, err := registry.Gather()
+	assert.ErrorContains(t, err, "db error")
+}
+
+func TestCollector_group(t *testing.T) {
+	c := NewCollector()
+	registry := prometheus.NewPedanticRegistry()
+	assert.Nil(t, registry.Register(c))
+
+	c.Count(outbox.MetricPublished, 1, map[string]string{outbox.TagTopic: "orders", outbox.TagOutbox: "sales"})
+	c.Count(outbox.MetricPublished, 2, map[string]string{outbox.TagTopic: "orders", outbox.TagOutbox: "billing"})
+	c.SetStatusSources(map[string]StatusSource{
+		"sales":   staticSource{backlog: outbox.Backlog{Records: 3}},
+		"billing": staticSource{backlog: outbox.Backlog{Records: 5}, status: outbox.DispatcherStatus{PausedTopics: []string{"invoices"}}},
+	})
+
+	expected := `
+# HELP outbox_backlog_records Number of records pending delivery
+# TYPE outbox_backlog_records gauge
+outbox_backlog_records{outbox="billing"} 5
+outbox_backlog_records{outbox="sales"} 3
+# HELP outbox_published_total Number of messages published successfully
+# TYPE outbox_published_total counter
+outbox_published_total{outbox="billing",topic="orders"} 2
+outbox_published_total{outbox="sales",topic="orders"} 1
+# HELP outbox_topic_paused Topics whose dispatch is paused
+# TYPE outbox_topic_paused gauge
+outbox_topic_paused{outbox="billing",topic="invoices"} 1
+`
+	assert.Nil(t, testutil.GatherAndCompare(registry, strings.NewReader(expected),
+		MetricBacklog, MetricTopicPaused, outbox.MetricPublished,
+	))
+}
+
+func TestGroupStatusSources(t *testing.T) {
+	group, err := outbox.NewDispatcherGroup(&outbox.MockBroker{}, []outbox.GroupMember{
+		{Name: "sales", Store: &outbox.MockStore{}},
+		{Name: "billing", Store: &outbox.MockStore{}},
+	}, outbox.DispatcherGroupSettings{ProcessInterval: time.Second}, "1")
+	assert.Nil(t, err)
+
+	sources := GroupStatusSources(group)
+	assert.Len(t, sources, 2)
+	sales, _ := group.Dispatcher("sales")
+	assert.Equal(t, StatusSource(sales), sources["sales"])
+}
@@ -0,0 +1,95 @@
+package outbox
+
+import (
+	"sort"
+	"sync"
+)
+
+// pausedTopics is the set of topics whose records are not dispatched, or all of them while the whole dispatch is
+// paused. It is shared by the Dispatcher and its processor
+type pausedTopics struct {
+	mu     sync.RWMutex
+	all    bool
+	topics map[string]struct{}
+}
+
+func newPausedTopics() *pausedTopics {
+	return &pausedTopics{topics: map[string]struct{}{}}
+}
+
+func (p *pausedTopics) setAll(paused bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.all = paused
+}
+
+// isAllPaused reports whether the whole dispatch is paused
+func (p *pausedTopics) isAllPaused() bool {
+	if p == nil {
+		return false
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.all
+}
+
+func (p *pausedTopics) pause(topic string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.topics[topic] = struct{}{}
+}
+
+func (p *pausedTopics) resume(topic string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.topics, topic)
+}
+
+// isPaused reports whether the topic is paused. No topic is paused in a nil set
+func (p *pausedTopics) isPaused(topic string) bool {
+	if p == nil {
+		return false
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	_, ok := p.topics[topic]
+	return ok
+}
+
+// list returns the paused topics in alphabetical order
+func (p *pausedTopics) list() []string {
+	if p == nil {
+		return nil
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	topics := make([]string, 0, len(p.topics))
+	for topic := range p.topics {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	return topics
+}
+
+// Pause stops the dispatch of all the records from the next processing cycle. The records are not locked while the
+// dispatch is paused, so they can be dispatched by the other dispatchers
+func (d Dispatcher) Pause() {
+	d.pausedTopics.setAll(true)
+}
+
+// Resume resumes the dispatch paused with Pause. The topics paused with PauseTopic stay paused
+func (d Dispatcher) Resume() {
+	d.pausedTopics.setAll(false)
+}
+
+// PauseTopic stops the dispatch of the records of the topic from the next processing cycle, e.g. while the consumers
+// of the topic are down. The records of the topic stay pending until the topic is resumed, while the records of the
+// other topics are still dispatched
+func (d Dispatcher) PauseTopic(topic string) {
+	d.pausedTopics.pause(topic)
+}
+
+// ResumeTopic resumes the dispatch of the records of a paused topic
+func (d Dispatcher) ResumeTopic(topic string) {
+	d.pausedTopics.resume(topic)
+}
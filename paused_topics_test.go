@@ -0,0 +1,93 @@
+package outbox
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	time2 "github.com/pkritiotis/outbox/internal/time"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDispatcher_PauseTopic(t *testing.T) {
+	d := NewDispatcher(&MockStore{}, &MockBroker{}, DispatcherSettings{}, "1")
+	assert.Equal(t, DispatcherStatus{PausedTopics: []string{}}, d.Status())
+
+	d.PauseTopic("payments")
+	d.PauseTopic("orders")
+	d.PauseTopic("payments")
+	assert.Equal(t, DispatcherStatus{PausedTopics: []string{"orders", "payments"}}, d.Status())
+
+	d.ResumeTopic("payments")
+	d.ResumeTopic("unknown")
+	assert.Equal(t, DispatcherStatus{PausedTopics: []string{"orders"}}, d.Status())
+
+	d.Pause()
+	assert.Equal(t, DispatcherStatus{Paused: true, PausedTopics: []string{"orders"}}, d.Status())
+	d.Resume()
+	assert.Equal(t, DispatcherStatus{PausedTopics: []string{"orders"}}, d.Status())
+}
+
+func Test_defaultRecordProcessor_ProcessRecords_paused(t *testing.T) {
+	store := &MockStore{}
+	paused := newPausedTopics()
+	paused.setAll(true)
+	d := defaultRecordProcessor{
+		store:        store,
+		selector:     stateSelector{store: store, lockID: "1"},
+		pausedTopics: paused,
+	}
+
+	assert.Nil(t, d.ProcessRecords())
+	store.AssertNotCalled(t, "UpdateRecordsLockByStates")
+}
+
+func Test_defaultRecordProcessor_ProcessRecords_pausedTopics(t *testing.T) {
+	sampleTime := time.Now().UTC()
+	timeProvider := &time2.MockProvider{}
+	timeProvider.On("Now").Return(sampleTime)
+	machineID := "1"
+	records := []Record{
+		{ID: uuid.New(), Message: Message{Key: "1", Topic: "orders"}, State: PendingDelivery},
+		{ID: uuid.New(), Message: Message{Key: "2", Topic: "payments"}, State: PendingDelivery},
+		{ID: uuid.New(), Message: Message{Key: "3", Topic: "orders"}, State: PendingDelivery},
+	}
+
+	store := &MockStore{}
+	store.On("UpdateRecordsLockByStates", machineID, sampleTime, []RecordState{PendingDelivery}, 0).Return(nil)
+	store.On("GetRecordsByLockID", machineID).Return(records, nil)
+	store.On("MarkProcessed", records[1].ID, 1, sampleTime, machineID).Return(nil)
+	store.On("ClearLocksByLockID", machineID).Return(nil)
+	broker := &MockBroker{}
+	broker.On("Send", MetadataHeaders{}.withMetadataHeaders(records[1])).Return(nil)
+
+	paused := newPausedTopics()
+	paused.pause("orders")
+	d := defaultRecordProcessor{
+		messageBroker: broker,
+		time:          timeProvider,
+		store:         store,
+		machineID:     machineID,
+		selector:      stateSelector{store: store, time: timeProvider, lockID: machineID},
+		pausedTopics:  paused,
+	}
+	err := d.ProcessRecords()
+
+	assert.Nil(t, err)
+	broker.AssertNumberOfCalls(t, "Send", 1)
+	store.AssertExpectations(t)
+}
+
+func Test_watermarkSelector_withoutPaused(t *testing.T) {
+	records := []Record{
+		{ID: uuid.New(), Message: Message{Topic: "payments"}},
+		{ID: uuid.New(), Message: Message{Topic: "orders"}},
+		{ID: uuid.New(), Message: Message{Topic: "payments"}},
+	}
+	paused := newPausedTopics()
+	paused.pause("orders")
+
+	s := newWatermarkSelector(&MockStore{}, time.Now(), 0)
+	assert.Equal(t, records[:1], s.withoutPaused(records, paused.isPaused))
+	assert.Equal(t, records, s.withoutPaused(records, newPausedTopics().isPaused))
+}
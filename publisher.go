@@ -2,6 +2,7 @@ package outbox
 
 import (
 	"database/sql"
+	time2 "time"
 
 	"github.com/pkritiotis/outbox/internal/time"
 	"github.com/pkritiotis/outbox/internal/uuid"
@@ -12,26 +13,46 @@ type Publisher struct {
 	store Store
 	time  time.Provider
 	uuid  uuid.Provider
+	// waiters are the records awaited by EnqueueAndWait
+	waiters *DeliveryWaiters
 }
 
 // NewPublisher is the Publisher constructor
 func NewPublisher(store Store) Publisher {
-	return Publisher{store: store, time: time.NewTimeProvider(), uuid: uuid.NewUUIDProvider()}
+	return NewPublisherWithClock(store, nil)
+}
+
+// NewPublisherWithClock constructs a Publisher that sets the record creation times with the provided clock,
+// which should be the Clock of the dispatchers. A nil clock defaults to the local clock
+func NewPublisherWithClock(store Store, clock Clock) Publisher {
+	return Publisher{store: store, time: clockOrDefault(clock), uuid: uuid.NewUUIDProvider()}
 }
 
 // Message encapsulates the contents of the message to be sent
 type Message struct {
-	Key     string
-	Headers map[string]string
-	Body    []byte
-	Topic   string
+	Key     string            `json:"key"`
+	Headers map[string]string `json:"headers"`
+	Body    []byte            `json:"body"`
+	Topic   string            `json:"topic"`
 }
 
 // Send stores the provided Message within the provided sql.Tx
 func (o Publisher) Send(msg Message, tx *sql.Tx) error {
-	newID := o.uuid.NewUUID()
-	record := Record{
-		ID:          newID,
+	return o.store.AddRecordTx(o.newRecord(msg), tx)
+}
+
+// SendWithExpiry stores the provided Message within the provided sql.Tx.
+// The message is not published if it could not be delivered before expiresAt
+func (o Publisher) SendWithExpiry(msg Message, expiresAt time2.Time, tx *sql.Tx) error {
+	record := o.newRecord(msg)
+	expiresAt = expiresAt.UTC()
+	record.ExpiresAt = &expiresAt
+	return o.store.AddRecordTx(record, tx)
+}
+
+func (o Publisher) newRecord(msg Message) Record {
+	return Record{
+		ID:          o.uuid.NewUUID(),
 		Message:     msg,
 		State:       PendingDelivery,
 		CreatedOn:   o.time.Now().UTC(),
@@ -39,6 +60,4 @@ func (o Publisher) Send(msg Message, tx *sql.Tx) error {
 		LockedOn:    nil,
 		ProcessedOn: nil,
 	}
-
-	return o.store.AddRecordTx(record, tx)
 }
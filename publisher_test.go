@@ -106,3 +106,32 @@ func TestOutbox_Add(t *testing.T) {
 		})
 	}
 }
+
+func TestOutbox_SendWithExpiry(t *testing.T) {
+	sampleTx := sql.Tx{}
+	sampleUUID, _ := uuid.NewUUID()
+	sampleTime := time.Now()
+	expiresAt := sampleTime.Add(time.Minute)
+	expiresAtUTC := expiresAt.UTC()
+
+	timeProvider := &time2.MockProvider{}
+	timeProvider.On("Now").Return(sampleTime)
+
+	uuidProvider := &uuid2.MockProvider{}
+	uuidProvider.On("NewUUID").Return(sampleUUID)
+
+	sampleMessage := Message{Key: "testKey", Body: []byte("testvalue"), Topic: "testTopic"}
+	store := &MockStore{}
+	store.On("AddRecordTx", Record{
+		ID:        sampleUUID,
+		Message:   sampleMessage,
+		State:     PendingDelivery,
+		CreatedOn: sampleTime.UTC(),
+		ExpiresAt: &expiresAtUTC,
+	}, &sampleTx).Return(nil)
+
+	s := Publisher{store: store, time: timeProvider, uuid: uuidProvider}
+	err := s.SendWithExpiry(sampleMessage, expiresAt, &sampleTx)
+	assert.Nil(t, err)
+	store.AssertExpectations(t)
+}
@@ -0,0 +1,34 @@
+package outbox
+
+import (
+	time2 "time"
+
+	"github.com/google/uuid"
+	"github.com/pkritiotis/outbox/internal/time"
+)
+
+// maxSLAExceededRecords is the maximum number of record ids reported per check
+const maxSLAExceededRecords = 1000
+
+type recordAgeChecker struct {
+	store        Store
+	time         time.Provider
+	RecordAgeSLA time2.Duration
+	onExceeded   func(ids []uuid.UUID)
+}
+
+func newRecordAgeChecker(store Store, recordAgeSLA time2.Duration, onExceeded func(ids []uuid.UUID), clock time.Provider) recordAgeChecker {
+	return recordAgeChecker{RecordAgeSLA: recordAgeSLA, onExceeded: onExceeded, store: store, time: clock}
+}
+
+func (d recordAgeChecker) CheckRecordsAge() error {
+	createdBefore := d.time.Now().UTC().Add(-d.RecordAgeSLA)
+	ids, err := d.store.GetRecordIDsByStateCreatedBefore(PendingDelivery, createdBefore, maxSLAExceededRecords)
+	if err != nil {
+		return err
+	}
+	if len(ids) > 0 {
+		d.onExceeded(ids)
+	}
+	return nil
+}
@@ -0,0 +1,14 @@
+package outbox
+
+import (
+	"github.com/stretchr/testify/mock"
+)
+
+type mockRecordAgeChecker struct {
+	mock.Mock
+}
+
+func (m *mockRecordAgeChecker) CheckRecordsAge() error {
+	args := m.Called()
+	return args.Error(0)
+}
@@ -0,0 +1,80 @@
+package outbox
+
+import (
+	"errors"
+	"testing"
+	time2 "time"
+
+	"github.com/google/uuid"
+	"github.com/pkritiotis/outbox/internal/time"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_recordAgeChecker_CheckRecordsAge(t *testing.T) {
+	sampleTime := time2.Now().UTC()
+	timeProvider := &time.MockProvider{}
+	timeProvider.On("Now").Return(sampleTime)
+	ids := []uuid.UUID{uuid.New(), uuid.New()}
+
+	tests := map[string]struct {
+		store       Store
+		expReported []uuid.UUID
+		expErr      error
+	}{
+		"Records exceeding the SLA should be reported": {
+			store: func() *MockStore {
+				mp := MockStore{}
+				mp.On("GetRecordIDsByStateCreatedBefore", PendingDelivery, sampleTime.Add(-time2.Hour), maxSLAExceededRecords).
+					Return(ids, nil)
+				return &mp
+			}(),
+			expReported: ids,
+			expErr:      nil,
+		},
+		"No records exceeding the SLA should not report": {
+			store: func() *MockStore {
+				mp := MockStore{}
+				mp.On("GetRecordIDsByStateCreatedBefore", PendingDelivery, sampleTime.Add(-time2.Hour), maxSLAExceededRecords).
+					Return([]uuid.UUID{}, nil)
+				return &mp
+			}(),
+			expReported: nil,
+			expErr:      nil,
+		},
+		"Error in fetching the records should return error": {
+			store: func() *MockStore {
+				mp := MockStore{}
+				mp.On("GetRecordIDsByStateCreatedBefore", PendingDelivery, sampleTime.Add(-time2.Hour), maxSLAExceededRecords).
+					Return([]uuid.UUID{}, errors.New("test"))
+				return &mp
+			}(),
+			expReported: nil,
+			expErr:      errors.New("test"),
+		},
+	}
+	for name, test := range tests {
+		tt := test
+		t.Run(name, func(t *testing.T) {
+			var reported []uuid.UUID
+			d := recordAgeChecker{
+				store:        tt.store,
+				time:         timeProvider,
+				RecordAgeSLA: time2.Hour,
+				onExceeded:   func(ids []uuid.UUID) { reported = ids },
+			}
+			err := d.CheckRecordsAge()
+			assert.Equal(t, tt.expErr, err)
+			assert.Equal(t, tt.expReported, reported)
+		})
+	}
+}
+
+func Test_newRecordAgeChecker(t *testing.T) {
+	mStore := &MockStore{}
+	rc := newRecordAgeChecker(mStore, time2.Minute, func([]uuid.UUID) {}, time.NewTimeProvider())
+
+	assert.Equal(t, mStore, rc.store)
+	assert.Equal(t, time.NewTimeProvider(), rc.time)
+	assert.Equal(t, time2.Minute, rc.RecordAgeSLA)
+	assert.NotNil(t, rc.onExceeded)
+}
@@ -1,26 +1,42 @@
 package outbox
 
 import (
+	"log/slog"
 	time2 "time"
 
 	"github.com/pkritiotis/outbox/internal/time"
 )
 
 type recordCleaner struct {
-	store             Store
-	time              time.Provider
-	MaxRecordLifetime time2.Duration
+	store              Store
+	time               time.Provider
+	MaxRecordLifetime  time2.Duration
+	maxAttemptLifetime time2.Duration
+	logger             *slog.Logger
 }
 
-func newRecordCleaner(store Store, maxRecordLifetime time2.Duration) recordCleaner {
-	return recordCleaner{MaxRecordLifetime: maxRecordLifetime, store: store, time: time.NewTimeProvider()}
+func newRecordCleaner(store Store, maxRecordLifetime time2.Duration, maxAttemptLifetime time2.Duration, clock time.Provider, logger *slog.Logger) recordCleaner {
+	return recordCleaner{MaxRecordLifetime: maxRecordLifetime, maxAttemptLifetime: maxAttemptLifetime, store: store, time: clock, logger: logger}
 }
 
 func (d recordCleaner) RemoveExpiredMessages() error {
 	expiryTime := d.time.Now().UTC().Add(-d.MaxRecordLifetime)
-	err := d.store.RemoveRecordsBeforeDatetime(expiryTime)
+	removed, skipped, err := d.store.RemoveRecordsBeforeDatetime(expiryTime)
 	if err != nil {
 		return err
 	}
-	return nil
+	if skipped > 0 {
+		loggerOrDefault(d.logger).Info("Record retention cleaner skipped the undelivered records",
+			slog.Int64("removed", removed), slog.Int64("skipped", skipped), slog.Time("created_before", expiryTime))
+	}
+	return d.removeExpiredAttempts()
+}
+
+// removeExpiredAttempts removes the audit entries of the attempts older than the attempt lifetime, if it is set
+func (d recordCleaner) removeExpiredAttempts() error {
+	if d.maxAttemptLifetime <= 0 {
+		return nil
+	}
+	_, err := d.store.RemoveAttemptsBeforeDatetime(d.time.Now().UTC().Add(-d.maxAttemptLifetime))
+	return err
 }
@@ -1,7 +1,9 @@
 package outbox
 
 import (
+	"bytes"
 	"errors"
+	"log/slog"
 	"testing"
 	time2 "time"
 
@@ -18,22 +20,57 @@ func Test_recordCleaner_removeExpiredMessages(t *testing.T) {
 		store              Store
 		time               time.Provider
 		MaxMessageLifetime time2.Duration
+		maxAttemptLifetime time2.Duration
 		expErr             error
 	}{
 		"Successful removing should not return error": {
 			store: func() *MockStore {
 				mp := MockStore{}
-				mp.On("RemoveRecordsBeforeDatetime", sampleTime.Add(-2*time2.Minute)).Return(nil)
+				mp.On("RemoveRecordsBeforeDatetime", sampleTime.Add(-2*time2.Minute)).Return(int64(3), int64(0), nil)
 				return &mp
 			}(),
 			time:               timeProvider,
 			MaxMessageLifetime: 2 * time2.Minute,
 			expErr:             nil,
 		},
+		"Skipped undelivered records should not return error": {
+			store: func() *MockStore {
+				mp := MockStore{}
+				mp.On("RemoveRecordsBeforeDatetime", sampleTime.Add(-2*time2.Minute)).Return(int64(3), int64(2), nil)
+				return &mp
+			}(),
+			time:               timeProvider,
+			MaxMessageLifetime: 2 * time2.Minute,
+			expErr:             nil,
+		},
+		"Expired attempts should be removed with the records": {
+			store: func() *MockStore {
+				mp := MockStore{}
+				mp.On("RemoveRecordsBeforeDatetime", sampleTime.Add(-2*time2.Minute)).Return(int64(3), int64(0), nil)
+				mp.On("RemoveAttemptsBeforeDatetime", sampleTime.Add(-time2.Hour)).Return(int64(5), nil)
+				return &mp
+			}(),
+			time:               timeProvider,
+			MaxMessageLifetime: 2 * time2.Minute,
+			maxAttemptLifetime: time2.Hour,
+			expErr:             nil,
+		},
+		"Error in removing the attempts should return error": {
+			store: func() *MockStore {
+				mp := MockStore{}
+				mp.On("RemoveRecordsBeforeDatetime", sampleTime.Add(-2*time2.Minute)).Return(int64(3), int64(0), nil)
+				mp.On("RemoveAttemptsBeforeDatetime", sampleTime.Add(-time2.Hour)).Return(int64(0), errors.New("test"))
+				return &mp
+			}(),
+			time:               timeProvider,
+			MaxMessageLifetime: 2 * time2.Minute,
+			maxAttemptLifetime: time2.Hour,
+			expErr:             errors.New("test"),
+		},
 		"Error in removing should return error": {
 			store: func() *MockStore {
 				mp := MockStore{}
-				mp.On("RemoveRecordsBeforeDatetime", sampleTime.Add(-2*time2.Minute)).Return(errors.New("test"))
+				mp.On("RemoveRecordsBeforeDatetime", sampleTime.Add(-2*time2.Minute)).Return(int64(0), int64(0), errors.New("test"))
 				return &mp
 			}(),
 			time:               timeProvider,
@@ -45,9 +82,10 @@ func Test_recordCleaner_removeExpiredMessages(t *testing.T) {
 		tt := test
 		t.Run(name, func(t *testing.T) {
 			d := recordCleaner{
-				store:             tt.store,
-				time:              tt.time,
-				MaxRecordLifetime: tt.MaxMessageLifetime,
+				store:              tt.store,
+				time:               tt.time,
+				MaxRecordLifetime:  tt.MaxMessageLifetime,
+				maxAttemptLifetime: tt.maxAttemptLifetime,
 			}
 			err := d.RemoveExpiredMessages()
 			assert.Equal(t, tt.expErr, err)
@@ -55,17 +93,32 @@ func Test_recordCleaner_removeExpiredMessages(t *testing.T) {
 	}
 }
 
+func Test_recordCleaner_removeExpiredMessages_logger(t *testing.T) {
+	sampleTime := time2.Now().UTC()
+	timeProvider := &time.MockProvider{}
+	timeProvider.On("Now").Return(sampleTime)
+	store := &MockStore{}
+	store.On("RemoveRecordsBeforeDatetime", sampleTime.Add(-time2.Minute)).Return(int64(3), int64(2), nil)
+	var logs bytes.Buffer
+	d := newRecordCleaner(store, time2.Minute, 0, timeProvider, slog.New(slog.NewTextHandler(&logs, nil)))
+
+	assert.Nil(t, d.RemoveExpiredMessages())
+	assert.Contains(t, logs.String(), "Record retention cleaner skipped the undelivered records")
+	assert.Contains(t, logs.String(), "removed=3 skipped=2")
+}
+
 func Test_newrecordCleaner(t *testing.T) {
 	mStore := &MockStore{}
 	duration := time2.Duration(1) * time2.Second
 	timeProvider := time.NewTimeProvider()
 	exprecordCleaner := recordCleaner{
-		store:             mStore,
-		time:              timeProvider,
-		MaxRecordLifetime: duration,
+		store:              mStore,
+		time:               timeProvider,
+		MaxRecordLifetime:  duration,
+		maxAttemptLifetime: 2 * duration,
 	}
 
-	rc := newRecordCleaner(mStore, duration)
+	rc := newRecordCleaner(mStore, duration, 2*duration, timeProvider, nil)
 
 	assert.Equal(t, exprecordCleaner, rc)
 }
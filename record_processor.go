@@ -1,93 +1,676 @@
 package outbox
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"sort"
+	"sync"
+	time2 "time"
 
 	"github.com/pkritiotis/outbox/internal/time"
 )
 
+// defaultAckTimeout is the default maximum time to wait for an AsyncMessageBroker acknowledgement
+const defaultAckTimeout = 30 * time2.Second
+
 // defaultRecordProcessor checks and dispatches new messages to be sent
 type defaultRecordProcessor struct {
-	messageBroker MessageBroker
-	store         Store
-	time          time.Provider
-	machineID     string
-	retrialPolicy RetrialPolicy
+	messageBroker         MessageBroker
+	store                 Store
+	time                  time.Provider
+	machineID             string
+	retrialPolicy         RetrialPolicy
+	orderingMode          OrderingMode
+	intraBatchConcurrency int
+	publishTimeout        time2.Duration
+	ackTimeout            time2.Duration
+	metadataHeaders       MetadataHeaders
+	lockHeartbeatInterval time2.Duration
+	metrics               MetricsRecorder
+	selector              recordSelector
+	pausedTopics          *pausedTopics
+	shutdown              *shutdown
+	shutdownAckTimeout    time2.Duration
+	onDeadLetter          func(rec Record, reason error)
+	deliveryWaiters       *DeliveryWaiters
+	twoPhaseBroker        TransactionalMessageBroker
+	auditAttempts         bool
+	recordLess            func(a, b Record) bool
+	logCyclesSummary      bool
+	cyclesSummaryLevel    slog.Level
+	logger                *slog.Logger
+	cycle                 *cycleSummary
+}
+
+// publishResult holds the outcome of a single publish attempt
+type publishResult struct {
+	record      Record
+	attemptedOn time2.Time
+	expired     bool
+	err         error
 }
 
 // newProcessor constructs a new defaultRecordProcessor
-func newProcessor(store Store, messageBroker MessageBroker, machineID string, retrialPolicy RetrialPolicy) *defaultRecordProcessor {
+func newProcessor(store Store, messageBroker MessageBroker, machineID string, settings DispatcherSettings, paused *pausedTopics, stop *shutdown) *defaultRecordProcessor {
+	orderingMode := settings.OrderingMode
+	// The watermark can only move forward over contiguous deliveries
+	if settings.SelectionStrategy == WatermarkSelection {
+		orderingMode = Ordered
+	}
+	clock := clockOrDefault(settings.Clock)
 	return &defaultRecordProcessor{
-		messageBroker: messageBroker,
-		store:         store,
-		time:          time.NewTimeProvider(),
-		machineID:     machineID,
-		retrialPolicy: retrialPolicy,
+		messageBroker:         messageBroker,
+		store:                 store,
+		time:                  clock,
+		machineID:             machineID,
+		retrialPolicy:         retrialPolicy(settings),
+		orderingMode:          orderingMode,
+		intraBatchConcurrency: settings.IntraBatchConcurrency,
+		publishTimeout:        settings.PublishTimeout,
+		ackTimeout:            settings.AckTimeout,
+		metadataHeaders:       settings.MetadataHeaders,
+		lockHeartbeatInterval: settings.LockHeartbeatInterval,
+		metrics:               settings.Metrics,
+		selector:              newRecordSelector(store, machineID, settings, clock, paused),
+		pausedTopics:          paused,
+		shutdown:              stop,
+		shutdownAckTimeout:    settings.ShutdownAckTimeout,
+		onDeadLetter:          settings.OnDeadLetter,
+		deliveryWaiters:       settings.DeliveryWaiters,
+		auditAttempts:         settings.AuditAttempts,
+		recordLess:            recordLess(settings),
+		logCyclesSummary:      settings.LogCyclesSummary,
+		cyclesSummaryLevel:    settings.CyclesSummaryLevel,
+		logger:                settings.Logger,
+		twoPhaseBroker:        twoPhaseBroker(messageBroker, settings),
 	}
 }
 
-// ProcessRecords locks unprocessed messages, tries to deliver them and then unlocks them
-func (d defaultRecordProcessor) ProcessRecords() error {
-	err := d.lockUnprocessedEntities()
-	defer d.store.ClearLocksByLockID(d.machineID)
-	if err != nil {
-		return err
+// twoPhaseBroker returns the broker as a TransactionalMessageBroker if the TwoPhasePublish setting is enabled and the
+// records are locked, so that their publish handles can be stored
+func twoPhaseBroker(broker MessageBroker, settings DispatcherSettings) TransactionalMessageBroker {
+	txBroker, ok := broker.(TransactionalMessageBroker)
+	if !ok || !settings.TwoPhasePublish || settings.SelectionStrategy != StateBasedSelection {
+		return nil
+	}
+	return txBroker
+}
+
+// retrialPolicy returns the RetrialPolicy, with the attempts capped by default for the watermark selection, whose
+// failed record holds back all the records after it
+func retrialPolicy(settings DispatcherSettings) RetrialPolicy {
+	policy := settings.RetrialPolicy
+	if settings.SelectionStrategy == WatermarkSelection && !policy.MaxSendAttemptsEnabled {
+		policy.MaxSendAttemptsEnabled = true
+		policy.MaxSendAttempts = defaultWatermarkMaxSendAttempts
+	}
+	return policy
+}
+
+// recordLess returns the RecordLess comparator unless the watermark selection requires the records in creation order
+func recordLess(settings DispatcherSettings) func(a, b Record) bool {
+	if settings.SelectionStrategy == WatermarkSelection {
+		return nil
+	}
+	return settings.RecordLess
+}
+
+// sortRecords orders the records with the RecordLess comparator, if it is set. In the KeyOrdered mode the records of a
+// key keep the order of the store: they take the positions of the key in the sorted batch in their original order
+func (d defaultRecordProcessor) sortRecords(records []Record) {
+	if d.recordLess == nil {
+		return
+	}
+	var byKey map[string][]Record
+	if d.orderingMode == KeyOrdered {
+		byKey = map[string][]Record{}
+		for _, rec := range records {
+			if key := orderingKey(rec); key != "" {
+				byKey[key] = append(byKey[key], rec)
+			}
+		}
+	}
+	sort.SliceStable(records, func(i, j int) bool { return d.recordLess(records[i], records[j]) })
+	if byKey == nil {
+		return
+	}
+	for i, rec := range records {
+		key := orderingKey(rec)
+		if key == "" {
+			continue
+		}
+		records[i] = byKey[key][0]
+		byKey[key] = byKey[key][1:]
+	}
+}
+
+// ProcessRecords selects the records to be dispatched, tries to deliver them and then releases them. The cycle is
+// summarized in a log line with the LogCyclesSummary setting
+func (d defaultRecordProcessor) ProcessRecords() (err error) {
+	if d.pausedTopics.isAllPaused() || d.shutdown.isStopping() {
+		return nil
 	}
-	records, err := d.store.GetRecordsByLockID(d.machineID)
+	if d.logCyclesSummary {
+		d.cycle = &cycleSummary{startedAt: d.time.Now()}
+		defer func() { d.cycle.log(d.logger, d.cyclesSummaryLevel, d.time.Now(), err) }()
+	}
+	return d.processRecords()
+}
+
+func (d defaultRecordProcessor) processRecords() error {
+	records, err := d.selector.selectRecords()
+	defer d.selector.release()
 	if err != nil {
 		return err
 	}
+	records = d.selector.withoutPaused(records, d.pausedTopics.isPaused)
+	d.sortRecords(records)
+	d.metricsRecorder().Gauge(MetricBatchSize, float64(len(records)), nil)
+	if d.cycle != nil {
+		d.cycle.locked = len(records)
+	}
 	if len(records) == 0 {
 		return nil
 	}
 
+	stopHeartbeat := d.startHeartbeat()
+	defer stopHeartbeat()
 	return d.publishMessages(records)
 }
 
+// startHeartbeat extends the locks of the selected records every lockHeartbeatInterval until the returned
+// function is called
+func (d defaultRecordProcessor) startHeartbeat() func() {
+	if d.lockHeartbeatInterval <= 0 {
+		return func() {}
+	}
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time2.NewTicker(d.lockHeartbeatInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				err := d.selector.heartbeat()
+				if err != nil {
+					loggerOrDefault(d.logger).Warn("Could not extend the record locks", slog.String("error", err.Error()))
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
 func (d defaultRecordProcessor) publishMessages(records []Record) error {
+	if d.orderingMode == Unordered {
+		if asyncBroker, ok := d.messageBroker.(AsyncMessageBroker); ok && d.twoPhaseBroker == nil {
+			return d.publishMessagesAsync(asyncBroker, records)
+		}
+		return d.publishMessagesUnordered(records)
+	}
+	if d.orderingMode == KeyOrdered {
+		return d.publishMessagesByKey(records)
+	}
 	for _, rec := range records {
-		// Send message to message broker
-		now := d.time.Now().UTC()
-		rec.LastAttemptOn = &now
-		rec.NumberOfAttempts++
-		err := d.messageBroker.Send(rec.Message)
-		// If an error occurs, remove the lock information, update retrial times and continue
+		err := d.storeResult(d.send(rec))
 		if err != nil {
-			rec.LockedOn = nil
-			rec.LockID = nil
-			errorMsg := err.Error()
-			rec.Error = &errorMsg
-			if d.retrialPolicy.MaxSendAttemptsEnabled && rec.NumberOfAttempts == d.retrialPolicy.MaxSendAttempts {
-				rec.State = MaxAttemptsReached
-			}
-			dbErr := d.store.UpdateRecordByID(rec)
-			if dbErr != nil {
-				return fmt.Errorf("Could not update the record in the db: %w", dbErr)
+			return err
+		}
+	}
+	return nil
+}
+
+// publishMessagesUnordered publishes all the records with up to intraBatchConcurrency concurrent sends
+// and then stores the outcome of every attempt, returning the joined errors of the failed records
+func (d defaultRecordProcessor) publishMessagesUnordered(records []Record) error {
+	results := make([]publishResult, len(records))
+	workers := d.intraBatchConcurrency
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > len(records) {
+		workers = len(records)
+	}
+
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range indexes {
+				results[idx] = d.send(records[idx])
 			}
+		}()
+	}
+	for idx := range records {
+		indexes <- idx
+	}
+	close(indexes)
+	wg.Wait()
+
+	resultsChan := make(chan publishResult, len(results))
+	for _, res := range results {
+		resultsChan <- res
+	}
+	close(resultsChan)
+	return d.storeResults(resultsChan)
+}
+
+// publishMessagesByKey shards the records by topic and key across up to intraBatchConcurrency workers, each
+// publishing its records in order, and stores the outcome of every attempt as it is received. A failure stops the
+// later records of the same key, which stay pending and are published in creation order in a later cycle
+func (d defaultRecordProcessor) publishMessagesByKey(records []Record) error {
+	workers := d.intraBatchConcurrency
+	if workers < 1 {
+		workers = 1
+	}
+	shards := make([][]Record, workers)
+	for _, rec := range records {
+		shard := keyShard(rec, workers)
+		shards[shard] = append(shards[shard], rec)
+	}
 
-			return fmt.Errorf("An error occurred when trying to send the message to the broker: %w", err)
+	results := make(chan publishResult, len(records))
+	var wg sync.WaitGroup
+	for _, shard := range shards {
+		if len(shard) == 0 {
+			continue
 		}
+		wg.Add(1)
+		go func(shard []Record) {
+			defer wg.Done()
+			failedKeys := map[string]struct{}{}
+			for _, rec := range shard {
+				key := orderingKey(rec)
+				if _, failed := failedKeys[key]; failed && key != "" {
+					continue
+				}
+				res := d.send(rec)
+				if res.err != nil {
+					failedKeys[key] = struct{}{}
+				}
+				results <- res
+			}
+		}(shard)
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+	return d.storeResults(results)
+}
+
+// orderingKey returns the topic and key pair whose records are published in order, or an empty string for the
+// records without a key
+func orderingKey(rec Record) string {
+	if rec.Message.Key == "" {
+		return ""
+	}
+	return rec.Message.Topic + "\x00" + rec.Message.Key
+}
 
-		// Remove lock information and update state
-		rec.State = Delivered
-		rec.LockedOn = nil
-		rec.LockID = nil
-		rec.ProcessedOn = &now
-		err = d.store.UpdateRecordByID(rec)
+// keyShard returns the worker of the record among the shards workers. The records of the same ordering key always
+// share a worker, while the records without a key are spread by their id
+func keyShard(rec Record, shards int) int {
+	h := fnv.New32a()
+	key := orderingKey(rec)
+	if key == "" {
+		key = rec.ID.String()
+	}
+	_, _ = h.Write([]byte(key))
+	return int(h.Sum32() % uint32(shards))
+}
 
+// publishMessagesAsync sends all the records through the AsyncMessageBroker without waiting for the previous
+// acknowledgements, and stores the outcome of every record as its acknowledgement arrives. It returns once all the
+// records are acknowledged or timed out, so no acknowledgement is in flight once the batch is released. Once the
+// dispatcher is stopped the acknowledgements are only waited for up to the shutdownAckTimeout, and the records that
+// are still in flight are released without storing their attempt
+func (d defaultRecordProcessor) publishMessagesAsync(broker AsyncMessageBroker, records []Record) error {
+	results := make(chan publishResult, len(records))
+	var mu sync.Mutex
+	pending := len(records)
+	abandon := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		abandoned := pending
+		if pending > 0 {
+			pending = 0
+			close(results)
+		}
+		return abandoned
+	}
+	for _, rec := range records {
+		d.sendAsync(broker, rec, func(res publishResult) {
+			mu.Lock()
+			defer mu.Unlock()
+			if pending == 0 {
+				return
+			}
+			results <- res
+			pending--
+			if pending == 0 {
+				close(results)
+			}
+		})
+	}
+	if d.shutdownAckTimeout > 0 {
+		stored := make(chan struct{})
+		defer close(stored)
+		go func() {
+			select {
+			case <-d.shutdown.stoppingC():
+			case <-stored:
+				return
+			}
+			timer := time2.NewTimer(d.shutdownAckTimeout)
+			defer timer.Stop()
+			select {
+			case <-timer.C:
+				if abandoned := abandon(); abandoned > 0 {
+					loggerOrDefault(d.logger).Warn("Releasing the records without acknowledgement on shutdown",
+						slog.Int("records", abandoned))
+				}
+			case <-stored:
+			}
+		}()
+	}
+	return d.storeResults(results)
+}
+
+// storeResults stores the outcome of every publish attempt as it is received, returning the joined errors of the
+// failed records. The failures are stored at once to avoid a round trip per record when the whole batch fails
+func (d defaultRecordProcessor) storeResults(results <-chan publishResult) error {
+	var errs []error
+	var failures []RecordFailure
+	var failed []publishResult
+	var attempted []publishResult
+	for res := range results {
+		attempted = append(attempted, res)
+		if res.expired || res.err != nil {
+			failure := d.failure(res)
+			d.countDeadLettered(res.record, failure)
+			failures = append(failures, failure)
+			failed = append(failed, res)
+			if res.err != nil {
+				errs = append(errs, fmt.Errorf("An error occurred when trying to send the message to the broker: %w", res.err))
+			}
+			continue
+		}
+		err := d.deliver(res)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		d.observeDeliveryLatency(res.record, res.attemptedOn)
+		d.deliveryWaiters.notify(res.record.ID, nil)
+		d.cycle.delivered()
+	}
+	if len(failures) > 0 {
+		err := d.selector.markFailures(failures)
 		if err != nil {
-			return fmt.Errorf("Could not update the record in the db: %w", err)
+			errs = append(errs, fmt.Errorf("Could not update the records in the db: %w", err))
+		} else {
+			for i, failure := range failures {
+				d.cycle.stored(failed[i], failure)
+				d.notifyDeadLettered(failed[i].record, failure, failed[i].err)
+				d.deliveryWaiters.notifyFailed(failure.ID, failure, failed[i].err)
+			}
+		}
+	}
+	if err := d.audit(attempted...); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// send delivers the record message to the message broker unless the record has expired
+func (d defaultRecordProcessor) send(rec Record) publishResult {
+	now := d.time.Now().UTC()
+	deadline, expired := d.publishDeadline(rec, now)
+	if expired {
+		return publishResult{record: rec, attemptedOn: now, expired: true}
+	}
+	rec.NumberOfAttempts++
+	msg := d.metadataHeaders.withMetadataHeaders(rec)
+	var err error
+	if d.twoPhaseBroker != nil {
+		rec.PublishHandle, err = d.prepare(rec, msg, deadline)
+	} else {
+		err = d.sendMessage(msg, deadline)
+	}
+	return d.result(rec, now, err)
+}
+
+// sendAsync sends the record message through the AsyncMessageBroker unless the record has expired, and calls
+// complete once with the outcome of the attempt. The attempt fails with ErrAckTimeout if it is not acknowledged
+// within the ack timeout or before the publish deadline
+func (d defaultRecordProcessor) sendAsync(broker AsyncMessageBroker, rec Record, complete func(publishResult)) {
+	now := d.time.Now().UTC()
+	deadline, expired := d.publishDeadline(rec, now)
+	if expired {
+		complete(publishResult{record: rec, attemptedOn: now, expired: true})
+		return
+	}
+	rec.NumberOfAttempts++
+
+	ackTimeout := d.ackTimeout
+	if ackTimeout <= 0 {
+		ackTimeout = defaultAckTimeout
+	}
+	if !deadline.IsZero() && deadline.Sub(now) < ackTimeout {
+		ackTimeout = deadline.Sub(now)
+	}
+	var once sync.Once
+	timer := time2.AfterFunc(ackTimeout, func() {
+		once.Do(func() { complete(d.result(rec, now, ErrAckTimeout)) })
+	})
+	broker.SendAsync(d.metadataHeaders.withMetadataHeaders(rec), func(err error) {
+		timer.Stop()
+		once.Do(func() { complete(d.result(rec, now, err)) })
+	})
+}
+
+// result records the metrics of the publish attempt of the record started at attemptedOn and returns its result
+func (d defaultRecordProcessor) result(rec Record, attemptedOn time2.Time, err error) publishResult {
+	tags := map[string]string{TagTopic: rec.Message.Topic}
+	d.metricsRecorder().Observe(MetricPublishDuration, d.time.Now().Sub(attemptedOn).Seconds(), tags)
+	if err != nil {
+		d.metricsRecorder().Count(MetricPublishFailures, 1, tags)
+	} else {
+		d.metricsRecorder().Count(MetricPublished, 1, tags)
+	}
+	return publishResult{record: rec, attemptedOn: attemptedOn, err: err}
+}
+
+// metricsRecorder returns the configured MetricsRecorder or a NoopMetricsRecorder
+func (d defaultRecordProcessor) metricsRecorder() MetricsRecorder {
+	if d.metrics == nil {
+		return NoopMetricsRecorder{}
+	}
+	return d.metrics
+}
+
+// audit appends the audit entries of the publish attempts if AuditAttempts is enabled. The expired records are
+// skipped, since they were not published
+func (d defaultRecordProcessor) audit(results ...publishResult) error {
+	if !d.auditAttempts {
+		return nil
+	}
+	var attempts []Attempt
+	for _, res := range results {
+		if res.expired {
+			continue
+		}
+		attempt := Attempt{
+			RecordID:    res.record.ID,
+			Topic:       res.record.Message.Topic,
+			Number:      res.record.NumberOfAttempts,
+			AttemptedOn: res.attemptedOn,
 		}
+		if res.err != nil {
+			msg := res.err.Error()
+			attempt.Error = &msg
+		}
+		attempts = append(attempts, attempt)
+	}
+	if len(attempts) == 0 {
+		return nil
+	}
+	err := d.store.AddAttempts(attempts)
+	if err != nil {
+		return fmt.Errorf("Could not store the publish attempts in the db: %w", err)
 	}
 	return nil
 }
 
-// lockUnprocessedEntities updates the messages with the current machine's lockID
-func (d defaultRecordProcessor) lockUnprocessedEntities() error {
-	lockTime := d.time.Now().UTC()
-	lockErr := d.store.UpdateRecordLockByState(d.machineID, lockTime, PendingDelivery)
-	if lockErr != nil {
-		return lockErr
+// notifyDeadLettered calls the OnDeadLetter callback with the record if the stored failure moved it to the
+// MaxAttemptsReached state. The record is updated with the stored failure
+func (d defaultRecordProcessor) notifyDeadLettered(rec Record, failure RecordFailure, reason error) {
+	if d.onDeadLetter == nil || failure.State != MaxAttemptsReached {
+		return
+	}
+	rec.State = failure.State
+	rec.NumberOfAttempts = failure.NumberOfAttempts
+	rec.LastAttemptOn = &failure.LastAttemptOn
+	rec.Error = &failure.Error
+	d.onDeadLetter(rec, reason)
+}
+
+// observeDeliveryLatency records the time from the creation of the delivered record to its processed time
+func (d defaultRecordProcessor) observeDeliveryLatency(rec Record, processedOn time2.Time) {
+	d.metricsRecorder().Observe(MetricDeliveryLatency, processedOn.Sub(rec.CreatedOn).Seconds(),
+		map[string]string{TagTopic: rec.Message.Topic})
+}
+
+// countDeadLettered counts the failure if it moves the record to the MaxAttemptsReached state
+func (d defaultRecordProcessor) countDeadLettered(rec Record, failure RecordFailure) {
+	if failure.State == MaxAttemptsReached {
+		d.metricsRecorder().Count(MetricDeadLettered, 1, map[string]string{TagTopic: rec.Message.Topic})
+	}
+}
+
+// publishDeadline returns the deadline of a publish attempt starting at now, which is the earliest of the
+// publish timeout and the record expiration, and whether the record has already expired
+func (d defaultRecordProcessor) publishDeadline(rec Record, now time2.Time) (time2.Time, bool) {
+	var deadline time2.Time
+	if d.publishTimeout > 0 {
+		deadline = now.Add(d.publishTimeout)
+	}
+	if rec.ExpiresAt == nil {
+		return deadline, false
+	}
+	if !rec.ExpiresAt.After(now) {
+		return time2.Time{}, true
+	}
+	if deadline.IsZero() || rec.ExpiresAt.Before(deadline) {
+		deadline = *rec.ExpiresAt
+	}
+	return deadline, false
+}
+
+// sendMessage sends the message, bounded by the deadline if the broker supports it
+func (d defaultRecordProcessor) sendMessage(msg Message, deadline time2.Time) error {
+	ctxBroker, ok := d.messageBroker.(ContextMessageBroker)
+	if !ok {
+		return d.messageBroker.Send(msg)
+	}
+	ctx := context.Background()
+	if !deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+	return ctxBroker.SendContext(ctx, msg)
+}
+
+// failure returns the failure to be stored for an expired or unsuccessful publish attempt
+func (d defaultRecordProcessor) failure(res publishResult) RecordFailure {
+	rec := res.record
+	failure := RecordFailure{
+		ID:               rec.ID,
+		State:            rec.State,
+		NumberOfAttempts: rec.NumberOfAttempts,
+		LastAttemptOn:    res.attemptedOn,
+	}
+	if res.expired {
+		failure.State = Expired
+		failure.Error = ErrRecordExpired.Error()
+		return failure
+	}
+	var permanentErr *PermanentError
+	if errors.As(res.err, &permanentErr) ||
+		d.retrialPolicy.MaxSendAttemptsEnabled && rec.NumberOfAttempts == d.retrialPolicy.MaxSendAttempts {
+		failure.State = MaxAttemptsReached
+	}
+	failure.Error = res.err.Error()
+	if failure.State == PendingDelivery && d.retrialPolicy.Backoff != nil {
+		nextRetryAt := res.attemptedOn.Add(d.retrialPolicy.Backoff.NextRetryDelay(rec.NumberOfAttempts))
+		failure.NextRetryAt = &nextRetryAt
+	}
+	return failure
+}
+
+// deliver marks the record as delivered and commits its prepared publish, if any. The prepared publish is aborted if
+// the record could not be marked as delivered, since it is published again
+func (d defaultRecordProcessor) deliver(res publishResult) error {
+	err := d.selector.markDelivered(res.record, res.attemptedOn)
+	if err != nil {
+		d.abortPrepared(res.record)
+		return fmt.Errorf("Could not update the record in the db: %w", err)
+	}
+	return d.commitPrepared(res.record)
+}
+
+// storeResult updates the record in the store according to the outcome of its publish attempt, and audits the attempt
+func (d defaultRecordProcessor) storeResult(res publishResult) error {
+	err := d.storeOutcome(res)
+	auditErr := d.audit(res)
+	if auditErr == nil {
+		return err
+	}
+	return errors.Join(err, auditErr)
+}
+
+// storeOutcome updates the record in the store according to the outcome of its publish attempt
+func (d defaultRecordProcessor) storeOutcome(res publishResult) error {
+	rec := res.record
+	// If an error occurs, remove the lock information, update retrial times and continue
+	if res.expired || res.err != nil {
+		failure := d.failure(res)
+		d.countDeadLettered(rec, failure)
+		dbErr := d.selector.markFailed(rec, failure)
+		if dbErr != nil {
+			return fmt.Errorf("Could not update the record in the db: %w", dbErr)
+		}
+		d.cycle.stored(res, failure)
+		d.notifyDeadLettered(rec, failure, res.err)
+		d.deliveryWaiters.notifyFailed(rec.ID, failure, res.err)
+		// Expired records are never published, so they do not count as failures
+		if res.expired {
+			return nil
+		}
+		return fmt.Errorf("An error occurred when trying to send the message to the broker: %w", res.err)
+	}
+
+	// Remove lock information and update state
+	err := d.deliver(res)
+	if err != nil {
+		return err
 	}
+	d.observeDeliveryLatency(rec, res.attemptedOn)
+	d.deliveryWaiters.notify(rec.ID, nil)
+	d.cycle.delivered()
 	return nil
 }
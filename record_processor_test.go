@@ -1,14 +1,19 @@
 package outbox
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"slices"
+	"strconv"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/google/uuid"
 	time2 "github.com/pkritiotis/outbox/internal/time"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
 )
 
 func TestDefaultRecordProcessor_newProcessor(t *testing.T) {
@@ -16,12 +21,51 @@ func TestDefaultRecordProcessor_newProcessor(t *testing.T) {
 		MaxSendAttemptsEnabled: false,
 		MaxSendAttempts:        0,
 	}
-	p := newProcessor(&MockStore{}, &MockBroker{}, "1", retrialPolicy)
+	settings := DispatcherSettings{
+		RetrialPolicy:         retrialPolicy,
+		OrderingMode:          Unordered,
+		IntraBatchConcurrency: 4,
+		PublishTimeout:        time.Second,
+		MetadataHeaders:       DefaultMetadataHeaders,
+		LockHeartbeatInterval: time.Second,
+		ShutdownAckTimeout:    time.Second,
+	}
+	paused := newPausedTopics()
+	stop := &shutdown{}
+	p := newProcessor(&MockStore{}, &MockBroker{}, "1", settings, paused, stop)
 	assert.NotNil(t, p)
 	assert.Equal(t, &MockStore{}, p.store)
 	assert.Equal(t, &MockBroker{}, p.messageBroker)
 	assert.Equal(t, "1", p.machineID)
 	assert.Equal(t, retrialPolicy, p.retrialPolicy)
+	assert.Equal(t, Unordered, p.orderingMode)
+	assert.Equal(t, 4, p.intraBatchConcurrency)
+	assert.Equal(t, time.Second, p.publishTimeout)
+	assert.Equal(t, DefaultMetadataHeaders, p.metadataHeaders)
+	assert.Equal(t, time.Second, p.lockHeartbeatInterval)
+	selector := newStateSelector(&MockStore{}, "1", time2.NewTimeProvider(), 0)
+	selector.paused = paused
+	assert.Equal(t, selector, p.selector)
+	assert.Same(t, paused, p.pausedTopics)
+	assert.Same(t, stop, p.shutdown)
+	assert.Equal(t, time.Second, p.shutdownAckTimeout)
+}
+
+func TestDefaultRecordProcessor_newProcessor_watermark(t *testing.T) {
+	start := time.Now().UTC()
+	settings := DispatcherSettings{
+		OrderingMode:          Unordered,
+		IntraBatchConcurrency: 4,
+		SelectionStrategy:     WatermarkSelection,
+		WatermarkStart:        start,
+	}
+	p := newProcessor(&MockStore{}, &MockBroker{}, "1", settings, nil, nil)
+	assert.Equal(t, Ordered, p.orderingMode)
+	assert.Equal(t, RetrialPolicy{MaxSendAttemptsEnabled: true, MaxSendAttempts: defaultWatermarkMaxSendAttempts}, p.retrialPolicy)
+	selector := newWatermarkSelector(&MockStore{}, start, 0)
+	selector.clock = time2.NewTimeProvider()
+	selector.lag = defaultWatermarkLag
+	assert.Equal(t, selector, p.selector)
 }
 
 func Test_defaultRecordProcessor_ProcessRecords(t *testing.T) {
@@ -37,6 +81,9 @@ func Test_defaultRecordProcessor_ProcessRecords(t *testing.T) {
 		Body:  []byte("testvalue"),
 		Topic: "testTopic",
 	}
+	sampleID := uuid.New()
+	// The dispatcher adds the record id to every published message
+	sentMessage := MetadataHeaders{}.withMetadataHeaders(Record{ID: sampleID, Message: sampleMessage})
 	machineID := "1"
 	tests := map[string]struct {
 		messageBroker MessageBroker
@@ -48,15 +95,15 @@ func Test_defaultRecordProcessor_ProcessRecords(t *testing.T) {
 		"Eligible records should be processed correctly": {
 			messageBroker: func() *MockBroker {
 				mp := MockBroker{}
-				mp.On("Send", sampleMessage).Return(nil)
+				mp.On("Send", sentMessage).Return(nil)
 				return &mp
 			}(),
 			store: func() *MockStore {
 				mp := MockStore{}
-				mp.On("UpdateRecordLockByState", machineID, sampleTime, PendingDelivery).Return(nil)
+				mp.On("UpdateRecordsLockByStates", machineID, sampleTime, []RecordState{PendingDelivery}, 0).Return(nil)
 				recordsToReturn := []Record{
 					{
-						ID:               uuid.New(),
+						ID:               sampleID,
 						Message:          sampleMessage,
 						State:            PendingDelivery,
 						CreatedOn:        time.Now(),
@@ -69,13 +116,7 @@ func Test_defaultRecordProcessor_ProcessRecords(t *testing.T) {
 					},
 				}
 				mp.On("GetRecordsByLockID", machineID).Return(recordsToReturn, nil)
-				recordToStore := recordsToReturn[0]
-				recordToStore.State = Delivered
-				recordToStore.LastAttemptOn = &sampleTime
-				recordToStore.LockID = nil
-				recordToStore.NumberOfAttempts++
-				recordToStore.ProcessedOn = &sampleTime
-				mp.On("UpdateRecordByID", recordToStore).Return(nil)
+				mp.On("MarkProcessed", recordsToReturn[0].ID, 1, sampleTime, machineID).Return(nil)
 				mp.On("ClearLocksByLockID", machineID).Return(nil)
 				return &mp
 			}(),
@@ -86,11 +127,47 @@ func Test_defaultRecordProcessor_ProcessRecords(t *testing.T) {
 			},
 			expErr: nil,
 		},
+		"Permanent broker error should move the record to MaxAttemptsReached on the first attempt": {
+			messageBroker: func() *MockBroker {
+				mp := MockBroker{}
+				mp.On("Send", sentMessage).Return(&PermanentError{Err: ErrMessageTooLargeForBroker})
+				return &mp
+			}(),
+			store: func() *MockStore {
+				mp := MockStore{}
+				mp.On("UpdateRecordsLockByStates", machineID, sampleTime, []RecordState{PendingDelivery}, 0).Return(nil)
+				recordsToReturn := []Record{
+					{
+						ID:        sampleID,
+						Message:   sampleMessage,
+						State:     PendingDelivery,
+						CreatedOn: time.Now(),
+						LockID:    &machineID,
+					},
+				}
+				mp.On("GetRecordsByLockID", machineID).Return(recordsToReturn, nil)
+				mp.On("RecordFailure", RecordFailure{
+					ID:               recordsToReturn[0].ID,
+					State:            MaxAttemptsReached,
+					Error:            ErrMessageTooLargeForBroker.Error(),
+					NumberOfAttempts: 1,
+					LastAttemptOn:    sampleTime,
+				}, machineID).Return(nil)
+				mp.On("ClearLocksByLockID", machineID).Return(nil)
+				return &mp
+			}(),
+			machineID: machineID,
+			retrialPolicy: RetrialPolicy{
+				MaxSendAttemptsEnabled: true,
+				MaxSendAttempts:        3,
+			},
+			expErr: fmt.Errorf("An error occurred when trying to send the message to the broker: %w", &PermanentError{Err: ErrMessageTooLargeForBroker}),
+		},
 		"No eligible records should not return an error": {
 			messageBroker: &MockBroker{},
 			store: func() *MockStore {
 				mp := MockStore{}
-				mp.On("UpdateRecordLockByState", machineID, sampleTime, PendingDelivery).Return(nil)
+				mp.On("UpdateRecordsLockByStates", machineID, sampleTime, []RecordState{PendingDelivery}, 0).Return(nil)
 				recordsToReturn := []Record{}
 				mp.On("GetRecordsByLockID", machineID).Return(recordsToReturn, nil)
 				mp.On("ClearLocksByLockID", machineID).Return(nil)
@@ -107,7 +184,7 @@ func Test_defaultRecordProcessor_ProcessRecords(t *testing.T) {
 			messageBroker: &MockBroker{},
 			store: func() *MockStore {
 				mp := MockStore{}
-				mp.On("UpdateRecordLockByState", machineID, sampleTime, PendingDelivery).
+				mp.On("UpdateRecordsLockByStates", machineID, sampleTime, []RecordState{PendingDelivery}, 0).
 					Return(errors.New("lock error"))
 				mp.On("ClearLocksByLockID", machineID).Return(nil)
 
@@ -124,10 +201,10 @@ func Test_defaultRecordProcessor_ProcessRecords(t *testing.T) {
 			messageBroker: &MockBroker{},
 			store: func() *MockStore {
 				mp := MockStore{}
-				mp.On("UpdateRecordLockByState", machineID, sampleTime, PendingDelivery).Return(nil)
+				mp.On("UpdateRecordsLockByStates", machineID, sampleTime, []RecordState{PendingDelivery}, 0).Return(nil)
 				recordsToReturn := []Record{
 					{
-						ID:               uuid.New(),
+						ID:               sampleID,
 						Message:          sampleMessage,
 						State:            PendingDelivery,
 						CreatedOn:        time.Now(),
@@ -155,15 +232,15 @@ func Test_defaultRecordProcessor_ProcessRecords(t *testing.T) {
 		"Error in Update should return an error": {
 			messageBroker: func() *MockBroker {
 				mp := MockBroker{}
-				mp.On("Send", sampleMessage).Return(nil)
+				mp.On("Send", sentMessage).Return(nil)
 				return &mp
 			}(),
 			store: func() *MockStore {
 				mp := MockStore{}
-				mp.On("UpdateRecordLockByState", machineID, sampleTime, PendingDelivery).Return(nil)
+				mp.On("UpdateRecordsLockByStates", machineID, sampleTime, []RecordState{PendingDelivery}, 0).Return(nil)
 				recordsToReturn := []Record{
 					{
-						ID:               uuid.New(),
+						ID:               sampleID,
 						Message:          sampleMessage,
 						State:            PendingDelivery,
 						CreatedOn:        time.Now(),
@@ -176,13 +253,7 @@ func Test_defaultRecordProcessor_ProcessRecords(t *testing.T) {
 					},
 				}
 				mp.On("GetRecordsByLockID", machineID).Return(recordsToReturn, nil)
-				recordToStore := recordsToReturn[0]
-				recordToStore.State = Delivered
-				recordToStore.LastAttemptOn = &sampleTime
-				recordToStore.LockID = nil
-				recordToStore.NumberOfAttempts++
-				recordToStore.ProcessedOn = &sampleTime
-				mp.On("UpdateRecordByID", recordToStore).
+				mp.On("MarkProcessed", recordsToReturn[0].ID, 1, sampleTime, machineID).
 					Return(errors.New("update error"))
 				mp.On("ClearLocksByLockID", machineID).Return(nil)
 
@@ -195,18 +266,55 @@ func Test_defaultRecordProcessor_ProcessRecords(t *testing.T) {
 			},
 			expErr: fmt.Errorf("Could not update the record in the db: %w", errors.New("update error")),
 		},
+		"Lost lock when marking the record as processed should return an error": {
+			messageBroker: func() *MockBroker {
+				mp := MockBroker{}
+				mp.On("Send", sentMessage).Return(nil)
+				return &mp
+			}(),
+			store: func() *MockStore {
+				mp := MockStore{}
+				mp.On("UpdateRecordsLockByStates", machineID, sampleTime, []RecordState{PendingDelivery}, 0).Return(nil)
+				recordsToReturn := []Record{
+					{
+						ID:               sampleID,
+						Message:          sampleMessage,
+						State:            PendingDelivery,
+						CreatedOn:        time.Now(),
+						LockID:           &machineID,
+						LockedOn:         nil,
+						ProcessedOn:      nil,
+						NumberOfAttempts: 0,
+						LastAttemptOn:    nil,
+						Error:            nil,
+					},
+				}
+				mp.On("GetRecordsByLockID", machineID).Return(recordsToReturn, nil)
+				mp.On("MarkProcessed", recordsToReturn[0].ID, 1, sampleTime, machineID).
+					Return(ErrRecordLockLost)
+				mp.On("ClearLocksByLockID", machineID).Return(nil)
+
+				return &mp
+			}(),
+			machineID: machineID,
+			retrialPolicy: RetrialPolicy{
+				MaxSendAttemptsEnabled: true,
+				MaxSendAttempts:        3,
+			},
+			expErr: fmt.Errorf("Could not update the record in the db: %w", ErrRecordLockLost),
+		},
 		"Error in Clear locks should not return an error": {
 			messageBroker: func() *MockBroker {
 				mp := MockBroker{}
-				mp.On("Send", sampleMessage).Return(nil)
+				mp.On("Send", sentMessage).Return(nil)
 				return &mp
 			}(),
 			store: func() *MockStore {
 				mp := MockStore{}
-				mp.On("UpdateRecordLockByState", machineID, sampleTime, PendingDelivery).Return(nil)
+				mp.On("UpdateRecordsLockByStates", machineID, sampleTime, []RecordState{PendingDelivery}, 0).Return(nil)
 				recordsToReturn := []Record{
 					{
-						ID:               uuid.New(),
+						ID:               sampleID,
 						Message:          sampleMessage,
 						State:            PendingDelivery,
 						CreatedOn:        time.Now(),
@@ -219,13 +327,7 @@ func Test_defaultRecordProcessor_ProcessRecords(t *testing.T) {
 					},
 				}
 				mp.On("GetRecordsByLockID", machineID).Return(recordsToReturn, nil)
-				recordToStore := recordsToReturn[0]
-				recordToStore.State = Delivered
-				recordToStore.LastAttemptOn = &sampleTime
-				recordToStore.LockID = nil
-				recordToStore.NumberOfAttempts++
-				recordToStore.ProcessedOn = &sampleTime
-				mp.On("UpdateRecordByID", recordToStore).Return(nil)
+				mp.On("MarkProcessed", recordsToReturn[0].ID, 1, sampleTime, machineID).Return(nil)
 				mp.On("ClearLocksByLockID", machineID).
 					Return(errors.New("clear locks error"))
 				return &mp
@@ -240,15 +342,15 @@ func Test_defaultRecordProcessor_ProcessRecords(t *testing.T) {
 		"Error in broker with retrial disabled send should not change the state and return an error": {
 			messageBroker: func() *MockBroker {
 				mp := MockBroker{}
-				mp.On("Send", sampleMessage).Return(errors.New("message broker error"))
+				mp.On("Send", sentMessage).Return(errors.New("message broker error"))
 				return &mp
 			}(),
 			store: func() *MockStore {
 				mp := MockStore{}
-				mp.On("UpdateRecordLockByState", machineID, sampleTime, PendingDelivery).Return(nil)
+				mp.On("UpdateRecordsLockByStates", machineID, sampleTime, []RecordState{PendingDelivery}, 0).Return(nil)
 				recordsToReturn := []Record{
 					{
-						ID:               uuid.New(),
+						ID:               sampleID,
 						Message:          sampleMessage,
 						State:            PendingDelivery,
 						CreatedOn:        time.Now(),
@@ -263,12 +365,15 @@ func Test_defaultRecordProcessor_ProcessRecords(t *testing.T) {
 				mp.On("GetRecordsByLockID", machineID).Return(recordsToReturn, nil)
 				recordToStore := recordsToReturn[0]
 				recordToStore.State = PendingDelivery
-				recordToStore.LastAttemptOn = &sampleTime
-				recordToStore.LockID = nil
 				recordToStore.NumberOfAttempts++
 				errMsg := "message broker error"
-				recordToStore.Error = &errMsg
-				mp.On("UpdateRecordByID", recordToStore).Return(nil)
+				mp.On("RecordFailure", RecordFailure{
+					ID:               recordToStore.ID,
+					State:            recordToStore.State,
+					Error:            errMsg,
+					NumberOfAttempts: recordToStore.NumberOfAttempts,
+					LastAttemptOn:    sampleTime,
+				}, machineID).Return(nil)
 				mp.On("ClearLocksByLockID", machineID).Return(nil)
 				return &mp
 			}(),
@@ -282,15 +387,15 @@ func Test_defaultRecordProcessor_ProcessRecords(t *testing.T) {
 		"Error in broker and subsequent error in update should return an error": {
 			messageBroker: func() *MockBroker {
 				mp := MockBroker{}
-				mp.On("Send", sampleMessage).Return(errors.New("message broker error"))
+				mp.On("Send", sentMessage).Return(errors.New("message broker error"))
 				return &mp
 			}(),
 			store: func() *MockStore {
 				mp := MockStore{}
-				mp.On("UpdateRecordLockByState", machineID, sampleTime, PendingDelivery).Return(nil)
+				mp.On("UpdateRecordsLockByStates", machineID, sampleTime, []RecordState{PendingDelivery}, 0).Return(nil)
 				recordsToReturn := []Record{
 					{
-						ID:               uuid.New(),
+						ID:               sampleID,
 						Message:          sampleMessage,
 						State:            PendingDelivery,
 						CreatedOn:        time.Now(),
@@ -305,12 +410,15 @@ func Test_defaultRecordProcessor_ProcessRecords(t *testing.T) {
 				mp.On("GetRecordsByLockID", machineID).Return(recordsToReturn, nil)
 				recordToStore := recordsToReturn[0]
 				recordToStore.State = PendingDelivery
-				recordToStore.LastAttemptOn = &sampleTime
-				recordToStore.LockID = nil
 				recordToStore.NumberOfAttempts++
 				errMsg := "message broker error"
-				recordToStore.Error = &errMsg
-				mp.On("UpdateRecordByID", recordToStore).Return(errors.New("db error"))
+				mp.On("RecordFailure", RecordFailure{
+					ID:               recordToStore.ID,
+					State:            recordToStore.State,
+					Error:            errMsg,
+					NumberOfAttempts: recordToStore.NumberOfAttempts,
+					LastAttemptOn:    sampleTime,
+				}, machineID).Return(errors.New("db error"))
 				mp.On("ClearLocksByLockID", machineID).Return(nil)
 				return &mp
 			}(),
@@ -324,15 +432,15 @@ func Test_defaultRecordProcessor_ProcessRecords(t *testing.T) {
 		"Error in broker with retrial enabled send should change the state and return an error": {
 			messageBroker: func() *MockBroker {
 				mp := MockBroker{}
-				mp.On("Send", sampleMessage).Return(errors.New("message broker error"))
+				mp.On("Send", sentMessage).Return(errors.New("message broker error"))
 				return &mp
 			}(),
 			store: func() *MockStore {
 				mp := MockStore{}
-				mp.On("UpdateRecordLockByState", machineID, sampleTime, PendingDelivery).Return(nil)
+				mp.On("UpdateRecordsLockByStates", machineID, sampleTime, []RecordState{PendingDelivery}, 0).Return(nil)
 				recordsToReturn := []Record{
 					{
-						ID:               uuid.New(),
+						ID:               sampleID,
 						Message:          sampleMessage,
 						State:            PendingDelivery,
 						CreatedOn:        time.Now(),
@@ -347,12 +455,15 @@ func Test_defaultRecordProcessor_ProcessRecords(t *testing.T) {
 				mp.On("GetRecordsByLockID", machineID).Return(recordsToReturn, nil)
 				recordToStore := recordsToReturn[0]
 				recordToStore.State = MaxAttemptsReached
-				recordToStore.LastAttemptOn = &sampleTime
-				recordToStore.LockID = nil
 				recordToStore.NumberOfAttempts++
 				errMsg := "message broker error"
-				recordToStore.Error = &errMsg
-				mp.On("UpdateRecordByID", recordToStore).Return(nil)
+				mp.On("RecordFailure", RecordFailure{
+					ID:               recordToStore.ID,
+					State:            recordToStore.State,
+					Error:            errMsg,
+					NumberOfAttempts: recordToStore.NumberOfAttempts,
+					LastAttemptOn:    sampleTime,
+				}, machineID).Return(nil)
 				mp.On("ClearLocksByLockID", machineID).Return(nil)
 				return &mp
 			}(),
@@ -373,9 +484,815 @@ func Test_defaultRecordProcessor_ProcessRecords(t *testing.T) {
 				store:         tt.store,
 				machineID:     tt.machineID,
 				retrialPolicy: tt.retrialPolicy,
+				selector:      stateSelector{store: tt.store, time: timeProvider, lockID: tt.machineID},
+			}
+			err := d.ProcessRecords()
+			assert.Equal(t, tt.expErr, err)
+		})
+	}
+}
+
+// concurrencyBroker tracks the maximum number of concurrent Send calls
+type concurrencyBroker struct {
+	mu          sync.Mutex
+	inFlight    int
+	maxInFlight int
+	failKey     string
+	// failBody restricts the failures of the failKey messages to the messages with the body, if set
+	failBody string
+}
+
+func (b *concurrencyBroker) Send(message Message) error {
+	b.mu.Lock()
+	b.inFlight++
+	if b.inFlight > b.maxInFlight {
+		b.maxInFlight = b.inFlight
+	}
+	b.mu.Unlock()
+
+	time.Sleep(10 * time.Millisecond)
+
+	b.mu.Lock()
+	b.inFlight--
+	b.mu.Unlock()
+	if message.Key == b.failKey && (b.failBody == "" || string(message.Body) == b.failBody) {
+		return errors.New("message broker error")
+	}
+	return nil
+}
+
+func Test_defaultRecordProcessor_ProcessRecords_unordered(t *testing.T) {
+	sampleTime := time.Now().UTC()
+	timeProvider := &time2.MockProvider{}
+	timeProvider.On("Now").Return(sampleTime)
+	machineID := "1"
+
+	var records []Record
+	for i := 0; i < 8; i++ {
+		records = append(records, Record{
+			ID:      uuid.New(),
+			Message: Message{Key: fmt.Sprintf("key-%d", i), Topic: "testTopic"},
+			State:   PendingDelivery,
+			LockID:  &machineID,
+		})
+	}
+
+	store := &MockStore{}
+	store.On("UpdateRecordsLockByStates", machineID, sampleTime, []RecordState{PendingDelivery}, 0).Return(nil)
+	store.On("GetRecordsByLockID", machineID).Return(records, nil)
+	store.On("ClearLocksByLockID", machineID).Return(nil)
+	for i, rec := range records {
+		if i == 3 {
+			continue
+		}
+		store.On("MarkProcessed", rec.ID, 1, sampleTime, machineID).Return(nil)
+	}
+	store.On("RecordFailures", []RecordFailure{{
+		ID:               records[3].ID,
+		State:            PendingDelivery,
+		Error:            "message broker error",
+		NumberOfAttempts: 1,
+		LastAttemptOn:    sampleTime,
+	}}, machineID).Return(nil)
+	broker := &concurrencyBroker{failKey: "key-3"}
+
+	d := defaultRecordProcessor{
+		messageBroker:         broker,
+		time:                  timeProvider,
+		store:                 store,
+		machineID:             machineID,
+		orderingMode:          Unordered,
+		intraBatchConcurrency: 3,
+		selector:              stateSelector{store: store, time: timeProvider, lockID: machineID},
+	}
+	err := d.ProcessRecords()
+
+	assert.Equal(t, errors.Join(
+		fmt.Errorf("An error occurred when trying to send the message to the broker: %w", errors.New("message broker error")),
+	), err)
+	assert.Equal(t, 3, broker.maxInFlight)
+	store.AssertNumberOfCalls(t, "MarkProcessed", 7)
+	store.AssertNumberOfCalls(t, "RecordFailures", 1)
+}
+
+// deadlineBroker records the deadline of every SendContext call
+type deadlineBroker struct {
+	MockBroker
+	deadlines []time.Time
+}
+
+func (b *deadlineBroker) SendContext(ctx context.Context, message Message) error {
+	deadline, _ := ctx.Deadline()
+	b.deadlines = append(b.deadlines, deadline)
+	return nil
+}
+
+func Test_defaultRecordProcessor_ProcessRecords_expiry(t *testing.T) {
+	sampleTime := time.Now().UTC()
+	timeProvider := &time2.MockProvider{}
+	timeProvider.On("Now").Return(sampleTime)
+	machineID := "1"
+	expired := sampleTime.Add(-time.Second)
+	expiresSoon := sampleTime.Add(time.Second)
+	expiresLate := sampleTime.Add(time.Hour)
+
+	records := []Record{
+		{ID: uuid.New(), Message: Message{Key: "expired"}, State: PendingDelivery, ExpiresAt: &expired},
+		{ID: uuid.New(), Message: Message{Key: "soon"}, State: PendingDelivery, ExpiresAt: &expiresSoon},
+		{ID: uuid.New(), Message: Message{Key: "late"}, State: PendingDelivery, ExpiresAt: &expiresLate},
+		{ID: uuid.New(), Message: Message{Key: "none"}, State: PendingDelivery},
+	}
+
+	store := &MockStore{}
+	store.On("UpdateRecordsLockByStates", machineID, sampleTime, []RecordState{PendingDelivery}, 0).Return(nil)
+	store.On("GetRecordsByLockID", machineID).Return(records, nil)
+	store.On("ClearLocksByLockID", machineID).Return(nil)
+	store.On("RecordFailure", RecordFailure{
+		ID:            records[0].ID,
+		State:         Expired,
+		Error:         ErrRecordExpired.Error(),
+		LastAttemptOn: sampleTime,
+	}, machineID).Return(nil)
+	for _, rec := range records[1:] {
+		store.On("MarkProcessed", rec.ID, 1, sampleTime, machineID).Return(nil)
+	}
+	broker := &deadlineBroker{}
+
+	d := defaultRecordProcessor{
+		messageBroker:  broker,
+		time:           timeProvider,
+		store:          store,
+		machineID:      machineID,
+		publishTimeout: time.Minute,
+		selector:       stateSelector{store: store, time: timeProvider, lockID: machineID},
+	}
+	err := d.ProcessRecords()
+
+	assert.Nil(t, err)
+	assert.Equal(t, []time.Time{expiresSoon, sampleTime.Add(time.Minute), sampleTime.Add(time.Minute)}, broker.deadlines)
+	broker.AssertNotCalled(t, "Send")
+	store.AssertExpectations(t)
+}
+
+func Test_defaultRecordProcessor_ProcessRecords_unorderedBatchFailure(t *testing.T) {
+	sampleTime := time.Now().UTC()
+	timeProvider := &time2.MockProvider{}
+	timeProvider.On("Now").Return(sampleTime)
+	machineID := "1"
+	expired := sampleTime.Add(-time.Second)
+	records := []Record{
+		{ID: uuid.New(), Message: Message{Key: "1"}, State: PendingDelivery, NumberOfAttempts: 2},
+		{ID: uuid.New(), Message: Message{Key: "2"}, State: PendingDelivery},
+		{ID: uuid.New(), Message: Message{Key: "3"}, State: PendingDelivery, ExpiresAt: &expired},
+	}
+	brokerErr := errors.New("broker is down")
+
+	store := &MockStore{}
+	store.On("UpdateRecordsLockByStates", machineID, sampleTime, []RecordState{PendingDelivery}, 0).Return(nil)
+	store.On("GetRecordsByLockID", machineID).Return(records, nil)
+	store.On("ClearLocksByLockID", machineID).Return(nil)
+	store.On("RecordFailures", []RecordFailure{
+		{ID: records[0].ID, State: MaxAttemptsReached, Error: brokerErr.Error(), NumberOfAttempts: 3, LastAttemptOn: sampleTime},
+		{ID: records[1].ID, State: PendingDelivery, Error: brokerErr.Error(), NumberOfAttempts: 1, LastAttemptOn: sampleTime},
+		{ID: records[2].ID, State: Expired, Error: ErrRecordExpired.Error(), NumberOfAttempts: 0, LastAttemptOn: sampleTime},
+	}, machineID).Return(errors.New("db error"))
+	broker := &MockBroker{}
+	broker.On("Send", MetadataHeaders{}.withMetadataHeaders(records[0])).Return(brokerErr)
+	broker.On("Send", MetadataHeaders{}.withMetadataHeaders(records[1])).Return(brokerErr)
+
+	d := defaultRecordProcessor{
+		messageBroker:         broker,
+		time:                  timeProvider,
+		store:                 store,
+		machineID:             machineID,
+		retrialPolicy:         RetrialPolicy{MaxSendAttemptsEnabled: true, MaxSendAttempts: 3},
+		orderingMode:          Unordered,
+		intraBatchConcurrency: 2,
+		selector:              stateSelector{store: store, time: timeProvider, lockID: machineID},
+	}
+	err := d.ProcessRecords()
+
+	assert.Equal(t, errors.Join(
+		fmt.Errorf("An error occurred when trying to send the message to the broker: %w", brokerErr),
+		fmt.Errorf("An error occurred when trying to send the message to the broker: %w", brokerErr),
+		fmt.Errorf("Could not update the records in the db: %w", errors.New("db error")),
+	), err)
+	store.AssertNumberOfCalls(t, "RecordFailures", 1)
+	store.AssertNotCalled(t, "RecordFailure")
+}
+
+// lockTableStore keeps the record locks in memory, following the lock semantics of the Store interface
+type lockTableStore struct {
+	MockStore
+	mu       sync.Mutex
+	records  map[uuid.UUID]Record
+	reaped   int
+	extended int
+}
+
+func (s *lockTableStore) UpdateRecordsLockByStates(lockID string, lockedOn time.Time, states []RecordState, _ int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, rec := range s.records {
+		if slices.Contains(states, rec.State) && rec.LockID == nil {
+			rec.LockID, rec.LockedOn = &lockID, &lockedOn
+			s.records[id] = rec
+		}
+	}
+	return nil
+}
+
+func (s *lockTableStore) GetRecordsByLockID(lockID string) ([]Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var recs []Record
+	for _, rec := range s.records {
+		if rec.LockID != nil && *rec.LockID == lockID {
+			recs = append(recs, rec)
+		}
+	}
+	return recs, nil
+}
+
+func (s *lockTableStore) MarkProcessed(id uuid.UUID, _ int, processedOn time.Time, lockID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rec := s.records[id]
+	if rec.LockID == nil || *rec.LockID != lockID {
+		return ErrRecordLockLost
+	}
+	rec.State, rec.ProcessedOn, rec.LockID, rec.LockedOn = Delivered, &processedOn, nil, nil
+	s.records[id] = rec
+	return nil
+}
+
+func (s *lockTableStore) ExtendLock(lockID string, lockedOn time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, rec := range s.records {
+		if rec.LockID != nil && *rec.LockID == lockID {
+			rec.LockedOn = &lockedOn
+			s.records[id] = rec
+			s.extended++
+		}
+	}
+	return nil
+}
+
+func (s *lockTableStore) ClearLocksWithDurationBeforeDate(before time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, rec := range s.records {
+		if rec.LockedOn != nil && rec.LockedOn.Before(before) {
+			rec.LockID, rec.LockedOn = nil, nil
+			s.records[id] = rec
+			s.reaped++
+		}
+	}
+	return nil
+}
+
+func (s *lockTableStore) ClearLocksByLockID(lockID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, rec := range s.records {
+		if rec.LockID != nil && *rec.LockID == lockID {
+			rec.LockID, rec.LockedOn = nil, nil
+			s.records[id] = rec
+		}
+	}
+	return nil
+}
+
+// slowBroker takes longer than the maximum lock duration to send a message
+type slowBroker struct {
+	delay time.Duration
+}
+
+func (b slowBroker) Send(Message) error {
+	time.Sleep(b.delay)
+	return nil
+}
+
+func Test_defaultRecordProcessor_ProcessRecords_lockHeartbeat(t *testing.T) {
+	maxLockDuration := 100 * time.Millisecond
+	tests := map[string]struct {
+		heartbeatInterval time.Duration
+		expErr            error
+		expReaped         bool
+	}{
+		"Heartbeated locks should never be reaped": {
+			heartbeatInterval: 20 * time.Millisecond,
+			expErr:            nil,
+			expReaped:         false,
+		},
+		"Locks without heartbeat should be reaped after the maximum lock duration": {
+			heartbeatInterval: 0,
+			expErr:            fmt.Errorf("Could not update the record in the db: %w", ErrRecordLockLost),
+			expReaped:         true,
+		},
+	}
+	for name, test := range tests {
+		tt := test
+		t.Run(name, func(t *testing.T) {
+			id := uuid.New()
+			store := &lockTableStore{records: map[uuid.UUID]Record{id: {ID: id, State: PendingDelivery}}}
+			timeProvider := time2.NewTimeProvider()
+			d := defaultRecordProcessor{
+				messageBroker:         slowBroker{delay: 3 * maxLockDuration},
+				time:                  timeProvider,
+				store:                 store,
+				machineID:             "1",
+				lockHeartbeatInterval: tt.heartbeatInterval,
+				selector:              stateSelector{store: store, time: timeProvider, lockID: "1"},
 			}
+			unlocker := recordUnlocker{store: store, time: timeProvider, MaxLockTimeDurationMins: maxLockDuration}
+
+			done := make(chan struct{})
+			reaperStopped := make(chan struct{})
+			go func() {
+				defer close(reaperStopped)
+				for {
+					select {
+					case <-done:
+						return
+					case <-time.After(10 * time.Millisecond):
+						_ = unlocker.UnlockExpiredMessages()
+					}
+				}
+			}()
 			err := d.ProcessRecords()
+			close(done)
+			<-reaperStopped
+
 			assert.Equal(t, tt.expErr, err)
+			assert.Equal(t, tt.expReaped, store.reaped > 0)
+			if tt.heartbeatInterval > 0 {
+				assert.Equal(t, Delivered, store.records[id].State)
+				assert.Greater(t, store.extended, 0)
+			}
+		})
+	}
+}
+
+func Test_defaultRecordProcessor_failure_backoff(t *testing.T) {
+	sampleTime := time.Now().UTC()
+	nextRetryAt := sampleTime.Add(4 * time.Second)
+	brokerErr := errors.New("broker error")
+	d := defaultRecordProcessor{
+		retrialPolicy: RetrialPolicy{
+			MaxSendAttemptsEnabled: true,
+			MaxSendAttempts:        5,
+			Backoff:                ExponentialBackoff{InitialDelay: time.Second},
+		},
+	}
+	id := uuid.New()
+
+	assert.Equal(t,
+		RecordFailure{ID: id, State: PendingDelivery, Error: "broker error", NumberOfAttempts: 3, LastAttemptOn: sampleTime, NextRetryAt: &nextRetryAt},
+		d.failure(publishResult{record: Record{ID: id, State: PendingDelivery, NumberOfAttempts: 3}, attemptedOn: sampleTime, err: brokerErr}),
+	)
+	assert.Equal(t,
+		RecordFailure{ID: id, State: MaxAttemptsReached, Error: "broker error", NumberOfAttempts: 5, LastAttemptOn: sampleTime},
+		d.failure(publishResult{record: Record{ID: id, State: PendingDelivery, NumberOfAttempts: 5}, attemptedOn: sampleTime, err: brokerErr}),
+	)
+}
+
+// recordingMetrics keeps the counters and the observations recorded by the processor in memory
+type recordingMetrics struct {
+	NoopMetricsRecorder
+	mu           sync.Mutex
+	counts       map[string]int64
+	observations map[string][]float64
+}
+
+func (m *recordingMetrics) Observe(name string, value float64, tags map[string]string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.observations != nil {
+		m.observations[name+"/"+tags[TagTopic]] = append(m.observations[name+"/"+tags[TagTopic]], value)
+	}
+}
+
+func (m *recordingMetrics) Count(name string, value int64, tags map[string]string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.counts[name+"/"+tags[TagTopic]] += value
+}
+
+func Test_defaultRecordProcessor_ProcessRecords_metrics(t *testing.T) {
+	sampleTime := time.Now().UTC()
+	timeProvider := &time2.MockProvider{}
+	timeProvider.On("Now").Return(sampleTime)
+	machineID := "1"
+	records := []Record{
+		{ID: uuid.New(), Message: Message{Key: "1", Topic: "orders"}, State: PendingDelivery, CreatedOn: sampleTime.Add(-5 * time.Second)},
+		{ID: uuid.New(), Message: Message{Key: "2", Topic: "orders"}, State: PendingDelivery, CreatedOn: sampleTime},
+		{ID: uuid.New(), Message: Message{Key: "3", Topic: "payments"}, State: PendingDelivery, CreatedOn: sampleTime},
+	}
+
+	store := &MockStore{}
+	store.On("UpdateRecordsLockByStates", machineID, sampleTime, []RecordState{PendingDelivery}, 0).Return(nil)
+	store.On("GetRecordsByLockID", machineID).Return(records, nil)
+	store.On("ClearLocksByLockID", machineID).Return(nil)
+	store.On("MarkProcessed", records[0].ID, 1, sampleTime, machineID).Return(nil)
+	store.On("RecordFailures", mock.Anything, machineID).Return(nil)
+	broker := &MockBroker{}
+	broker.On("Send", MetadataHeaders{}.withMetadataHeaders(records[0])).Return(nil)
+	broker.On("Send", MetadataHeaders{}.withMetadataHeaders(records[1])).Return(errors.New("broker error"))
+	broker.On("Send", MetadataHeaders{}.withMetadataHeaders(records[2])).Return(&PermanentError{Err: ErrMessageTooLargeForBroker})
+	metrics := &recordingMetrics{counts: map[string]int64{}, observations: map[string][]float64{}}
+
+	d := defaultRecordProcessor{
+		messageBroker: broker,
+		time:          timeProvider,
+		store:         store,
+		machineID:     machineID,
+		orderingMode:  Unordered,
+		metrics:       metrics,
+		selector:      stateSelector{store: store, time: timeProvider, lockID: machineID},
+	}
+	_ = d.ProcessRecords()
+
+	assert.Equal(t, map[string]int64{
+		MetricPublished + "/orders":         1,
+		MetricPublishFailures + "/orders":   1,
+		MetricPublishFailures + "/payments": 1,
+		MetricDeadLettered + "/payments":    1,
+	}, metrics.counts)
+	assert.Equal(t, []float64{5}, metrics.observations[MetricDeliveryLatency+"/orders"])
+	assert.Empty(t, metrics.observations[MetricDeliveryLatency+"/payments"])
+}
+
+func Test_defaultRecordProcessor_ProcessRecords_onDeadLetter(t *testing.T) {
+	sampleTime := time.Now().UTC()
+	timeProvider := &time2.MockProvider{}
+	timeProvider.On("Now").Return(sampleTime)
+	machineID := "1"
+	brokerErr := errors.New("broker error")
+
+	tests := map[string]struct {
+		orderingMode OrderingMode
+		storeErr     error
+		expNotified  int
+	}{
+		"Dead lettered records of an ordered batch should be notified": {
+			orderingMode: Ordered,
+			expNotified:  1,
+		},
+		"Dead lettered records of an unordered batch should be notified": {
+			orderingMode: Unordered,
+			expNotified:  1,
+		},
+		"Records whose failure could not be stored should not be notified": {
+			orderingMode: Unordered,
+			storeErr:     errors.New("db error"),
+			expNotified:  0,
+		},
+	}
+	for name, test := range tests {
+		tt := test
+		t.Run(name, func(t *testing.T) {
+			records := []Record{
+				{ID: uuid.New(), Message: Message{Key: "1", Topic: "orders"}, State: PendingDelivery, NumberOfAttempts: 2},
+				{ID: uuid.New(), Message: Message{Key: "2", Topic: "orders"}, State: PendingDelivery},
+			}
+			store := &MockStore{}
+			store.On("UpdateRecordsLockByStates", machineID, sampleTime, []RecordState{PendingDelivery}, 0).Return(nil)
+			store.On("GetRecordsByLockID", machineID).Return(records, nil)
+			store.On("ClearLocksByLockID", machineID).Return(nil)
+			store.On("RecordFailure", mock.Anything, machineID).Return(tt.storeErr)
+			store.On("RecordFailures", mock.Anything, machineID).Return(tt.storeErr)
+			broker := &MockBroker{}
+			broker.On("Send", mock.Anything).Return(brokerErr)
+
+			var notified []Record
+			d := defaultRecordProcessor{
+				messageBroker: broker,
+				time:          timeProvider,
+				store:         store,
+				machineID:     machineID,
+				orderingMode:  tt.orderingMode,
+				retrialPolicy: RetrialPolicy{MaxSendAttemptsEnabled: true, MaxSendAttempts: 3},
+				selector:      stateSelector{store: store, time: timeProvider, lockID: machineID},
+				onDeadLetter: func(rec Record, reason error) {
+					assert.Equal(t, brokerErr, reason)
+					notified = append(notified, rec)
+				},
+			}
+			_ = d.ProcessRecords()
+
+			assert.Len(t, notified, tt.expNotified)
+			if tt.expNotified > 0 {
+				assert.Equal(t, records[0].ID, notified[0].ID)
+				assert.Equal(t, MaxAttemptsReached, notified[0].State)
+				assert.Equal(t, 3, notified[0].NumberOfAttempts)
+				assert.Equal(t, brokerErr.Error(), *notified[0].Error)
+				assert.Equal(t, sampleTime, *notified[0].LastAttemptOn)
+			}
+		})
+	}
+}
+
+func Test_defaultRecordProcessor_ProcessRecords_auditAttempts(t *testing.T) {
+	sampleTime := time.Now().UTC()
+	timeProvider := &time2.MockProvider{}
+	timeProvider.On("Now").Return(sampleTime)
+	machineID := "1"
+	brokerErr := "broker error"
+	expiresAt := sampleTime.Add(-time.Second)
+
+	tests := map[string]struct {
+		orderingMode OrderingMode
+		auditErr     error
+		expErr       bool
+	}{
+		"Attempts of an ordered batch should be audited one by one": {
+			orderingMode: Ordered,
+		},
+		"Attempts of an unordered batch should be audited at once": {
+			orderingMode: Unordered,
+		},
+		"Error in auditing should return an error": {
+			orderingMode: Unordered,
+			auditErr:     errors.New("db error"),
+			expErr:       true,
+		},
+	}
+	for name, test := range tests {
+		tt := test
+		t.Run(name, func(t *testing.T) {
+			records := []Record{
+				{ID: uuid.New(), Message: Message{Key: "1", Topic: "orders"}, State: PendingDelivery},
+				{ID: uuid.New(), Message: Message{Key: "2", Topic: "orders"}, State: PendingDelivery, ExpiresAt: &expiresAt},
+				{ID: uuid.New(), Message: Message{Key: "3", Topic: "payments"}, State: PendingDelivery, NumberOfAttempts: 1},
+			}
+			store := &MockStore{}
+			store.On("UpdateRecordsLockByStates", machineID, sampleTime, []RecordState{PendingDelivery}, 0).Return(nil)
+			store.On("GetRecordsByLockID", machineID).Return(records, nil)
+			store.On("ClearLocksByLockID", machineID).Return(nil)
+			store.On("MarkProcessed", records[0].ID, 1, sampleTime, machineID).Return(nil)
+			store.On("RecordFailure", mock.Anything, machineID).Return(nil)
+			store.On("RecordFailures", mock.Anything, machineID).Return(nil)
+			var audited []Attempt
+			store.On("AddAttempts", mock.Anything).Run(func(args mock.Arguments) {
+				audited = append(audited, args.Get(0).([]Attempt)...)
+			}).Return(tt.auditErr)
+			broker := &MockBroker{}
+			broker.On("Send", MetadataHeaders{}.withMetadataHeaders(records[0])).Return(nil)
+			broker.On("Send", MetadataHeaders{}.withMetadataHeaders(records[2])).Return(errors.New(brokerErr))
+
+			d := defaultRecordProcessor{
+				messageBroker: broker,
+				time:          timeProvider,
+				store:         store,
+				machineID:     machineID,
+				orderingMode:  tt.orderingMode,
+				auditAttempts: true,
+				selector:      stateSelector{store: store, time: timeProvider, lockID: machineID},
+			}
+			err := d.ProcessRecords()
+
+			assert.NotNil(t, err)
+			assert.Equal(t, tt.expErr, errors.Is(err, tt.auditErr) && tt.auditErr != nil)
+			assert.ElementsMatch(t, []Attempt{
+				{RecordID: records[0].ID, Topic: "orders", Number: 1, AttemptedOn: sampleTime},
+				{RecordID: records[2].ID, Topic: "payments", Number: 2, AttemptedOn: sampleTime, Error: &brokerErr},
+			}, audited)
+			if tt.orderingMode == Unordered {
+				store.AssertNumberOfCalls(t, "AddAttempts", 1)
+			}
+		})
+	}
+}
+
+// asyncBroker acknowledges the messages asynchronously in reverse order, failing the failKey message and never
+// acknowledging the lostKey message
+type asyncBroker struct {
+	MockBroker
+	mu      sync.Mutex
+	pending []func(err error)
+	failKey string
+	lostKey string
+}
+
+func (b *asyncBroker) SendAsync(message Message, done func(err error)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch message.Key {
+	case b.lostKey:
+	case b.failKey:
+		go done(errors.New("message broker error"))
+	default:
+		b.pending = append(b.pending, done)
+	}
+}
+
+func (b *asyncBroker) ackPending() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for i := len(b.pending) - 1; i >= 0; i-- {
+		go b.pending[i](nil)
+	}
+}
+
+func Test_defaultRecordProcessor_ProcessRecords_async(t *testing.T) {
+	sampleTime := time.Now().UTC()
+	timeProvider := &time2.MockProvider{}
+	timeProvider.On("Now").Return(sampleTime)
+	machineID := "1"
+
+	var records []Record
+	for i := 0; i < 5; i++ {
+		records = append(records, Record{
+			ID:      uuid.New(),
+			Message: Message{Key: fmt.Sprintf("key-%d", i)},
+			State:   PendingDelivery,
 		})
 	}
+
+	store := &MockStore{}
+	store.On("UpdateRecordsLockByStates", machineID, sampleTime, []RecordState{PendingDelivery}, 0).Return(nil)
+	store.On("GetRecordsByLockID", machineID).Return(records, nil)
+	store.On("ClearLocksByLockID", machineID).Return(nil)
+	for _, rec := range records[2:] {
+		store.On("MarkProcessed", rec.ID, 1, sampleTime, machineID).Return(nil)
+	}
+	store.On("RecordFailures", []RecordFailure{
+		{ID: records[0].ID, State: PendingDelivery, Error: "message broker error", NumberOfAttempts: 1, LastAttemptOn: sampleTime},
+		{ID: records[1].ID, State: PendingDelivery, Error: ErrAckTimeout.Error(), NumberOfAttempts: 1, LastAttemptOn: sampleTime},
+	}, machineID).Return(nil)
+	broker := &asyncBroker{failKey: "key-0", lostKey: "key-1"}
+	broker.On("Send", mock.Anything).Return(nil)
+
+	d := defaultRecordProcessor{
+		messageBroker: broker,
+		time:          timeProvider,
+		store:         store,
+		machineID:     machineID,
+		orderingMode:  Unordered,
+		ackTimeout:    50 * time.Millisecond,
+		selector:      stateSelector{store: store, time: timeProvider, lockID: machineID},
+	}
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		broker.ackPending()
+	}()
+	err := d.ProcessRecords()
+
+	assert.Equal(t, errors.Join(
+		fmt.Errorf("An error occurred when trying to send the message to the broker: %w", errors.New("message broker error")),
+		fmt.Errorf("An error occurred when trying to send the message to the broker: %w", ErrAckTimeout),
+	), err)
+	broker.AssertNotCalled(t, "Send", mock.Anything)
+	store.AssertExpectations(t)
+	store.AssertCalled(t, "ClearLocksByLockID", machineID)
+}
+
+// orderBroker records the order of the sent messages of every key and the maximum number of concurrent sends
+type orderBroker struct {
+	concurrencyBroker
+	sent map[string][]string
+}
+
+func (b *orderBroker) Send(message Message) error {
+	err := b.concurrencyBroker.Send(message)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err == nil {
+		b.sent[message.Key] = append(b.sent[message.Key], string(message.Body))
+	}
+	return err
+}
+
+func Test_defaultRecordProcessor_ProcessRecords_keyOrdered(t *testing.T) {
+	sampleTime := time.Now().UTC()
+	timeProvider := &time2.MockProvider{}
+	timeProvider.On("Now").Return(sampleTime)
+	machineID := "1"
+	const keys, recordsPerKey = 40, 5
+
+	var records []Record
+	for i := 0; i < recordsPerKey; i++ {
+		for k := 0; k < keys; k++ {
+			records = append(records, Record{
+				ID:      uuid.New(),
+				Message: Message{Key: fmt.Sprintf("key-%d", k), Body: []byte(strconv.Itoa(i))},
+				State:   PendingDelivery,
+			})
+		}
+	}
+	// The third record of key-3 fails, so its two later records must not be published
+	failed := records[2*keys+3]
+
+	store := &MockStore{}
+	store.On("UpdateRecordsLockByStates", machineID, sampleTime, []RecordState{PendingDelivery}, 0).Return(nil)
+	store.On("GetRecordsByLockID", machineID).Return(records, nil)
+	store.On("ClearLocksByLockID", machineID).Return(nil)
+	store.On("MarkProcessed", mock.Anything, mock.Anything, sampleTime, machineID).Return(nil)
+	store.On("RecordFailures", []RecordFailure{{
+		ID:               failed.ID,
+		State:            PendingDelivery,
+		Error:            "message broker error",
+		NumberOfAttempts: 1,
+		LastAttemptOn:    sampleTime,
+	}}, machineID).Return(nil)
+	broker := &orderBroker{sent: map[string][]string{}}
+	broker.failBody = "2"
+	broker.failKey = "key-3"
+
+	d := defaultRecordProcessor{
+		messageBroker:         broker,
+		time:                  timeProvider,
+		store:                 store,
+		machineID:             machineID,
+		orderingMode:          KeyOrdered,
+		intraBatchConcurrency: 8,
+		selector:              stateSelector{store: store, time: timeProvider, lockID: machineID},
+	}
+	start := time.Now()
+	err := d.ProcessRecords()
+	elapsed := time.Since(start)
+
+	assert.Equal(t, errors.Join(
+		fmt.Errorf("An error occurred when trying to send the message to the broker: %w", errors.New("message broker error")),
+	), err)
+	for k := 0; k < keys; k++ {
+		key := fmt.Sprintf("key-%d", k)
+		if key == "key-3" {
+			assert.Equal(t, []string{"0", "1"}, broker.sent[key])
+			continue
+		}
+		assert.Equal(t, []string{"0", "1", "2", "3", "4"}, broker.sent[key], key)
+	}
+	assert.Greater(t, broker.maxInFlight, 1)
+	assert.LessOrEqual(t, broker.maxInFlight, 8)
+	// A serial publish of the batch takes at least 200 sends of 10ms
+	assert.Less(t, elapsed, time.Duration(len(records))*10*time.Millisecond/2)
+	store.AssertNumberOfCalls(t, "MarkProcessed", keys*recordsPerKey-3)
+}
+
+func Test_defaultRecordProcessor_ProcessRecords_recordLess(t *testing.T) {
+	sampleTime := time.Now().UTC()
+	timeProvider := &time2.MockProvider{}
+	timeProvider.On("Now").Return(sampleTime)
+	machineID := "1"
+	priority := func(p string) Message { return Message{Key: p, Headers: map[string]string{"priority": p}} }
+	records := []Record{
+		{ID: uuid.New(), Message: priority("low"), State: PendingDelivery},
+		{ID: uuid.New(), Message: priority("high"), State: PendingDelivery},
+		{ID: uuid.New(), Message: priority("low"), State: PendingDelivery},
+		{ID: uuid.New(), Message: priority("high"), State: PendingDelivery},
+	}
+	store := &MockStore{}
+	store.On("UpdateRecordsLockByStates", machineID, sampleTime, []RecordState{PendingDelivery}, 0).Return(nil)
+	store.On("GetRecordsByLockID", machineID).Return(slices.Clone(records), nil)
+	store.On("ClearLocksByLockID", machineID).Return(nil)
+	var delivered []uuid.UUID
+	store.On("MarkProcessed", mock.Anything, mock.Anything, sampleTime, machineID).Return(nil).Run(func(args mock.Arguments) {
+		delivered = append(delivered, args.Get(0).(uuid.UUID))
+	})
+	broker := &MockBroker{}
+	broker.On("Send", mock.Anything).Return(nil)
+
+	d := defaultRecordProcessor{
+		messageBroker: broker,
+		time:          timeProvider,
+		store:         store,
+		machineID:     machineID,
+		selector:      stateSelector{store: store, time: timeProvider, lockID: machineID},
+		recordLess: func(a, b Record) bool {
+			return a.Message.Headers["priority"] == "high" && b.Message.Headers["priority"] != "high"
+		},
+	}
+	err := d.ProcessRecords()
+
+	assert.Nil(t, err)
+	// The records of the same priority keep the order of the store
+	assert.Equal(t, []uuid.UUID{records[1].ID, records[3].ID, records[0].ID, records[2].ID}, delivered)
+}
+
+func Test_defaultRecordProcessor_sortRecords_keyOrdered(t *testing.T) {
+	rec := func(key string, priority string) Record {
+		return Record{ID: uuid.New(), Message: Message{Key: key, Topic: "topic", Headers: map[string]string{"priority": priority}}}
+	}
+	records := []Record{rec("a", "low"), rec("b", "low"), rec("a", "high"), rec("", "low"), rec("", "high"), rec("b", "high")}
+	sorted := slices.Clone(records)
+	d := defaultRecordProcessor{
+		orderingMode: KeyOrdered,
+		recordLess: func(a, b Record) bool {
+			return a.Message.Headers["priority"] == "high" && b.Message.Headers["priority"] != "high"
+		},
+	}
+	d.sortRecords(sorted)
+
+	// The keys are ordered by the comparator, but the records of a key keep the order of the store
+	assert.Equal(t, []Record{records[0], records[4], records[1], records[2], records[5], records[3]}, sorted)
+}
+
+func Test_recordLess(t *testing.T) {
+	less := func(a, b Record) bool { return a.CreatedOn.Before(b.CreatedOn) }
+	assert.NotNil(t, recordLess(DispatcherSettings{RecordLess: less}))
+	assert.Nil(t, recordLess(DispatcherSettings{RecordLess: less, SelectionStrategy: WatermarkSelection}))
+	assert.Nil(t, recordLess(DispatcherSettings{}))
 }
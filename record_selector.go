@@ -0,0 +1,267 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	time2 "time"
+
+	"github.com/google/uuid"
+	"github.com/pkritiotis/outbox/internal/time"
+)
+
+// SelectionStrategy defines how the dispatcher selects the records to be dispatched
+type SelectionStrategy int
+
+const (
+	// StateBasedSelection locks the records in the PendingDelivery state and updates their state after every
+	// delivery attempt. It supports multiple concurrent dispatchers and the RetrialPolicy
+	StateBasedSelection SelectionStrategy = iota
+	// WatermarkSelection selects the records created after an in-memory cursor of the last delivered
+	// (created_on, id) pair and never updates the records. It is meant for outbox tables that are not owned by the
+	// dispatcher, supports a single dispatcher instance and publishes in Ordered mode only. The cursor restarts from
+	// the WatermarkStart on every restart, so records may be delivered more than once. Records committed later than the
+	// WatermarkLag after their creation time are skipped, and the record at the head of the cursor holds back the
+	// records after it until it is delivered or dead-lettered
+	WatermarkSelection
+)
+
+const (
+	defaultWatermarkBatchSize = 100
+	// defaultWatermarkLag is the default grace period for the late commits of the WatermarkSelection strategy
+	defaultWatermarkLag = 10 * time2.Second
+	// defaultWatermarkMaxSendAttempts caps the attempts of the record at the head of the watermark if the RetrialPolicy
+	// does not
+	defaultWatermarkMaxSendAttempts = 10
+)
+
+type recordSelector interface {
+	// selectRecords returns the batch of records that should be published
+	selectRecords() ([]Record, error)
+	// markDelivered is called for every record of the batch that was delivered successfully
+	markDelivered(rec Record, deliveredOn time2.Time) error
+	// markFailed is called for every record of the batch that could not be delivered
+	markFailed(rec Record, failure RecordFailure) error
+	// markFailures is called once with all the failed records of an Unordered batch
+	markFailures(failures []RecordFailure) error
+	// withoutPaused returns the selected records that should be published while the topics matching isPaused are
+	// paused. The records that are left out stay pending
+	withoutPaused(records []Record, isPaused func(topic string) bool) []Record
+	// heartbeat is called periodically while the batch is being published
+	heartbeat() error
+	// release is called once all the records of the batch have been processed
+	release() error
+}
+
+func newRecordSelector(store Store, machineID string, settings DispatcherSettings, clock time.Provider, paused *pausedTopics) recordSelector {
+	if settings.SelectionStrategy == WatermarkSelection {
+		s := newWatermarkSelector(store, settings.WatermarkStart, settings.WatermarkBatchSize)
+		s.clock = clock
+		s.lag = watermarkLagOrDefault(settings.WatermarkLag)
+		return s
+	}
+	s := newStateSelector(store, machineID, clock, settings.BatchSize)
+	s.maxBatchBytes = settings.MaxBatchBytes
+	s.paused = paused
+	return s
+}
+
+// dispatchedStates are the states of the records locked by the stateSelector
+var dispatchedStates = []RecordState{PendingDelivery}
+
+// errBatchFull stops the iteration of the locked records once the maxBatchBytes of the batch is reached
+var errBatchFull = errors.New("batch full")
+
+// stateSelector selects the records by locking up to batchSize due records in the PendingDelivery state, leaving out
+// the records of the paused topics, and fetches them up to maxBatchBytes
+type stateSelector struct {
+	store         Store
+	time          time.Provider
+	lockID        string
+	batchSize     int
+	maxBatchBytes int
+	paused        *pausedTopics
+}
+
+func newStateSelector(store Store, lockID string, clock time.Provider, batchSize int) stateSelector {
+	return stateSelector{store: store, time: clock, lockID: lockID, batchSize: batchSize}
+}
+
+func (s stateSelector) selectRecords() ([]Record, error) {
+	lockTime := s.time.Now().UTC()
+	var err error
+	if topics := s.paused.list(); len(topics) > 0 {
+		err = s.store.UpdateRecordsLockByStatesExcludingTopics(s.lockID, lockTime, dispatchedStates, s.batchSize, topics)
+	} else {
+		err = s.store.UpdateRecordsLockByStates(s.lockID, lockTime, dispatchedStates, s.batchSize)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if s.maxBatchBytes <= 0 {
+		return s.store.GetRecordsByLockID(s.lockID)
+	}
+	return s.fetchUpToMaxBatchBytes()
+}
+
+// fetchUpToMaxBatchBytes streams the locked records until the next one would exceed the maxBatchBytes, so that the
+// records after it are never decoded
+func (s stateSelector) fetchUpToMaxBatchBytes() ([]Record, error) {
+	var records []Record
+	size := 0
+	err := s.store.IterateRecordsByLockID(context.Background(), s.lockID, func(rec Record) error {
+		recSize := messageSize(rec.Message)
+		if len(records) > 0 && size+recSize > s.maxBatchBytes {
+			return errBatchFull
+		}
+		records = append(records, rec)
+		size += recSize
+		return nil
+	})
+	if err != nil && !errors.Is(err, errBatchFull) {
+		return nil, err
+	}
+	return records, nil
+}
+
+// messageSize is the size of the key, headers and body of the decoded message
+func messageSize(msg Message) int {
+	size := len(msg.Key) + len(msg.Body)
+	for k, v := range msg.Headers {
+		size += len(k) + len(v)
+	}
+	return size
+}
+
+func (s stateSelector) markDelivered(rec Record, deliveredOn time2.Time) error {
+	return s.store.MarkProcessed(rec.ID, rec.NumberOfAttempts, deliveredOn, s.lockID)
+}
+
+func (s stateSelector) markFailed(_ Record, failure RecordFailure) error {
+	return s.store.RecordFailure(failure, s.lockID)
+}
+
+func (s stateSelector) markFailures(failures []RecordFailure) error {
+	return s.store.RecordFailures(failures, s.lockID)
+}
+
+// withoutPaused leaves out the records of the paused topics that were locked anyway, e.g. the records of a topic
+// paused during the lock or that the store cannot filter by topic. They are unlocked with the rest of the batch
+func (s stateSelector) withoutPaused(records []Record, isPaused func(topic string) bool) []Record {
+	selected := records[:0:0]
+	for _, rec := range records {
+		if !isPaused(rec.Message.Topic) {
+			selected = append(selected, rec)
+		}
+	}
+	return selected
+}
+
+func (s stateSelector) heartbeat() error {
+	return s.store.ExtendLock(s.lockID, s.time.Now().UTC())
+}
+
+func (s stateSelector) release() error {
+	return s.store.ClearLocksByLockID(s.lockID)
+}
+
+// watermarkSelector selects the records created after the last delivered record
+type watermarkSelector struct {
+	store     Store
+	batchSize int
+	createdOn time2.Time
+	id        uuid.UUID
+	// clock and lag leave out the records created less than lag ago, whose transactions may not be committed yet
+	clock time.Provider
+	lag   time2.Duration
+	// headID and headAttempts count the attempts of the record at the head of the watermark, since they are not
+	// stored
+	headID       uuid.UUID
+	headAttempts int
+}
+
+func watermarkLagOrDefault(lag time2.Duration) time2.Duration {
+	if lag == 0 {
+		return defaultWatermarkLag
+	}
+	return lag
+}
+
+func newWatermarkSelector(store Store, start time2.Time, batchSize int) *watermarkSelector {
+	if batchSize <= 0 {
+		batchSize = defaultWatermarkBatchSize
+	}
+	return &watermarkSelector{store: store, batchSize: batchSize, createdOn: start}
+}
+
+// selectRecords returns the records after the watermark that were created before the lag, with the attempts counted
+// in memory
+func (s *watermarkSelector) selectRecords() ([]Record, error) {
+	records, err := s.store.GetRecordsAfterWatermark(s.createdOn, s.id, s.batchSize)
+	if err != nil {
+		return nil, err
+	}
+	if s.lag > 0 && s.clock != nil {
+		until := s.clock.Now().UTC().Add(-s.lag)
+		for i, rec := range records {
+			if rec.CreatedOn.After(until) {
+				records = records[:i]
+				break
+			}
+		}
+	}
+	for i := range records {
+		records[i].NumberOfAttempts = 0
+		if records[i].ID == s.headID {
+			records[i].NumberOfAttempts = s.headAttempts
+		}
+	}
+	return records, nil
+}
+
+func (s *watermarkSelector) markDelivered(rec Record, _ time2.Time) error {
+	s.advance(rec)
+	return nil
+}
+
+// markFailed keeps the watermark before the failed record, so that it is selected again in the next cycle, and counts
+// its attempts. The watermark moves past it once it has expired or reached the maximum attempts
+func (s *watermarkSelector) markFailed(rec Record, failure RecordFailure) error {
+	if failure.State == Expired || failure.State == MaxAttemptsReached {
+		s.advance(rec)
+		return nil
+	}
+	s.headID = rec.ID
+	s.headAttempts = failure.NumberOfAttempts
+	return nil
+}
+
+func (s *watermarkSelector) advance(rec Record) {
+	s.createdOn = rec.CreatedOn
+	s.id = rec.ID
+	s.headID = uuid.Nil
+	s.headAttempts = 0
+}
+
+// markFailures is never called, since the watermark selection only publishes in Ordered mode
+func (s *watermarkSelector) markFailures([]RecordFailure) error {
+	return nil
+}
+
+// withoutPaused stops the batch before the first record of a paused topic, since the watermark cannot move past it
+// without skipping it. The topics after it are held back until the paused topic is resumed
+func (s *watermarkSelector) withoutPaused(records []Record, isPaused func(topic string) bool) []Record {
+	for i, rec := range records {
+		if isPaused(rec.Message.Topic) {
+			return records[:i]
+		}
+	}
+	return records
+}
+
+func (s *watermarkSelector) heartbeat() error {
+	return nil
+}
+
+func (s *watermarkSelector) release() error {
+	return nil
+}
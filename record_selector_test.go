@@ -0,0 +1,340 @@
+package outbox
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	time2 "time"
+
+	"github.com/google/uuid"
+	"github.com/pkritiotis/outbox/internal/time"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_newRecordSelector(t *testing.T) {
+	store := &MockStore{}
+	start := time2.Now()
+
+	clock := time.NewTimeProvider()
+	assert.Equal(t, newStateSelector(store, "1", clock, 0), newRecordSelector(store, "1", DispatcherSettings{}, clock, nil))
+	assert.Equal(t,
+		stateSelector{store: store, time: clock, lockID: "1", batchSize: 50},
+		newRecordSelector(store, "1", DispatcherSettings{BatchSize: 50}, clock, nil),
+	)
+	assert.Equal(t,
+		stateSelector{store: store, time: clock, lockID: "1", maxBatchBytes: 1024},
+		newRecordSelector(store, "1", DispatcherSettings{MaxBatchBytes: 1024}, clock, nil),
+	)
+	assert.Equal(t,
+		&watermarkSelector{store: store, batchSize: 10, createdOn: start, clock: clock, lag: defaultWatermarkLag},
+		newRecordSelector(store, "1", DispatcherSettings{
+			SelectionStrategy:  WatermarkSelection,
+			WatermarkStart:     start,
+			WatermarkBatchSize: 10,
+		}, clock, nil),
+	)
+	assert.Equal(t,
+		&watermarkSelector{store: store, batchSize: defaultWatermarkBatchSize, createdOn: start, clock: clock, lag: -1},
+		newRecordSelector(store, "1", DispatcherSettings{
+			SelectionStrategy: WatermarkSelection,
+			WatermarkStart:    start,
+			WatermarkLag:      -1,
+		}, clock, nil),
+	)
+	assert.Equal(t, defaultWatermarkBatchSize, newWatermarkSelector(store, start, 0).batchSize)
+}
+
+func Test_stateSelector_selectRecords(t *testing.T) {
+	sampleTime := time2.Now().UTC()
+	timeProvider := &time.MockProvider{}
+	timeProvider.On("Now").Return(sampleTime)
+	records := []Record{{ID: uuid.New()}}
+
+	tests := map[string]struct {
+		store      *MockStore
+		expRecords []Record
+		expErr     error
+	}{
+		"Successful selection should return the locked records": {
+			store: func() *MockStore {
+				mp := MockStore{}
+				mp.On("UpdateRecordsLockByStates", "1", sampleTime, []RecordState{PendingDelivery}, 0).Return(nil)
+				mp.On("GetRecordsByLockID", "1").Return(records, nil)
+				return &mp
+			}(),
+			expRecords: records,
+			expErr:     nil,
+		},
+		"Error in locking should return an error": {
+			store: func() *MockStore {
+				mp := MockStore{}
+				mp.On("UpdateRecordsLockByStates", "1", sampleTime, []RecordState{PendingDelivery}, 0).Return(errors.New("lock error"))
+				return &mp
+			}(),
+			expRecords: nil,
+			expErr:     errors.New("lock error"),
+		},
+	}
+	for name, test := range tests {
+		tt := test
+		t.Run(name, func(t *testing.T) {
+			s := stateSelector{store: tt.store, time: timeProvider, lockID: "1"}
+			recs, err := s.selectRecords()
+			assert.Equal(t, tt.expRecords, recs)
+			assert.Equal(t, tt.expErr, err)
+		})
+	}
+}
+
+func Test_stateSelector_selectRecords_pausedTopics(t *testing.T) {
+	sampleTime := time2.Now().UTC()
+	timeProvider := &time.MockProvider{}
+	timeProvider.On("Now").Return(sampleTime)
+	// The oldest due records of the paused topic would fill the batch, so they are left out by the lock
+	records := []Record{{ID: uuid.New(), Message: Message{Topic: "orders"}}, {ID: uuid.New(), Message: Message{Topic: "payments"}}}
+	store := &MockStore{}
+	store.On("UpdateRecordsLockByStatesExcludingTopics", "1", sampleTime, []RecordState{PendingDelivery}, 2, []string{"invoices", "refunds"}).Return(nil)
+	store.On("GetRecordsByLockID", "1").Return(records, nil)
+	paused := newPausedTopics()
+	paused.pause("refunds")
+	paused.pause("invoices")
+	s := newStateSelector(store, "1", timeProvider, 2)
+	s.paused = paused
+
+	recs, err := s.selectRecords()
+	assert.Nil(t, err)
+	assert.Equal(t, records, recs)
+	store.AssertNotCalled(t, "UpdateRecordsLockByStates", "1", sampleTime, []RecordState{PendingDelivery}, 2)
+
+	// The lock is not filtered once the topics are resumed
+	paused.resume("refunds")
+	paused.resume("invoices")
+	store.On("UpdateRecordsLockByStates", "1", sampleTime, []RecordState{PendingDelivery}, 2).Return(nil)
+	_, err = s.selectRecords()
+	assert.Nil(t, err)
+	store.AssertExpectations(t)
+}
+
+func Test_stateSelector_selectRecords_batchSize(t *testing.T) {
+	sampleTime := time2.Now().UTC()
+	timeProvider := &time.MockProvider{}
+	timeProvider.On("Now").Return(sampleTime)
+	store := &MockStore{}
+	store.On("UpdateRecordsLockByStates", "1", sampleTime, []RecordState{PendingDelivery}, 50).Return(nil)
+	store.On("GetRecordsByLockID", "1").Return([]Record{}, nil)
+
+	_, err := newStateSelector(store, "1", timeProvider, 50).selectRecords()
+	assert.Nil(t, err)
+	store.AssertExpectations(t)
+}
+
+func Test_stateSelector_selectRecords_maxBatchBytes(t *testing.T) {
+	sampleTime := time2.Now().UTC()
+	timeProvider := &time.MockProvider{}
+	timeProvider.On("Now").Return(sampleTime)
+	record := func(size int) Record {
+		return Record{ID: uuid.New(), Message: Message{Key: "k", Headers: map[string]string{"h": "v"}, Body: bytes.Repeat([]byte("b"), size-3)}}
+	}
+	small := []Record{record(40), record(40), record(40)}
+	large := []Record{record(200), record(40)}
+
+	tests := map[string]struct {
+		records    []Record
+		iterErr    error
+		expRecords []Record
+		expErr     error
+	}{
+		"Records within the budget should all be selected": {
+			records:    small[:2],
+			expRecords: small[:2],
+		},
+		"Records exceeding the budget should not be selected": {
+			records:    small,
+			expRecords: small[:2],
+		},
+		"Message larger than the budget should be selected alone": {
+			records:    large,
+			expRecords: large[:1],
+		},
+		"Error in fetching should return an error": {
+			records:    small[:1],
+			iterErr:    errors.New("fetch error"),
+			expRecords: nil,
+			expErr:     errors.New("fetch error"),
+		},
+	}
+	for name, test := range tests {
+		tt := test
+		t.Run(name, func(t *testing.T) {
+			store := &MockStore{}
+			store.On("UpdateRecordsLockByStates", "1", sampleTime, []RecordState{PendingDelivery}, 10).Return(nil)
+			store.On("IterateRecordsByLockID", context.Background(), "1").Return(tt.records, tt.iterErr)
+
+			s := stateSelector{store: store, time: timeProvider, lockID: "1", batchSize: 10, maxBatchBytes: 100}
+			recs, err := s.selectRecords()
+			assert.Equal(t, tt.expRecords, recs)
+			assert.Equal(t, tt.expErr, err)
+			store.AssertNotCalled(t, "GetRecordsByLockID", "1")
+		})
+	}
+}
+
+func Test_watermarkSelector(t *testing.T) {
+	start := time2.Now().UTC()
+	first := Record{ID: uuid.New(), CreatedOn: start.Add(time2.Second)}
+	second := Record{ID: uuid.New(), CreatedOn: start.Add(2 * time2.Second)}
+
+	store := &MockStore{}
+	store.On("GetRecordsAfterWatermark", start, uuid.Nil, 2).Return([]Record{first, second}, nil).Once()
+	store.On("GetRecordsAfterWatermark", first.CreatedOn, first.ID, 2).Return([]Record{second}, nil).Once()
+
+	s := newWatermarkSelector(store, start, 2)
+
+	recs, err := s.selectRecords()
+	assert.Nil(t, err)
+	assert.Equal(t, []Record{first, second}, recs)
+
+	assert.Nil(t, s.markDelivered(first, time2.Now()))
+	assert.Nil(t, s.markFailed(second, RecordFailure{ID: second.ID, State: PendingDelivery, Error: "error"}))
+	assert.Nil(t, s.release())
+
+	recs, err = s.selectRecords()
+	assert.Nil(t, err)
+	assert.Equal(t, []Record{second}, recs)
+	store.AssertExpectations(t)
+
+	assert.Nil(t, s.markFailed(second, RecordFailure{ID: second.ID, State: Expired, Error: ErrRecordExpired.Error()}))
+	assert.Equal(t, second.CreatedOn, s.createdOn)
+	assert.Equal(t, second.ID, s.id)
+}
+
+func Test_watermarkSelector_lag(t *testing.T) {
+	now := time2.Now().UTC()
+	timeProvider := &time.MockProvider{}
+	timeProvider.On("Now").Return(now)
+	committed := Record{ID: uuid.New(), CreatedOn: now.Add(-time2.Minute)}
+	recent := Record{ID: uuid.New(), CreatedOn: now.Add(-time2.Second)}
+	later := Record{ID: uuid.New(), CreatedOn: now}
+
+	store := &MockStore{}
+	store.On("GetRecordsAfterWatermark", now.Add(-time2.Hour), uuid.Nil, 10).Return([]Record{committed, recent, later}, nil)
+
+	// The records created within the lag are left for a later cycle
+	s := newWatermarkSelector(store, now.Add(-time2.Hour), 10)
+	s.clock = timeProvider
+	s.lag = 10 * time2.Second
+	recs, err := s.selectRecords()
+	assert.Nil(t, err)
+	assert.Equal(t, []Record{committed}, recs)
+
+	s.lag = -1
+	recs, err = s.selectRecords()
+	assert.Nil(t, err)
+	assert.Equal(t, []Record{committed, recent, later}, recs)
+}
+
+func Test_watermarkSelector_headAttempts(t *testing.T) {
+	start := time2.Now().UTC()
+	head := Record{ID: uuid.New(), CreatedOn: start.Add(time2.Second), NumberOfAttempts: 7}
+	next := Record{ID: uuid.New(), CreatedOn: start.Add(2 * time2.Second), NumberOfAttempts: 3}
+
+	store := &MockStore{}
+	store.On("GetRecordsAfterWatermark", start, uuid.Nil, 2).Return([]Record{head, next}, nil)
+	store.On("GetRecordsAfterWatermark", head.CreatedOn, head.ID, 2).Return([]Record{next}, nil)
+	s := newWatermarkSelector(store, start, 2)
+
+	// The stored attempts are ignored
+	recs, err := s.selectRecords()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, recs[0].NumberOfAttempts)
+	assert.Equal(t, 0, recs[1].NumberOfAttempts)
+
+	// The attempts of the failed head are counted in memory
+	assert.Nil(t, s.markFailed(head, RecordFailure{ID: head.ID, State: PendingDelivery, NumberOfAttempts: 1}))
+	recs, err = s.selectRecords()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, recs[0].NumberOfAttempts)
+	assert.Equal(t, 0, recs[1].NumberOfAttempts)
+
+	// The watermark moves past the head once it reaches the maximum attempts
+	assert.Nil(t, s.markFailed(head, RecordFailure{ID: head.ID, State: MaxAttemptsReached, NumberOfAttempts: 2}))
+	recs, err = s.selectRecords()
+	assert.Nil(t, err)
+	assert.Equal(t, []Record{{ID: next.ID, CreatedOn: next.CreatedOn}}, recs)
+}
+
+func Test_defaultRecordProcessor_ProcessRecords_watermarkDeadLetter(t *testing.T) {
+	start := time2.Now().UTC()
+	timeProvider := &time.MockProvider{}
+	timeProvider.On("Now").Return(start)
+	failing := Record{ID: uuid.New(), CreatedOn: start.Add(time2.Second), Message: Message{Key: "1"}}
+	next := Record{ID: uuid.New(), CreatedOn: start.Add(2 * time2.Second), Message: Message{Key: "2"}}
+	store := &MockStore{}
+	store.On("GetRecordsAfterWatermark", start, uuid.Nil, defaultWatermarkBatchSize).Return([]Record{failing, next}, nil)
+	store.On("GetRecordsAfterWatermark", failing.CreatedOn, failing.ID, defaultWatermarkBatchSize).Return([]Record{next}, nil)
+	broker := &MockBroker{}
+	broker.On("Send", MetadataHeaders{}.withMetadataHeaders(failing)).Return(errors.New("broker error"))
+	broker.On("Send", MetadataHeaders{}.withMetadataHeaders(next)).Return(nil)
+
+	var deadLettered []uuid.UUID
+	selector := newWatermarkSelector(store, start, 0)
+	d := defaultRecordProcessor{
+		messageBroker: broker,
+		time:          timeProvider,
+		store:         store,
+		machineID:     "1",
+		selector:      selector,
+		retrialPolicy: retrialPolicy(DispatcherSettings{SelectionStrategy: WatermarkSelection}),
+		onDeadLetter: func(rec Record, _ error) {
+			deadLettered = append(deadLettered, rec.ID)
+		},
+	}
+
+	// The failing record holds the watermark until its attempts are exhausted
+	for i := 1; i < defaultWatermarkMaxSendAttempts; i++ {
+		assert.NotNil(t, d.ProcessRecords())
+		assert.Equal(t, start, selector.createdOn)
+	}
+	assert.Empty(t, deadLettered)
+
+	// The last attempt dead-letters it and moves the watermark past it
+	assert.NotNil(t, d.ProcessRecords())
+	assert.Equal(t, []uuid.UUID{failing.ID}, deadLettered)
+	assert.Equal(t, failing.ID, selector.id)
+	broker.AssertNumberOfCalls(t, "Send", defaultWatermarkMaxSendAttempts)
+
+	assert.Nil(t, d.ProcessRecords())
+	assert.Equal(t, next.ID, selector.id)
+}
+
+func Test_defaultRecordProcessor_ProcessRecords_watermark(t *testing.T) {
+	start := time2.Now().UTC()
+	timeProvider := &time.MockProvider{}
+	timeProvider.On("Now").Return(start)
+	records := []Record{
+		{ID: uuid.New(), CreatedOn: start.Add(time2.Second), Message: Message{Key: "1"}},
+		{ID: uuid.New(), CreatedOn: start.Add(2 * time2.Second), Message: Message{Key: "2"}},
+		{ID: uuid.New(), CreatedOn: start.Add(3 * time2.Second), Message: Message{Key: "3"}},
+	}
+	store := &MockStore{}
+	store.On("GetRecordsAfterWatermark", start, uuid.Nil, defaultWatermarkBatchSize).Return(records, nil)
+	broker := &MockBroker{}
+	broker.On("Send", MetadataHeaders{}.withMetadataHeaders(records[0])).Return(nil)
+	broker.On("Send", MetadataHeaders{}.withMetadataHeaders(records[1])).Return(errors.New("broker error"))
+
+	selector := newWatermarkSelector(store, start, 0)
+	d := defaultRecordProcessor{
+		messageBroker: broker,
+		time:          timeProvider,
+		store:         store,
+		machineID:     "1",
+		selector:      selector,
+	}
+	err := d.ProcessRecords()
+
+	assert.NotNil(t, err)
+	assert.Equal(t, records[0].CreatedOn, selector.createdOn)
+	assert.Equal(t, records[0].ID, selector.id)
+	broker.AssertNumberOfCalls(t, "Send", 2)
+}
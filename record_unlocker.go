@@ -12,8 +12,8 @@ type recordUnlocker struct {
 	MaxLockTimeDurationMins time2.Duration
 }
 
-func newRecordUnlocker(store Store, maxLockTimeDurationMins time2.Duration) recordUnlocker {
-	return recordUnlocker{MaxLockTimeDurationMins: maxLockTimeDurationMins, store: store, time: time.NewTimeProvider()}
+func newRecordUnlocker(store Store, maxLockTimeDurationMins time2.Duration, clock time.Provider) recordUnlocker {
+	return recordUnlocker{MaxLockTimeDurationMins: maxLockTimeDurationMins, store: store, time: clock}
 }
 
 func (d recordUnlocker) UnlockExpiredMessages() error {
@@ -5,8 +5,10 @@ import (
 	"testing"
 	time2 "time"
 
+	"github.com/google/uuid"
 	"github.com/pkritiotis/outbox/internal/time"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
 )
 
 func Test_recordUnlocker_unlockExpiredMessages(t *testing.T) {
@@ -65,7 +67,50 @@ func Test_newRecordUnlocker(t *testing.T) {
 		MaxLockTimeDurationMins: duration,
 	}
 
-	rc := newRecordUnlocker(mStore, duration)
+	rc := newRecordUnlocker(mStore, duration, timeProvider)
 
 	assert.Equal(t, expRecordUnlocker, rc)
 }
+
+// Test_recordUnlocker_crashedDispatcher simulates a dispatcher crashing in the middle of a batch. The records keep
+// their PendingDelivery state while they are locked, so once the lock checker clears the expired locks the records
+// that were not delivered are published by another dispatcher, and the delivered ones are not published again
+func Test_recordUnlocker_crashedDispatcher(t *testing.T) {
+	maxLockDuration := 10 * time2.Minute
+	delivered, stranded := uuid.New(), uuid.New()
+	store := &lockTableStore{records: map[uuid.UUID]Record{
+		delivered: {ID: delivered, State: PendingDelivery, Message: Message{Key: "1"}},
+		stranded:  {ID: stranded, State: PendingDelivery, Message: Message{Key: "2"}},
+	}}
+
+	// The crashed dispatcher locks the batch and delivers a single record
+	crashed := newStateSelector(store, "crashed", skewedClock{}, 0)
+	recs, err := crashed.selectRecords()
+	assert.Nil(t, err)
+	assert.Len(t, recs, 2)
+	assert.Nil(t, crashed.markDelivered(store.records[delivered], time2.Now()))
+
+	broker := &MockBroker{}
+	broker.On("Send", MetadataHeaders{}.withMetadataHeaders(store.records[stranded])).Return(nil)
+	survivor := defaultRecordProcessor{
+		messageBroker: broker,
+		store:         store,
+		time:          skewedClock{skew: maxLockDuration + time2.Minute},
+		machineID:     "survivor",
+		selector:      newStateSelector(store, "survivor", skewedClock{skew: maxLockDuration + time2.Minute}, 0),
+	}
+
+	// The stranded record is not published while the lock of the crashed dispatcher is valid
+	assert.Nil(t, survivor.ProcessRecords())
+	broker.AssertNotCalled(t, "Send", mock.Anything)
+	assert.Equal(t, PendingDelivery, store.records[stranded].State)
+
+	unlocker := newRecordUnlocker(store, maxLockDuration, skewedClock{skew: maxLockDuration + time2.Minute})
+	assert.Nil(t, unlocker.UnlockExpiredMessages())
+	assert.Equal(t, 1, store.reaped)
+	assert.Nil(t, survivor.ProcessRecords())
+
+	broker.AssertNumberOfCalls(t, "Send", 1)
+	assert.Equal(t, Delivered, store.records[stranded].State)
+	assert.Equal(t, Delivered, store.records[delivered].State)
+}
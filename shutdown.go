@@ -0,0 +1,74 @@
+package outbox
+
+import "sync"
+
+// shutdown signals the stop of the dispatcher to its processor, and the end of the processor to the application.
+// It is shared by the Dispatcher and its processor. The channels are created on first use
+type shutdown struct {
+	mu       sync.Mutex
+	stopping chan struct{}
+	stopped  chan struct{}
+}
+
+func (s *shutdown) channels() (stopping, stopped chan struct{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopping == nil {
+		s.stopping = make(chan struct{})
+		s.stopped = make(chan struct{})
+	}
+	return s.stopping, s.stopped
+}
+
+// stoppingC returns a channel closed once the dispatcher is stopped, or a nil channel without a shutdown
+func (s *shutdown) stoppingC() <-chan struct{} {
+	if s == nil {
+		return nil
+	}
+	stopping, _ := s.channels()
+	return stopping
+}
+
+// isStopping reports whether the dispatcher is stopped
+func (s *shutdown) isStopping() bool {
+	select {
+	case <-s.stoppingC():
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *shutdown) stop() {
+	if s == nil {
+		return
+	}
+	stopping, _ := s.channels()
+	closeOnce(&s.mu, stopping)
+}
+
+func (s *shutdown) finish() {
+	if s == nil {
+		return
+	}
+	_, stopped := s.channels()
+	closeOnce(&s.mu, stopped)
+}
+
+func closeOnce(mu *sync.Mutex, ch chan struct{}) {
+	mu.Lock()
+	defer mu.Unlock()
+	select {
+	case <-ch:
+	default:
+		close(ch)
+	}
+}
+
+// Stopped returns a channel closed once the record processor has stopped after the doneChan of Run is signaled, i.e.
+// once the in-flight acknowledgements of the last batch are stored and its locks released. Close the broker and the
+// store after it
+func (d Dispatcher) Stopped() <-chan struct{} {
+	_, stopped := d.shutdown.channels()
+	return stopped
+}
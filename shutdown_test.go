@@ -0,0 +1,102 @@
+package outbox
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	time2 "github.com/pkritiotis/outbox/internal/time"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func Test_defaultRecordProcessor_ProcessRecords_shutdown(t *testing.T) {
+	sampleTime := time.Now().UTC()
+	timeProvider := &time2.MockProvider{}
+	timeProvider.On("Now").Return(sampleTime)
+	machineID := "1"
+
+	var records []Record
+	for i := 0; i < 4; i++ {
+		records = append(records, Record{
+			ID:      uuid.New(),
+			Message: Message{Key: fmt.Sprintf("key-%d", i)},
+			State:   PendingDelivery,
+		})
+	}
+
+	store := &MockStore{}
+	store.On("UpdateRecordsLockByStates", machineID, sampleTime, []RecordState{PendingDelivery}, 0).Return(nil)
+	store.On("GetRecordsByLockID", machineID).Return(records, nil)
+	store.On("ClearLocksByLockID", machineID).Return(nil)
+	for _, rec := range records[1:] {
+		store.On("MarkProcessed", rec.ID, 1, sampleTime, machineID).Return(nil)
+	}
+	broker := &asyncBroker{lostKey: "key-0"}
+
+	stop := &shutdown{}
+	d := defaultRecordProcessor{
+		messageBroker:      broker,
+		time:               timeProvider,
+		store:              store,
+		machineID:          machineID,
+		orderingMode:       Unordered,
+		ackTimeout:         time.Minute,
+		shutdownAckTimeout: 50 * time.Millisecond,
+		selector:           stateSelector{store: store, time: timeProvider, lockID: machineID},
+		shutdown:           stop,
+	}
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		stop.stop()
+		broker.ackPending()
+	}()
+	start := time.Now()
+	err := d.ProcessRecords()
+
+	assert.Nil(t, err)
+	assert.Less(t, time.Since(start), time.Minute)
+	store.AssertExpectations(t)
+	store.AssertNotCalled(t, "RecordFailures", mock.Anything, mock.Anything)
+	store.AssertNotCalled(t, "RecordFailure", mock.Anything, mock.Anything)
+
+	// No new batch is locked once the dispatcher is stopped
+	assert.Nil(t, d.ProcessRecords())
+	store.AssertNumberOfCalls(t, "UpdateRecordsLockByStates", 1)
+}
+
+func TestDispatcher_Stopped(t *testing.T) {
+	processor := &mockRecordProcessor{}
+	processor.On("ProcessRecords").Return(nil)
+	unlocker := &mockRecordUnlocker{}
+	unlocker.On("UnlockExpiredMessages").Return(nil)
+	cleaner := &mockRecordCleaner{}
+	cleaner.On("RemoveExpiredMessages").Return(nil)
+	d := Dispatcher{
+		recordProcessor: processor,
+		recordUnlocker:  unlocker,
+		recordCleaner:   cleaner,
+		settings: DispatcherSettings{
+			ProcessInterval:       time.Hour,
+			LockCheckerInterval:   time.Hour,
+			CleanupWorkerInterval: time.Hour,
+		},
+		shutdown: &shutdown{},
+	}
+	doneChan := make(chan struct{})
+	d.Run(make(chan error), doneChan)
+
+	select {
+	case <-d.Stopped():
+		t.Fatal("the dispatcher should not be stopped before doneChan is signaled")
+	default:
+	}
+	doneChan <- struct{}{}
+	select {
+	case <-d.Stopped():
+	case <-time.After(time.Second):
+		t.Fatal("the dispatcher should be stopped once doneChan is signaled")
+	}
+	assert.True(t, d.shutdown.isStopping())
+}
@@ -0,0 +1,46 @@
+package outbox
+
+import "time"
+
+// DispatcherStatus describes the runtime controls of the dispatcher
+type DispatcherStatus struct {
+	// Paused is true while the whole dispatch is paused with Pause
+	Paused bool
+	// PausedTopics are the topics whose records are not dispatched, in alphabetical order
+	PausedTopics []string
+}
+
+// Backlog returns the number of PendingDelivery records and the age of the oldest one. It queries the store
+func (d Dispatcher) Backlog() (Backlog, error) {
+	backlog, err := d.store.GetBacklogByState(PendingDelivery)
+	if err != nil {
+		return Backlog{}, err
+	}
+	if backlog.OldestCreatedOn != nil {
+		backlog.OldestAge = d.time.Now().UTC().Sub(*backlog.OldestCreatedOn)
+	}
+	return backlog, nil
+}
+
+// Status returns the current status of the runtime controls of the dispatcher
+func (d Dispatcher) Status() DispatcherStatus {
+	return DispatcherStatus{Paused: d.pausedTopics.isAllPaused(), PausedTopics: d.pausedTopics.list()}
+}
+
+// Store returns the store of the dispatcher, which is limited to MaxDBConcurrency concurrent calls if it is set, e.g. to
+// serve it with admin.Handler within the limit
+func (d Dispatcher) Store() Store {
+	return d.store
+}
+
+// Clock returns the Clock of the dispatcher, the local clock if the Clock setting is not set
+func (d Dispatcher) Clock() Clock {
+	return d.time
+}
+
+// ReleaseStaleLocks clears the locks acquired or last extended more than olderThan ago, e.g. to release the records
+// of a crashed dispatcher before the lock checker does. The records of a dispatcher still publishing them may be
+// published twice if olderThan is too short
+func (d Dispatcher) ReleaseStaleLocks(olderThan time.Duration) error {
+	return d.store.ClearLocksWithDurationBeforeDate(d.time.Now().UTC().Add(-olderThan))
+}
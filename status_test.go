@@ -0,0 +1,73 @@
+package outbox
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	time2 "github.com/pkritiotis/outbox/internal/time"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDispatcher_Backlog(t *testing.T) {
+	sampleTime := time.Now().UTC()
+	timeProvider := &time2.MockProvider{}
+	timeProvider.On("Now").Return(sampleTime)
+	oldest := sampleTime.Add(-time.Minute)
+
+	tests := map[string]struct {
+		store      *MockStore
+		expBacklog Backlog
+		expErr     error
+	}{
+		"Pending records should return the age of the oldest one": {
+			store: func() *MockStore {
+				mp := MockStore{}
+				mp.On("GetBacklogByState", PendingDelivery).Return(Backlog{Records: 3, OldestCreatedOn: &oldest}, nil)
+				return &mp
+			}(),
+			expBacklog: Backlog{Records: 3, OldestCreatedOn: &oldest, OldestAge: time.Minute},
+			expErr:     nil,
+		},
+		"No pending records should return an empty backlog": {
+			store: func() *MockStore {
+				mp := MockStore{}
+				mp.On("GetBacklogByState", PendingDelivery).Return(Backlog{}, nil)
+				return &mp
+			}(),
+			expBacklog: Backlog{},
+			expErr:     nil,
+		},
+		"Error in the store should return an error": {
+			store: func() *MockStore {
+				mp := MockStore{}
+				mp.On("GetBacklogByState", PendingDelivery).Return(Backlog{}, errors.New("db error"))
+				return &mp
+			}(),
+			expBacklog: Backlog{},
+			expErr:     errors.New("db error"),
+		},
+	}
+	for name, test := range tests {
+		tt := test
+		t.Run(name, func(t *testing.T) {
+			d := Dispatcher{store: tt.store, time: timeProvider}
+			backlog, err := d.Backlog()
+			assert.Equal(t, tt.expBacklog, backlog)
+			assert.Equal(t, tt.expErr, err)
+		})
+	}
+}
+
+func TestDispatcher_ReleaseStaleLocks(t *testing.T) {
+	sampleTime := time.Now().UTC()
+	timeProvider := &time2.MockProvider{}
+	timeProvider.On("Now").Return(sampleTime)
+	store := &MockStore{}
+	store.On("ClearLocksWithDurationBeforeDate", sampleTime.Add(-10*time.Minute)).Return(nil)
+
+	d := Dispatcher{store: store, time: timeProvider}
+
+	assert.Nil(t, d.ReleaseStaleLocks(10*time.Minute))
+	store.AssertExpectations(t)
+}
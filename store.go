@@ -1,6 +1,7 @@
 package outbox
 
 import (
+	"context"
 	"database/sql"
 	"time"
 
@@ -19,6 +20,26 @@ type Record struct {
 	NumberOfAttempts int
 	LastAttemptOn    *time.Time
 	Error            *string
+	// ExpiresAt is the optional time after which the record should no longer be published
+	ExpiresAt *time.Time
+	// NextRetryAt is the earliest time of the next delivery attempt, set by the RetrialPolicy Backoff
+	NextRetryAt *time.Time
+	// Sequence is the gap-free sequence number of the record among the records of its topic and message key,
+	// set by the stores numbering the records per key
+	Sequence *int64
+	// PublishHandle is the handle of the publish prepared by a TransactionalMessageBroker that is not committed or
+	// aborted yet
+	PublishHandle *string
+}
+
+// Backlog describes the records waiting in a state
+type Backlog struct {
+	// Records is the number of records
+	Records int64
+	// OldestCreatedOn is the creation time of the oldest record, nil if there are no records
+	OldestCreatedOn *time.Time
+	// OldestAge is the age of the oldest record, set by Dispatcher.Backlog with the clock of the dispatcher
+	OldestAge time.Duration
 }
 
 // RecordState is the State of the Record
@@ -31,22 +52,143 @@ const (
 	Delivered
 	// MaxAttemptsReached indicates that the message is not Delivered but the max attempts are reached so it shouldn't be delivered
 	MaxAttemptsReached
+	// Exported indicates that the message was not Delivered but exported through the Dispatcher DrainToWriter,
+	// so it is excluded from the dispatch
+	Exported
+	// Expired indicates that the message was not Delivered because it expired before it could be published
+	Expired
 )
 
+// MaxNextRetryDelay is the furthest after now the next retry time of a record can be set with Store.SetNextRetryAt, so
+// that a mistyped time does not hide a record for years
+const MaxNextRetryDelay = 30 * 24 * time.Hour
+
+// TerminalRecordStates returns the states of the records that are no longer dispatched, which are the only records
+// removed by the message retention
+func TerminalRecordStates() []RecordState {
+	return []RecordState{Delivered, MaxAttemptsReached, Exported, Expired}
+}
+
+// RecordFailure is the outcome of a failed delivery attempt of a record
+type RecordFailure struct {
+	ID               uuid.UUID
+	State            RecordState
+	Error            string
+	NumberOfAttempts int
+	LastAttemptOn    time.Time
+	// NextRetryAt is the earliest time of the next delivery attempt. The record is due immediately if it is nil
+	NextRetryAt *time.Time
+}
+
+// Attempt is the audit entry of a publish attempt of a record
+type Attempt struct {
+	RecordID uuid.UUID
+	Topic    string
+	// Number is the number of the attempt of the record, starting from 1
+	Number      int
+	AttemptedOn time.Time
+	// Error is the error of the attempt, it is nil if the message was published
+	Error *string
+}
+
 // Store is the interface that should be implemented by SQL-like database drivers to support the outbox functionality
 type Store interface {
-	// AddRecordTx stores the message within the provided database transaction
+	// AddRecordTx stores the message within the provided database transaction. It returns ErrDuplicateRecord if the
+	// record id exists or the store enforces a business key that conflicts with a pending record
 	AddRecordTx(record Record, tx *sql.Tx) error
-	// GetRecordsByLockID returns the records by lockID
+	// AddRecord stores the record outside of a transaction. It returns ErrDuplicateRecord if the record id exists
+	AddRecord(ctx context.Context, record Record) error
+	// GetRecordsByLockID returns the records by lockID ordered by their creation time
 	GetRecordsByLockID(lockID string) ([]Record, error)
-	// UpdateRecordLockByState updates the lock of all records with the provided state
+	// IterateRecordsByLockID streams the records locked by lockID ordered by their creation time to fn,
+	// stopping at the first error returned by fn
+	IterateRecordsByLockID(ctx context.Context, lockID string, fn func(Record) error) error
+	// GetRecordsAfterWatermark returns up to limit records created after the provided (createdOn, id) pair,
+	// ordered by their creation time and id
+	GetRecordsAfterWatermark(createdOn time.Time, id uuid.UUID, limit int) ([]Record, error)
+	// GetRecordIDsByStateCreatedBefore returns the ids of up to limit records with the provided state that were
+	// created before the provided time
+	GetRecordIDsByStateCreatedBefore(state RecordState, createdBefore time.Time, limit int) ([]uuid.UUID, error)
+	// GetRecordByID returns the record with the provided id, or ErrRecordNotFound if it does not exist
+	GetRecordByID(id uuid.UUID) (Record, error)
+	// GetRecordsByState returns up to limit records with the provided state created after the provided
+	// (createdOn, id) pair, ordered by their creation time and id
+	GetRecordsByState(state RecordState, createdOn time.Time, id uuid.UUID, limit int) ([]Record, error)
+	// RequeueRecord moves the MaxAttemptsReached record with the provided id back to PendingDelivery, resetting its
+	// attempts and error. It returns ErrRecordNotFound if there is no such record in the MaxAttemptsReached state
+	RequeueRecord(id uuid.UUID) error
+	// ReplaceExportedRecord stores the provided PendingDelivery record in place of the unlocked Exported record with the
+	// same id, e.g. to import again a record drained with its id. It returns ErrDuplicateRecord if the stored record is
+	// in another state or locked, or conflicts with the business key of a pending record, and ErrRecordNotFound if there
+	// is no record with the id
+	ReplaceExportedRecord(ctx context.Context, record Record) error
+	// SetNextRetryAt overrides the next retry time of the PendingDelivery record with the provided id, so that it is
+	// retried earlier or later than scheduled by the backoff. The time must be in UTC and at most MaxNextRetryDelay
+	// after now, and the stores may reject the times out of their range. It returns ErrRecordNotFound if there is no
+	// such record in the PendingDelivery state
+	SetNextRetryAt(id uuid.UUID, nextRetryAt time.Time) error
+	// GetBacklogByState returns the number of records with the provided state and the creation time of the oldest one
+	GetBacklogByState(state RecordState) (Backlog, error)
+	// UpdateRecordLockByState updates the lock of all unlocked records with the provided state, including the records
+	// whose next retry time is after lockedOn, e.g. to drain them. The dispatch locks only the due records with
+	// UpdateRecordsLockByStates
 	UpdateRecordLockByState(lockID string, lockedOn time.Time, state RecordState) error
+	// UpdateRecordsLockByStates updates the lock of up to limit unlocked records with any of the provided states that
+	// are due for delivery. The stores should lock the records that have been due the longest first, by their next
+	// retry time or else their creation time, so that the new and the retried records are interleaved fairly, unless
+	// they are configured otherwise. All the due records are locked if limit is not positive
+	UpdateRecordsLockByStates(lockID string, lockedOn time.Time, states []RecordState, limit int) error
+	// UpdateRecordsLockByStatesExcludingTopics updates the lock of up to limit unlocked records like
+	// UpdateRecordsLockByStates, leaving out the records of the excluded topics, so that the records of the paused
+	// topics do not fill the batches. The stores that cannot filter some records by topic lock them like
+	// UpdateRecordsLockByStates
+	UpdateRecordsLockByStatesExcludingTopics(lockID string, lockedOn time.Time, states []RecordState, limit int, excludedTopics []string) error
 	// UpdateRecordByID updates the provided the record
 	UpdateRecordByID(message Record) error
-	// ClearLocksWithDurationBeforeDate clears the locks of records with a lock time before the provided time
+	// MarkProcessed marks the record with the provided id as delivered after numberOfAttempts attempts without
+	// rewriting its message. The update only applies while the record is locked by lockID, otherwise
+	// ErrRecordLockLost is returned
+	MarkProcessed(id uuid.UUID, numberOfAttempts int, processedOn time.Time, lockID string) error
+	// RecordFailure stores the outcome of a failed delivery attempt without rewriting the record message. The update
+	// only applies while the record is locked by lockID, otherwise ErrRecordLockLost is returned
+	RecordFailure(failure RecordFailure, lockID string) error
+	// RecordFailures stores the outcomes of the failed delivery attempts of multiple records in a single transaction
+	// without rewriting the record messages. The records no longer locked by lockID are left unchanged, and
+	// ErrRecordLockLost is returned once the outcomes of the other records are stored
+	RecordFailures(failures []RecordFailure, lockID string) error
+	// MarkExported marks the record with the provided id as Exported and clears its lock without rewriting its message.
+	// The update only applies while the record is locked by lockID, otherwise ErrRecordLockLost is returned
+	MarkExported(id uuid.UUID, lockID string) error
+	// SetLock updates the lock information of the record with the provided id without rewriting its message
+	SetLock(id uuid.UUID, lockID *string, lockedOn *time.Time) error
+	// ExtendLock refreshes the lock time of all records locked by lockID
+	ExtendLock(lockID string, lockedOn time.Time) error
+	// ClearLocksWithDurationBeforeDate clears the locks of records with a lock time before the provided time.
+	// The lock time is the time the lock was acquired or last extended with ExtendLock
 	ClearLocksWithDurationBeforeDate(time time.Time) error
 	// ClearLocksByLockID clears all records locked by the provided lockID
 	ClearLocksByLockID(lockID string) error
-	// RemoveRecordsBeforeDatetime removes all records before the provided time
-	RemoveRecordsBeforeDatetime(expiryTime time.Time) error
+	// RemoveRecordsBeforeDatetime removes the unlocked records in a TerminalRecordStates state created before the
+	// provided time. The records in the other states, locked, or with a PublishHandle left for
+	// Dispatcher.RecoverPreparedPublishes are never removed, and are returned as skipped with the removed ones
+	RemoveRecordsBeforeDatetime(expiryTime time.Time) (removed int64, skipped int64, err error)
+	// RemoveRecordsByIDs removes the unlocked records in a TerminalRecordStates state with the provided ids, e.g. after
+	// they were archived. The ids of the pending and locked records, and of the records with a PublishHandle, are
+	// skipped, and are returned as skipped with the removed ones. The duplicate ids are counted once
+	RemoveRecordsByIDs(ids []uuid.UUID) (removed int64, skipped int64, err error)
+	// AddAttempts appends the audit entries of the provided publish attempts. The entries are never updated
+	AddAttempts(attempts []Attempt) error
+	// RemoveAttemptsBeforeDatetime removes the audit entries of the attempts made before the provided time and
+	// returns the number of removed entries
+	RemoveAttemptsBeforeDatetime(before time.Time) (int64, error)
+	// SetPublishHandle stores the handle of the publish prepared for the record with the provided id.
+	// The update only applies while the record is locked by lockID, otherwise ErrRecordLockLost is returned
+	SetPublishHandle(id uuid.UUID, lockID string, handle string) error
+	// ClearPublishHandle clears the handle of the record with the provided id once its prepared publish is committed
+	// or aborted. The update only applies while the record holds the provided handle
+	ClearPublishHandle(id uuid.UUID, handle string) error
+	// GetRecordsWithPublishHandle returns up to limit unlocked records holding a publish handle, whose prepared
+	// publish was neither committed nor aborted by the dispatcher that prepared it. The Delivered records processed
+	// after deliveredBefore are left out, since the dispatcher that delivered them may still be committing them
+	GetRecordsWithPublishHandle(deliveredBefore time.Time, limit int) ([]Record, error)
 }
@@ -0,0 +1,61 @@
+package mysql
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkritiotis/outbox"
+)
+
+// attemptsSchema is the script that creates the audit table of the publish attempts
+const attemptsSchema = `CREATE TABLE IF NOT EXISTS outbox_attempts (
+        id BIGINT NOT NULL AUTO_INCREMENT,
+        record_id varchar(100) NOT NULL,
+        topic varchar(255) NOT NULL,
+        attempt INT NOT NULL,
+        attempted_on DATETIME NOT NULL,
+        error TEXT NULL,
+        PRIMARY KEY (id),
+        INDEX idx_outbox_attempts_record_id (record_id),
+        INDEX idx_outbox_attempts_attempted_on (attempted_on)
+)`
+
+// maxAttemptsPerStatement is the maximum number of attempts inserted by a single statement
+const maxAttemptsPerStatement = 500
+
+// AddAttempts inserts the audit entries of the attempts in statements of up to maxAttemptsPerStatement rows
+func (s Store) AddAttempts(attempts []outbox.Attempt) error {
+	for len(attempts) > 0 {
+		chunk := attempts
+		if len(chunk) > maxAttemptsPerStatement {
+			chunk = chunk[:maxAttemptsPerStatement]
+		}
+		attempts = attempts[len(chunk):]
+
+		q := "INSERT INTO outbox_attempts (record_id, topic, attempt, attempted_on, error) VALUES "
+		args := make([]interface{}, 0, 5*len(chunk))
+		for i, a := range chunk {
+			if i > 0 {
+				q += ","
+			}
+			q += "(?,?,?,?,?)"
+			args = append(args, a.RecordID, a.Topic, a.Number, a.AttemptedOn, a.Error)
+		}
+		_, err := s.exec(context.Background(), "AddAttempts", q, args...)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RemoveAttemptsBeforeDatetime removes the audit entries of the attempts made before the provided time
+func (s Store) RemoveAttemptsBeforeDatetime(before time.Time) (int64, error) {
+	res, err := s.exec(context.Background(), "RemoveAttemptsBeforeDatetime",
+		`DELETE FROM outbox_attempts WHERE attempted_on < ?`,
+		before)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
@@ -0,0 +1,77 @@
+package mysql
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkritiotis/outbox"
+)
+
+// defaultBacklogRefreshInterval is the default interval of the pending records count of the backlog guard
+const defaultBacklogRefreshInterval = 10 * time.Second
+
+// backlogGuard rejects the inserts while the number of pending records exceeds max. The number is counted at most
+// once every refreshInterval, by the insert that finds it stale, and the inserts in between add to it, so that the
+// guard does not add a COUNT to every insert
+type backlogGuard struct {
+	max             int64
+	refreshInterval time.Duration
+	count           atomic.Int64
+	mu              sync.Mutex
+	refreshedAt     time.Time
+	now             func() time.Time
+}
+
+func newBacklogGuard(max int64, refreshInterval time.Duration) *backlogGuard {
+	if max <= 0 {
+		return nil
+	}
+	if refreshInterval <= 0 {
+		refreshInterval = defaultBacklogRefreshInterval
+	}
+	return &backlogGuard{max: max, refreshInterval: refreshInterval, now: time.Now}
+}
+
+// check returns an outbox.ErrOutboxFull error if the backlog exceeds the maximum, refreshing it with count if it is
+// stale. Only one insert refreshes the count at a time, the others check the previous count. A failed count keeps the
+// previous count until the next refresh, so that the guard never blocks the inserts on its own
+func (g *backlogGuard) check(count func() (int64, bool)) error {
+	if g == nil {
+		return nil
+	}
+	if g.mu.TryLock() {
+		if g.now().Sub(g.refreshedAt) >= g.refreshInterval {
+			if n, ok := count(); ok {
+				g.count.Store(n)
+			}
+			g.refreshedAt = g.now()
+		}
+		g.mu.Unlock()
+	}
+	if n := g.count.Load(); n >= g.max {
+		return fmt.Errorf("%w: %d pending records, the maximum is %d", outbox.ErrOutboxFull, n, g.max)
+	}
+	return nil
+}
+
+// added counts an inserted record until the next refresh
+func (g *backlogGuard) added() {
+	if g != nil {
+		g.count.Add(1)
+	}
+}
+
+// checkBacklog checks the backlog guard, if MaxBacklog is set. A failed count is logged
+func (s Store) checkBacklog(ctx context.Context) error {
+	return s.backlogGuard.check(func() (int64, bool) {
+		backlog, err := s.GetBacklogByState(outbox.PendingDelivery)
+		if err != nil {
+			s.logger.WarnContext(ctx, "Could not count the outbox backlog", "error", err)
+			return 0, false
+		}
+		return backlog.Records, true
+	})
+}
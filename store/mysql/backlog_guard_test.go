@@ -0,0 +1,54 @@
+package mysql
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/pkritiotis/outbox"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_backlogGuard_check(t *testing.T) {
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	g := newBacklogGuard(3, time.Minute)
+	g.now = func() time.Time { return now }
+	counts := 0
+	pending := int64(1)
+	ok := true
+	count := func() (int64, bool) {
+		counts++
+		return pending, ok
+	}
+
+	assert.Nil(t, g.check(count))
+	g.added()
+	assert.Nil(t, g.check(count))
+	g.added()
+	assert.True(t, errors.Is(g.check(count), outbox.ErrOutboxFull))
+	assert.Equal(t, 1, counts)
+
+	// The records delivered in the meantime are counted once the count is stale
+	now = now.Add(time.Minute)
+	assert.Nil(t, g.check(count))
+	assert.Equal(t, 2, counts)
+
+	// A failed count keeps the previous count
+	now = now.Add(time.Minute)
+	pending, ok = 10, false
+	assert.Nil(t, g.check(count))
+	assert.Equal(t, 3, counts)
+
+	now = now.Add(time.Minute)
+	ok = true
+	assert.True(t, errors.Is(g.check(count), outbox.ErrOutboxFull))
+}
+
+func Test_newBacklogGuard(t *testing.T) {
+	assert.Nil(t, newBacklogGuard(0, time.Minute))
+	assert.Equal(t, defaultBacklogRefreshInterval, newBacklogGuard(1, 0).refreshInterval)
+
+	var disabled *backlogGuard
+	assert.Nil(t, disabled.check(func() (int64, bool) { return 100, true }))
+	disabled.added()
+}
@@ -0,0 +1,89 @@
+package mysql
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+const (
+	defaultClockRefreshInterval = time.Minute
+	clockQueryTimeout           = 5 * time.Second
+)
+
+// DBClock is an outbox.Clock following the database clock, so that all the outbox instances take their time
+// decisions with the same clock regardless of the skew of their local clocks. It measures the offset of the
+// database clock from the local clock every refresh interval and applies it to the local clock in between
+type DBClock struct {
+	fetch           func(ctx context.Context) (time.Time, error)
+	local           func() time.Time
+	refreshInterval time.Duration
+
+	mu          sync.Mutex
+	logger      *slog.Logger
+	offset      time.Duration
+	refreshedAt time.Time
+	synced      bool
+}
+
+// NewDBClock constructs a DBClock reading the clock of the db. The refresh interval defaults to one minute
+func NewDBClock(db *sql.DB, refreshInterval time.Duration) *DBClock {
+	return newDBClock(func(ctx context.Context) (time.Time, error) {
+		var now time.Time
+		err := db.QueryRowContext(ctx, "SELECT UTC_TIMESTAMP(6)").Scan(&now)
+		return now, err
+	}, time.Now, refreshInterval)
+}
+
+func newDBClock(fetch func(ctx context.Context) (time.Time, error), local func() time.Time, refreshInterval time.Duration) *DBClock {
+	if refreshInterval <= 0 {
+		refreshInterval = defaultClockRefreshInterval
+	}
+	return &DBClock{fetch: fetch, local: local, refreshInterval: refreshInterval}
+}
+
+// SetLogger sets the logger of the failed reads of the database clock, slog.Default() by default
+func (c *DBClock) SetLogger(logger *slog.Logger) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.logger = logger
+}
+
+// Now returns the current database time. It queries the database when the last query, successful or not, is older
+// than the refresh interval, and keeps using the last offset if the query fails. Until a query succeeds, e.g. while
+// the database is unreachable at startup, it returns the local time
+func (c *DBClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.local()
+	if c.refreshedAt.IsZero() || now.Sub(c.refreshedAt) >= c.refreshInterval {
+		c.refresh()
+		now = c.local()
+	}
+	return now.Add(c.offset).UTC()
+}
+
+// refresh measures the offset of the database clock, assuming that the query took the same time to reach the
+// database and to return
+func (c *DBClock) refresh() {
+	ctx, cancel := context.WithTimeout(context.Background(), clockQueryTimeout)
+	defer cancel()
+	before := c.local()
+	dbNow, err := c.fetch(ctx)
+	after := c.local()
+	c.refreshedAt = after
+	if err != nil {
+		if !c.synced {
+			loggerOrDefault(c.logger).Warn("Could not read the database clock, using the local clock",
+				slog.Duration("retry_in", c.refreshInterval), slog.String("error", err.Error()))
+			return
+		}
+		loggerOrDefault(c.logger).Warn("Could not read the database clock, using the last known offset",
+			slog.Duration("offset", c.offset), slog.String("error", err.Error()))
+		return
+	}
+	c.offset = dbNow.Sub(before.Add(after.Sub(before) / 2))
+	c.synced = true
+}
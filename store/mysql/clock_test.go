@@ -0,0 +1,71 @@
+package mysql
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDBClock_Now(t *testing.T) {
+	local := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	skew := time.Hour
+	var fetchErr error
+	fetches := 0
+	c := newDBClock(func(context.Context) (time.Time, error) {
+		fetches++
+		return local.Add(skew), fetchErr
+	}, func() time.Time { return local }, time.Minute)
+
+	assert.Equal(t, local.Add(time.Hour), c.Now())
+	assert.Equal(t, 1, fetches)
+
+	// The offset is reused within the refresh interval
+	local = local.Add(30 * time.Second)
+	skew = 2 * time.Hour
+	assert.Equal(t, local.Add(time.Hour), c.Now())
+	assert.Equal(t, 1, fetches)
+
+	// The offset is measured again after the refresh interval
+	local = local.Add(time.Minute)
+	assert.Equal(t, local.Add(2*time.Hour), c.Now())
+	assert.Equal(t, 2, fetches)
+
+	// The last offset is kept if the database clock can not be read
+	local = local.Add(time.Minute)
+	fetchErr = errors.New("db error")
+	assert.Equal(t, local.Add(2*time.Hour), c.Now())
+	assert.Equal(t, 3, fetches)
+}
+
+func TestDBClock_Now_unsynced(t *testing.T) {
+	local := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	fetchErr := errors.New("db unreachable")
+	fetches := 0
+	c := newDBClock(func(context.Context) (time.Time, error) {
+		fetches++
+		return local.Add(time.Hour), fetchErr
+	}, func() time.Time { return local }, time.Minute)
+
+	// The local clock is used until the database clock is read
+	assert.Equal(t, local, c.Now())
+	assert.Equal(t, 1, fetches)
+
+	// The failed query is not retried within the refresh interval
+	local = local.Add(30 * time.Second)
+	assert.Equal(t, local, c.Now())
+	assert.Equal(t, 1, fetches)
+
+	// The query is retried after the refresh interval
+	local = local.Add(time.Minute)
+	fetchErr = nil
+	assert.Equal(t, local.Add(time.Hour), c.Now())
+	assert.Equal(t, 2, fetches)
+}
+
+func Test_newDBClock(t *testing.T) {
+	c := newDBClock(nil, time.Now, 0)
+	assert.Equal(t, defaultClockRefreshInterval, c.refreshInterval)
+}
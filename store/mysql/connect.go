@@ -0,0 +1,45 @@
+package mysql
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/pkritiotis/outbox"
+)
+
+// defaultConnectBackoff is the delay between the connection attempts of NewStoreContext if ConnectBackoff is not set
+var defaultConnectBackoff = outbox.ExponentialBackoff{InitialDelay: time.Second, MaxDelay: 30 * time.Second}
+
+// connect pings the database up to attempts times, waiting for the backoff delay between the attempts, until it is
+// reachable or the context is done. It returns the error of the last ping
+func connect(ctx context.Context, ping func(ctx context.Context) error, attempts int, backoff outbox.BackoffPolicy, logger *slog.Logger) error {
+	if attempts < 1 {
+		attempts = 1
+	}
+	if backoff == nil {
+		backoff = defaultConnectBackoff
+	}
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = ping(ctx)
+		if err == nil {
+			return nil
+		}
+		if attempt >= attempts {
+			return fmt.Errorf("could not connect to the database after %d attempts: %w", attempt, err)
+		}
+		delay := backoff.NextRetryDelay(attempt)
+		logger.WarnContext(ctx, "Could not connect to the database, retrying",
+			"attempt", attempt, "attempts", attempts, "delay", delay, "error", err)
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("could not connect to the database after %d attempts: %w", attempt, errors.Join(ctx.Err(), err))
+		case <-timer.C:
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package mysql
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/pkritiotis/outbox"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_connect(t *testing.T) {
+	pingErr := errors.New("connection refused")
+	backoff := outbox.ExponentialBackoff{InitialDelay: time.Millisecond}
+
+	tests := map[string]struct {
+		failures    int
+		attempts    int
+		timeout     time.Duration
+		expPings    int
+		expErr      error
+		expErrIsCtx bool
+	}{
+		"Reachable database should be pinged once": {
+			attempts: 3,
+			expPings: 1,
+		},
+		"Database reachable after retries should connect": {
+			failures: 2,
+			attempts: 3,
+			expPings: 3,
+		},
+		"Unreachable database should fail after the attempts": {
+			failures: 5,
+			attempts: 3,
+			expPings: 3,
+			expErr:   pingErr,
+		},
+		"Default should fail on the first ping": {
+			failures: 1,
+			expPings: 1,
+			expErr:   pingErr,
+		},
+		"Context deadline should stop the retries": {
+			failures:    5,
+			attempts:    100,
+			timeout:     time.Nanosecond,
+			expPings:    1,
+			expErr:      pingErr,
+			expErrIsCtx: true,
+		},
+	}
+	for name, test := range tests {
+		tt := test
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			if tt.timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tt.timeout)
+				defer cancel()
+				<-ctx.Done()
+			}
+			pings := 0
+			ping := func(context.Context) error {
+				pings++
+				if pings <= tt.failures {
+					return pingErr
+				}
+				return nil
+			}
+
+			err := connect(ctx, ping, tt.attempts, backoff, slog.Default())
+
+			assert.Equal(t, tt.expPings, pings)
+			if tt.expErr == nil {
+				assert.Nil(t, err)
+				return
+			}
+			assert.True(t, errors.Is(err, tt.expErr))
+			assert.Equal(t, tt.expErrIsCtx, errors.Is(err, context.DeadlineExceeded))
+		})
+	}
+}
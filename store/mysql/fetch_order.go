@@ -0,0 +1,43 @@
+package mysql
+
+import (
+	"fmt"
+	"math"
+)
+
+// FetchOrder defines which due records are locked first when the dispatcher limits its batch size
+type FetchOrder int
+
+const (
+	// DueTimeOrder locks the records that have been due the longest first, by their next retry time or else their
+	// creation time, so that the new records and the retries interleave by the time they became due
+	DueTimeOrder FetchOrder = iota
+	// CreationOrder locks the oldest records first, whether they are new or retried. A record failing repeatedly
+	// without a backoff is locked ahead of the newer records on every cycle
+	CreationOrder
+	// NewRecordsFirst locks the records that were never attempted first, oldest first, and then the retries. The
+	// retries may starve while new records keep arriving faster than the batch size
+	NewRecordsFirst
+)
+
+// orderBy returns the ORDER BY clause of the fetch order
+func (o FetchOrder) orderBy() (string, error) {
+	switch o {
+	case DueTimeOrder:
+		return "ORDER BY COALESCE(next_retry_at, created_on), created_on", nil
+	case CreationOrder:
+		return "ORDER BY created_on", nil
+	case NewRecordsFirst:
+		return "ORDER BY number_of_attempts > 0, created_on", nil
+	}
+	return "", fmt.Errorf("invalid fetch order %d", o)
+}
+
+// retryQuota returns the maximum number of retried records of a batch of limit records with the retry share, at
+// least 1 so that the retries never starve, or limit if the share does not cap the retries
+func retryQuota(limit int, share float64) int {
+	if share <= 0 || share >= 1 {
+		return limit
+	}
+	return int(math.Max(1, math.Floor(float64(limit)*share)))
+}
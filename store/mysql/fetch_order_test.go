@@ -0,0 +1,49 @@
+package mysql
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFetchOrder_orderBy(t *testing.T) {
+	tests := map[string]struct {
+		order      FetchOrder
+		expOrderBy string
+		expErr     bool
+	}{
+		"Due time order should order by the next retry or creation time": {
+			order:      DueTimeOrder,
+			expOrderBy: "ORDER BY COALESCE(next_retry_at, created_on), created_on",
+		},
+		"Creation order should order by the creation time": {
+			order:      CreationOrder,
+			expOrderBy: "ORDER BY created_on",
+		},
+		"New records first should order the never attempted records first": {
+			order:      NewRecordsFirst,
+			expOrderBy: "ORDER BY number_of_attempts > 0, created_on",
+		},
+		"Unknown order should return an error": {
+			order:  FetchOrder(10),
+			expErr: true,
+		},
+	}
+	for name, test := range tests {
+		tt := test
+		t.Run(name, func(t *testing.T) {
+			orderBy, err := tt.order.orderBy()
+			assert.Equal(t, tt.expOrderBy, orderBy)
+			assert.Equal(t, tt.expErr, err != nil)
+		})
+	}
+	_, err := NewStoreWithDB(nil, Settings{FetchOrder: FetchOrder(10)})
+	assert.NotNil(t, err)
+}
+
+func Test_retryQuota(t *testing.T) {
+	assert.Equal(t, 100, retryQuota(100, 0))
+	assert.Equal(t, 100, retryQuota(100, 1))
+	assert.Equal(t, 20, retryQuota(100, 0.2))
+	assert.Equal(t, 1, retryQuota(3, 0.2))
+}
@@ -0,0 +1,71 @@
+package mysql
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/pkritiotis/outbox"
+	time2 "github.com/pkritiotis/outbox/internal/time"
+)
+
+const defaultMaxClockSkew = 5 * time.Minute
+
+// FutureTimestampPolicy defines how the inserts handle the record timestamps that are further in the future than the
+// MaxClockSkew, e.g. the creation times of a producer whose clock is ahead
+type FutureTimestampPolicy int
+
+const (
+	// ClampFutureTimestamps stores the future timestamps as the current time of the Clock and logs a warning, so that
+	// the records are still stored
+	ClampFutureTimestamps FutureTimestampPolicy = iota
+	// RejectFutureTimestamps rejects the records with future timestamps with outbox.ErrFutureTimestamp
+	RejectFutureTimestamps
+)
+
+func maxClockSkewOrDefault(skew time.Duration) time.Duration {
+	if skew == 0 {
+		return defaultMaxClockSkew
+	}
+	return skew
+}
+
+// checkTimestamps applies the FutureTimestampPolicy to the creation, lock, processing and last attempt times of the
+// record, and returns the record with the clamped times. The expiry and next retry times are meant to be in the future
+// and are not checked
+func (s Store) checkTimestamps(rec outbox.Record) (outbox.Record, error) {
+	if s.maxClockSkew < 0 {
+		return rec, nil
+	}
+	now := time2.ProviderOrDefault(s.clock).Now().UTC()
+	check := func(field string, t time.Time) (time.Time, error) {
+		if !t.After(now.Add(s.maxClockSkew)) {
+			return t, nil
+		}
+		if s.futureTimestamps == RejectFutureTimestamps {
+			return t, fmt.Errorf("%w: %s %v is %v ahead of the clock", outbox.ErrFutureTimestamp, field, t, t.Sub(now))
+		}
+		s.logger.Warn("Clamped a future timestamp of a record, the clock of its producer may be ahead",
+			"record_id", rec.ID, "field", field, "timestamp", t, "skew", t.Sub(now))
+		return now, nil
+	}
+	var err error
+	rec.CreatedOn, err = check("created_on", rec.CreatedOn)
+	if err != nil {
+		return rec, err
+	}
+	// The optional times are copied, so that the record of the caller is never modified
+	for _, opt := range []struct {
+		field string
+		t     **time.Time
+	}{{"locked_on", &rec.LockedOn}, {"processed_on", &rec.ProcessedOn}, {"last_attempted_on", &rec.LastAttemptOn}} {
+		if *opt.t == nil {
+			continue
+		}
+		checked, err := check(opt.field, **opt.t)
+		if err != nil {
+			return rec, err
+		}
+		*opt.t = &checked
+	}
+	return rec, nil
+}
@@ -0,0 +1,87 @@
+package mysql
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pkritiotis/outbox"
+	"github.com/stretchr/testify/assert"
+)
+
+type fixedClock time.Time
+
+func (c fixedClock) Now() time.Time { return time.Time(c) }
+
+func TestStore_checkTimestamps(t *testing.T) {
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	withinSkew := now.Add(time.Minute)
+	future := now.Add(time.Hour)
+
+	tests := map[string]struct {
+		policy  FutureTimestampPolicy
+		skew    time.Duration
+		rec     outbox.Record
+		exp     outbox.Record
+		expErr  error
+		expLogs bool
+	}{
+		"Timestamps within the skew should be kept": {
+			rec: outbox.Record{CreatedOn: withinSkew, ProcessedOn: &withinSkew},
+			exp: outbox.Record{CreatedOn: withinSkew, ProcessedOn: &withinSkew},
+		},
+		"Future timestamps should be clamped and logged": {
+			rec:     outbox.Record{CreatedOn: future, ProcessedOn: &future, LastAttemptOn: &withinSkew},
+			exp:     outbox.Record{CreatedOn: now, ProcessedOn: &now, LastAttemptOn: &withinSkew},
+			expLogs: true,
+		},
+		"Future timestamps should be rejected with the reject policy": {
+			policy: RejectFutureTimestamps,
+			rec:    outbox.Record{CreatedOn: now, LockedOn: &future},
+			expErr: outbox.ErrFutureTimestamp,
+		},
+		"Future timestamps should be kept with a negative skew": {
+			policy: RejectFutureTimestamps,
+			skew:   -1,
+			rec:    outbox.Record{CreatedOn: future},
+			exp:    outbox.Record{CreatedOn: future},
+		},
+	}
+	for name, test := range tests {
+		tt := test
+		t.Run(name, func(t *testing.T) {
+			var logs bytes.Buffer
+			s := Store{
+				maxClockSkew:     maxClockSkewOrDefault(tt.skew),
+				futureTimestamps: tt.policy,
+				clock:            fixedClock(now),
+				logger:           slog.New(slog.NewTextHandler(&logs, nil)),
+			}
+			got, err := s.checkTimestamps(tt.rec)
+			if tt.expErr != nil {
+				assert.True(t, errors.Is(err, tt.expErr))
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, tt.exp, got)
+			assert.Equal(t, tt.expLogs, logs.Len() > 0)
+			// The times of the caller are not modified
+			assert.Equal(t, now.Add(time.Hour), future)
+		})
+	}
+}
+
+func Test_newStore_maxClockSkew(t *testing.T) {
+	s, err := NewStoreWithDB(nil, Settings{})
+	assert.Nil(t, err)
+	assert.Equal(t, defaultMaxClockSkew, s.maxClockSkew)
+	assert.Equal(t, ClampFutureTimestamps, s.futureTimestamps)
+
+	rec := outbox.Record{ID: uuid.New(), CreatedOn: time.Now().Add(time.Hour)}
+	got, err := s.checkTimestamps(rec)
+	assert.Nil(t, err)
+	assert.WithinDuration(t, time.Now(), got.CreatedOn, time.Minute)
+}
@@ -0,0 +1,42 @@
+package mysql
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkritiotis/outbox"
+)
+
+// keySequencesSchema is the script that creates the table of the per key sequence counters
+const keySequencesSchema = `CREATE TABLE IF NOT EXISTS outbox_key_sequences (
+        topic varchar(255) NOT NULL,
+        message_key varchar(255) NOT NULL,
+        seq BIGINT NOT NULL,
+        PRIMARY KEY (topic, message_key)
+)`
+
+// nextSequenceQuery increments the counter of the key, creating it at 1 if needed. LAST_INSERT_ID(expr) returns the
+// new value through the last insert id of the statement result, since mysql does not support RETURNING
+const nextSequenceQuery = `INSERT INTO outbox_key_sequences (topic, message_key, seq) VALUES (?, ?, LAST_INSERT_ID(1))
+		ON DUPLICATE KEY UPDATE seq = LAST_INSERT_ID(seq + 1)`
+
+// assignSequence sets the next sequence number of the topic and key of the inserted record
+func (s Store) assignSequence(ctx context.Context, db execer, rec outbox.Record) error {
+	seq, err := s.nextSequence(ctx, db, rec.Message.Topic, rec.Message.Key)
+	if err != nil {
+		return err
+	}
+	_, err = s.execContext(ctx, db, "UPDATE outbox SET sequence = ? WHERE id = ?", seq, rec.ID)
+	return translateError(err)
+}
+
+// nextSequence returns the next sequence number of the topic and key. The counter row stays locked until the
+// transaction of db ends, so only the enqueues of the same key are serialized and a rolled back enqueue leaves no gap
+func (s Store) nextSequence(ctx context.Context, db execer, topic string, key string) (int64, error) {
+	defer s.observeDuration("NextSequence", time.Now())
+	res, err := s.execContext(ctx, db, nextSequenceQuery, topic, key)
+	if err != nil {
+		return 0, translateError(err)
+	}
+	return res.LastInsertId()
+}
@@ -0,0 +1,174 @@
+//go:build integration
+
+package mysql
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pkritiotis/outbox"
+)
+
+// openTestDB opens the database of the OUTBOX_TEST_MYSQL_DSN environment variable, e.g.
+// "root:pass@tcp(localhost:3306)/outbox_test?parseTime=True"
+func openTestDB(tb testing.TB) *sql.DB {
+	dsn := os.Getenv("OUTBOX_TEST_MYSQL_DSN")
+	if dsn == "" {
+		tb.Skip("OUTBOX_TEST_MYSQL_DSN is not set")
+	}
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { _ = db.Close() })
+	return db
+}
+
+func TestStore_nextSequence(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+	s, err := NewStoreWithDB(db, Settings{KeySequences: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.EnsureSchema(ctx); err != nil {
+		t.Fatal(err)
+	}
+	key := t.Name()
+	_, _ = db.Exec("DELETE FROM outbox_key_sequences WHERE topic = ? AND message_key = ?", "test", key)
+
+	for exp := int64(1); exp <= 3; exp++ {
+		seq, seqErr := s.nextSequence(ctx, db, "test", key)
+		if seqErr != nil || seq != exp {
+			t.Fatalf("expected sequence %d, got %d: %v", exp, seq, seqErr)
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.nextSequence(ctx, tx, "test", key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = tx.Rollback()
+	seq, err := s.nextSequence(ctx, db, "test", key)
+	if err != nil || seq != 4 {
+		t.Fatalf("expected the rolled back sequence 4 to be reused, got %d: %v", seq, err)
+	}
+}
+
+func TestStore_AddRecordTx_duplicateSequence(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+	s, err := NewStoreWithDB(db, Settings{KeySequences: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.EnsureSchema(ctx); err != nil {
+		t.Fatal(err)
+	}
+	key := t.Name()
+	_, _ = db.Exec("DELETE FROM outbox_key_sequences WHERE topic = ? AND message_key = ?", "test", key)
+	record := func() outbox.Record {
+		return outbox.Record{ID: uuid.New(), State: outbox.PendingDelivery, CreatedOn: time.Now().UTC(),
+			Message: outbox.Message{Topic: "test", Key: key}}
+	}
+	first, second := record(), record()
+	for _, rec := range []outbox.Record{first, second} {
+		rec := rec
+		t.Cleanup(func() { _, _ = db.Exec("DELETE FROM outbox WHERE id = ?", rec.ID.String()) })
+	}
+
+	// The duplicate insert is ignored by the transaction, without taking a sequence number
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.AddRecordTx(first, tx); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.AddRecordTx(first, tx); !errors.Is(err, outbox.ErrDuplicateRecord) {
+		t.Fatalf("expected a duplicate record error, got %v", err)
+	}
+	if err = s.AddRecordTx(second, tx); err != nil {
+		t.Fatal(err)
+	}
+	if err = tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	for exp, rec := range map[int64]outbox.Record{1: first, 2: second} {
+		stored, getErr := s.GetRecordByID(rec.ID)
+		if getErr != nil {
+			t.Fatal(getErr)
+		}
+		if stored.Sequence == nil || *stored.Sequence != exp {
+			t.Fatalf("expected the sequence %d of the record %v, got %v", exp, rec.ID, stored.Sequence)
+		}
+	}
+}
+
+// Benchmark_sequences compares the per key counters with a naive global counter updated by every enqueue
+// transaction, which serializes all the concurrent enqueues on a single row
+func Benchmark_sequences(b *testing.B) {
+	db := openTestDB(b)
+	ctx := context.Background()
+	s, err := NewStoreWithDB(db, Settings{KeySequences: true})
+	if err != nil {
+		b.Fatal(err)
+	}
+	if err = s.EnsureSchema(ctx); err != nil {
+		b.Fatal(err)
+	}
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS outbox_global_sequence (id INT NOT NULL, seq BIGINT NOT NULL, PRIMARY KEY (id))`)
+	if err != nil {
+		b.Fatal(err)
+	}
+	globalNext := func(tx *sql.Tx) error {
+		_, err := tx.Exec(`INSERT INTO outbox_global_sequence (id, seq) VALUES (1, LAST_INSERT_ID(1))
+			ON DUPLICATE KEY UPDATE seq = LAST_INSERT_ID(seq + 1)`)
+		return err
+	}
+	perKeyNext := func(tx *sql.Tx, key string) error {
+		_, err := s.nextSequence(ctx, tx, "benchmark", key)
+		return err
+	}
+	var keys int64
+
+	run := func(b *testing.B, next func(tx *sql.Tx, key string) error) {
+		b.SetParallelism(16)
+		b.RunParallel(func(pb *testing.PB) {
+			key := fmt.Sprintf("key-%d", atomic.AddInt64(&keys, 1))
+			for pb.Next() {
+				tx, err := db.Begin()
+				if err != nil {
+					b.Error(err)
+					return
+				}
+				if err = next(tx, key); err != nil {
+					_ = tx.Rollback()
+					b.Error(err)
+					return
+				}
+				if err = tx.Commit(); err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		})
+	}
+	b.Run("global counter", func(b *testing.B) {
+		run(b, func(tx *sql.Tx, _ string) error { return globalNext(tx) })
+	})
+	b.Run("per key counters", func(b *testing.B) {
+		run(b, perKeyNext)
+	})
+}
@@ -0,0 +1,229 @@
+package mysql
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/pkritiotis/outbox"
+)
+
+// SchemaVersion is the version of the schema required by this version of the store, see Migrate
+const SchemaVersion = 10
+
+// schemaVersionTable is the script that creates the table of the applied migrations
+const schemaVersionTable = `CREATE TABLE IF NOT EXISTS outbox_schema_version (
+        version INT NOT NULL,
+        description varchar(255) NOT NULL,
+        applied_on DATETIME NOT NULL,
+        PRIMARY KEY (version)
+)`
+
+// migrateLockTimeout is the number of seconds to wait for the migrate lock
+const migrateLockTimeout = 60
+
+// migrationStep is a statement of a migration. The statement is skipped if done returns true, since mysql DDL
+// statements cannot be run conditionally, so that the migrations of the tables altered by hand can be re-run
+type migrationStep struct {
+	statement string
+	done      func(ctx context.Context, conn *sql.Conn, table tableName) (bool, error)
+}
+
+// migration upgrades the schema to its version
+type migration struct {
+	version     int
+	description string
+	steps       []migrationStep
+}
+
+// migrations are the schema migrations in version order. A migration must never change once released, new
+// changes are added as a new migration along with the SchemaVersion and the schema of EnsureSchema
+var migrations = []migration{
+	{version: 1, description: "create the outbox table", steps: []migrationStep{{
+		statement: `CREATE TABLE IF NOT EXISTS outbox (
+        id varchar(100) NOT NULL,
+        data BLOB NOT NULL,
+        state INT NOT NULL,
+        created_on DATETIME NOT NULL,
+        locked_by varchar(100) NULL,
+        locked_on DATETIME NULL,
+        processed_on DATETIME NULL,
+        number_of_attempts INT NOT NULL,
+        last_attempted_on DATETIME NULL,
+        error varchar(1000) NULL
+)`,
+	}}},
+	{version: 2, description: "add the primary key", steps: []migrationStep{
+		{statement: `ALTER TABLE outbox ADD PRIMARY KEY (id)`, done: hasIndex("PRIMARY")},
+	}},
+	{version: 3, description: "add the expires_at column", steps: []migrationStep{
+		{statement: `ALTER TABLE outbox ADD COLUMN expires_at DATETIME NULL`, done: hasColumn("expires_at")},
+	}},
+	{version: 4, description: "add the next_retry_at column", steps: []migrationStep{
+		{statement: `ALTER TABLE outbox ADD COLUMN next_retry_at DATETIME NULL`, done: hasColumn("next_retry_at")},
+		{
+			statement: `ALTER TABLE outbox ADD INDEX idx_outbox_state_next_retry_at (state, next_retry_at)`,
+			done:      hasIndex("idx_outbox_state_next_retry_at"),
+		},
+	}},
+	{version: 5, description: "add the business key columns", steps: []migrationStep{
+		{statement: `ALTER TABLE outbox ADD COLUMN business_key CHAR(64) NULL`, done: hasColumn("business_key")},
+		{
+			statement: `ALTER TABLE outbox ADD COLUMN pending_business_key CHAR(64) AS (IF(state = 0, business_key, NULL)) STORED`,
+			done:      hasColumn("pending_business_key"),
+		},
+		{
+			statement: `ALTER TABLE outbox ADD UNIQUE INDEX uq_outbox_pending_business_key (pending_business_key)`,
+			done:      hasIndex("uq_outbox_pending_business_key"),
+		},
+	}},
+	{version: 6, description: "add the sequence column", steps: []migrationStep{
+		{statement: `ALTER TABLE outbox ADD COLUMN sequence BIGINT NULL`, done: hasColumn("sequence")},
+	}},
+	{version: 7, description: "create the key sequences table", steps: []migrationStep{
+		{statement: keySequencesSchema},
+	}},
+	{version: 8, description: "create the attempts audit table", steps: []migrationStep{
+		{statement: attemptsSchema},
+	}},
+	{version: 9, description: "add the publish_handle column", steps: []migrationStep{
+		{statement: `ALTER TABLE outbox ADD COLUMN publish_handle varchar(255) NULL`, done: hasColumn("publish_handle")},
+		{
+			statement: `ALTER TABLE outbox ADD INDEX idx_outbox_publish_handle (publish_handle)`,
+			done:      hasIndex("idx_outbox_publish_handle"),
+		},
+	}},
+	{version: 10, description: "add the topic column", steps: []migrationStep{
+		{statement: `ALTER TABLE outbox ADD COLUMN topic varchar(255) NULL`, done: hasColumn("topic")},
+		{
+			statement: `ALTER TABLE outbox ADD INDEX idx_outbox_state_topic (state, topic)`,
+			done:      hasIndex("idx_outbox_state_topic"),
+		},
+	}},
+}
+
+// hasColumn returns whether the outbox table has the column
+func hasColumn(column string) func(ctx context.Context, conn *sql.Conn, table tableName) (bool, error) {
+	return func(ctx context.Context, conn *sql.Conn, table tableName) (bool, error) {
+		return exists(ctx, conn, table, `SELECT COUNT(*) FROM information_schema.COLUMNS
+			WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = 'outbox' AND COLUMN_NAME = ?`, column)
+	}
+}
+
+// hasIndex returns whether the outbox table has the index
+func hasIndex(index string) func(ctx context.Context, conn *sql.Conn, table tableName) (bool, error) {
+	return func(ctx context.Context, conn *sql.Conn, table tableName) (bool, error) {
+		return exists(ctx, conn, table, `SELECT COUNT(*) FROM information_schema.STATISTICS
+			WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = 'outbox' AND INDEX_NAME = ?`, index)
+	}
+}
+
+func exists(ctx context.Context, conn *sql.Conn, table tableName, query string, args ...interface{}) (bool, error) {
+	var count int
+	err := conn.QueryRowContext(ctx, table.sql(query), args...).Scan(&count)
+	return count > 0, err
+}
+
+// Migrate upgrades the schema of the database to the SchemaVersion, applying the migrations that are not recorded in
+// the outbox_schema_version table yet. It is safe to run on every start and by several instances at once: the
+// migrations are applied under an advisory lock, and the statements of a migration that were already applied, e.g.
+// by hand with the ALTERs of a previous version, are skipped. mysql commits every DDL statement, so a failed migration
+// is not rolled back but is completed by the next Migrate call
+func Migrate(ctx context.Context, db *sql.DB) error {
+	return MigrateTable(ctx, db, DefaultTableName)
+}
+
+// MigrateTable upgrades the schema of the outbox table with the provided name, and of the tables named after it, like
+// Migrate. The tables of every name are migrated independently, under their own lock and schema version
+func MigrateTable(ctx context.Context, db *sql.DB, name string) error {
+	if err := validateTableName(name); err != nil {
+		return err
+	}
+	table := tableNameOrDefault(name)
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var locked sql.NullInt64
+	err = conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, ?)", table.migrateLock(), migrateLockTimeout).Scan(&locked)
+	if err != nil {
+		return fmt.Errorf("could not acquire the migrate lock: %w", err)
+	}
+	if locked.Int64 != 1 {
+		return fmt.Errorf("could not acquire the migrate lock within %d seconds", migrateLockTimeout)
+	}
+	defer func() {
+		_, _ = conn.ExecContext(context.Background(), "SELECT RELEASE_LOCK(?)", table.migrateLock())
+	}()
+
+	if _, err = conn.ExecContext(ctx, table.sql(schemaVersionTable)); err != nil {
+		return err
+	}
+	current, err := schemaVersion(ctx, conn, table)
+	if err != nil {
+		return err
+	}
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		if err = m.apply(ctx, conn, table); err != nil {
+			return fmt.Errorf("could not apply the migration %d (%s): %w", m.version, m.description, err)
+		}
+	}
+	return nil
+}
+
+// apply runs the steps of the migration that are not done and records its version
+func (m migration) apply(ctx context.Context, conn *sql.Conn, table tableName) error {
+	for _, step := range m.steps {
+		if step.done != nil {
+			done, err := step.done(ctx, conn, table)
+			if err != nil {
+				return err
+			}
+			if done {
+				continue
+			}
+		}
+		if _, err := conn.ExecContext(ctx, table.sql(step.statement)); err != nil {
+			return err
+		}
+	}
+	_, err := conn.ExecContext(ctx,
+		table.sql(`INSERT INTO outbox_schema_version (version, description, applied_on) VALUES (?, ?, ?)`),
+		m.version, m.description, time.Now().UTC())
+	return err
+}
+
+// schemaVersion returns the highest applied migration version, or 0 if none was applied
+func schemaVersion(ctx context.Context, conn *sql.Conn, table tableName) (int, error) {
+	var version sql.NullInt64
+	err := conn.QueryRowContext(ctx, table.sql(`SELECT MAX(version) FROM outbox_schema_version`)).Scan(&version)
+	return int(version.Int64), err
+}
+
+// CheckSchemaVersion returns an outbox.ErrSchemaOutdated error if the schema was not migrated to the SchemaVersion
+// with Migrate, so that an application can refuse to start against an under-migrated table
+func (s Store) CheckSchemaVersion(ctx context.Context) error {
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	version, err := schemaVersion(ctx, conn, s.table)
+	if err != nil {
+		if errors.Is(translateError(err), outbox.ErrSchemaMissing) {
+			return fmt.Errorf("%w: the schema version table does not exist, run MigrateTable", outbox.ErrSchemaOutdated)
+		}
+		return err
+	}
+	if version < SchemaVersion {
+		return fmt.Errorf("%w: the schema version is %d, %d is required", outbox.ErrSchemaOutdated, version, SchemaVersion)
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+//go:build integration
+
+package mysql
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pkritiotis/outbox"
+)
+
+func TestMigrate(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+	s, err := NewStoreWithDB(db, Settings{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// An existing table created by EnsureSchema is migrated without changes
+	if err = s.EnsureSchema(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err = Migrate(ctx, db); err != nil {
+			t.Fatalf("migrate %d: %v", i, err)
+		}
+	}
+	if err = s.CheckSchemaVersion(ctx); err != nil {
+		t.Fatal(err)
+	}
+	var count int
+	if err = db.QueryRow("SELECT COUNT(*) FROM outbox_schema_version").Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != SchemaVersion {
+		t.Fatalf("expected %d applied migrations, got %d", SchemaVersion, count)
+	}
+}
+
+func TestMigrateTable(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+	t.Cleanup(func() {
+		for _, table := range []string{"orders_outbox", "orders_outbox_schema_version"} {
+			_, _ = db.Exec("DROP TABLE IF EXISTS " + table)
+		}
+	})
+	s, err := NewStoreWithDB(db, Settings{TableName: "orders_outbox"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = MigrateTable(ctx, db, "orders_outbox"); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.CheckSchemaVersion(ctx); err != nil {
+		t.Fatal(err)
+	}
+	rec := outbox.Record{ID: uuid.New(), State: outbox.PendingDelivery, CreatedOn: time.Now().UTC(), Message: outbox.Message{Topic: t.Name()}}
+	if err = s.AddRecord(ctx, rec); err != nil {
+		t.Fatal(err)
+	}
+	var count int
+	if err = db.QueryRow("SELECT COUNT(*) FROM orders_outbox WHERE id = ?", rec.ID.String()).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Fatalf("expected the record in the orders_outbox table, got %d", count)
+	}
+}
@@ -0,0 +1,19 @@
+package mysql
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_migrations(t *testing.T) {
+	assert.Len(t, migrations, SchemaVersion)
+	for i, m := range migrations {
+		assert.Equal(t, i+1, m.version)
+		assert.NotEmpty(t, m.description)
+		assert.NotEmpty(t, m.steps)
+		for _, step := range m.steps {
+			assert.NotEmpty(t, step.statement)
+		}
+	}
+}
@@ -2,15 +2,23 @@
 package mysql
 
 import (
-	"bytes"
+	"context"
+	"crypto/sha256"
 	"database/sql"
-	"encoding/gob"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"log"
+	"log/slog"
+	"net"
+	"strings"
 	"time"
 
-	_ "github.com/go-sql-driver/mysql" // needed for loading mysql driver
+	mysqldriver "github.com/go-sql-driver/mysql"
+	"github.com/google/uuid"
 	"github.com/pkritiotis/outbox"
+	time2 "github.com/pkritiotis/outbox/internal/time"
 )
 
 // Settings contain the mysql settings
@@ -20,28 +28,269 @@ type Settings struct {
 	MySQLHost     string
 	MySQLPort     string
 	MySQLDB       string
+	// ConnectAttempts is the number of times NewStore and NewStoreContext ping the database before failing, so that
+	// the application can start before the database is reachable. Defaults to a single attempt
+	ConnectAttempts int
+	// ConnectBackoff is the delay between the connection attempts. Defaults to an ExponentialBackoff from 1 second up
+	// to 30 seconds
+	ConnectBackoff outbox.BackoffPolicy
+	// TableName is the name of the outbox table, outbox by default. The attempts, key sequences and schema version
+	// tables are named after it, e.g. orders_outbox_attempts, so that several outboxes can share a database. Tables
+	// other than the default one are migrated with MigrateTable
+	TableName string
+	// Location is the time zone of the DATETIME values of the outbox table, used by the driver to write and parse them.
+	// Defaults to UTC, which is the time zone of all the outbox timestamps. It is only meant for existing tables
+	// holding local times, since a time zone with daylight saving time makes the times of the transition ambiguous
+	Location *time.Location
+	// SelectionPredicate is an optional SQL condition that is added with AND to the queries selecting the records to
+	// be dispatched, e.g. "region = ?". It is an escape hatch for deployment specific routing: values must only be
+	// passed through ? placeholders and SelectionPredicateArgs, and keeping the condition index friendly is the
+	// responsibility of the user
+	SelectionPredicate string
+	// SelectionPredicateArgs are the values of the SelectionPredicate placeholders
+	SelectionPredicateArgs []interface{}
+	// AutoMigrate creates the outbox table with EnsureSchema when a query fails because the table does not exist
+	// and retries the query once. Transactional inserts through AddRecordTx are never retried
+	AutoMigrate bool
+	// CompressionThreshold is the serialized message size in bytes above which the messages are stored gzip
+	// compressed. Compression is disabled if it is not set. Messages are decoded regardless of the setting
+	CompressionThreshold int
+	// Metrics records the serialized and stored message sizes and the slow queries. Defaults to
+	// outbox.NoopMetricsRecorder
+	Metrics outbox.MetricsRecorder
+	// SlowQueryThreshold is the duration above which the store calls are logged and counted as slow queries.
+	// Defaults to 5 seconds, a negative value disables the slow query logs
+	SlowQueryThreshold time.Duration
+	// Logger is the logger of the slow queries. Defaults to slog.Default()
+	Logger *slog.Logger
+	// BusinessKeyHeaders are the names of the message headers whose values form the business key of a record, e.g.
+	// "order-id" and "event-type". The schema rejects a record with ErrDuplicateRecord if another PendingDelivery
+	// record has the same business key. Records missing any of the headers have no business key, and the business
+	// key is not enforced if it is not set
+	BusinessKeyHeaders []string
+	// KeySequences numbers the records of every topic and message key with a gap-free sequence, starting from 1,
+	// which is published in the MetadataHeaders Sequence header. The counters are stored in the outbox_key_sequences
+	// table and updated within the transaction of the record, so AddRecord uses a transaction when it is enabled.
+	// Records without a key are not numbered
+	KeySequences bool
+	// FetchOrder defines which due records are locked first when the dispatcher limits its BatchSize. Defaults to
+	// DueTimeOrder
+	FetchOrder FetchOrder
+	// MaxRetryShare caps the share of the retried records, which were attempted before, in a batch of the dispatcher
+	// BatchSize, e.g. 0.2 for at most a fifth of the batch, so that the retries of a sustained partial failure do not
+	// starve the new records. The rest of the batch is filled with retries if there are not enough new records, and
+	// at least one retry is locked per batch. The retries are not capped if it is not set
+	MaxRetryShare float64
+	// MaxBacklog is the maximum number of PendingDelivery records. Once it is reached, the inserts of pending records
+	// fail with outbox.ErrOutboxFull, so that the producers can apply backpressure during a long broker outage instead
+	// of growing the table until the database fails. The number is counted every BacklogRefreshInterval, so it may be
+	// exceeded by the inserts of other instances in between. It is not enforced if it is not set
+	MaxBacklog int64
+	// BacklogRefreshInterval is the interval at which the pending records are counted for MaxBacklog, 10 seconds by
+	// default
+	BacklogRefreshInterval time.Duration
+	// UsePreparedStatements prepares every query of the store once and reuses the statement on every connection,
+	// which saves the parsing of the hot queries. It is disabled by default, since some proxies and connection poolers
+	// do not support prepared statements. The inserts of AddRecordTx and the queries with IN lists of a variable
+	// length are never prepared. Close the store to release the statements
+	UsePreparedStatements bool
+	// SerializerTypeHeader is the name of the message header holding the message type that selects the Serializer
+	SerializerTypeHeader string
+	// Serializers are the serializers of the message types, keyed by the SerializerTypeHeader values. The messages
+	// of the other types are gob encoded. The id of the serializer is stored with every message, so a Serializer must
+	// stay registered as long as messages encoded by it are stored
+	Serializers map[string]Serializer
+	// VerifySerialization decodes every encoded message back before it is stored, so that a broken serializer fails the
+	// insert instead of storing messages that can not be decoded by the dispatcher. It doubles the serialization cost
+	VerifySerialization bool
+	// SerializationFailureThreshold is the number of consecutive failed serializations of a message type after which
+	// the inserts of the type are refused with outbox.ErrSerializerQuarantined, without calling its serializer, so that
+	// a broken serializer is reported loudly while the other types are still stored. Quarantines are logged as errors.
+	// The types are never quarantined if it is not set
+	SerializationFailureThreshold int
+	// SerializationQuarantineDuration is the duration of a quarantine, after which the type is serialized again. The
+	// quarantine lasts as long as the store if it is not set
+	SerializationQuarantineDuration time.Duration
+	// OnSerializerQuarantined is called with the message type and the last serialization error once a type is
+	// quarantined, e.g. to page the team. The SerializerTypeHeader value of the type is empty without Serializers
+	OnSerializerQuarantined func(messageType string, err error)
+	// MaxClockSkew is how far in the future the creation, lock, processing and last attempt times of an inserted record
+	// may be, compared with the Clock, before the FutureTimestamps policy applies. A record created in the future would
+	// be ordered after the newer records and outlive its retention. Defaults to 5 minutes, a negative value disables
+	// the check
+	MaxClockSkew time.Duration
+	// FutureTimestamps defines whether the timestamps beyond the MaxClockSkew are clamped, by default, or rejected
+	FutureTimestamps FutureTimestampPolicy
+	// Clock is the reference clock of the MaxClockSkew, which should be the Clock of the outbox, e.g. a DBClock.
+	// Defaults to the local clock
+	Clock outbox.Clock
 }
 
+const defaultSlowQueryThreshold = 5 * time.Second
+
 // Store implements a mysql Store
 type Store struct {
-	db *sql.DB
+	db                     *sql.DB
+	selectionPredicate     string
+	selectionPredicateArgs []interface{}
+	autoMigrate            bool
+	serializer             serializer
+	metrics                outbox.MetricsRecorder
+	slowQueryThreshold     time.Duration
+	logger                 *slog.Logger
+	businessKeyHeaders     []string
+	keySequences           bool
+	statements             *statementCache
+	backlogGuard           *backlogGuard
+	location               *time.Location
+	fetchOrder             FetchOrder
+	maxRetryShare          float64
+	table                  tableName
+	maxClockSkew           time.Duration
+	futureTimestamps       FutureTimestampPolicy
+	clock                  outbox.Clock
 }
 
-// NewStore constructor
+// NewStore constructor. It exits the process if the database can not be reached within the ConnectAttempts, see
+// NewStoreContext to get the error instead
 func NewStore(settings Settings) (*Store, error) {
-	db, err := sql.Open("mysql",
-		fmt.Sprintf("%v:%v@tcp(%v:%v)/%v?parseTime=True",
-			settings.MySQLUsername, settings.MySQLPass, settings.MySQLHost, settings.MySQLPort, settings.MySQLDB))
-	if err != nil || db.Ping() != nil {
+	err := validatePredicate(settings.SelectionPredicate, settings.SelectionPredicateArgs)
+	if err != nil {
+		return nil, err
+	}
+	db, err := open(context.Background(), settings)
+	if err != nil {
 		log.Fatalf("failed to connect to database %v", err)
 		return nil, err
 	}
-	return &Store{db: db}, nil
+	return NewStoreWithDB(db, settings)
+}
+
+// NewStoreContext constructs a Store connected with the settings, waiting for the database to be reachable within the
+// ConnectAttempts and the context, e.g. while the database starts along with the application. It returns the
+// connection error instead of exiting the process
+func NewStoreContext(ctx context.Context, settings Settings) (*Store, error) {
+	err := validatePredicate(settings.SelectionPredicate, settings.SelectionPredicateArgs)
+	if err != nil {
+		return nil, err
+	}
+	db, err := open(ctx, settings)
+	if err != nil {
+		return nil, err
+	}
+	return NewStoreWithDB(db, settings)
 }
 
-// ClearLocksWithDurationBeforeDate clears all records with the provided id
+// open opens the pool of the connection settings and pings the database with the connect retries. The pool is closed
+// if the database can not be reached
+func open(ctx context.Context, settings Settings) (*sql.DB, error) {
+	db, err := sql.Open("mysql", dsn(settings))
+	if err != nil {
+		return nil, err
+	}
+	err = connect(ctx, db.PingContext, settings.ConnectAttempts, settings.ConnectBackoff, loggerOrDefault(settings.Logger))
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// dsn returns the data source name of the connection settings. The DATETIME values are parsed to time.Time and
+// read and written in the Location, UTC by default. The loc parameter is left out of the name when it is UTC, since
+// it is the default of the driver
+func dsn(settings Settings) string {
+	cfg := mysqldriver.NewConfig()
+	cfg.User = settings.MySQLUsername
+	cfg.Passwd = settings.MySQLPass
+	cfg.Net = "tcp"
+	cfg.Addr = net.JoinHostPort(settings.MySQLHost, settings.MySQLPort)
+	cfg.DBName = settings.MySQLDB
+	cfg.ParseTime = true
+	cfg.Loc = locationOrDefault(settings.Location)
+	return cfg.FormatDSN()
+}
+
+// NewStoreWithDB constructs a Store using the provided connection pool, e.g. the pool of the application.
+// The pool must be opened with parseTime=True, and with loc=UTC unless the outbox table holds times of another
+// Location. The connection settings are ignored
+func NewStoreWithDB(db *sql.DB, settings Settings) (*Store, error) {
+	err := validatePredicate(settings.SelectionPredicate, settings.SelectionPredicateArgs)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = settings.FetchOrder.orderBy(); err != nil {
+		return nil, err
+	}
+	if err = validateTableName(settings.TableName); err != nil {
+		return nil, err
+	}
+	ser, err := newSerializer(settings.CompressionThreshold, settings.Metrics).
+		withSerializers(settings.SerializerTypeHeader, settings.Serializers)
+	if err != nil {
+		return nil, err
+	}
+	ser.verify = settings.VerifySerialization
+	ser.quarantine = newSerializationQuarantine(settings.SerializationFailureThreshold,
+		settings.SerializationQuarantineDuration, settings.OnSerializerQuarantined, loggerOrDefault(settings.Logger))
+	var statements *statementCache
+	if settings.UsePreparedStatements {
+		statements = newStatementCache(db)
+	}
+	return &Store{
+		db:                     db,
+		statements:             statements,
+		backlogGuard:           newBacklogGuard(settings.MaxBacklog, settings.BacklogRefreshInterval),
+		location:               locationOrDefault(settings.Location),
+		fetchOrder:             settings.FetchOrder,
+		maxRetryShare:          settings.MaxRetryShare,
+		table:                  tableNameOrDefault(settings.TableName),
+		maxClockSkew:           maxClockSkewOrDefault(settings.MaxClockSkew),
+		futureTimestamps:       settings.FutureTimestamps,
+		clock:                  time2.ProviderOrDefault(settings.Clock),
+		selectionPredicate:     settings.SelectionPredicate,
+		selectionPredicateArgs: settings.SelectionPredicateArgs,
+		autoMigrate:            settings.AutoMigrate,
+		serializer:             ser,
+		metrics:                metricsOrDefault(settings.Metrics),
+		slowQueryThreshold:     slowQueryThresholdOrDefault(settings.SlowQueryThreshold),
+		logger:                 loggerOrDefault(settings.Logger),
+		businessKeyHeaders:     settings.BusinessKeyHeaders,
+		keySequences:           settings.KeySequences,
+	}, nil
+}
+
+func locationOrDefault(location *time.Location) *time.Location {
+	if location == nil {
+		return time.UTC
+	}
+	return location
+}
+
+func metricsOrDefault(metrics outbox.MetricsRecorder) outbox.MetricsRecorder {
+	if metrics == nil {
+		return outbox.NoopMetricsRecorder{}
+	}
+	return metrics
+}
+
+func slowQueryThresholdOrDefault(threshold time.Duration) time.Duration {
+	if threshold == 0 {
+		return defaultSlowQueryThreshold
+	}
+	return threshold
+}
+
+func loggerOrDefault(logger *slog.Logger) *slog.Logger {
+	if logger == nil {
+		return slog.Default()
+	}
+	return logger
+}
+
+// ClearLocksWithDurationBeforeDate clears the locks acquired or last extended before the provided time
 func (s Store) ClearLocksWithDurationBeforeDate(time time.Time) error {
-	_, err := s.db.Exec(
+	_, err := s.exec(context.Background(), "ClearLocksWithDurationBeforeDate",
 		`UPDATE outbox 
 		SET
 			locked_by=NULL,
@@ -56,18 +305,17 @@ func (s Store) ClearLocksWithDurationBeforeDate(time time.Time) error {
 	return nil
 }
 
-// UpdateRecordLockByState updated the lock information based on the state
-func (s Store) UpdateRecordLockByState(lockID string, lockedOn time.Time, state outbox.RecordState) error {
-	_, err := s.db.Exec(
+// ExtendLock refreshes the lock time of the records locked by lockID, so that their locks are not cleared
+// by ClearLocksWithDurationBeforeDate
+func (s Store) ExtendLock(lockID string, lockedOn time.Time) error {
+	_, err := s.exec(context.Background(), "ExtendLock",
 		`UPDATE outbox 
-		SET 
-			locked_by=?,
+		SET
 			locked_on=?
-		WHERE state = ?
+		WHERE locked_by = ?
 		`,
-		lockID,
 		lockedOn,
-		state,
+		lockID,
 	)
 	if err != nil {
 		return err
@@ -75,16 +323,125 @@ func (s Store) UpdateRecordLockByState(lockID string, lockedOn time.Time, state
 	return nil
 }
 
+// UpdateRecordLockByState locks all the unlocked records of the state, whatever their next retry time
+func (s Store) UpdateRecordLockByState(lockID string, lockedOn time.Time, state outbox.RecordState) error {
+	predicate, predicateArgs := s.withSelectionPredicate(`state = ? AND locked_by IS NULL`, state)
+	_, err := s.exec(context.Background(), "UpdateRecordLockByState",
+		`UPDATE outbox 
+		SET 
+			locked_by=?,
+			locked_on=?
+		WHERE `+predicate,
+		append([]interface{}{lockID, lockedOn}, predicateArgs...)...,
+	)
+	return err
+}
+
+// UpdateRecordsLockByStates locks up to limit due records of the states in the FetchOrder. With a MaxRetryShare,
+// the retried records are locked up to their quota, then the new records, and the retries fill the rest of the batch
+func (s Store) UpdateRecordsLockByStates(lockID string, lockedOn time.Time, states []outbox.RecordState, limit int) error {
+	return s.UpdateRecordsLockByStatesExcludingTopics(lockID, lockedOn, states, limit, nil)
+}
+
+// UpdateRecordsLockByStatesExcludingTopics locks the records like UpdateRecordsLockByStates, leaving out the records
+// of the excluded topics. The records stored before the topic column was added have no topic and are still locked
+func (s Store) UpdateRecordsLockByStatesExcludingTopics(lockID string, lockedOn time.Time, states []outbox.RecordState, limit int, excludedTopics []string) error {
+	if len(states) == 0 {
+		return nil
+	}
+	condition, conditionArgs := topicsCondition(excludedTopics)
+	if limit <= 0 {
+		_, err := s.lockRecords(lockID, lockedOn, states, condition, conditionArgs, 0)
+		return err
+	}
+	quota := retryQuota(limit, s.maxRetryShare)
+	if quota == limit {
+		_, err := s.lockRecords(lockID, lockedOn, states, condition, conditionArgs, limit)
+		return err
+	}
+	retries, err := s.lockRecords(lockID, lockedOn, states, joinConditions(condition, "number_of_attempts > 0"), conditionArgs, quota)
+	if err != nil {
+		return err
+	}
+	fresh, err := s.lockRecords(lockID, lockedOn, states, joinConditions(condition, "number_of_attempts = 0"), conditionArgs, limit-int(retries))
+	if err != nil {
+		return err
+	}
+	if rest := limit - int(retries) - int(fresh); rest > 0 {
+		_, err = s.lockRecords(lockID, lockedOn, states, joinConditions(condition, "number_of_attempts > 0"), conditionArgs, rest)
+	}
+	return err
+}
+
+// topicsCondition returns the condition leaving out the records of the excluded topics, if any
+func topicsCondition(excludedTopics []string) (string, []interface{}) {
+	if len(excludedTopics) == 0 {
+		return "", nil
+	}
+	args := make([]interface{}, len(excludedTopics))
+	for i, topic := range excludedTopics {
+		args[i] = topic
+	}
+	return "(topic IS NULL OR topic NOT IN (" + placeholders(len(excludedTopics)) + "))", args
+}
+
+// joinConditions joins the non-empty conditions with AND
+func joinConditions(conditions ...string) string {
+	var joined []string
+	for _, c := range conditions {
+		if c != "" {
+			joined = append(joined, c)
+		}
+	}
+	return strings.Join(joined, " AND ")
+}
+
+// lockRecords locks up to limit due records of the states matching the condition, if any, in the FetchOrder, and
+// returns the number of locked records. All the due records are locked if limit is not positive
+func (s Store) lockRecords(lockID string, lockedOn time.Time, states []outbox.RecordState, condition string, conditionArgs []interface{}, limit int) (int64, error) {
+	args := []interface{}{lockID, lockedOn}
+	for _, state := range states {
+		args = append(args, state)
+	}
+	where := `state IN (` + placeholders(len(states)) + `) AND locked_by IS NULL AND (next_retry_at IS NULL OR next_retry_at <= ?)`
+	if condition != "" {
+		where += " AND " + condition
+	}
+	predicate, predicateArgs := s.withSelectionPredicate(where, append([]interface{}{lockedOn}, conditionArgs...)...)
+	args = append(args, predicateArgs...)
+	q := `UPDATE outbox 
+		SET 
+			locked_by=?,
+			locked_on=?
+		WHERE ` + predicate
+	if limit > 0 {
+		orderBy, err := s.fetchOrder.orderBy()
+		if err != nil {
+			return 0, err
+		}
+		q += " " + orderBy + " LIMIT ?"
+		args = append(args, limit)
+	}
+	ctx := context.Background()
+	if len(conditionArgs) > 0 {
+		// The excluded topics vary with the paused topics
+		ctx = unprepared(ctx)
+	}
+	res, err := s.exec(ctx, "UpdateRecordsLockByStates", q, args...)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
 // UpdateRecordByID updates the provided record based on its id
 func (s Store) UpdateRecordByID(rec outbox.Record) error {
-	msgData := new(bytes.Buffer)
-	enc := gob.NewEncoder(msgData)
-	encErr := enc.Encode(rec.Message)
+	data, encErr := s.serializer.encode(rec.Message)
 	if encErr != nil {
 		return encErr
 	}
 
-	_, err := s.db.Exec(
+	_, err := s.exec(context.Background(), "UpdateRecordByID",
 		`UPDATE outbox 
 		SET 
 			data=?,
@@ -95,10 +452,13 @@ func (s Store) UpdateRecordByID(rec outbox.Record) error {
 			processed_on=?,
 		    number_of_attempts=?,
 		    last_attempted_on=?,
-		    error=?
+		    error=?,
+		    expires_at=?,
+		    next_retry_at=?,
+		    topic=?
 		WHERE id = ?
 		`,
-		msgData.Bytes(),
+		data,
 		rec.State,
 		rec.CreatedOn,
 		rec.LockID,
@@ -107,6 +467,9 @@ func (s Store) UpdateRecordByID(rec outbox.Record) error {
 		rec.NumberOfAttempts,
 		rec.LastAttemptOn,
 		rec.Error,
+		rec.ExpiresAt,
+		rec.NextRetryAt,
+		rec.Message.Topic,
 		rec.ID,
 	)
 	if err != nil {
@@ -115,9 +478,212 @@ func (s Store) UpdateRecordByID(rec outbox.Record) error {
 	return nil
 }
 
+// MarkProcessed marks the record as delivered after the provided number of attempts and clears its lock without
+// rewriting the message data. The record is only updated if it is still locked by the provided lockID
+func (s Store) MarkProcessed(id uuid.UUID, numberOfAttempts int, processedOn time.Time, lockID string) error {
+	res, err := s.exec(context.Background(), "MarkProcessed",
+		`UPDATE outbox 
+		SET 
+			state=?,
+			processed_on=?,
+			last_attempted_on=?,
+			number_of_attempts=?,
+			locked_by=NULL,
+			locked_on=NULL
+		WHERE id = ? AND locked_by = ?
+		`,
+		outbox.Delivered,
+		processedOn,
+		processedOn,
+		numberOfAttempts,
+		id,
+		lockID,
+	)
+	if err != nil {
+		return err
+	}
+	return checkLockedUpdate(res)
+}
+
+// SetPublishHandle stores the handle of the publish prepared for the record while it is locked by lockID
+func (s Store) SetPublishHandle(id uuid.UUID, lockID string, handle string) error {
+	res, err := s.exec(context.Background(), "SetPublishHandle",
+		`UPDATE outbox SET publish_handle = ? WHERE id = ? AND locked_by = ?`,
+		handle,
+		id,
+		lockID,
+	)
+	if err != nil {
+		return err
+	}
+	return checkLockedUpdate(res)
+}
+
+// ClearPublishHandle clears the handle of the record if it still holds the provided handle
+func (s Store) ClearPublishHandle(id uuid.UUID, handle string) error {
+	_, err := s.exec(context.Background(), "ClearPublishHandle",
+		`UPDATE outbox SET publish_handle = NULL WHERE id = ? AND publish_handle = ?`,
+		id,
+		handle,
+	)
+	return err
+}
+
+// GetRecordsWithPublishHandle returns up to limit unlocked records holding a publish handle, leaving out the Delivered
+// records processed after deliveredBefore. The selection predicate applies, so that a scoped dispatcher only recovers
+// the publishes prepared through its own broker
+func (s Store) GetRecordsWithPublishHandle(deliveredBefore time.Time, limit int) ([]outbox.Record, error) {
+	predicate, args := s.withSelectionPredicate(
+		`publish_handle IS NOT NULL AND locked_by IS NULL AND (state <> ? OR processed_on < ?)`,
+		outbox.Delivered,
+		deliveredBefore,
+	)
+	rows, err := s.query(context.Background(), "GetRecordsWithPublishHandle",
+		"SELECT "+recordColumns+` from outbox
+		WHERE `+predicate+`
+		ORDER BY created_on
+		LIMIT ?`,
+		append(args, limit)...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	var records []outbox.Record
+	err = s.iterateRecords(rows, func(rec outbox.Record) error {
+		records = append(records, rec)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// recordFailureQuery stores a failed delivery attempt and clears the record lock, if the record is still locked by
+// the lock id
+const recordFailureQuery = `UPDATE outbox 
+		SET 
+			state=?,
+			number_of_attempts=?,
+			last_attempted_on=?,
+			error=?,
+			next_retry_at=?,
+			locked_by=NULL,
+			locked_on=NULL
+		WHERE id = ? AND locked_by = ?
+		`
+
+// recordFailureArgs returns the arguments of the recordFailureQuery
+func recordFailureArgs(f outbox.RecordFailure, lockID string) []interface{} {
+	return []interface{}{f.State, f.NumberOfAttempts, f.LastAttemptOn, f.Error, f.NextRetryAt, f.ID, lockID}
+}
+
+// RecordFailure stores a failed delivery attempt and clears the record lock without rewriting the message data.
+// The record is only updated if it is still locked by the provided lockID
+func (s Store) RecordFailure(failure outbox.RecordFailure, lockID string) error {
+	res, err := s.exec(context.Background(), "RecordFailure", recordFailureQuery, recordFailureArgs(failure, lockID)...)
+	if err != nil {
+		return err
+	}
+	return checkLockedUpdate(res)
+}
+
+// RecordFailures stores the failed delivery attempts and clears the record locks in a single transaction
+// without rewriting the message data. The records no longer locked by the provided lockID are left unchanged, and
+// outbox.ErrRecordLockLost is returned with their ids once the other failures are committed
+func (s Store) RecordFailures(failures []outbox.RecordFailure, lockID string) error {
+	if len(failures) == 0 {
+		return nil
+	}
+	ctx := context.Background()
+	var lost []uuid.UUID
+	err := s.withSchema(ctx, func() error {
+		var txErr error
+		lost, txErr = s.recordFailuresTx(ctx, failures, lockID)
+		return translateError(txErr)
+	})
+	if err != nil {
+		return err
+	}
+	if len(lost) > 0 {
+		return fmt.Errorf("%w: %v", outbox.ErrRecordLockLost, lost)
+	}
+	return nil
+}
+
+// recordFailuresTx stores the failures in a transaction and returns the ids of the records no longer locked by lockID
+func (s Store) recordFailuresTx(ctx context.Context, failures []outbox.RecordFailure, lockID string) ([]uuid.UUID, error) {
+	defer s.observeDuration("RecordFailures", time.Now())
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	stmt, err := tx.PrepareContext(ctx, s.table.sql(recordFailureQuery))
+	if err != nil {
+		return nil, errors.Join(err, tx.Rollback())
+	}
+	defer stmt.Close()
+	var lost []uuid.UUID
+	for _, f := range failures {
+		res, err := stmt.ExecContext(ctx, recordFailureArgs(f, lockID)...)
+		if err != nil {
+			return nil, errors.Join(err, tx.Rollback())
+		}
+		err = checkLockedUpdate(res)
+		if errors.Is(err, outbox.ErrRecordLockLost) {
+			lost = append(lost, f.ID)
+			continue
+		}
+		if err != nil {
+			return nil, errors.Join(err, tx.Rollback())
+		}
+	}
+	return lost, tx.Commit()
+}
+
+// MarkExported marks the record as exported and clears its lock without rewriting the message data.
+// The record is only updated if it is still locked by the provided lockID
+func (s Store) MarkExported(id uuid.UUID, lockID string) error {
+	res, err := s.exec(context.Background(), "MarkExported",
+		`UPDATE outbox 
+		SET 
+			state=?,
+			locked_by=NULL,
+			locked_on=NULL
+		WHERE id = ? AND locked_by = ?
+		`,
+		outbox.Exported,
+		id,
+		lockID,
+	)
+	if err != nil {
+		return err
+	}
+	return checkLockedUpdate(res)
+}
+
+// SetLock updates the lock information of the record with the provided id
+func (s Store) SetLock(id uuid.UUID, lockID *string, lockedOn *time.Time) error {
+	_, err := s.exec(context.Background(), "SetLock",
+		`UPDATE outbox 
+		SET 
+			locked_by=?,
+			locked_on=?
+		WHERE id = ?
+		`,
+		lockID,
+		lockedOn,
+		id,
+	)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
 // ClearLocksByLockID clears lock information of the records with the provided id
 func (s Store) ClearLocksByLockID(lockID string) error {
-	_, err := s.db.Exec(
+	_, err := s.exec(context.Background(), "ClearLocksByLockID",
 		`UPDATE outbox 
 		SET 
 			locked_by=NULL,
@@ -133,56 +699,379 @@ func (s Store) ClearLocksByLockID(lockID string) error {
 
 // GetRecordsByLockID returns the records of the provided id
 func (s Store) GetRecordsByLockID(lockID string) ([]outbox.Record, error) {
-	rows, err := s.db.Query(
-		"SELECT id, data, state, created_on,locked_by,locked_on,processed_on,number_of_attempts,last_attempted_on,error from outbox WHERE locked_by = ?",
+	var records []outbox.Record
+	err := s.IterateRecordsByLockID(context.Background(), lockID, func(rec outbox.Record) error {
+		records = append(records, rec)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// IterateRecordsByLockID streams the records of the provided lock id to fn
+func (s Store) IterateRecordsByLockID(ctx context.Context, lockID string, fn func(outbox.Record) error) error {
+	rows, err := s.query(ctx, "IterateRecordsByLockID",
+		"SELECT "+recordColumns+" from outbox WHERE locked_by = ? ORDER BY created_on",
 		lockID,
 	)
+	if err != nil {
+		return err
+	}
+	return s.iterateRecords(rows, fn)
+}
+
+// GetRecordsAfterWatermark returns up to limit records created after the provided (createdOn, id) pair
+func (s Store) GetRecordsAfterWatermark(createdOn time.Time, id uuid.UUID, limit int) ([]outbox.Record, error) {
+	predicate, args := s.withSelectionPredicate(`(created_on > ? OR (created_on = ? AND id > ?))`, createdOn, createdOn, id)
+	rows, err := s.query(context.Background(), "GetRecordsAfterWatermark",
+		"SELECT "+recordColumns+` from outbox 
+		WHERE `+predicate+`
+		ORDER BY created_on, id
+		LIMIT ?`,
+		append(args, limit)...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	var records []outbox.Record
+	err = s.iterateRecords(rows, func(rec outbox.Record) error {
+		records = append(records, rec)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// GetRecordIDsByStateCreatedBefore returns the ids of up to limit records of the state created before the provided time
+func (s Store) GetRecordIDsByStateCreatedBefore(state outbox.RecordState, createdBefore time.Time, limit int) ([]uuid.UUID, error) {
+	rows, err := s.query(context.Background(), "GetRecordIDsByStateCreatedBefore",
+		`SELECT id from outbox 
+		WHERE state = ? AND created_on < ?
+		ORDER BY created_on
+		LIMIT ?`,
+		state,
+		createdBefore,
+		limit,
+	)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	// An album slice to hold data from returned rows.
-	var messages []outbox.Record
+	var ids []uuid.UUID
+	for rows.Next() {
+		var id uuid.UUID
+		scanErr := rows.Scan(&id)
+		if scanErr != nil {
+			return nil, scanErr
+		}
+		ids = append(ids, id)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// GetRecordByID returns the record with the provided id, or outbox.ErrRecordNotFound if it does not exist
+func (s Store) GetRecordByID(id uuid.UUID) (outbox.Record, error) {
+	rows, err := s.query(context.Background(), "GetRecordByID",
+		"SELECT "+recordColumns+" from outbox WHERE id = ?",
+		id,
+	)
+	if err != nil {
+		return outbox.Record{}, err
+	}
+	var records []outbox.Record
+	err = s.iterateRecords(rows, func(rec outbox.Record) error {
+		records = append(records, rec)
+		return nil
+	})
+	if err != nil {
+		return outbox.Record{}, err
+	}
+	if len(records) == 0 {
+		return outbox.Record{}, fmt.Errorf("%w: %v", outbox.ErrRecordNotFound, id)
+	}
+	return records[0], nil
+}
+
+// GetRecordsByState returns up to limit records with the provided state created after the provided (createdOn, id)
+// pair. The selection predicate does not apply
+func (s Store) GetRecordsByState(state outbox.RecordState, createdOn time.Time, id uuid.UUID, limit int) ([]outbox.Record, error) {
+	rows, err := s.query(context.Background(), "GetRecordsByState",
+		"SELECT "+recordColumns+` from outbox 
+		WHERE state = ? AND (created_on > ? OR (created_on = ? AND id > ?))
+		ORDER BY created_on, id
+		LIMIT ?`,
+		state, createdOn, createdOn, id, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	var records []outbox.Record
+	err = s.iterateRecords(rows, func(rec outbox.Record) error {
+		records = append(records, rec)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// RequeueRecord moves the MaxAttemptsReached record back to PendingDelivery with its attempts reset. It returns
+// outbox.ErrDuplicateRecord if a pending record has the same business key
+func (s Store) RequeueRecord(id uuid.UUID) error {
+	res, err := s.exec(context.Background(), "RequeueRecord",
+		`UPDATE outbox 
+		SET
+			state=?,
+			number_of_attempts=0,
+			last_attempted_on=NULL,
+			error=NULL,
+			next_retry_at=NULL
+		WHERE id = ? AND state = ?
+		`,
+		outbox.PendingDelivery,
+		id,
+		outbox.MaxAttemptsReached,
+	)
+	if err != nil {
+		return err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return fmt.Errorf("%w: no dead-lettered record %v", outbox.ErrRecordNotFound, id)
+	}
+	return nil
+}
+
+// ReplaceExportedRecord stores the PendingDelivery record in place of the unlocked Exported record with the same id,
+// with its attempts, error, retry time and publish handle reset. The record keeps its sequence number. It returns
+// outbox.ErrDuplicateRecord if the stored record is not Exported or not unlocked, or if a pending record has the
+// same business key
+func (s Store) ReplaceExportedRecord(ctx context.Context, rec outbox.Record) error {
+	rec, err := s.checkTimestamps(rec)
+	if err != nil {
+		return err
+	}
+	if err = s.checkBacklog(ctx); err != nil {
+		return err
+	}
+	data, encErr := s.serializer.encode(rec.Message)
+	if encErr != nil {
+		return encErr
+	}
+	res, err := s.exec(ctx, "ReplaceExportedRecord",
+		`UPDATE outbox 
+		SET
+			data=?,
+			state=?,
+			created_on=?,
+			processed_on=NULL,
+			number_of_attempts=0,
+			last_attempted_on=NULL,
+			error=NULL,
+			expires_at=?,
+			next_retry_at=NULL,
+			business_key=?,
+			topic=?,
+			publish_handle=NULL
+		WHERE id = ? AND locked_by IS NULL AND state = ?
+		`,
+		data,
+		outbox.PendingDelivery,
+		rec.CreatedOn,
+		rec.ExpiresAt,
+		s.businessKey(rec.Message),
+		rec.Message.Topic,
+		rec.ID,
+		outbox.Exported,
+	)
+	if err != nil {
+		return translateError(err)
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected > 0 {
+		s.backlogGuard.added()
+		return nil
+	}
+	if _, err = s.GetRecordByID(rec.ID); err != nil {
+		return err
+	}
+	return fmt.Errorf("%w: the record %v is not an unlocked Exported record", outbox.ErrDuplicateRecord, rec.ID)
+}
+
+// SetNextRetryAt overrides the next retry time of the PendingDelivery record. The time must be a UTC time within the
+// range of the DATETIME column and at most outbox.MaxNextRetryDelay after the Clock, see validNextRetryAt. mySQL does
+// not count the rows updated with their current value, so the record is read again when none is updated
+func (s Store) SetNextRetryAt(id uuid.UUID, nextRetryAt time.Time) error {
+	if err := validNextRetryAt(nextRetryAt, s.clock.Now().UTC()); err != nil {
+		return err
+	}
+	res, err := s.exec(context.Background(), "SetNextRetryAt",
+		`UPDATE outbox SET next_retry_at = ? WHERE id = ? AND state = ?`,
+		nextRetryAt,
+		id,
+		outbox.PendingDelivery,
+	)
+	if err != nil {
+		return err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected > 0 {
+		return nil
+	}
+	rec, err := s.GetRecordByID(id)
+	if err != nil {
+		return err
+	}
+	if rec.State != outbox.PendingDelivery {
+		return fmt.Errorf("%w: no pending record %v", outbox.ErrRecordNotFound, id)
+	}
+	return nil
+}
+
+// minDatetime is the earliest value of the DATETIME columns
+var minDatetime = time.Date(1000, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// validNextRetryAt returns an error if the next retry time is not in UTC, is before the range of the DATETIME column or
+// is more than outbox.MaxNextRetryDelay after now. Times in the past are accepted, so that the record is retried
+// immediately
+func validNextRetryAt(nextRetryAt time.Time, now time.Time) error {
+	if nextRetryAt.Location() != time.UTC {
+		return fmt.Errorf("the next retry time %v must be in UTC", nextRetryAt)
+	}
+	if nextRetryAt.Before(minDatetime) {
+		return fmt.Errorf("the next retry time %v is before the earliest DATETIME value", nextRetryAt)
+	}
+	if nextRetryAt.Sub(now) > outbox.MaxNextRetryDelay {
+		return fmt.Errorf("the next retry time %v is more than %v after now", nextRetryAt, outbox.MaxNextRetryDelay)
+	}
+	return nil
+}
+
+// GetBacklogByState returns the number of records with the provided state and the creation time of the oldest one
+func (s Store) GetBacklogByState(state outbox.RecordState) (outbox.Backlog, error) {
+	rows, err := s.query(context.Background(), "GetBacklogByState",
+		`SELECT COUNT(*), MIN(created_on) from outbox 
+		WHERE state = ?`,
+		state,
+	)
+	if err != nil {
+		return outbox.Backlog{}, err
+	}
+	defer rows.Close()
+
+	var backlog outbox.Backlog
+	if rows.Next() {
+		var oldest sql.NullTime
+		scanErr := rows.Scan(&backlog.Records, &oldest)
+		if scanErr != nil {
+			return outbox.Backlog{}, scanErr
+		}
+		if oldest.Valid {
+			backlog.OldestCreatedOn = &oldest.Time
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return outbox.Backlog{}, err
+	}
+	return backlog, nil
+}
+
+// recordColumns is the list of the selected columns that iterateRecords expects
+const recordColumns = "id, data, state, created_on,locked_by,locked_on,processed_on,number_of_attempts,last_attempted_on,error,expires_at,next_retry_at,sequence,publish_handle"
+
+// iterateRecords decodes every row to a record and passes it to fn. The rows are closed once iterated
+func (s Store) iterateRecords(rows *sql.Rows, fn func(outbox.Record) error) error {
+	defer rows.Close()
 
 	// Loop through rows, using Scan to assign column data to struct fields.
 	for rows.Next() {
 		var rec outbox.Record
 		var data []byte
-		scanErr := rows.Scan(&rec.ID, &data, &rec.State, &rec.CreatedOn, &rec.LockID, &rec.LockedOn, &rec.ProcessedOn, &rec.NumberOfAttempts, &rec.LastAttemptOn, &rec.Error)
+		scanErr := rows.Scan(&rec.ID, &data, &rec.State, &rec.CreatedOn, &rec.LockID, &rec.LockedOn, &rec.ProcessedOn, &rec.NumberOfAttempts, &rec.LastAttemptOn, &rec.Error, &rec.ExpiresAt, &rec.NextRetryAt, &rec.Sequence, &rec.PublishHandle)
 		if scanErr != nil {
-			if scanErr == sql.ErrNoRows {
-				return messages, nil
-			}
-			return messages, err
+			return scanErr
 		}
-		decErr := gob.NewDecoder(bytes.NewReader(data)).Decode(&rec.Message)
+		decErr := s.serializer.decode(data, &rec.Message)
 		if decErr != nil {
-			return nil, decErr
+			return decErr
 		}
 
-		messages = append(messages, rec)
-	}
-	if err = rows.Err(); err != nil {
-		return messages, err
+		fnErr := fn(rec)
+		if fnErr != nil {
+			return fnErr
+		}
 	}
-	return messages, nil
+	return rows.Err()
 }
 
-// AddRecordTx stores the record in the db within the provided transaction tx
+// AddRecordTx stores the record in the db within the provided transaction tx.
+// The schema is never created within the transaction, since mysql implicitly commits on DDL statements
 func (s Store) AddRecordTx(rec outbox.Record, tx *sql.Tx) error {
-	msgBuf := new(bytes.Buffer)
-	msgEnc := gob.NewEncoder(msgBuf)
-	encErr := msgEnc.Encode(rec.Message)
+	return s.insertRecord(context.Background(), tx, rec)
+}
+
+// AddRecord stores the record in the db outside of a transaction
+func (s Store) AddRecord(ctx context.Context, rec outbox.Record) error {
+	return s.withSchema(ctx, func() error {
+		if !s.keySequences {
+			return s.insertRecord(ctx, s.db, rec)
+		}
+		tx, err := s.db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		err = s.insertRecord(ctx, tx, rec)
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+		return tx.Commit()
+	})
+}
 
+// execer is implemented by both sql.DB and sql.Tx
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+func (s Store) insertRecord(ctx context.Context, db execer, rec outbox.Record) error {
+	rec, err := s.checkTimestamps(rec)
+	if err != nil {
+		return err
+	}
+	if rec.State == outbox.PendingDelivery {
+		if err := s.checkBacklog(ctx); err != nil {
+			return err
+		}
+	}
+	data, encErr := s.serializer.encode(rec.Message)
 	if encErr != nil {
 		return encErr
 	}
-	q := "INSERT INTO outbox (id, data, state, created_on,locked_by,locked_on,processed_on,number_of_attempts,last_attempted_on,error) VALUES (?,?,?,?,?,?,?,?,?,?)"
+	defer s.observeDuration("AddRecord", time.Now())
+	q := "INSERT INTO outbox (id, data, state, created_on,locked_by,locked_on,processed_on,number_of_attempts,last_attempted_on,error,expires_at,next_retry_at,business_key,sequence,topic) VALUES (?,?,?,?,?,?,?,?,?,?,?,?,?,?,?)"
 
-	_, err := tx.Exec(q,
+	_, err = s.execContext(ctx, db, q,
 		rec.ID,
-		msgBuf.Bytes(),
+		data,
 		rec.State,
 		rec.CreatedOn,
 		rec.LockID,
@@ -190,22 +1079,230 @@ func (s Store) AddRecordTx(rec outbox.Record, tx *sql.Tx) error {
 		rec.ProcessedOn,
 		rec.NumberOfAttempts,
 		rec.LastAttemptOn,
-		rec.Error)
+		rec.Error,
+		rec.ExpiresAt,
+		rec.NextRetryAt,
+		s.businessKey(rec.Message),
+		nil,
+		rec.Message.Topic)
 	if err != nil {
-		return err
+		return translateError(err)
+	}
+	// The sequence is assigned once the record is inserted, so that a duplicate record does not take a number
+	if s.keySequences && rec.Message.Key != "" {
+		err = s.assignSequence(ctx, db, rec)
+		if err != nil {
+			return err
+		}
+	}
+	if rec.State == outbox.PendingDelivery {
+		s.backlogGuard.added()
 	}
 	return nil
 }
 
-// RemoveRecordsBeforeDatetime removes records before the provided datetime
-func (s Store) RemoveRecordsBeforeDatetime(expiryTime time.Time) error {
-	_, err := s.db.Exec(
+// businessKey returns the hex encoded sha256 hash of the values of the BusinessKeyHeaders of the message,
+// or nil if the business key is not set or the message misses any of the headers
+func (s Store) businessKey(msg outbox.Message) *string {
+	if len(s.businessKeyHeaders) == 0 {
+		return nil
+	}
+	h := sha256.New()
+	for _, name := range s.businessKeyHeaders {
+		value, ok := msg.Headers[name]
+		if !ok {
+			return nil
+		}
+		// The values are length prefixed, so that different values cannot be concatenated to the same key
+		_ = binary.Write(h, binary.BigEndian, uint64(len(value)))
+		h.Write([]byte(value))
+	}
+	key := hex.EncodeToString(h.Sum(nil))
+	return &key
+}
+
+// RemoveRecordsBeforeDatetime removes the unlocked terminal records without a publish handle created before the
+// provided datetime. The state condition is part of the delete statement, so the undelivered records cannot be
+// removed by a misconfigured retention
+func (s Store) RemoveRecordsBeforeDatetime(expiryTime time.Time) (int64, int64, error) {
+	condition, conditionArgs := removableCondition()
+	args := append([]interface{}{expiryTime}, conditionArgs...)
+	res, err := s.exec(context.Background(), "RemoveRecordsBeforeDatetime",
 		`DELETE FROM outbox 
-		WHERE created_on < ?
+		WHERE created_on < ? AND `+condition+`
+		`,
+		args...)
+	if err != nil {
+		return 0, 0, err
+	}
+	removed, err := res.RowsAffected()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	rows, err := s.query(context.Background(), "CountSkippedRecordsBeforeDatetime",
+		`SELECT COUNT(*) FROM outbox 
+		WHERE created_on < ? AND NOT `+condition+`
 		`,
-		expiryTime)
+		args...)
+	if err != nil {
+		return removed, 0, err
+	}
+	defer rows.Close()
+	var skipped int64
+	if rows.Next() {
+		err = rows.Scan(&skipped)
+		if err != nil {
+			return removed, 0, err
+		}
+	}
+	return removed, skipped, rows.Err()
+}
+
+// removableCondition returns the condition of the records that can be removed, the unlocked records in a
+// TerminalRecordStates state without a publish handle, and its arguments. Every delete path applies it, so that an
+// undelivered record is never removed, nor a delivered record whose prepared publish is left to
+// RecoverPreparedPublishes
+func removableCondition() (string, []interface{}) {
+	states := outbox.TerminalRecordStates()
+	args := make([]interface{}, len(states))
+	for i, state := range states {
+		args[i] = state
+	}
+	return "(state IN (" + placeholders(len(states)) + ") AND locked_by IS NULL AND publish_handle IS NULL)", args
+}
+
+// maxIDsPerStatement is the maximum number of ids of a single IN list, well below the placeholder limit of mysql
+const maxIDsPerStatement = 1000
+
+// RemoveRecordsByIDs removes the unlocked terminal records without a publish handle with the provided ids in
+// statements of up to maxIDsPerStatement ids. The distinct ids of the other records, and the unknown ones, are
+// returned as skipped. The statements are not run in a transaction, so the records of the successful statements are
+// removed even if a later statement fails
+func (s Store) RemoveRecordsByIDs(ids []uuid.UUID) (int64, int64, error) {
+	ids = distinctIDs(ids)
+	condition, conditionArgs := removableCondition()
+	var removed int64
+	for _, chunk := range chunkIDs(ids, maxIDsPerStatement) {
+		args := make([]interface{}, 0, len(chunk)+len(conditionArgs))
+		for _, id := range chunk {
+			args = append(args, id)
+		}
+		args = append(args, conditionArgs...)
+		res, err := s.exec(unprepared(context.Background()), "RemoveRecordsByIDs",
+			"DELETE FROM outbox WHERE id IN ("+placeholders(len(chunk))+") AND "+condition,
+			args...)
+		if err != nil {
+			return removed, 0, err
+		}
+		affected, err := res.RowsAffected()
+		if err != nil {
+			return removed, 0, err
+		}
+		removed += affected
+	}
+	return removed, int64(len(ids)) - removed, nil
+}
+
+// distinctIDs returns the ids without their duplicates, in the order of their first occurrence
+func distinctIDs(ids []uuid.UUID) []uuid.UUID {
+	seen := make(map[uuid.UUID]struct{}, len(ids))
+	distinct := make([]uuid.UUID, 0, len(ids))
+	for _, id := range ids {
+		if _, ok := seen[id]; ok {
+			continue
+		}
+		seen[id] = struct{}{}
+		distinct = append(distinct, id)
+	}
+	return distinct
+}
+
+// chunkIDs splits the ids in chunks of up to size ids
+func chunkIDs(ids []uuid.UUID, size int) [][]uuid.UUID {
+	var chunks [][]uuid.UUID
+	for len(ids) > size {
+		chunks = append(chunks, ids[:size])
+		ids = ids[size:]
+	}
+	if len(ids) > 0 {
+		chunks = append(chunks, ids)
+	}
+	return chunks
+}
+
+// placeholders returns a comma separated list of n placeholders
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?,", n), ",")
+}
+
+// checkLockedUpdate returns outbox.ErrRecordLockLost if the lock guarded update did not affect any record
+func checkLockedUpdate(res sql.Result) error {
+	affected, err := res.RowsAffected()
 	if err != nil {
 		return err
 	}
+	if affected == 0 {
+		return outbox.ErrRecordLockLost
+	}
 	return nil
 }
+
+// withSelectionPredicate appends the configured selection predicate to the provided condition
+func (s Store) withSelectionPredicate(condition string, args ...interface{}) (string, []interface{}) {
+	if s.selectionPredicate == "" {
+		return condition, args
+	}
+	return condition + " AND (" + s.selectionPredicate + ")", append(args, s.selectionPredicateArgs...)
+}
+
+// validatePredicate checks that the predicate can be safely appended with AND to a WHERE clause.
+// Quotes are rejected so that all the values are passed as arguments.
+func validatePredicate(predicate string, args []interface{}) error {
+	for _, forbidden := range []string{";", "--", "#", "/*", "*/", "'", "\"", "\\"} {
+		if strings.Contains(predicate, forbidden) {
+			return fmt.Errorf("invalid selection predicate: %q is not allowed", forbidden)
+		}
+	}
+	depth := 0
+	for _, c := range predicate {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		}
+		if depth < 0 {
+			break
+		}
+	}
+	if depth != 0 {
+		return errors.New("invalid selection predicate: unbalanced parentheses")
+	}
+	if placeholders := strings.Count(predicate, "?"); placeholders != len(args) {
+		return fmt.Errorf("invalid selection predicate: %d placeholders but %d arguments", placeholders, len(args))
+	}
+	return nil
+}
+
+const (
+	// errDuplicateEntry is the mysql error number of unique key violations
+	errDuplicateEntry = 1062
+	// errNoSuchTable is the mysql error number of queries against missing tables
+	errNoSuchTable = 1146
+)
+
+// translateError maps the mysql errors to the corresponding outbox errors
+func translateError(err error) error {
+	var mysqlErr *mysqldriver.MySQLError
+	if !errors.As(err, &mysqlErr) {
+		return err
+	}
+	switch mysqlErr.Number {
+	case errDuplicateEntry:
+		return fmt.Errorf("%w: %v", outbox.ErrDuplicateRecord, err)
+	case errNoSuchTable:
+		return fmt.Errorf("%w: create the outbox table or enable the AutoMigrate setting: %v", outbox.ErrSchemaMissing, err)
+	}
+	return err
+}
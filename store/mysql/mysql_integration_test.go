@@ -0,0 +1,635 @@
+//go:build integration
+
+package mysql
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pkritiotis/outbox"
+)
+
+func TestStore_UpdateRecordsLockByStates(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+	now := time.Now().UTC().Truncate(time.Second)
+	retryAt := now.Add(-3 * time.Hour)
+	notDue := now.Add(time.Hour)
+	// The retried record has been due since before the creation of the new ones
+	records := []outbox.Record{
+		{ID: uuid.New(), State: outbox.PendingDelivery, CreatedOn: now.Add(-2 * time.Hour)},
+		{ID: uuid.New(), State: outbox.PendingDelivery, CreatedOn: now.Add(-4 * time.Hour), NextRetryAt: &retryAt},
+		{ID: uuid.New(), State: outbox.PendingDelivery, CreatedOn: now.Add(-time.Hour)},
+		{ID: uuid.New(), State: outbox.PendingDelivery, CreatedOn: now.Add(-5 * time.Hour), NextRetryAt: &notDue},
+	}
+	// The predicate scopes the lock to the records of the test
+	ids := make([]interface{}, len(records))
+	for i, rec := range records {
+		ids[i] = rec.ID.String()
+	}
+	s, err := NewStoreWithDB(db, Settings{SelectionPredicate: "id IN (?,?,?,?)", SelectionPredicateArgs: ids})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.EnsureSchema(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for _, rec := range records {
+		rec.Message = outbox.Message{Key: "key", Topic: t.Name()}
+		if err = s.AddRecord(ctx, rec); err != nil {
+			t.Fatal(err)
+		}
+		rec := rec
+		t.Cleanup(func() { _, _ = db.Exec("DELETE FROM outbox WHERE id = ?", rec.ID.String()) })
+	}
+
+	lockID := "lock-" + uuid.NewString()
+	err = s.UpdateRecordsLockByStates(lockID, now, []outbox.RecordState{outbox.PendingDelivery, outbox.Exported}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	locked, err := s.GetRecordsByLockID(lockID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(locked) != 2 || locked[0].ID != records[1].ID || locked[1].ID != records[0].ID {
+		t.Fatalf("expected the retried and the oldest new records to be locked, got %+v", locked)
+	}
+}
+
+func TestStore_AddAttempts(t *testing.T) {
+	db := openTestDB(t)
+	s, err := NewStoreWithDB(db, Settings{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.EnsureSchema(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	id := uuid.New()
+	t.Cleanup(func() { _, _ = db.Exec("DELETE FROM outbox_attempts WHERE record_id = ?", id.String()) })
+	old := time.Now().UTC().Add(-48 * time.Hour).Truncate(time.Second)
+	recent := time.Now().UTC().Truncate(time.Second)
+	errMsg := "broker error"
+	attempts := make([]outbox.Attempt, maxAttemptsPerStatement+1)
+	for i := range attempts {
+		attempts[i] = outbox.Attempt{RecordID: id, Topic: "topic", Number: i + 1, AttemptedOn: old, Error: &errMsg}
+	}
+	attempts[len(attempts)-1].AttemptedOn = recent
+	attempts[len(attempts)-1].Error = nil
+	if err = s.AddAttempts(attempts); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = s.RemoveAttemptsBeforeDatetime(recent.Add(-time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	var count int
+	var lastErr *string
+	err = db.QueryRow("SELECT COUNT(*), MAX(error) FROM outbox_attempts WHERE record_id = ?", id.String()).Scan(&count, &lastErr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 || lastErr != nil {
+		t.Fatalf("expected the successful recent attempt to be kept, got %d attempts with error %v", count, lastErr)
+	}
+}
+
+func TestStore_UpdateRecordsLockByStates_maxRetryShare(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+	now := time.Now().UTC().Truncate(time.Second)
+	var records []outbox.Record
+	for i := 0; i < 6; i++ {
+		rec := outbox.Record{ID: uuid.New(), State: outbox.PendingDelivery, CreatedOn: now.Add(time.Duration(i-10) * time.Minute)}
+		// The oldest records are retries
+		if i < 4 {
+			rec.NumberOfAttempts = 1
+		}
+		records = append(records, rec)
+	}
+	ids := make([]interface{}, len(records))
+	for i, rec := range records {
+		ids[i] = rec.ID.String()
+	}
+	s, err := NewStoreWithDB(db, Settings{
+		SelectionPredicate:     "id IN (?,?,?,?,?,?)",
+		SelectionPredicateArgs: ids,
+		MaxRetryShare:          0.25,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.EnsureSchema(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for _, rec := range records {
+		rec.Message = outbox.Message{Key: "key", Topic: t.Name()}
+		if err = s.AddRecord(ctx, rec); err != nil {
+			t.Fatal(err)
+		}
+		rec := rec
+		t.Cleanup(func() { _, _ = db.Exec("DELETE FROM outbox WHERE id = ?", rec.ID.String()) })
+	}
+
+	lockID := "lock-" + uuid.NewString()
+	if err = s.UpdateRecordsLockByStates(lockID, now, []outbox.RecordState{outbox.PendingDelivery}, 4); err != nil {
+		t.Fatal(err)
+	}
+	locked, err := s.GetRecordsByLockID(lockID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A single retry fits the quota of the batch of 4, the new records and one more retry fill the rest
+	if len(locked) != 4 || locked[0].ID != records[0].ID || locked[1].ID != records[1].ID ||
+		locked[2].ID != records[4].ID || locked[3].ID != records[5].ID {
+		t.Fatalf("expected two retries and the two new records to be locked, got %+v", locked)
+	}
+}
+
+func TestStore_RecordFailureAfterLockTakeover(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+	s, err := NewStoreWithDB(db, Settings{SelectionPredicate: "topic = ?", SelectionPredicateArgs: []interface{}{t.Name()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.EnsureSchema(ctx); err != nil {
+		t.Fatal(err)
+	}
+	rec := outbox.Record{ID: uuid.New(), State: outbox.PendingDelivery, CreatedOn: time.Now().UTC(), Message: outbox.Message{Key: "key", Topic: t.Name()}}
+	if err = s.AddRecord(ctx, rec); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _, _ = db.Exec("DELETE FROM outbox WHERE id = ?", rec.ID.String()) })
+
+	// The lock of the stale dispatcher is reaped and the record is delivered by another one
+	stale, other := "stale-"+uuid.NewString(), "other-"+uuid.NewString()
+	now := time.Now().UTC()
+	if err = s.UpdateRecordsLockByStates(stale, now, []outbox.RecordState{outbox.PendingDelivery}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.ClearLocksByLockID(stale); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.UpdateRecordsLockByStates(other, now, []outbox.RecordState{outbox.PendingDelivery}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.MarkProcessed(rec.ID, 1, now, other); err != nil {
+		t.Fatal(err)
+	}
+
+	// The failure of the stale dispatcher does not overwrite the delivered record
+	err = s.RecordFailure(outbox.RecordFailure{ID: rec.ID, State: outbox.PendingDelivery, Error: "broker error", NumberOfAttempts: 2, LastAttemptOn: now}, stale)
+	if !errors.Is(err, outbox.ErrRecordLockLost) {
+		t.Fatalf("expected ErrRecordLockLost, got %v", err)
+	}
+	got, err := s.GetRecordByID(rec.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.State != outbox.Delivered || got.NumberOfAttempts != 1 {
+		t.Fatalf("expected the record to stay delivered, got %+v", got)
+	}
+}
+
+func TestStore_RecordFailuresAfterLockTakeover(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+	s, err := NewStoreWithDB(db, Settings{SelectionPredicate: "topic = ?", SelectionPredicateArgs: []interface{}{t.Name()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.EnsureSchema(ctx); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC()
+	taken := outbox.Record{ID: uuid.New(), State: outbox.PendingDelivery, CreatedOn: now, Message: outbox.Message{Key: "taken", Topic: t.Name()}}
+	kept := outbox.Record{ID: uuid.New(), State: outbox.PendingDelivery, CreatedOn: now, Message: outbox.Message{Key: "kept", Topic: t.Name()}}
+	for _, rec := range []outbox.Record{taken, kept} {
+		if err = s.AddRecord(ctx, rec); err != nil {
+			t.Fatal(err)
+		}
+		rec := rec
+		t.Cleanup(func() { _, _ = db.Exec("DELETE FROM outbox WHERE id = ?", rec.ID.String()) })
+	}
+
+	// The lock of the taken record is reaped and the record is delivered by another dispatcher
+	stale, other := "stale-"+uuid.NewString(), "other-"+uuid.NewString()
+	if err = s.UpdateRecordsLockByStates(stale, now, []outbox.RecordState{outbox.PendingDelivery}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.SetLock(taken.ID, &other, &now); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.MarkProcessed(taken.ID, 1, now, other); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the failure of the record still locked by the stale dispatcher is stored
+	err = s.RecordFailures([]outbox.RecordFailure{
+		{ID: taken.ID, State: outbox.PendingDelivery, Error: "broker error", NumberOfAttempts: 2, LastAttemptOn: now},
+		{ID: kept.ID, State: outbox.PendingDelivery, Error: "broker error", NumberOfAttempts: 1, LastAttemptOn: now},
+	}, stale)
+	if !errors.Is(err, outbox.ErrRecordLockLost) {
+		t.Fatalf("expected ErrRecordLockLost, got %v", err)
+	}
+	got, err := s.GetRecordByID(taken.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.State != outbox.Delivered || got.NumberOfAttempts != 1 {
+		t.Fatalf("expected the taken record to stay delivered, got %+v", got)
+	}
+	got, err = s.GetRecordByID(kept.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.NumberOfAttempts != 1 || got.Error == nil || got.LockID != nil {
+		t.Fatalf("expected the failure of the kept record to be stored, got %+v", got)
+	}
+}
+
+func TestStore_PublishHandle(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+	s, err := NewStoreWithDB(db, Settings{SelectionPredicate: "topic = ?", SelectionPredicateArgs: []interface{}{t.Name()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.EnsureSchema(ctx); err != nil {
+		t.Fatal(err)
+	}
+	rec := outbox.Record{ID: uuid.New(), State: outbox.PendingDelivery, CreatedOn: time.Now().UTC(), Message: outbox.Message{Key: "key", Topic: t.Name()}}
+	if err = s.AddRecord(ctx, rec); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _, _ = db.Exec("DELETE FROM outbox WHERE id = ?", rec.ID.String()) })
+
+	// The handle is only stored on a record held by the lock
+	if err = s.SetPublishHandle(rec.ID, "other", "handle"); err != outbox.ErrRecordLockLost {
+		t.Fatalf("expected ErrRecordLockLost, got %v", err)
+	}
+	lockID := "lock-" + uuid.NewString()
+	if err = s.UpdateRecordsLockByStates(lockID, time.Now().UTC(), []outbox.RecordState{outbox.PendingDelivery}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.SetPublishHandle(rec.ID, lockID, "handle"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The locked record is not recovered
+	prepared, err := s.GetRecordsWithPublishHandle(time.Now().UTC(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range prepared {
+		if p.ID == rec.ID {
+			t.Fatalf("expected the locked record not to be recovered")
+		}
+	}
+	if err = s.ClearLocksByLockID(lockID); err != nil {
+		t.Fatal(err)
+	}
+	prepared, err = s.GetRecordsWithPublishHandle(time.Now().UTC(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(prepared) != 1 || *prepared[0].PublishHandle != "handle" {
+		t.Fatalf("expected the unlocked record to be recovered, got %+v", prepared)
+	}
+
+	// A handle replaced in the meantime is not cleared
+	if err = s.ClearPublishHandle(rec.ID, "previous"); err != nil {
+		t.Fatal(err)
+	}
+	var handle *string
+	if err = db.QueryRow("SELECT publish_handle FROM outbox WHERE id = ?", rec.ID.String()).Scan(&handle); err != nil {
+		t.Fatal(err)
+	}
+	if handle == nil || *handle != "handle" {
+		t.Fatalf("expected the handle to be kept, got %v", handle)
+	}
+	if err = s.ClearPublishHandle(rec.ID, "handle"); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.QueryRow("SELECT publish_handle FROM outbox WHERE id = ?", rec.ID.String()).Scan(&handle); err != nil {
+		t.Fatal(err)
+	}
+	if handle != nil {
+		t.Fatalf("expected the handle to be cleared, got %v", *handle)
+	}
+}
+
+func TestStore_GetRecordsWithPublishHandle_delivered(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+	s, err := NewStoreWithDB(db, Settings{SelectionPredicate: "topic = ?", SelectionPredicateArgs: []interface{}{t.Name()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.EnsureSchema(ctx); err != nil {
+		t.Fatal(err)
+	}
+	rec := outbox.Record{ID: uuid.New(), State: outbox.PendingDelivery, CreatedOn: time.Now().UTC(), Message: outbox.Message{Key: "key", Topic: t.Name()}}
+	if err = s.AddRecord(ctx, rec); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _, _ = db.Exec("DELETE FROM outbox WHERE id = ?", rec.ID.String()) })
+	lockID := "lock-" + uuid.NewString()
+	if err = s.UpdateRecordsLockByStates(lockID, time.Now().UTC(), []outbox.RecordState{outbox.PendingDelivery}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.SetPublishHandle(rec.ID, lockID, "handle"); err != nil {
+		t.Fatal(err)
+	}
+	processedOn := time.Now().UTC().Truncate(time.Second)
+	if err = s.MarkProcessed(rec.ID, 1, processedOn, lockID); err != nil {
+		t.Fatal(err)
+	}
+
+	// The record delivered after deliveredBefore is still being committed by its dispatcher
+	prepared, err := s.GetRecordsWithPublishHandle(processedOn.Add(-time.Minute), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(prepared) != 0 {
+		t.Fatalf("expected the recently delivered record not to be recovered, got %+v", prepared)
+	}
+	prepared, err = s.GetRecordsWithPublishHandle(processedOn.Add(time.Minute), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(prepared) != 1 || prepared[0].State != outbox.Delivered {
+		t.Fatalf("expected the delivered record to be recovered, got %+v", prepared)
+	}
+}
+
+func TestStore_SetNextRetryAt(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+	s, err := NewStoreWithDB(db, Settings{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.EnsureSchema(ctx); err != nil {
+		t.Fatal(err)
+	}
+	rec := outbox.Record{ID: uuid.New(), State: outbox.PendingDelivery, CreatedOn: time.Now().UTC(), Message: outbox.Message{Key: "key", Topic: t.Name()}}
+	if err = s.AddRecord(ctx, rec); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _, _ = db.Exec("DELETE FROM outbox WHERE id = ?", rec.ID.String()) })
+
+	retryAt := time.Now().UTC().Add(time.Hour).Truncate(time.Second)
+	// Setting the current retry time again is not an error
+	for i := 0; i < 2; i++ {
+		if err = s.SetNextRetryAt(rec.ID, retryAt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, err := s.GetRecordByID(rec.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.NextRetryAt == nil || !got.NextRetryAt.Equal(retryAt) {
+		t.Fatalf("expected the next retry time %v, got %v", retryAt, got.NextRetryAt)
+	}
+	if err = s.SetNextRetryAt(uuid.New(), retryAt); !errors.Is(err, outbox.ErrRecordNotFound) {
+		t.Fatalf("expected ErrRecordNotFound, got %v", err)
+	}
+}
+
+func TestStore_DrainAndImport(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+	rec := outbox.Record{ID: uuid.New(), State: outbox.PendingDelivery, CreatedOn: time.Now().UTC(), Message: outbox.Message{Key: "key", Topic: t.Name(), Body: []byte("body")}}
+	// The predicate scopes the drain to the record of the test
+	s, err := NewStoreWithDB(db, Settings{SelectionPredicate: "id = ?", SelectionPredicateArgs: []interface{}{rec.ID.String()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.EnsureSchema(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.AddRecord(ctx, rec); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _, _ = db.Exec("DELETE FROM outbox WHERE id = ?", rec.ID.String()) })
+
+	var drained bytes.Buffer
+	exported, err := outbox.NewDispatcher(s, nil, outbox.DispatcherSettings{}, "drain-"+uuid.NewString()).DrainToWriter(ctx, &drained)
+	if err != nil || exported != 1 {
+		t.Fatalf("expected the record to be drained, got %d: %v", exported, err)
+	}
+
+	// The Exported record is dispatched again once imported with its id
+	publisher := outbox.NewPublisher(s)
+	imported, err := publisher.ImportFromReader(ctx, bytes.NewReader(drained.Bytes()), outbox.ImportSettings{PreserveIDs: true})
+	if err != nil || imported != 1 {
+		t.Fatalf("expected the record to be imported, got %d: %v", imported, err)
+	}
+	got, err := s.GetRecordByID(rec.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.State != outbox.PendingDelivery || string(got.Message.Body) != "body" {
+		t.Fatalf("expected the record to be pending again, got %+v", got)
+	}
+
+	// The pending record is not replaced by a second import
+	imported, err = publisher.ImportFromReader(ctx, bytes.NewReader(drained.Bytes()), outbox.ImportSettings{PreserveIDs: true})
+	if imported != 0 || !errors.Is(err, outbox.ErrDuplicateRecord) {
+		t.Fatalf("expected ErrDuplicateRecord, got %d: %v", imported, err)
+	}
+
+	// Nor is the record once delivered, so that importing the file again does not publish it twice
+	if _, err = db.Exec("UPDATE outbox SET state = ? WHERE id = ?", outbox.Delivered, rec.ID.String()); err != nil {
+		t.Fatal(err)
+	}
+	imported, err = publisher.ImportFromReader(ctx, bytes.NewReader(drained.Bytes()), outbox.ImportSettings{PreserveIDs: true})
+	if imported != 0 || !errors.Is(err, outbox.ErrDuplicateRecord) {
+		t.Fatalf("expected ErrDuplicateRecord, got %d: %v", imported, err)
+	}
+	got, err = s.GetRecordByID(rec.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.State != outbox.Delivered {
+		t.Fatalf("expected the record to stay delivered, got %+v", got)
+	}
+}
+
+func TestStore_DrainRecordWaitingForRetry(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+	retryAt := time.Now().UTC().Add(time.Hour).Truncate(time.Second)
+	rec := outbox.Record{ID: uuid.New(), State: outbox.PendingDelivery, CreatedOn: time.Now().UTC(), NextRetryAt: &retryAt, NumberOfAttempts: 1, Message: outbox.Message{Key: "key", Topic: t.Name(), Body: []byte("body")}}
+	// The predicate scopes the drain to the record of the test
+	s, err := NewStoreWithDB(db, Settings{SelectionPredicate: "id = ?", SelectionPredicateArgs: []interface{}{rec.ID.String()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.EnsureSchema(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.AddRecord(ctx, rec); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _, _ = db.Exec("DELETE FROM outbox WHERE id = ?", rec.ID.String()) })
+
+	var drained bytes.Buffer
+	exported, err := outbox.NewDispatcher(s, nil, outbox.DispatcherSettings{}, "drain-"+uuid.NewString()).DrainToWriter(ctx, &drained)
+	if err != nil || exported != 1 {
+		t.Fatalf("expected the record waiting for its retry to be drained, got %d: %v", exported, err)
+	}
+	got, err := s.GetRecordByID(rec.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.State != outbox.Exported {
+		t.Fatalf("expected the record to be exported, got %+v", got)
+	}
+}
+
+func TestStore_UpdateRecordsLockByStatesExcludingTopics(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+	now := time.Now().UTC().Truncate(time.Second)
+	paused, active := "paused-"+uuid.NewString(), "active-"+uuid.NewString()
+	// The records of the paused topic are the oldest, so they would fill the batch
+	records := []outbox.Record{
+		{ID: uuid.New(), State: outbox.PendingDelivery, CreatedOn: now.Add(-3 * time.Hour), Message: outbox.Message{Topic: paused}},
+		{ID: uuid.New(), State: outbox.PendingDelivery, CreatedOn: now.Add(-2 * time.Hour), Message: outbox.Message{Topic: paused}},
+		{ID: uuid.New(), State: outbox.PendingDelivery, CreatedOn: now.Add(-time.Hour), Message: outbox.Message{Topic: active}},
+	}
+	ids := make([]interface{}, len(records))
+	for i, rec := range records {
+		ids[i] = rec.ID.String()
+	}
+	s, err := NewStoreWithDB(db, Settings{SelectionPredicate: "id IN (?,?,?)", SelectionPredicateArgs: ids})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.EnsureSchema(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for _, rec := range records {
+		if err = s.AddRecord(ctx, rec); err != nil {
+			t.Fatal(err)
+		}
+		rec := rec
+		t.Cleanup(func() { _, _ = db.Exec("DELETE FROM outbox WHERE id = ?", rec.ID.String()) })
+	}
+
+	lockID := "lock-" + uuid.NewString()
+	err = s.UpdateRecordsLockByStatesExcludingTopics(lockID, now, []outbox.RecordState{outbox.PendingDelivery}, 2, []string{paused})
+	if err != nil {
+		t.Fatal(err)
+	}
+	locked, err := s.GetRecordsByLockID(lockID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(locked) != 1 || locked[0].ID != records[2].ID {
+		t.Fatalf("expected only the record of the active topic to be locked, got %+v", locked)
+	}
+}
+
+func TestStore_RemoveRecordsByIDs(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+	now := time.Now().UTC().Truncate(time.Second)
+	lockID := "lock-" + uuid.NewString()
+	records := []outbox.Record{
+		{ID: uuid.New(), State: outbox.Delivered, CreatedOn: now, ProcessedOn: &now},
+		{ID: uuid.New(), State: outbox.PendingDelivery, CreatedOn: now},
+		{ID: uuid.New(), State: outbox.Delivered, CreatedOn: now, ProcessedOn: &now, LockID: &lockID, LockedOn: &now},
+	}
+	s, err := NewStoreWithDB(db, Settings{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.EnsureSchema(ctx); err != nil {
+		t.Fatal(err)
+	}
+	ids := []uuid.UUID{uuid.New()}
+	for _, rec := range records {
+		if err = s.AddRecord(ctx, rec); err != nil {
+			t.Fatal(err)
+		}
+		rec := rec
+		ids = append(ids, rec.ID)
+		t.Cleanup(func() { _, _ = db.Exec("DELETE FROM outbox WHERE id = ?", rec.ID.String()) })
+	}
+
+	// Only the unlocked terminal record is removed, the pending, locked and unknown ids are skipped. The duplicate ids
+	// are counted once
+	removed, skipped, err := s.RemoveRecordsByIDs(append(ids, ids...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 1 || skipped != 3 {
+		t.Fatalf("expected 1 removed and 3 skipped records, got %d and %d", removed, skipped)
+	}
+	if _, err = s.GetRecordByID(records[0].ID); !errors.Is(err, outbox.ErrRecordNotFound) {
+		t.Fatalf("expected the delivered record to be removed, got %v", err)
+	}
+	for _, rec := range records[1:] {
+		if _, err = s.GetRecordByID(rec.ID); err != nil {
+			t.Fatalf("expected the record %v to survive, got %v", rec.ID, err)
+		}
+	}
+}
+
+func TestStore_RemoveRecordsBeforeDatetime(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+	old := time.Now().UTC().Add(-24 * time.Hour).Truncate(time.Second)
+	lockID := "lock-" + uuid.NewString()
+	records := []outbox.Record{
+		{ID: uuid.New(), State: outbox.Delivered, CreatedOn: old, ProcessedOn: &old},
+		{ID: uuid.New(), State: outbox.PendingDelivery, CreatedOn: old},
+		{ID: uuid.New(), State: outbox.Delivered, CreatedOn: old, ProcessedOn: &old, LockID: &lockID, LockedOn: &old},
+		{ID: uuid.New(), State: outbox.Delivered, CreatedOn: old, ProcessedOn: &old},
+	}
+	s, err := NewStoreWithDB(db, Settings{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.EnsureSchema(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for _, rec := range records {
+		if err = s.AddRecord(ctx, rec); err != nil {
+			t.Fatal(err)
+		}
+		rec := rec
+		t.Cleanup(func() { _, _ = db.Exec("DELETE FROM outbox WHERE id = ?", rec.ID.String()) })
+	}
+	// The commit of the prepared publish of the last record failed, so it is left to RecoverPreparedPublishes
+	if _, err = db.Exec("UPDATE outbox SET publish_handle = ? WHERE id = ?", "handle", records[3].ID.String()); err != nil {
+		t.Fatal(err)
+	}
+
+	// The pending, the locked and the unrecovered records survive the retention, even when they are older than it
+	_, skipped, err := s.RemoveRecordsBeforeDatetime(old.Add(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if skipped < 3 {
+		t.Fatalf("expected at least the pending, the locked and the unrecovered records to be skipped, got %d", skipped)
+	}
+	if _, err = s.GetRecordByID(records[0].ID); !errors.Is(err, outbox.ErrRecordNotFound) {
+		t.Fatalf("expected the delivered record to be removed, got %v", err)
+	}
+	for _, rec := range records[1:] {
+		if _, err = s.GetRecordByID(rec.ID); err != nil {
+			t.Fatalf("expected the record %v to survive, got %v", rec.ID, err)
+		}
+	}
+}
@@ -0,0 +1,350 @@
+package mysql
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+	_ "time/tzdata"
+
+	mysqldriver "github.com/go-sql-driver/mysql"
+	"github.com/google/uuid"
+	"github.com/pkritiotis/outbox"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_translateError(t *testing.T) {
+	duplicateErr := &mysqldriver.MySQLError{Number: errDuplicateEntry, Message: "Duplicate entry"}
+	otherErr := &mysqldriver.MySQLError{Number: 1064, Message: "syntax error"}
+
+	assert.True(t, errors.Is(translateError(duplicateErr), outbox.ErrDuplicateRecord))
+	assert.Equal(t, otherErr, translateError(otherErr))
+	assert.Equal(t, errors.New("error"), translateError(errors.New("error")))
+}
+
+func Test_validatePredicate(t *testing.T) {
+	tests := map[string]struct {
+		predicate string
+		args      []interface{}
+		expErr    error
+	}{
+		"Empty predicate should be valid": {
+			predicate: "",
+			args:      nil,
+			expErr:    nil,
+		},
+		"Parameterized predicate should be valid": {
+			predicate: "region = ? AND (tenant = ? OR tenant IS NULL)",
+			args:      []interface{}{"eu", "t1"},
+			expErr:    nil,
+		},
+		"Statement separator should be rejected": {
+			predicate: "region = ?; DROP TABLE outbox",
+			args:      []interface{}{"eu"},
+			expErr:    errors.New(`invalid selection predicate: ";" is not allowed`),
+		},
+		"Comments should be rejected": {
+			predicate: "region = ? -- comment",
+			args:      []interface{}{"eu"},
+			expErr:    errors.New(`invalid selection predicate: "--" is not allowed`),
+		},
+		"Literal values should be rejected": {
+			predicate: "region = 'eu'",
+			args:      nil,
+			expErr:    errors.New(`invalid selection predicate: "'" is not allowed`),
+		},
+		"Unbalanced parentheses should be rejected": {
+			predicate: "region = ?) OR (1 = 1",
+			args:      []interface{}{"eu"},
+			expErr:    errors.New("invalid selection predicate: unbalanced parentheses"),
+		},
+		"Mismatching arguments should be rejected": {
+			predicate: "region = ?",
+			args:      nil,
+			expErr:    errors.New("invalid selection predicate: 1 placeholders but 0 arguments"),
+		},
+	}
+	for name, test := range tests {
+		tt := test
+		t.Run(name, func(t *testing.T) {
+			err := validatePredicate(tt.predicate, tt.args)
+			assert.Equal(t, tt.expErr, err)
+		})
+	}
+}
+
+func TestStore_withSelectionPredicate(t *testing.T) {
+	s := Store{}
+	condition, args := s.withSelectionPredicate("state = ?", 0)
+	assert.Equal(t, "state = ?", condition)
+	assert.Equal(t, []interface{}{0}, args)
+
+	s = Store{selectionPredicate: "region = ?", selectionPredicateArgs: []interface{}{"eu"}}
+	condition, args = s.withSelectionPredicate("state = ?", 0)
+	assert.Equal(t, "state = ? AND (region = ?)", condition)
+	assert.Equal(t, []interface{}{0, "eu"}, args)
+}
+
+func Test_translateError_missingTable(t *testing.T) {
+	err := translateError(&mysqldriver.MySQLError{Number: errNoSuchTable, Message: "Table 'outbox.outbox' doesn't exist"})
+
+	assert.True(t, errors.Is(err, outbox.ErrSchemaMissing))
+	assert.Contains(t, err.Error(), "enable the AutoMigrate setting")
+}
+
+func TestStore_withSchema(t *testing.T) {
+	schemaErr := translateError(&mysqldriver.MySQLError{Number: errNoSuchTable})
+	otherErr := errors.New("other error")
+
+	tests := map[string]struct {
+		store    Store
+		fnErrs   []error
+		expErr   error
+		expCalls int
+	}{
+		"Successful call should not be retried": {
+			store:    Store{autoMigrate: true},
+			fnErrs:   []error{nil},
+			expErr:   nil,
+			expCalls: 1,
+		},
+		"Missing schema without auto migrate should return the error": {
+			store:    Store{autoMigrate: false},
+			fnErrs:   []error{schemaErr},
+			expErr:   schemaErr,
+			expCalls: 1,
+		},
+		"Other errors should not trigger the migration": {
+			store:    Store{autoMigrate: true},
+			fnErrs:   []error{otherErr},
+			expErr:   otherErr,
+			expCalls: 1,
+		},
+	}
+	for name, test := range tests {
+		tt := test
+		t.Run(name, func(t *testing.T) {
+			calls := 0
+			err := tt.store.withSchema(context.Background(), func() error {
+				calls++
+				return tt.fnErrs[calls-1]
+			})
+			assert.Equal(t, tt.expErr, err)
+			assert.Equal(t, tt.expCalls, calls)
+		})
+	}
+}
+
+func Test_recordFailureArgs(t *testing.T) {
+	id := uuid.New()
+	lastAttemptOn := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	nextRetryAt := lastAttemptOn.Add(time.Minute)
+
+	args := recordFailureArgs(outbox.RecordFailure{
+		ID:               id,
+		State:            outbox.PendingDelivery,
+		Error:            "broker error",
+		NumberOfAttempts: 2,
+		LastAttemptOn:    lastAttemptOn,
+		NextRetryAt:      &nextRetryAt,
+	}, "lock")
+
+	assert.Equal(t, strings.Count(recordFailureQuery, "?"), len(args))
+	assert.Equal(t, []interface{}{outbox.PendingDelivery, 2, lastAttemptOn, "broker error", &nextRetryAt, id, "lock"}, args)
+}
+
+func TestNewStoreWithDB(t *testing.T) {
+	db, err := sql.Open("mysql", "user:pass@tcp(localhost:3306)/outbox?parseTime=True")
+	assert.Nil(t, err)
+	defer db.Close()
+
+	s, err := NewStoreWithDB(db, Settings{AutoMigrate: true})
+	assert.Nil(t, err)
+	assert.Equal(t, db, s.db)
+	assert.True(t, s.autoMigrate)
+
+	s, err = NewStoreWithDB(db, Settings{SelectionPredicate: "region = ?"})
+	assert.Nil(t, s)
+	assert.NotNil(t, err)
+}
+
+func Test_chunkIDs(t *testing.T) {
+	ids := make([]uuid.UUID, 5)
+	for i := range ids {
+		ids[i] = uuid.New()
+	}
+	tests := map[string]struct {
+		ids       []uuid.UUID
+		size      int
+		expChunks [][]uuid.UUID
+	}{
+		"No ids should return no chunks": {
+			ids:       nil,
+			size:      2,
+			expChunks: nil,
+		},
+		"Ids should be split in chunks of the provided size": {
+			ids:       ids,
+			size:      2,
+			expChunks: [][]uuid.UUID{ids[:2], ids[2:4], ids[4:]},
+		},
+		"Ids fitting in a chunk should return a single chunk": {
+			ids:       ids,
+			size:      5,
+			expChunks: [][]uuid.UUID{ids},
+		},
+	}
+	for name, test := range tests {
+		tt := test
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tt.expChunks, chunkIDs(tt.ids, tt.size))
+		})
+	}
+}
+
+func Test_distinctIDs(t *testing.T) {
+	first, second := uuid.New(), uuid.New()
+	assert.Equal(t, []uuid.UUID{first, second}, distinctIDs([]uuid.UUID{first, second, first, second, first}))
+	assert.Empty(t, distinctIDs(nil))
+}
+
+func Test_placeholders(t *testing.T) {
+	assert.Equal(t, "?", placeholders(1))
+	assert.Equal(t, "?,?,?", placeholders(3))
+}
+
+func TestStore_observeDuration(t *testing.T) {
+	tests := map[string]struct {
+		threshold time.Duration
+		start     time.Time
+		expSlow   bool
+	}{
+		"Query slower than the threshold should be logged and counted": {
+			threshold: time.Second,
+			start:     time.Now().Add(-2 * time.Second),
+			expSlow:   true,
+		},
+		"Query faster than the threshold should not be logged": {
+			threshold: time.Minute,
+			start:     time.Now(),
+			expSlow:   false,
+		},
+		"Disabled threshold should not log": {
+			threshold: -1,
+			start:     time.Now().Add(-time.Hour),
+			expSlow:   false,
+		},
+	}
+	for name, test := range tests {
+		tt := test
+		t.Run(name, func(t *testing.T) {
+			logs := &bytes.Buffer{}
+			metrics := newRecordingMetrics()
+			s := Store{
+				slowQueryThreshold: tt.threshold,
+				logger:             slog.New(slog.NewTextHandler(logs, nil)),
+				metrics:            metrics,
+			}
+			s.observeDuration("MarkProcessed", tt.start)
+
+			assert.Equal(t, tt.expSlow, strings.Contains(logs.String(), "Slow outbox query"))
+			assert.Equal(t, tt.expSlow, strings.Contains(logs.String(), "query=MarkProcessed"))
+			if tt.expSlow {
+				assert.Equal(t, int64(1), metrics.counts[outbox.MetricSlowQueries+"/"])
+			} else {
+				assert.Empty(t, metrics.counts)
+			}
+		})
+	}
+}
+
+func TestNewStoreWithDB_defaults(t *testing.T) {
+	s, err := NewStoreWithDB(nil, Settings{})
+	assert.Nil(t, err)
+	assert.Equal(t, defaultSlowQueryThreshold, s.slowQueryThreshold)
+	assert.Equal(t, slog.Default(), s.logger)
+	assert.Equal(t, outbox.NoopMetricsRecorder{}, s.metrics)
+}
+
+func TestStore_businessKey(t *testing.T) {
+	s := Store{businessKeyHeaders: []string{"order-id", "event-type"}}
+	msg := outbox.Message{Headers: map[string]string{"order-id": "42", "event-type": "created", "other": "value"}}
+
+	key := s.businessKey(msg)
+	assert.NotNil(t, key)
+	assert.Len(t, *key, 64)
+	assert.Equal(t, key, s.businessKey(outbox.Message{Headers: map[string]string{"order-id": "42", "event-type": "created"}}))
+	assert.NotEqual(t, key, s.businessKey(outbox.Message{Headers: map[string]string{"order-id": "42", "event-type": "updated"}}))
+	assert.NotEqual(t,
+		s.businessKey(outbox.Message{Headers: map[string]string{"order-id": "4", "event-type": "2created"}}),
+		key,
+	)
+	assert.Nil(t, s.businessKey(outbox.Message{Headers: map[string]string{"order-id": "42"}}))
+	assert.Nil(t, Store{}.businessKey(msg))
+}
+
+func Test_dsn(t *testing.T) {
+	settings := Settings{
+		MySQLUsername: "user",
+		MySQLPass:     "p@ss",
+		MySQLHost:     "localhost",
+		MySQLPort:     "3306",
+		MySQLDB:       "outbox",
+	}
+	assert.Equal(t, "user:p@ss@tcp(localhost:3306)/outbox?parseTime=true", dsn(settings))
+
+	cfg, err := mysqldriver.ParseDSN(dsn(settings))
+	assert.Nil(t, err)
+	assert.Equal(t, time.UTC, cfg.Loc)
+
+	amsterdam, err := time.LoadLocation("Europe/Amsterdam")
+	assert.Nil(t, err)
+	settings.Location = amsterdam
+	assert.Equal(t, "user:p@ss@tcp(localhost:3306)/outbox?loc=Europe%2FAmsterdam&parseTime=true", dsn(settings))
+}
+
+func Test_validNextRetryAt(t *testing.T) {
+	now := time.Date(2024, time.January, 2, 3, 4, 5, 0, time.UTC)
+	athens, err := time.LoadLocation("Europe/Athens")
+	assert.Nil(t, err)
+	tests := map[string]struct {
+		nextRetryAt time.Time
+		expErr      bool
+	}{
+		"Time after now should be valid": {
+			nextRetryAt: now.Add(time.Hour),
+			expErr:      false,
+		},
+		"Time before now should be valid": {
+			nextRetryAt: now.Add(-time.Hour),
+			expErr:      false,
+		},
+		"Zero time should be rejected": {
+			nextRetryAt: time.Time{},
+			expErr:      true,
+		},
+		"Time before the earliest DATETIME value should be rejected": {
+			nextRetryAt: minDatetime.Add(-time.Second),
+			expErr:      true,
+		},
+		"Time too far after now should be rejected": {
+			nextRetryAt: now.Add(outbox.MaxNextRetryDelay + time.Second),
+			expErr:      true,
+		},
+		"Time not in UTC should be rejected": {
+			nextRetryAt: now.Add(time.Hour).In(athens),
+			expErr:      true,
+		},
+	}
+	for name, test := range tests {
+		tt := test
+		t.Run(name, func(t *testing.T) {
+			err := validNextRetryAt(tt.nextRetryAt, now)
+			assert.Equal(t, tt.expErr, err != nil)
+		})
+	}
+}
@@ -0,0 +1,213 @@
+package mysql
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkritiotis/outbox"
+)
+
+// ErrBusinessKeyInUse is returned by PartitionTable if the business key is in use, since the table cannot be
+// partitioned with its unique index
+var ErrBusinessKeyInUse = errors.New("the business key of the outbox table is in use")
+
+// maxPartition is the name of the catch-all partition of the records created after the last partition bound
+const maxPartition = "pmax"
+
+// partitionBoundLayout is the layout of the DATETIME literals of the partition bounds
+const partitionBoundLayout = "2006-01-02 15:04:05"
+
+// partition is a range partition of the outbox table, holding the records created before its bound
+type partition struct {
+	name  string
+	bound time.Time
+}
+
+// PartitionTable partitions the outbox table by range of created_on, with a partition of the records created before
+// start and the pmax partition of the later records. Use CreatePartitions to split pmax in partitions of an interval.
+// mysql requires the partitioning column in every unique key, so the primary key becomes (id, created_on) and the
+// business key index is dropped: record ids are only unique per creation time and BusinessKeyHeaders cannot be used.
+// It returns ErrBusinessKeyInUse without altering the table if the store has BusinessKeyHeaders or if pending records
+// have a business key. The table is rebuilt, so it should be partitioned while it is small
+func (s Store) PartitionTable(ctx context.Context, start time.Time) error {
+	defer s.observeDuration("PartitionTable", time.Now())
+	if len(s.businessKeyHeaders) > 0 {
+		return fmt.Errorf("%w: the store has BusinessKeyHeaders", ErrBusinessKeyInUse)
+	}
+	var keyed int64
+	err := s.db.QueryRowContext(ctx, s.table.sql(`SELECT COUNT(*) FROM outbox WHERE business_key IS NOT NULL AND state = ?`),
+		outbox.PendingDelivery).Scan(&keyed)
+	if err != nil {
+		return err
+	}
+	if keyed > 0 {
+		return fmt.Errorf("%w: %d pending records have a business key", ErrBusinessKeyInUse, keyed)
+	}
+	err = s.dropIndexIfExists(ctx, "uq_outbox_pending_business_key")
+	if err != nil {
+		return err
+	}
+	first := s.partitionFor(start)
+	_, err = s.db.ExecContext(ctx, s.table.sql(`ALTER TABLE outbox DROP PRIMARY KEY, ADD PRIMARY KEY (id, created_on)
+		PARTITION BY RANGE COLUMNS(created_on) (`+partitionDefinition(first)+`,
+		PARTITION `+maxPartition+` VALUES LESS THAN (MAXVALUE))`))
+	return err
+}
+
+// dropIndexIfExists drops the index of the outbox table unless it does not exist, since mysql has no DROP INDEX IF
+// EXISTS
+func (s Store) dropIndexIfExists(ctx context.Context, index string) error {
+	var indexes int64
+	err := s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM information_schema.STATISTICS
+		WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND INDEX_NAME = ?`, string(tableNameOrDefault(string(s.table))), index).Scan(&indexes)
+	if err != nil || indexes == 0 {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, s.table.sql(`ALTER TABLE outbox DROP INDEX `+index))
+	return err
+}
+
+// CreatePartitions splits the pmax partition in partitions of interval, a multiple of a day, until a partition
+// holds the records created at until, and returns the names of the created partitions. It should run ahead of time,
+// e.g. daily for the next week, since the records already in pmax are copied to the new partitions
+func (s Store) CreatePartitions(ctx context.Context, until time.Time, interval time.Duration) ([]string, error) {
+	if interval <= 0 || interval%(24*time.Hour) != 0 {
+		return nil, fmt.Errorf("invalid partition interval %v: it must be a multiple of a day", interval)
+	}
+	partitions, err := s.partitions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(partitions) == 0 {
+		return nil, errors.New("the outbox table is not partitioned, see PartitionTable")
+	}
+	var created []partition
+	for bound := partitions[len(partitions)-1].bound; !bound.After(until); {
+		bound = bound.Add(interval)
+		created = append(created, s.partitionFor(bound))
+	}
+	if len(created) == 0 {
+		return nil, nil
+	}
+	defer s.observeDuration("CreatePartitions", time.Now())
+	_, err = s.db.ExecContext(ctx, s.table.sql(reorganizeQuery(created)))
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(created))
+	for i, p := range created {
+		names[i] = p.name
+	}
+	return names, nil
+}
+
+// DropPartitionsBefore drops the partitions of the records created before the provided time, and returns the names
+// of the dropped partitions and of the skipped ones. Like RemoveRecordsBeforeDatetime, a partition holding records
+// that are not in a TerminalRecordStates state, locked, or holding a publish handle, is never dropped, and is dropped
+// by a later call once they are delivered. Dropping a partition is a metadata operation regardless of the number of its records
+func (s Store) DropPartitionsBefore(ctx context.Context, before time.Time) (dropped []string, skipped []string, err error) {
+	partitions, err := s.partitions(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, p := range partitions {
+		if p.bound.After(before) {
+			break
+		}
+		ok, dropErr := s.dropPartitionIfRemovable(ctx, p)
+		if dropErr != nil {
+			return dropped, skipped, dropErr
+		}
+		if !ok {
+			skipped = append(skipped, p.name)
+			continue
+		}
+		dropped = append(dropped, p.name)
+	}
+	if len(skipped) > 0 {
+		s.logger.WarnContext(ctx, "Skipped the outbox partitions holding undelivered records", "partitions", skipped)
+	}
+	return dropped, skipped, nil
+}
+
+// dropPartitionIfRemovable drops the partition if all its records can be removed. The table is write locked from the
+// check to the drop, so that a record inserted or updated in between is not dropped. The writes to the table wait for
+// the check, which only scans the partition
+func (s Store) dropPartitionIfRemovable(ctx context.Context, p partition) (bool, error) {
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	if _, err = conn.ExecContext(ctx, s.table.sql(`LOCK TABLES outbox WRITE`)); err != nil {
+		return false, err
+	}
+	defer func() { _, _ = conn.ExecContext(context.Background(), `UNLOCK TABLES`) }()
+
+	condition, args := removableCondition()
+	var pending int64
+	err = conn.QueryRowContext(ctx, s.table.sql(`SELECT COUNT(*) FROM outbox PARTITION (`+p.name+`)
+		WHERE NOT `+condition), args...).Scan(&pending)
+	if err != nil || pending > 0 {
+		return false, err
+	}
+	_, err = conn.ExecContext(ctx, s.table.sql(`ALTER TABLE outbox DROP PARTITION `+p.name))
+	return err == nil, err
+}
+
+// partitions returns the partitions of the outbox table in bound order, without pmax
+func (s Store) partitions(ctx context.Context) ([]partition, error) {
+	rows, err := s.db.QueryContext(ctx, s.table.sql(`SELECT PARTITION_NAME, PARTITION_DESCRIPTION FROM information_schema.PARTITIONS
+		WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = 'outbox' AND PARTITION_NAME IS NOT NULL
+		ORDER BY PARTITION_ORDINAL_POSITION`))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var partitions []partition
+	for rows.Next() {
+		var name, description string
+		if err = rows.Scan(&name, &description); err != nil {
+			return nil, err
+		}
+		if name == maxPartition {
+			continue
+		}
+		bound, err := s.parsePartitionBound(description)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bound of the partition %s: %w", name, err)
+		}
+		partitions = append(partitions, partition{name: name, bound: bound})
+	}
+	return partitions, rows.Err()
+}
+
+// partitionFor returns the partition of the records created before bound, truncated to the day in the Location
+func (s Store) partitionFor(bound time.Time) partition {
+	bound = bound.In(s.location)
+	bound = time.Date(bound.Year(), bound.Month(), bound.Day(), 0, 0, 0, 0, s.location)
+	return partition{name: "p" + bound.Format("20060102"), bound: bound}
+}
+
+// parsePartitionBound parses the quoted DATETIME literal of a partition description in the Location
+func (s Store) parsePartitionBound(description string) (time.Time, error) {
+	return time.ParseInLocation(partitionBoundLayout, strings.Trim(description, "'"), s.location)
+}
+
+// partitionDefinition returns the definition of the partition in a PARTITION BY clause
+func partitionDefinition(p partition) string {
+	return "PARTITION " + p.name + " VALUES LESS THAN ('" + p.bound.Format(partitionBoundLayout) + "')"
+}
+
+// reorganizeQuery returns the statement splitting pmax in the partitions, followed by pmax
+func reorganizeQuery(partitions []partition) string {
+	definitions := make([]string, 0, len(partitions)+1)
+	for _, p := range partitions {
+		definitions = append(definitions, partitionDefinition(p))
+	}
+	definitions = append(definitions, "PARTITION "+maxPartition+" VALUES LESS THAN (MAXVALUE)")
+	return "ALTER TABLE outbox REORGANIZE PARTITION " + maxPartition + " INTO (" + strings.Join(definitions, ", ") + ")"
+}
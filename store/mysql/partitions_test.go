@@ -0,0 +1,47 @@
+package mysql
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStore_partitionFor(t *testing.T) {
+	s := Store{location: time.UTC}
+	p := s.partitionFor(time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC))
+	assert.Equal(t, partition{name: "p20240102", bound: time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)}, p)
+
+	bound, err := s.parsePartitionBound("'2024-01-02 00:00:00'")
+	assert.Nil(t, err)
+	assert.Equal(t, p.bound, bound)
+	_, err = s.parsePartitionBound("MAXVALUE")
+	assert.NotNil(t, err)
+}
+
+func Test_reorganizeQuery(t *testing.T) {
+	s := Store{location: time.UTC}
+	q := reorganizeQuery([]partition{
+		s.partitionFor(time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)),
+		s.partitionFor(time.Date(2024, 1, 3, 0, 0, 0, 0, time.UTC)),
+	})
+	assert.Equal(t, "ALTER TABLE outbox REORGANIZE PARTITION pmax INTO ("+
+		"PARTITION p20240102 VALUES LESS THAN ('2024-01-02 00:00:00'), "+
+		"PARTITION p20240103 VALUES LESS THAN ('2024-01-03 00:00:00'), "+
+		"PARTITION pmax VALUES LESS THAN (MAXVALUE))", q)
+}
+
+func TestStore_CreatePartitions_interval(t *testing.T) {
+	s := Store{location: time.UTC}
+	for _, interval := range []time.Duration{0, time.Hour, 36 * time.Hour} {
+		_, err := s.CreatePartitions(context.Background(), time.Now(), interval)
+		assert.ErrorContains(t, err, "invalid partition interval")
+	}
+}
+
+func TestStore_PartitionTable_businessKey(t *testing.T) {
+	s := Store{location: time.UTC, businessKeyHeaders: []string{"order-id"}}
+	err := s.PartitionTable(context.Background(), time.Now())
+	assert.ErrorIs(t, err, ErrBusinessKeyInUse)
+}
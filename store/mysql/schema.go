@@ -0,0 +1,104 @@
+package mysql
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/pkritiotis/outbox"
+)
+
+// schema is the script that creates the outbox table at the SchemaVersion, it must be kept in line with the migrations
+const schema = `CREATE TABLE IF NOT EXISTS outbox (
+        id varchar(100) NOT NULL,
+        data BLOB NOT NULL,
+        state INT NOT NULL,
+        created_on DATETIME NOT NULL,
+        locked_by varchar(100) NULL,
+        locked_on DATETIME NULL,
+        processed_on DATETIME NULL,
+        number_of_attempts INT NOT NULL,
+        last_attempted_on DATETIME NULL,
+        error varchar(1000) NULL,
+        expires_at DATETIME NULL,
+        next_retry_at DATETIME NULL,
+        business_key CHAR(64) NULL,
+        sequence BIGINT NULL,
+        publish_handle varchar(255) NULL,
+        topic varchar(255) NULL,
+        pending_business_key CHAR(64) AS (IF(state = 0, business_key, NULL)) STORED,
+        PRIMARY KEY (id),
+        INDEX idx_outbox_state_next_retry_at (state, next_retry_at),
+        INDEX idx_outbox_publish_handle (publish_handle),
+        INDEX idx_outbox_state_topic (state, topic),
+        UNIQUE INDEX uq_outbox_pending_business_key (pending_business_key)
+)`
+
+// EnsureSchema creates the outbox table, the attempts audit table and the key sequences table if KeySequences is
+// enabled, if they do not exist
+func (s Store) EnsureSchema(ctx context.Context) error {
+	defer s.observeDuration("EnsureSchema", time.Now())
+	_, err := s.db.ExecContext(ctx, s.table.sql(schema))
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, s.table.sql(attemptsSchema))
+	if err != nil || !s.keySequences {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, s.table.sql(keySequencesSchema))
+	return err
+}
+
+// withSchema runs fn and, if it fails because the outbox table does not exist and AutoMigrate is enabled,
+// creates the table and runs fn once more
+func (s Store) withSchema(ctx context.Context, fn func() error) error {
+	err := fn()
+	if err == nil || !s.autoMigrate || !errors.Is(err, outbox.ErrSchemaMissing) {
+		return err
+	}
+	migrateErr := s.EnsureSchema(ctx)
+	if migrateErr != nil {
+		return errors.Join(err, migrateErr)
+	}
+	return fn()
+}
+
+// exec executes the query, creating the schema if needed. The name identifies the query in the slow query logs
+func (s Store) exec(ctx context.Context, name string, query string, args ...interface{}) (sql.Result, error) {
+	var res sql.Result
+	err := s.withSchema(ctx, func() error {
+		defer s.observeDuration(name, time.Now())
+		var execErr error
+		res, execErr = s.execContext(ctx, s.db, query, args...)
+		return translateError(execErr)
+	})
+	return res, err
+}
+
+// query runs the query, creating the schema if needed. The name identifies the query in the slow query logs,
+// which only measure the time until the first rows are returned
+func (s Store) query(ctx context.Context, name string, query string, args ...interface{}) (*sql.Rows, error) {
+	var rows *sql.Rows
+	err := s.withSchema(ctx, func() error {
+		defer s.observeDuration(name, time.Now())
+		var queryErr error
+		rows, queryErr = s.queryContext(ctx, query, args...)
+		return translateError(queryErr)
+	})
+	return rows, err
+}
+
+// observeDuration logs and counts the store calls started at start that took longer than the slow query threshold
+func (s Store) observeDuration(name string, start time.Time) {
+	if s.slowQueryThreshold <= 0 {
+		return
+	}
+	duration := time.Since(start)
+	if duration < s.slowQueryThreshold {
+		return
+	}
+	s.logger.Warn("Slow outbox query", "query", name, "duration", duration, "threshold", s.slowQueryThreshold)
+	s.metrics.Count(outbox.MetricSlowQueries, 1, map[string]string{outbox.TagQuery: name})
+}
@@ -0,0 +1,92 @@
+package mysql
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/pkritiotis/outbox"
+)
+
+// serializationQuarantine refuses the messages of a type once threshold consecutive encodings of the type have failed,
+// which usually means that a deploy broke the serializer of the type. The quarantine of a type is lifted after
+// duration, and the failures are counted again from the next encoding. It lasts as long as the store if duration is 0
+type serializationQuarantine struct {
+	threshold     int
+	duration      time.Duration
+	onQuarantined func(messageType string, err error)
+	logger        *slog.Logger
+	now           func() time.Time
+	mu            sync.Mutex
+	failures      map[string]int
+	until         map[string]time.Time
+}
+
+func newSerializationQuarantine(threshold int, duration time.Duration, onQuarantined func(string, error), logger *slog.Logger) *serializationQuarantine {
+	if threshold <= 0 {
+		return nil
+	}
+	return &serializationQuarantine{
+		threshold:     threshold,
+		duration:      duration,
+		onQuarantined: onQuarantined,
+		logger:        logger,
+		now:           time.Now,
+		failures:      map[string]int{},
+		until:         map[string]time.Time{},
+	}
+}
+
+// check returns an outbox.ErrSerializerQuarantined error if the type is quarantined
+func (q *serializationQuarantine) check(messageType string) error {
+	if q == nil {
+		return nil
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	until, ok := q.until[messageType]
+	if !ok {
+		return nil
+	}
+	if q.duration > 0 && !q.now().Before(until) {
+		delete(q.until, messageType)
+		return nil
+	}
+	return fmt.Errorf("%w: message type %q", outbox.ErrSerializerQuarantined, messageType)
+}
+
+// succeeded resets the consecutive failures of the type
+func (q *serializationQuarantine) succeeded(messageType string) {
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.failures, messageType)
+}
+
+// failed counts a failed encoding of the type and quarantines it once the threshold is reached. The quarantine is
+// logged as an error and reported to onQuarantined with the last failure
+func (q *serializationQuarantine) failed(messageType string, err error) {
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	q.failures[messageType]++
+	quarantined := q.failures[messageType] >= q.threshold
+	if quarantined {
+		delete(q.failures, messageType)
+		q.until[messageType] = q.now().Add(q.duration)
+	}
+	q.mu.Unlock()
+	if !quarantined {
+		return
+	}
+	q.logger.ErrorContext(context.Background(), "Quarantined the serialization of a message type after consecutive failures",
+		"message_type", messageType, "failures", q.threshold, "error", err)
+	if q.onQuarantined != nil {
+		q.onQuarantined(messageType, err)
+	}
+}
@@ -0,0 +1,115 @@
+package mysql
+
+import (
+	"errors"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/pkritiotis/outbox"
+	"github.com/stretchr/testify/assert"
+)
+
+// flakySerializer fails to marshal the messages with a "bad" body, and encodes the others as their body, which can
+// only be decoded if they are not "garbage"
+type flakySerializer struct{}
+
+func (flakySerializer) ID() string { return "flaky" }
+
+func (flakySerializer) Marshal(msg outbox.Message) ([]byte, error) {
+	if string(msg.Body) == "bad" {
+		return nil, errors.New("marshal error")
+	}
+	return msg.Body, nil
+}
+
+func (flakySerializer) Unmarshal(data []byte, msg *outbox.Message) error {
+	if string(data) == "garbage" {
+		return errors.New("unmarshal error")
+	}
+	msg.Body = data
+	return nil
+}
+
+func Test_serializer_quarantine(t *testing.T) {
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	var quarantined []string
+	metrics := newRecordingMetrics()
+	ser, err := newSerializer(0, metrics).withSerializers("type", map[string]Serializer{
+		"flaky": flakySerializer{},
+		"upper": upperSerializer{},
+	})
+	assert.Nil(t, err)
+	ser.quarantine = newSerializationQuarantine(2, time.Minute, func(messageType string, err error) {
+		assert.Equal(t, errors.New("marshal error"), err)
+		quarantined = append(quarantined, messageType)
+	}, slog.Default())
+	ser.quarantine.now = func() time.Time { return now }
+	msg := func(typ, body string) outbox.Message {
+		return outbox.Message{Headers: map[string]string{"type": typ}, Body: []byte(body)}
+	}
+
+	// A successful serialization resets the consecutive failures
+	for _, body := range []string{"bad", "good", "bad"} {
+		_, err = ser.encode(msg("flaky", body))
+	}
+	assert.Equal(t, errors.New("marshal error"), err)
+	assert.Empty(t, quarantined)
+
+	_, err = ser.encode(msg("flaky", "bad"))
+	assert.Equal(t, errors.New("marshal error"), err)
+	assert.Equal(t, []string{"flaky"}, quarantined)
+	assert.Equal(t, int64(3), metrics.counts[outbox.MetricSerializationFailures+"/"])
+
+	// The quarantined type is refused without serializing it, the other types are still serialized
+	_, err = ser.encode(msg("flaky", "good"))
+	assert.True(t, errors.Is(err, outbox.ErrSerializerQuarantined))
+	_, err = ser.encode(msg("upper", "good"))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3), metrics.counts[outbox.MetricSerializationFailures+"/"])
+
+	// The quarantine is lifted after its duration
+	now = now.Add(time.Minute)
+	_, err = ser.encode(msg("flaky", "good"))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"flaky"}, quarantined)
+}
+
+func Test_serializer_quarantine_untilRestart(t *testing.T) {
+	ser, err := newSerializer(0, nil).withSerializers("type", map[string]Serializer{"flaky": flakySerializer{}})
+	assert.Nil(t, err)
+	ser.quarantine = newSerializationQuarantine(1, 0, nil, slog.Default())
+	now := time.Now()
+	ser.quarantine.now = func() time.Time { return now }
+
+	_, err = ser.encode(outbox.Message{Headers: map[string]string{"type": "flaky"}, Body: []byte("bad")})
+	assert.Equal(t, errors.New("marshal error"), err)
+	now = now.Add(24 * time.Hour)
+	_, err = ser.encode(outbox.Message{Headers: map[string]string{"type": "flaky"}, Body: []byte("good")})
+	assert.True(t, errors.Is(err, outbox.ErrSerializerQuarantined))
+}
+
+func Test_serializer_verify(t *testing.T) {
+	garbage := outbox.Message{Headers: map[string]string{"type": "flaky"}, Body: []byte("garbage")}
+	metrics := newRecordingMetrics()
+	ser, err := newSerializer(0, metrics).withSerializers("type", map[string]Serializer{"flaky": flakySerializer{}})
+	assert.Nil(t, err)
+
+	_, err = ser.encode(garbage)
+	assert.Nil(t, err)
+
+	ser.verify = true
+	_, err = ser.encode(garbage)
+	assert.EqualError(t, err, "the encoded message can not be decoded: unmarshal error")
+	assert.Equal(t, int64(1), metrics.counts[outbox.MetricSerializationFailures+"/"])
+}
+
+func Test_newSerializationQuarantine(t *testing.T) {
+	assert.Nil(t, newSerializationQuarantine(0, time.Minute, nil, slog.Default()))
+	assert.Nil(t, (*serializationQuarantine)(nil).check("type"))
+
+	s, err := NewStoreWithDB(nil, Settings{SerializationFailureThreshold: 3, VerifySerialization: true})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, s.serializer.quarantine.threshold)
+	assert.True(t, s.serializer.verify)
+}
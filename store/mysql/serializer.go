@@ -0,0 +1,206 @@
+package mysql
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+
+	"github.com/pkritiotis/outbox"
+)
+
+// gzipMagic is the header of gzip streams. It is never the start of a gob stream, where the message length is followed
+// by a type id that can not be encoded as 0x8b, so compressed and uncompressed messages can be told apart on decoding
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// formatMarker starts the messages encoded by a registered Serializer, followed by the length of the serializer id,
+// the id and the payload. It is never the start of a gob stream, whose first byte is either a length below 0x80 or
+// the negated byte count of a longer length, nor of a gzip stream
+const formatMarker = 0x80
+
+// Serializer encodes the messages of a message type stored in the data column
+type Serializer interface {
+	// ID identifies the format of the encoded messages. It is stored with every message and must not change once
+	// messages are stored, since the messages are decoded by the serializer of the stored id
+	ID() string
+	Marshal(msg outbox.Message) ([]byte, error)
+	Unmarshal(data []byte, msg *outbox.Message) error
+}
+
+// JSONSerializer encodes the messages as JSON
+type JSONSerializer struct{}
+
+// ID returns the "json" format id
+func (JSONSerializer) ID() string {
+	return "json"
+}
+
+// Marshal encodes the message as JSON
+func (JSONSerializer) Marshal(msg outbox.Message) ([]byte, error) {
+	return json.Marshal(msg)
+}
+
+// Unmarshal decodes a JSON encoded message
+func (JSONSerializer) Unmarshal(data []byte, msg *outbox.Message) error {
+	return json.Unmarshal(data, msg)
+}
+
+// serializer encodes the messages stored in the data column
+type serializer struct {
+	compressionThreshold int
+	metrics              outbox.MetricsRecorder
+	typeHeader           string
+	byType               map[string]Serializer
+	byID                 map[string]Serializer
+	verify               bool
+	quarantine           *serializationQuarantine
+}
+
+func newSerializer(compressionThreshold int, metrics outbox.MetricsRecorder) serializer {
+	return serializer{compressionThreshold: compressionThreshold, metrics: metricsOrDefault(metrics)}
+}
+
+// withSerializers returns the serializer encoding the messages whose typeHeader value is a key of serializers with the
+// corresponding Serializer. It fails if the serializer ids are not unique or do not fit the format marker
+func (s serializer) withSerializers(typeHeader string, serializers map[string]Serializer) (serializer, error) {
+	if len(serializers) == 0 {
+		return s, nil
+	}
+	if typeHeader == "" {
+		return s, errors.New("the serializer type header is required to select the serializers")
+	}
+	s.typeHeader = typeHeader
+	s.byType = serializers
+	s.byID = make(map[string]Serializer, len(serializers))
+	for _, ser := range serializers {
+		id := ser.ID()
+		if id == "" || len(id) > 255 {
+			return s, fmt.Errorf("invalid serializer id %q: it must be between 1 and 255 bytes", id)
+		}
+		if other, ok := s.byID[id]; ok && reflect.TypeOf(other) != reflect.TypeOf(ser) {
+			return s, fmt.Errorf("invalid serializer id %q: it is used by more than one serializer", id)
+		}
+		s.byID[id] = ser
+	}
+	return s, nil
+}
+
+// encode encodes the message with the Serializer of its type, or gob encodes it if it has none, and compresses it
+// with gzip if it is larger than the compression threshold. The messages of a quarantined type are refused, and the
+// encoded message is decoded back to check it if verify is set
+func (s serializer) encode(msg outbox.Message) ([]byte, error) {
+	messageType := s.messageType(msg)
+	if err := s.quarantine.check(messageType); err != nil {
+		return nil, err
+	}
+	data, err := s.marshal(msg)
+	if err == nil && s.verify {
+		err = s.decode(data, &outbox.Message{})
+		if err != nil {
+			err = fmt.Errorf("the encoded message can not be decoded: %w", err)
+		}
+	}
+	if err != nil {
+		s.metrics.Count(outbox.MetricSerializationFailures, 1, map[string]string{outbox.TagMessageType: messageType})
+		s.quarantine.failed(messageType, err)
+		return nil, err
+	}
+	s.quarantine.succeeded(messageType)
+	serializedBytes := len(data)
+	compressed := s.compressionThreshold > 0 && len(data) > s.compressionThreshold
+	if compressed {
+		data, err = compress(data)
+		if err != nil {
+			return nil, err
+		}
+	}
+	s.record(serializedBytes, len(data), compressed)
+	return data, nil
+}
+
+// messageType returns the value of the type header of the message, empty if the serializers are not set
+func (s serializer) messageType(msg outbox.Message) string {
+	if s.typeHeader == "" {
+		return ""
+	}
+	return msg.Headers[s.typeHeader]
+}
+
+// marshal encodes the message without compression. The messages encoded by a registered Serializer are prefixed
+// with the format marker and the serializer id
+func (s serializer) marshal(msg outbox.Message) ([]byte, error) {
+	ser, ok := s.byType[msg.Headers[s.typeHeader]]
+	if !ok {
+		msgBuf := new(bytes.Buffer)
+		err := gob.NewEncoder(msgBuf).Encode(msg)
+		if err != nil {
+			return nil, err
+		}
+		return msgBuf.Bytes(), nil
+	}
+	payload, err := ser.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	id := ser.ID()
+	data := make([]byte, 0, 2+len(id)+len(payload))
+	data = append(data, formatMarker, byte(len(id)))
+	data = append(data, id...)
+	return append(data, payload...), nil
+}
+
+func (s serializer) record(serializedBytes, storedBytes int, compressed bool) {
+	tags := map[string]string{outbox.TagCompressed: strconv.FormatBool(compressed)}
+	s.metrics.Count(outbox.MetricSerializations, 1, tags)
+	s.metrics.Observe(outbox.MetricSerializedBytes, float64(serializedBytes), tags)
+	s.metrics.Observe(outbox.MetricStoredBytes, float64(storedBytes), tags)
+	if compressed {
+		s.metrics.Observe(outbox.MetricCompressionRatio, float64(storedBytes)/float64(serializedBytes), tags)
+	}
+}
+
+func compress(data []byte) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	zw := gzip.NewWriter(buf)
+	_, err := zw.Write(data)
+	if err != nil {
+		return nil, err
+	}
+	err = zw.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decode decodes a message encoded by the serializer, compressed or not, with the Serializer of its format marker
+func (s serializer) decode(data []byte, msg *outbox.Message) error {
+	if bytes.HasPrefix(data, gzipMagic) {
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		data, err = io.ReadAll(zr)
+		if err != nil {
+			return err
+		}
+	}
+	if len(data) == 0 || data[0] != formatMarker {
+		return gob.NewDecoder(bytes.NewReader(data)).Decode(msg)
+	}
+	if len(data) < 2 || len(data) < 2+int(data[1]) {
+		return errors.New("invalid message format marker")
+	}
+	id := string(data[2 : 2+int(data[1])])
+	ser, ok := s.byID[id]
+	if !ok {
+		return fmt.Errorf("no serializer is registered for the stored message format %q", id)
+	}
+	return ser.Unmarshal(data[2+int(data[1]):], msg)
+}
@@ -0,0 +1,177 @@
+package mysql
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/pkritiotis/outbox"
+	"github.com/stretchr/testify/assert"
+)
+
+// recordingMetrics keeps the recorded metrics in memory
+type recordingMetrics struct {
+	mu           sync.Mutex
+	counts       map[string]int64
+	observations map[string][]float64
+}
+
+func newRecordingMetrics() *recordingMetrics {
+	return &recordingMetrics{counts: map[string]int64{}, observations: map[string][]float64{}}
+}
+
+func (m *recordingMetrics) Count(name string, value int64, tags map[string]string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.counts[name+"/"+tags[outbox.TagCompressed]] += value
+}
+
+func (m *recordingMetrics) Observe(name string, value float64, _ map[string]string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.observations[name] = append(m.observations[name], value)
+}
+
+func (m *recordingMetrics) Gauge(string, float64, map[string]string) {}
+
+func Test_serializer(t *testing.T) {
+	small := outbox.Message{Key: "key", Body: []byte("body"), Topic: "topic"}
+	large := outbox.Message{Key: "key", Body: []byte(strings.Repeat("body", 1000)), Topic: "topic"}
+	metrics := newRecordingMetrics()
+	s := newSerializer(512, metrics)
+
+	for _, msg := range []outbox.Message{small, large} {
+		data, err := s.encode(msg)
+		assert.Nil(t, err)
+		assert.Equal(t, len(msg.Body) > 512, bytes.HasPrefix(data, gzipMagic))
+
+		var got outbox.Message
+		assert.Nil(t, s.decode(data, &got))
+		assert.Equal(t, msg, got)
+	}
+
+	assert.Equal(t, int64(1), metrics.counts[outbox.MetricSerializations+"/false"])
+	assert.Equal(t, int64(1), metrics.counts[outbox.MetricSerializations+"/true"])
+	assert.Len(t, metrics.observations[outbox.MetricSerializedBytes], 2)
+	assert.Len(t, metrics.observations[outbox.MetricStoredBytes], 2)
+	assert.Len(t, metrics.observations[outbox.MetricCompressionRatio], 1)
+	assert.Less(t, metrics.observations[outbox.MetricCompressionRatio][0], 1.0)
+}
+
+func Test_newSerializer(t *testing.T) {
+	assert.Equal(t, serializer{metrics: outbox.NoopMetricsRecorder{}}, newSerializer(0, nil))
+}
+
+// upperSerializer is a Serializer storing the message body in upper case
+type upperSerializer struct{}
+
+func (upperSerializer) ID() string { return "upper" }
+
+func (upperSerializer) Marshal(msg outbox.Message) ([]byte, error) {
+	return []byte(strings.ToUpper(string(msg.Body))), nil
+}
+
+func (upperSerializer) Unmarshal(data []byte, msg *outbox.Message) error {
+	msg.Body = data
+	return nil
+}
+
+func Test_serializer_withSerializers(t *testing.T) {
+	s, err := newSerializer(512, nil).withSerializers("type", map[string]Serializer{
+		"order":   JSONSerializer{},
+		"payment": JSONSerializer{},
+		"upper":   upperSerializer{},
+	})
+	assert.Nil(t, err)
+
+	tests := map[string]struct {
+		msg       outbox.Message
+		expPrefix []byte
+		expMsg    outbox.Message
+	}{
+		"Registered type should be encoded by its serializer": {
+			msg:       outbox.Message{Key: "key", Headers: map[string]string{"type": "order"}, Body: []byte("body")},
+			expPrefix: append([]byte{formatMarker, 4}, "json"...),
+			expMsg:    outbox.Message{Key: "key", Headers: map[string]string{"type": "order"}, Body: []byte("body")},
+		},
+		"Serializer should be selected by the type": {
+			msg:       outbox.Message{Key: "key", Headers: map[string]string{"type": "upper"}, Body: []byte("body")},
+			expPrefix: append([]byte{formatMarker, 5}, "upper"...),
+			expMsg:    outbox.Message{Body: []byte("BODY")},
+		},
+		"Unregistered type should be gob encoded": {
+			msg:       outbox.Message{Key: "key", Headers: map[string]string{"type": "other"}, Body: []byte("body")},
+			expPrefix: nil,
+			expMsg:    outbox.Message{Key: "key", Headers: map[string]string{"type": "other"}, Body: []byte("body")},
+		},
+		"Compressed message should be decoded by its serializer": {
+			msg:       outbox.Message{Headers: map[string]string{"type": "payment"}, Body: []byte(strings.Repeat("body", 1000))},
+			expPrefix: gzipMagic,
+			expMsg:    outbox.Message{Headers: map[string]string{"type": "payment"}, Body: []byte(strings.Repeat("body", 1000))},
+		},
+	}
+	for name, test := range tests {
+		tt := test
+		t.Run(name, func(t *testing.T) {
+			data, err := s.encode(tt.msg)
+			assert.Nil(t, err)
+			assert.True(t, bytes.HasPrefix(data, tt.expPrefix))
+
+			var got outbox.Message
+			assert.Nil(t, s.decode(data, &got))
+			assert.Equal(t, tt.expMsg, got)
+		})
+	}
+
+	data, err := s.encode(outbox.Message{Headers: map[string]string{"type": "order"}})
+	assert.Nil(t, err)
+	assert.EqualError(t, newSerializer(0, nil).decode(data, &outbox.Message{}),
+		`no serializer is registered for the stored message format "json"`)
+
+	_, err = newSerializer(0, nil).withSerializers("", map[string]Serializer{"order": JSONSerializer{}})
+	assert.NotNil(t, err)
+	_, err = newSerializer(0, nil).withSerializers("type", map[string]Serializer{"order": JSONSerializer{}, "upper": renamedSerializer{}})
+	assert.EqualError(t, err, `invalid serializer id "json": it is used by more than one serializer`)
+}
+
+// renamedSerializer is a Serializer reusing the id of JSONSerializer
+type renamedSerializer struct{ upperSerializer }
+
+func (renamedSerializer) ID() string { return "json" }
+
+func Benchmark_serializer_encode(b *testing.B) {
+	msg := outbox.Message{
+		Key:     "key",
+		Headers: map[string]string{"content-type": "application/json"},
+		Body:    []byte(strings.Repeat(`{"id":1,"name":"sample","tags":["a","b"]},`, 100)),
+		Topic:   "topic",
+	}
+	for _, threshold := range []int{0, 256, 1024, 8192} {
+		b.Run("threshold="+strconv.Itoa(threshold), func(b *testing.B) {
+			metrics := newRecordingMetrics()
+			s := newSerializer(threshold, metrics)
+			for i := 0; i < b.N; i++ {
+				_, err := s.encode(msg)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(mean(metrics.observations[outbox.MetricSerializedBytes]), "serialized-bytes/op")
+			b.ReportMetric(mean(metrics.observations[outbox.MetricStoredBytes]), "stored-bytes/op")
+			b.ReportMetric(float64(metrics.counts[outbox.MetricSerializations+"/true"])/float64(b.N), "compressed/op")
+		})
+	}
+}
+
+func mean(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	var sum float64
+	for _, v := range values {
+		sum += v
+	}
+	return sum / float64(len(values))
+}
@@ -0,0 +1,117 @@
+package mysql
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sync"
+)
+
+// maxPreparedStatements bounds the number of prepared statements, in case distinct queries are not marked with
+// unprepared. The queries over the limit are run without a prepared statement
+const maxPreparedStatements = 64
+
+// unpreparedKey is the context key of the queries run without a prepared statement
+type unpreparedKey struct{}
+
+// unprepared returns a copy of ctx whose queries are run without a prepared statement, e.g. the IN lists of a
+// variable length, which are distinct queries that would fill the cache with statements used once
+func unprepared(ctx context.Context) context.Context {
+	return context.WithValue(ctx, unpreparedKey{}, true)
+}
+
+// statementCache prepares every query once and reuses the statement. database/sql prepares the statement again on
+// every connection of the pool it runs on, and is safe for concurrent use
+type statementCache struct {
+	db    *sql.DB
+	mu    sync.Mutex
+	stmts map[string]*sql.Stmt
+}
+
+func newStatementCache(db *sql.DB) *statementCache {
+	return &statementCache{db: db, stmts: map[string]*sql.Stmt{}}
+}
+
+// get returns the prepared statement of the query, or nil if the statements are not prepared, the query is marked with
+// unprepared or the cache is full. The query is prepared without holding the lock, so that a slow prepare does not
+// block the other queries, and the statement of a concurrent prepare of the same query is kept
+func (c *statementCache) get(ctx context.Context, query string) (*sql.Stmt, error) {
+	if c == nil || ctx.Value(unpreparedKey{}) != nil {
+		return nil, nil
+	}
+	c.mu.Lock()
+	stmt, ok := c.stmts[query]
+	full := len(c.stmts) >= maxPreparedStatements
+	c.mu.Unlock()
+	if ok {
+		return stmt, nil
+	}
+	if full {
+		return nil, nil
+	}
+	stmt, err := c.db.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cached, ok := c.stmts[query]; ok {
+		_ = stmt.Close()
+		return cached, nil
+	}
+	if len(c.stmts) >= maxPreparedStatements {
+		_ = stmt.Close()
+		return nil, nil
+	}
+	c.stmts[query] = stmt
+	return stmt, nil
+}
+
+// close closes all the prepared statements
+func (c *statementCache) close() error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var errs []error
+	for query, stmt := range c.stmts {
+		errs = append(errs, stmt.Close())
+		delete(c.stmts, query)
+	}
+	return errors.Join(errs...)
+}
+
+// execContext executes the query on db, with the prepared statement of the query if db is the pool of the store.
+// Transactions never use the prepared statements, since they may belong to another pool
+func (s Store) execContext(ctx context.Context, db execer, query string, args ...interface{}) (sql.Result, error) {
+	query = s.table.sql(query)
+	if pool, ok := db.(*sql.DB); ok && pool == s.db {
+		stmt, err := s.statements.get(ctx, query)
+		if err != nil {
+			return nil, err
+		}
+		if stmt != nil {
+			return stmt.ExecContext(ctx, args...)
+		}
+	}
+	return db.ExecContext(ctx, query, args...)
+}
+
+// queryContext runs the query on the pool of the store, with the prepared statement of the query if enabled
+func (s Store) queryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	query = s.table.sql(query)
+	stmt, err := s.statements.get(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	if stmt != nil {
+		return stmt.QueryContext(ctx, args...)
+	}
+	return s.db.QueryContext(ctx, query, args...)
+}
+
+// Close closes the prepared statements of the store. The connection pool is left open
+func (s Store) Close() error {
+	return s.statements.close()
+}
@@ -0,0 +1,83 @@
+//go:build integration
+
+package mysql
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pkritiotis/outbox"
+)
+
+// Benchmark_preparedStatements compares the insert and mark processed paths with and without prepared statements
+func Benchmark_preparedStatements(b *testing.B) {
+	db := openTestDB(b)
+	ctx := context.Background()
+	var created []uuid.UUID
+	b.Cleanup(func() {
+		for _, id := range created {
+			_, _ = db.Exec("DELETE FROM outbox WHERE id = ?", id.String())
+		}
+	})
+	for _, prepared := range []bool{false, true} {
+		s, err := NewStoreWithDB(db, Settings{UsePreparedStatements: prepared})
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err = s.EnsureSchema(ctx); err != nil {
+			b.Fatal(err)
+		}
+		name := "unprepared"
+		if prepared {
+			name = "prepared"
+		}
+		lockID := "bench-" + name
+
+		b.Run(name+"/AddRecord", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				rec := outbox.Record{
+					ID:        uuid.New(),
+					Message:   outbox.Message{Key: "key", Body: []byte("body"), Topic: "bench"},
+					State:     outbox.PendingDelivery,
+					CreatedOn: time.Now().UTC(),
+				}
+				if err := s.AddRecord(ctx, rec); err != nil {
+					b.Fatal(err)
+				}
+				created = append(created, rec.ID)
+			}
+		})
+
+		b.Run(name+"/MarkProcessed", func(b *testing.B) {
+			ids := make([]uuid.UUID, b.N)
+			for i := range ids {
+				ids[i] = uuid.New()
+				rec := outbox.Record{
+					ID:        ids[i],
+					Message:   outbox.Message{Key: "key", Body: []byte("body"), Topic: "bench"},
+					State:     outbox.PendingDelivery,
+					CreatedOn: time.Now().UTC(),
+				}
+				if err := s.AddRecord(ctx, rec); err != nil {
+					b.Fatal(err)
+				}
+				created = append(created, rec.ID)
+				if _, err := db.Exec("UPDATE outbox SET locked_by = ?, locked_on = ? WHERE id = ?", lockID, time.Now().UTC(), ids[i].String()); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ResetTimer()
+			for _, id := range ids {
+				if err := s.MarkProcessed(id, 1, time.Now().UTC(), lockID); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+
+		if err = s.Close(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package mysql
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// countingDriver is a database/sql driver that counts the prepared statements, calling onPrepare first if it is set
+type countingDriver struct {
+	prepares  atomic.Int64
+	onPrepare func(query string)
+}
+
+func (d *countingDriver) Open(string) (driver.Conn, error) {
+	return countingConn{driver: d}, nil
+}
+
+type countingConn struct {
+	driver *countingDriver
+}
+
+func (c countingConn) Prepare(query string) (driver.Stmt, error) {
+	if c.driver.onPrepare != nil {
+		c.driver.onPrepare(query)
+	}
+	c.driver.prepares.Add(1)
+	return countingStmt{}, nil
+}
+
+func (c countingConn) Close() error { return nil }
+
+func (c countingConn) Begin() (driver.Tx, error) { return countingTx{}, nil }
+
+type countingTx struct{}
+
+func (countingTx) Commit() error   { return nil }
+func (countingTx) Rollback() error { return nil }
+
+type countingStmt struct{}
+
+func (countingStmt) Close() error  { return nil }
+func (countingStmt) NumInput() int { return -1 }
+func (countingStmt) Exec([]driver.Value) (driver.Result, error) {
+	return driver.RowsAffected(1), nil
+}
+func (countingStmt) Query([]driver.Value) (driver.Rows, error) { return countingRows{}, nil }
+
+type countingRows struct{}
+
+func (countingRows) Columns() []string         { return nil }
+func (countingRows) Close() error              { return nil }
+func (countingRows) Next([]driver.Value) error { return io.EOF }
+
+var driverID atomic.Int64
+
+func openCountingDB(t *testing.T) (*sql.DB, *countingDriver) {
+	d := &countingDriver{}
+	name := fmt.Sprintf("counting-%d", driverID.Add(1))
+	sql.Register(name, d)
+	db, err := sql.Open(name, "")
+	assert.Nil(t, err)
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { _ = db.Close() })
+	return db, d
+}
+
+func TestStore_execContext(t *testing.T) {
+	ctx := context.Background()
+	tests := map[string]struct {
+		usePreparedStatements bool
+		useTx                 bool
+		expPrepares           int64
+	}{
+		"Prepared statements should be reused": {
+			usePreparedStatements: true,
+			expPrepares:           1,
+		},
+		"Queries should be prepared on every call without prepared statements": {
+			usePreparedStatements: false,
+			expPrepares:           3,
+		},
+		"Transactions should not use the prepared statements": {
+			usePreparedStatements: true,
+			useTx:                 true,
+			expPrepares:           3,
+		},
+	}
+	for name, test := range tests {
+		tt := test
+		t.Run(name, func(t *testing.T) {
+			db, d := openCountingDB(t)
+			s, err := NewStoreWithDB(db, Settings{UsePreparedStatements: tt.usePreparedStatements})
+			assert.Nil(t, err)
+
+			var execer execer = db
+			if tt.useTx {
+				tx, err := db.Begin()
+				assert.Nil(t, err)
+				defer func() { _ = tx.Rollback() }()
+				execer = tx
+			}
+			for i := 0; i < 3; i++ {
+				_, err = s.execContext(ctx, execer, "UPDATE outbox SET state = ?", i)
+				assert.Nil(t, err)
+			}
+			assert.Equal(t, tt.expPrepares, d.prepares.Load())
+			assert.Nil(t, s.Close())
+		})
+	}
+}
+
+func Test_statementCache_get(t *testing.T) {
+	ctx := context.Background()
+	db, d := openCountingDB(t)
+	c := newStatementCache(db)
+
+	for i := 0; i < maxPreparedStatements; i++ {
+		stmt, err := c.get(ctx, fmt.Sprintf("SELECT %d", i))
+		assert.Nil(t, err)
+		assert.NotNil(t, stmt)
+	}
+	stmt, err := c.get(ctx, "SELECT 0")
+	assert.Nil(t, err)
+	assert.NotNil(t, stmt)
+
+	stmt, err = c.get(ctx, "SELECT -1")
+	assert.Nil(t, err)
+	assert.Nil(t, stmt)
+	assert.Equal(t, int64(maxPreparedStatements), d.prepares.Load())
+
+	assert.Nil(t, c.close())
+	assert.Empty(t, c.stmts)
+
+	var disabled *statementCache
+	stmt, err = disabled.get(ctx, "SELECT 0")
+	assert.Nil(t, err)
+	assert.Nil(t, stmt)
+	assert.Nil(t, disabled.close())
+}
+
+func Test_statementCache_get_unprepared(t *testing.T) {
+	db, d := openCountingDB(t)
+	c := newStatementCache(db)
+
+	stmt, err := c.get(unprepared(context.Background()), "DELETE FROM outbox WHERE id IN (?,?)")
+	assert.Nil(t, err)
+	assert.Nil(t, stmt)
+	assert.Empty(t, c.stmts)
+	assert.Equal(t, int64(0), d.prepares.Load())
+}
+
+func Test_statementCache_get_concurrentPrepare(t *testing.T) {
+	ctx := context.Background()
+	db, d := openCountingDB(t)
+	db.SetMaxOpenConns(2)
+	c := newStatementCache(db)
+	cached, err := c.get(ctx, "SELECT 0")
+	assert.Nil(t, err)
+
+	preparing, release := make(chan struct{}), make(chan struct{})
+	d.onPrepare = func(query string) {
+		if query == "SELECT 1" {
+			preparing <- struct{}{}
+			<-release
+		}
+	}
+	prepared := make(chan *sql.Stmt)
+	go func() {
+		stmt, _ := c.get(ctx, "SELECT 1")
+		prepared <- stmt
+	}()
+	<-preparing
+
+	// The cached statements are returned while another query is being prepared
+	stmt, err := c.get(ctx, "SELECT 0")
+	assert.Nil(t, err)
+	assert.Equal(t, cached, stmt)
+	close(release)
+	assert.NotNil(t, <-prepared)
+	assert.Len(t, c.stmts, 2)
+	assert.Nil(t, c.close())
+}
@@ -0,0 +1,57 @@
+package mysql
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// DefaultTableName is the name of the outbox table if the TableName setting is not set
+const DefaultTableName = "outbox"
+
+// maxTableNameLength keeps the names of the tables derived from the outbox table, e.g. <name>_schema_version, within
+// the 64 characters of a mysql identifier
+const maxTableNameLength = 64 - len("_schema_version")
+
+var (
+	validTableName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	// tableReference matches the references to the outbox table and to the tables named after it in the queries
+	// of the store. The index names are not matched, since they are only unique per table
+	tableReference = regexp.MustCompile(`\b` + DefaultTableName + `(_attempts|_key_sequences|_schema_version)?\b`)
+)
+
+// tableName is the name of the outbox table of a store. The attempts, key sequences and schema version tables are
+// named after it, e.g. orders_outbox_attempts for the orders_outbox table
+type tableName string
+
+func tableNameOrDefault(name string) tableName {
+	if name == "" {
+		return DefaultTableName
+	}
+	return tableName(name)
+}
+
+func validateTableName(name string) error {
+	if name == "" {
+		return nil
+	}
+	if !validTableName.MatchString(name) || len(name) > maxTableNameLength {
+		return fmt.Errorf("invalid table name %q: it must be an unquoted identifier of at most %d characters",
+			name, maxTableNameLength)
+	}
+	return nil
+}
+
+// sql returns the query with its references to the default tables replaced by the tables of the name. The queries
+// of the store are written against the default tables, so they are returned unchanged for the default name
+func (t tableName) sql(query string) string {
+	if t == "" || t == DefaultTableName {
+		return query
+	}
+	return tableReference.ReplaceAllString(query, string(t)+"$1")
+}
+
+// migrateLock is the name of the advisory lock held while migrating the tables, so that concurrent Migrate calls of
+// several instances apply every migration once
+func (t tableName) migrateLock() string {
+	return string(tableNameOrDefault(string(t))) + "_migrate"
+}
@@ -0,0 +1,44 @@
+package mysql
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_tableName_sql(t *testing.T) {
+	table := tableName("orders_outbox")
+
+	assert.Equal(t, "UPDATE orders_outbox SET next_retry_at = ? WHERE id = ?", table.sql("UPDATE outbox SET next_retry_at = ? WHERE id = ?"))
+	assert.Equal(t, "INSERT INTO orders_outbox_attempts (record_id) VALUES (?)", table.sql("INSERT INTO outbox_attempts (record_id) VALUES (?)"))
+	assert.Equal(t, "SELECT MAX(version) FROM orders_outbox_schema_version", table.sql("SELECT MAX(version) FROM outbox_schema_version"))
+	assert.Equal(t, "WHERE TABLE_NAME = 'orders_outbox' AND INDEX_NAME = ?", table.sql("WHERE TABLE_NAME = 'outbox' AND INDEX_NAME = ?"))
+	// The index names are kept, since they are only unique per table
+	assert.Equal(t, "ALTER TABLE orders_outbox ADD INDEX idx_outbox_publish_handle (publish_handle)",
+		table.sql("ALTER TABLE outbox ADD INDEX idx_outbox_publish_handle (publish_handle)"))
+
+	// Every table of the schemas is renamed
+	for _, script := range []string{schema, attemptsSchema, keySequencesSchema, schemaVersionTable} {
+		renamed := table.sql(script)
+		assert.Contains(t, renamed, "CREATE TABLE IF NOT EXISTS orders_outbox")
+		assert.NotContains(t, strings.ReplaceAll(renamed, "orders_outbox", ""), " outbox")
+	}
+	assert.Equal(t, schema, tableName(DefaultTableName).sql(schema))
+	assert.Equal(t, "orders_outbox_migrate", table.migrateLock())
+	assert.Equal(t, "outbox_migrate", tableName("").migrateLock())
+}
+
+func Test_validateTableName(t *testing.T) {
+	assert.Nil(t, validateTableName(""))
+	assert.Nil(t, validateTableName("orders_outbox"))
+	assert.NotNil(t, validateTableName("orders-outbox"))
+	assert.NotNil(t, validateTableName("outbox; DROP TABLE users"))
+	assert.NotNil(t, validateTableName(strings.Repeat("a", maxTableNameLength+1)))
+
+	_, err := NewStoreWithDB(nil, Settings{TableName: "`outbox`"})
+	assert.NotNil(t, err)
+	s, err := NewStoreWithDB(nil, Settings{})
+	assert.Nil(t, err)
+	assert.Equal(t, tableName(DefaultTableName), s.table)
+}
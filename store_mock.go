@@ -1,9 +1,11 @@
 package outbox
 
 import (
+	"context"
 	"database/sql"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/stretchr/testify/mock"
 )
 
@@ -18,24 +20,138 @@ func (m *MockStore) AddRecordTx(record Record, tx *sql.Tx) error {
 	return args.Error(0)
 }
 
+// AddRecord method mock
+func (m *MockStore) AddRecord(ctx context.Context, record Record) error {
+	args := m.Called(ctx, record)
+	return args.Error(0)
+}
+
 // GetRecordsByLockID method mock
 func (m *MockStore) GetRecordsByLockID(lockID string) ([]Record, error) {
 	args := m.Called(lockID)
 	return args.Get(0).([]Record), args.Error(1)
 }
 
+// IterateRecordsByLockID method mock that passes the returned records to fn
+func (m *MockStore) IterateRecordsByLockID(ctx context.Context, lockID string, fn func(Record) error) error {
+	args := m.Called(ctx, lockID)
+	for _, rec := range args.Get(0).([]Record) {
+		err := fn(rec)
+		if err != nil {
+			return err
+		}
+	}
+	return args.Error(1)
+}
+
+// GetRecordsAfterWatermark method mock
+func (m *MockStore) GetRecordsAfterWatermark(createdOn time.Time, id uuid.UUID, limit int) ([]Record, error) {
+	args := m.Called(createdOn, id, limit)
+	return args.Get(0).([]Record), args.Error(1)
+}
+
+// GetRecordByID method mock
+func (m *MockStore) GetRecordByID(id uuid.UUID) (Record, error) {
+	args := m.Called(id)
+	return args.Get(0).(Record), args.Error(1)
+}
+
+// GetRecordsByState method mock
+func (m *MockStore) GetRecordsByState(state RecordState, createdOn time.Time, id uuid.UUID, limit int) ([]Record, error) {
+	args := m.Called(state, createdOn, id, limit)
+	return args.Get(0).([]Record), args.Error(1)
+}
+
+// RequeueRecord method mock
+func (m *MockStore) RequeueRecord(id uuid.UUID) error {
+	args := m.Called(id)
+	return args.Error(0)
+}
+
+// ReplaceExportedRecord method mock
+func (m *MockStore) ReplaceExportedRecord(ctx context.Context, record Record) error {
+	args := m.Called(ctx, record)
+	return args.Error(0)
+}
+
+// SetNextRetryAt method mock
+func (m *MockStore) SetNextRetryAt(id uuid.UUID, nextRetryAt time.Time) error {
+	args := m.Called(id, nextRetryAt)
+	return args.Error(0)
+}
+
+// GetBacklogByState method mock
+func (m *MockStore) GetBacklogByState(state RecordState) (Backlog, error) {
+	args := m.Called(state)
+	return args.Get(0).(Backlog), args.Error(1)
+}
+
+// GetRecordIDsByStateCreatedBefore method mock
+func (m *MockStore) GetRecordIDsByStateCreatedBefore(state RecordState, createdBefore time.Time, limit int) ([]uuid.UUID, error) {
+	args := m.Called(state, createdBefore, limit)
+	return args.Get(0).([]uuid.UUID), args.Error(1)
+}
+
 // UpdateRecordLockByState method mock
 func (m *MockStore) UpdateRecordLockByState(lockID string, lockedOn time.Time, state RecordState) error {
 	args := m.Called(lockID, lockedOn, state)
 	return args.Error(0)
 }
 
+// UpdateRecordsLockByStates method mock
+func (m *MockStore) UpdateRecordsLockByStates(lockID string, lockedOn time.Time, states []RecordState, limit int) error {
+	args := m.Called(lockID, lockedOn, states, limit)
+	return args.Error(0)
+}
+
+// UpdateRecordsLockByStatesExcludingTopics method mock
+func (m *MockStore) UpdateRecordsLockByStatesExcludingTopics(lockID string, lockedOn time.Time, states []RecordState, limit int, excludedTopics []string) error {
+	args := m.Called(lockID, lockedOn, states, limit, excludedTopics)
+	return args.Error(0)
+}
+
 // UpdateRecordByID method mock
 func (m *MockStore) UpdateRecordByID(message Record) error {
 	args := m.Called(message)
 	return args.Error(0)
 }
 
+// MarkProcessed method mock
+func (m *MockStore) MarkProcessed(id uuid.UUID, numberOfAttempts int, processedOn time.Time, lockID string) error {
+	args := m.Called(id, numberOfAttempts, processedOn, lockID)
+	return args.Error(0)
+}
+
+// RecordFailure method mock
+func (m *MockStore) RecordFailure(failure RecordFailure, lockID string) error {
+	args := m.Called(failure, lockID)
+	return args.Error(0)
+}
+
+// RecordFailures method mock
+func (m *MockStore) RecordFailures(failures []RecordFailure, lockID string) error {
+	args := m.Called(failures, lockID)
+	return args.Error(0)
+}
+
+// MarkExported method mock
+func (m *MockStore) MarkExported(id uuid.UUID, lockID string) error {
+	args := m.Called(id, lockID)
+	return args.Error(0)
+}
+
+// ExtendLock method mock
+func (m *MockStore) ExtendLock(lockID string, lockedOn time.Time) error {
+	args := m.Called(lockID, lockedOn)
+	return args.Error(0)
+}
+
+// SetLock method mock
+func (m *MockStore) SetLock(id uuid.UUID, lockID *string, lockedOn *time.Time) error {
+	args := m.Called(id, lockID, lockedOn)
+	return args.Error(0)
+}
+
 // ClearLocksWithDurationBeforeDate method mock
 func (m *MockStore) ClearLocksWithDurationBeforeDate(time time.Time) error {
 	args := m.Called(time)
@@ -49,7 +165,43 @@ func (m *MockStore) ClearLocksByLockID(lockID string) error {
 }
 
 // RemoveRecordsBeforeDatetime method mock
-func (m *MockStore) RemoveRecordsBeforeDatetime(expiryTime time.Time) error {
+func (m *MockStore) RemoveRecordsBeforeDatetime(expiryTime time.Time) (int64, int64, error) {
 	args := m.Called(expiryTime)
+	return args.Get(0).(int64), args.Get(1).(int64), args.Error(2)
+}
+
+// RemoveRecordsByIDs method mock
+func (m *MockStore) RemoveRecordsByIDs(ids []uuid.UUID) (int64, int64, error) {
+	args := m.Called(ids)
+	return args.Get(0).(int64), args.Get(1).(int64), args.Error(2)
+}
+
+// AddAttempts method mock
+func (m *MockStore) AddAttempts(attempts []Attempt) error {
+	args := m.Called(attempts)
+	return args.Error(0)
+}
+
+// RemoveAttemptsBeforeDatetime method mock
+func (m *MockStore) RemoveAttemptsBeforeDatetime(before time.Time) (int64, error) {
+	args := m.Called(before)
+	return args.Get(0).(int64), args.Error(1)
+}
+
+// SetPublishHandle method mock
+func (m *MockStore) SetPublishHandle(id uuid.UUID, lockID string, handle string) error {
+	args := m.Called(id, lockID, handle)
+	return args.Error(0)
+}
+
+// ClearPublishHandle method mock
+func (m *MockStore) ClearPublishHandle(id uuid.UUID, handle string) error {
+	args := m.Called(id, handle)
 	return args.Error(0)
 }
+
+// GetRecordsWithPublishHandle method mock
+func (m *MockStore) GetRecordsWithPublishHandle(deliveredBefore time.Time, limit int) ([]Record, error) {
+	args := m.Called(deliveredBefore, limit)
+	return args.Get(0).([]Record), args.Error(1)
+}
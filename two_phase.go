@@ -0,0 +1,125 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	time2 "time"
+)
+
+// recoveryBatchSize is the number of records recovered per query by RecoverPreparedPublishes
+const recoveryBatchSize = 100
+
+// prepare prepares the publish of the message through the TransactionalMessageBroker and stores its handle on the
+// record, so that it can be recovered if the dispatcher stops before committing or aborting it. The publish prepared
+// by a previous attempt of the record is aborted first. A publish whose handle could not be stored is aborted
+func (d defaultRecordProcessor) prepare(rec Record, msg Message, deadline time2.Time) (*string, error) {
+	ctx, cancel := brokerContext(deadline)
+	defer cancel()
+	if rec.PublishHandle != nil {
+		err := d.twoPhaseBroker.Abort(ctx, *rec.PublishHandle)
+		if err != nil {
+			return nil, fmt.Errorf("could not abort the previous prepared publish: %w", err)
+		}
+	}
+	handle, err := d.twoPhaseBroker.Prepare(ctx, msg)
+	if err != nil {
+		return nil, err
+	}
+	err = d.store.SetPublishHandle(rec.ID, d.machineID, handle)
+	if err != nil {
+		return nil, errors.Join(err, d.twoPhaseBroker.Abort(ctx, handle))
+	}
+	return &handle, nil
+}
+
+// commitPrepared commits the prepared publish of the delivered record, if any, and clears its handle. A prepared
+// publish that could not be committed keeps its handle, so that it is committed by the recovery
+func (d defaultRecordProcessor) commitPrepared(rec Record) error {
+	if rec.PublishHandle == nil {
+		return nil
+	}
+	ctx, cancel := brokerContext(d.brokerDeadline())
+	defer cancel()
+	err := d.twoPhaseBroker.Commit(ctx, *rec.PublishHandle)
+	if err != nil {
+		return fmt.Errorf("Could not commit the prepared publish of the record %v: %w", rec.ID, err)
+	}
+	err = d.store.ClearPublishHandle(rec.ID, *rec.PublishHandle)
+	if err != nil {
+		return fmt.Errorf("Could not update the record in the db: %w", err)
+	}
+	return nil
+}
+
+// abortPrepared aborts the prepared publish of a record that could not be marked as delivered, if any, and clears its
+// handle. A failure is only logged, since the recovery aborts the publishes of the records that were not delivered
+func (d defaultRecordProcessor) abortPrepared(rec Record) {
+	if rec.PublishHandle == nil {
+		return
+	}
+	ctx, cancel := brokerContext(d.brokerDeadline())
+	defer cancel()
+	err := d.twoPhaseBroker.Abort(ctx, *rec.PublishHandle)
+	if err == nil {
+		err = d.store.ClearPublishHandle(rec.ID, *rec.PublishHandle)
+	}
+	if err != nil {
+		loggerOrDefault(d.logger).Warn("Could not abort the prepared publish of the record",
+			slog.String("record", rec.ID.String()), slog.String("error", err.Error()))
+	}
+}
+
+// brokerDeadline is the deadline of a commit or an abort, which is bounded by the publish timeout
+func (d defaultRecordProcessor) brokerDeadline() time2.Time {
+	if d.publishTimeout <= 0 {
+		return time2.Time{}
+	}
+	return d.time.Now().Add(d.publishTimeout)
+}
+
+// brokerContext returns the context of a broker call bounded by the deadline, if it is set
+func brokerContext(deadline time2.Time) (context.Context, context.CancelFunc) {
+	if deadline.IsZero() {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithDeadline(context.Background(), deadline)
+}
+
+// RecoverPreparedPublishes completes the publishes prepared by a dispatcher that stopped before committing or aborting
+// them, and returns the number of recovered records. The prepared publish of a Delivered record is committed and the
+// others are aborted, since the records that were not marked as delivered are published again. It only applies to the
+// unlocked records, and to the Delivered records processed more than MaxLockTimeDuration ago, since their lock is
+// released before the commit, so it is safe to run while other dispatchers are running. Run calls it on start with
+// the TwoPhasePublish setting
+func (d Dispatcher) RecoverPreparedPublishes(ctx context.Context) (int, error) {
+	if d.twoPhaseBroker == nil {
+		return 0, nil
+	}
+	deliveredBefore := d.time.Now().UTC().Add(-d.settings.MaxLockTimeDuration)
+	recovered := 0
+	for {
+		records, err := d.store.GetRecordsWithPublishHandle(deliveredBefore, recoveryBatchSize)
+		if err != nil {
+			return recovered, err
+		}
+		for _, rec := range records {
+			if rec.State == Delivered {
+				err = d.twoPhaseBroker.Commit(ctx, *rec.PublishHandle)
+			} else {
+				err = d.twoPhaseBroker.Abort(ctx, *rec.PublishHandle)
+			}
+			if err == nil {
+				err = d.store.ClearPublishHandle(rec.ID, *rec.PublishHandle)
+			}
+			if err != nil {
+				return recovered, fmt.Errorf("could not recover the prepared publish of the record %v: %w", rec.ID, err)
+			}
+			recovered++
+		}
+		if len(records) < recoveryBatchSize {
+			return recovered, nil
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	time2 "github.com/pkritiotis/outbox/internal/time"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// txBroker prepares the messages under the handle "h-<key>" and records the calls of every handle
+type txBroker struct {
+	MockBroker
+	mu         sync.Mutex
+	calls      []string
+	prepareErr error
+	commitErr  error
+}
+
+func (b *txBroker) Prepare(_ context.Context, message Message) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.calls = append(b.calls, "prepare h-"+message.Key)
+	if b.prepareErr != nil {
+		return "", b.prepareErr
+	}
+	return "h-" + message.Key, nil
+}
+
+func (b *txBroker) Commit(_ context.Context, handle string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.calls = append(b.calls, "commit "+handle)
+	return b.commitErr
+}
+
+func (b *txBroker) Abort(_ context.Context, handle string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.calls = append(b.calls, "abort "+handle)
+	return nil
+}
+
+func Test_defaultRecordProcessor_ProcessRecords_twoPhase(t *testing.T) {
+	sampleTime := time.Now().UTC()
+	timeProvider := &time2.MockProvider{}
+	timeProvider.On("Now").Return(sampleTime)
+	machineID := "1"
+	previousHandle := "h-previous"
+	record := Record{ID: uuid.New(), Message: Message{Key: "1"}, State: PendingDelivery}
+	retried := Record{ID: uuid.New(), Message: Message{Key: "1"}, State: PendingDelivery, PublishHandle: &previousHandle}
+	dbErr := errors.New("db error")
+
+	tests := map[string]struct {
+		record     Record
+		prepareErr error
+		setErr     error
+		markErr    error
+		commitErr  error
+		expCalls   []string
+		expCleared bool
+		expFailure bool
+		expErr     error
+	}{
+		"Successful publish should be committed once the record is delivered": {
+			record:     record,
+			expCalls:   []string{"prepare h-1", "commit h-1"},
+			expCleared: true,
+		},
+		"Publish prepared by a previous attempt should be aborted": {
+			record:     retried,
+			expCalls:   []string{"abort h-previous", "prepare h-1", "commit h-1"},
+			expCleared: true,
+		},
+		"Error in preparing should fail the record": {
+			record:     record,
+			prepareErr: errors.New("broker error"),
+			expCalls:   []string{"prepare h-1"},
+			expFailure: true,
+			expErr:     fmt.Errorf("An error occurred when trying to send the message to the broker: %w", errors.New("broker error")),
+		},
+		"Error in storing the handle should abort the publish": {
+			record:     record,
+			setErr:     ErrRecordLockLost,
+			expCalls:   []string{"prepare h-1", "abort h-1"},
+			expFailure: true,
+			expErr:     fmt.Errorf("An error occurred when trying to send the message to the broker: %w", errors.Join(ErrRecordLockLost, nil)),
+		},
+		"Error in marking the record as delivered should abort the publish": {
+			record:     record,
+			markErr:    dbErr,
+			expCalls:   []string{"prepare h-1", "abort h-1"},
+			expCleared: true,
+			expErr:     fmt.Errorf("Could not update the record in the db: %w", dbErr),
+		},
+		"Error in committing should keep the handle for the recovery": {
+			record:    record,
+			commitErr: errors.New("commit error"),
+			expCalls:  []string{"prepare h-1", "commit h-1"},
+			expErr:    fmt.Errorf("Could not commit the prepared publish of the record %v: %w", record.ID, errors.New("commit error")),
+		},
+	}
+	for name, test := range tests {
+		tt := test
+		t.Run(name, func(t *testing.T) {
+			store := &MockStore{}
+			store.On("UpdateRecordsLockByStates", machineID, sampleTime, []RecordState{PendingDelivery}, 0).Return(nil)
+			store.On("GetRecordsByLockID", machineID).Return([]Record{tt.record}, nil)
+			store.On("ClearLocksByLockID", machineID).Return(nil)
+			store.On("SetPublishHandle", tt.record.ID, machineID, "h-1").Return(tt.setErr)
+			store.On("MarkProcessed", tt.record.ID, 1, sampleTime, machineID).Return(tt.markErr)
+			store.On("ClearPublishHandle", tt.record.ID, "h-1").Return(nil)
+			store.On("RecordFailure", mock.Anything, machineID).Return(nil)
+			broker := &txBroker{prepareErr: tt.prepareErr, commitErr: tt.commitErr}
+
+			d := defaultRecordProcessor{
+				messageBroker:  broker,
+				time:           timeProvider,
+				store:          store,
+				machineID:      machineID,
+				selector:       stateSelector{store: store, time: timeProvider, lockID: machineID},
+				twoPhaseBroker: broker,
+			}
+			err := d.ProcessRecords()
+
+			assert.Equal(t, tt.expErr, err)
+			assert.Equal(t, tt.expCalls, broker.calls)
+			broker.AssertNotCalled(t, "Send", mock.Anything)
+			if tt.expCleared {
+				store.AssertCalled(t, "ClearPublishHandle", tt.record.ID, "h-1")
+			} else {
+				store.AssertNotCalled(t, "ClearPublishHandle", tt.record.ID, "h-1")
+			}
+			if tt.expFailure {
+				store.AssertCalled(t, "RecordFailure", mock.Anything, machineID)
+				store.AssertNotCalled(t, "MarkProcessed", tt.record.ID, 1, sampleTime, machineID)
+			}
+		})
+	}
+}
+
+func TestDispatcher_RecoverPreparedPublishes(t *testing.T) {
+	sampleTime := time.Now().UTC()
+	timeProvider := &time2.MockProvider{}
+	timeProvider.On("Now").Return(sampleTime)
+	deliveredBefore := sampleTime.Add(-time.Minute)
+	delivered, pending := "h-delivered", "h-pending"
+	records := []Record{
+		{ID: uuid.New(), State: Delivered, PublishHandle: &delivered},
+		{ID: uuid.New(), State: PendingDelivery, PublishHandle: &pending},
+	}
+
+	tests := map[string]struct {
+		store        *MockStore
+		broker       *txBroker
+		expRecovered int
+		expCalls     []string
+		expErr       error
+	}{
+		"Delivered records should be committed and the others aborted": {
+			store: func() *MockStore {
+				mp := MockStore{}
+				mp.On("GetRecordsWithPublishHandle", deliveredBefore, recoveryBatchSize).Return(records, nil)
+				mp.On("ClearPublishHandle", records[0].ID, delivered).Return(nil)
+				mp.On("ClearPublishHandle", records[1].ID, pending).Return(nil)
+				return &mp
+			}(),
+			broker:       &txBroker{},
+			expRecovered: 2,
+			expCalls:     []string{"commit h-delivered", "abort h-pending"},
+		},
+		"Error in committing should stop the recovery": {
+			store: func() *MockStore {
+				mp := MockStore{}
+				mp.On("GetRecordsWithPublishHandle", deliveredBefore, recoveryBatchSize).Return(records, nil)
+				return &mp
+			}(),
+			broker:       &txBroker{commitErr: errors.New("commit error")},
+			expRecovered: 0,
+			expCalls:     []string{"commit h-delivered"},
+			expErr:       fmt.Errorf("could not recover the prepared publish of the record %v: %w", records[0].ID, errors.New("commit error")),
+		},
+		"Error in fetching should return an error": {
+			store: func() *MockStore {
+				mp := MockStore{}
+				mp.On("GetRecordsWithPublishHandle", deliveredBefore, recoveryBatchSize).Return([]Record(nil), errors.New("db error"))
+				return &mp
+			}(),
+			broker: &txBroker{},
+			expErr: errors.New("db error"),
+		},
+	}
+	for name, test := range tests {
+		tt := test
+		t.Run(name, func(t *testing.T) {
+			d := Dispatcher{
+				store:          tt.store,
+				twoPhaseBroker: tt.broker,
+				time:           timeProvider,
+				settings:       DispatcherSettings{MaxLockTimeDuration: time.Minute},
+			}
+			recovered, err := d.RecoverPreparedPublishes(context.Background())
+			assert.Equal(t, tt.expErr, err)
+			assert.Equal(t, tt.expRecovered, recovered)
+			assert.Equal(t, tt.expCalls, tt.broker.calls)
+		})
+	}
+}
+
+func TestDispatcher_RecoverPreparedPublishes_batches(t *testing.T) {
+	handle := "h"
+	var batch []Record
+	for i := 0; i < recoveryBatchSize; i++ {
+		batch = append(batch, Record{ID: uuid.New(), State: Delivered, PublishHandle: &handle})
+	}
+	store := &MockStore{}
+	store.On("GetRecordsWithPublishHandle", mock.Anything, recoveryBatchSize).Return(batch, nil).Once()
+	store.On("GetRecordsWithPublishHandle", mock.Anything, recoveryBatchSize).Return([]Record{}, nil).Once()
+	store.On("ClearPublishHandle", mock.Anything, handle).Return(nil)
+
+	d := Dispatcher{store: store, twoPhaseBroker: &txBroker{}, time: time2.NewTimeProvider()}
+	recovered, err := d.RecoverPreparedPublishes(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, recoveryBatchSize, recovered)
+	store.AssertNumberOfCalls(t, "GetRecordsWithPublishHandle", 2)
+}
+
+func Test_twoPhaseBroker(t *testing.T) {
+	broker := &txBroker{}
+	assert.Equal(t, broker, twoPhaseBroker(broker, DispatcherSettings{TwoPhasePublish: true}))
+	assert.Nil(t, twoPhaseBroker(broker, DispatcherSettings{}))
+	assert.Nil(t, twoPhaseBroker(broker, DispatcherSettings{TwoPhasePublish: true, SelectionStrategy: WatermarkSelection}))
+	assert.Nil(t, twoPhaseBroker(&MockBroker{}, DispatcherSettings{TwoPhasePublish: true}))
+}